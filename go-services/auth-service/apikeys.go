@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks API keys so they can be told apart from JWTs
+const apiKeyPrefix = "mp3k_"
+
+const (
+	maxAPIKeyName = 100
+	maxAPIKeys    = 20
+)
+
+// apiKeyScopes are the permissions a key can be limited to. A key never
+// grants more than its user's role.
+var apiKeyScopes = []string{"upload", "download-own", "download-any", "manage-users"}
+
+// ErrAPIKeyInvalid is returned for an unknown, expired or revoked key
+var ErrAPIKeyInvalid = errors.New("invalid api key")
+
+// APIKey is a long lived credential for scripts. Only a hash of the key is
+// stored, and Prefix, its first characters, identifies it in listings.
+type APIKey struct {
+	Id         int64      `json:"id"`
+	UserId     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// CreateAPIKeyRequest is the body of a request to create a key. Without
+// scopes a key can do everything its user's role allows.
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// hashAPIKey returns the hash API keys are stored as. Like refresh tokens
+// they are random, so the same hash is used.
+func hashAPIKey(key string) string {
+	return hashRefreshToken(key)
+}
+
+// handleCreateAPIKey creates a key for the caller. The key itself is only
+// ever returned here.
+func (s *AuthServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	req := &CreateAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPIKeyName {
+		WriteJSON(w, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d characters", maxAPIKeyName))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = apiKeyScopes
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			WriteJSON(w, http.StatusBadRequest, "scopes must be among "+strings.Join(apiKeyScopes, ", "))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		WriteJSON(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+
+	keys, err := s.store.ListAPIKeys(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(keys) >= maxAPIKeys {
+		WriteJSON(w, http.StatusConflict, fmt.Sprintf("at most %d api keys are allowed", maxAPIKeys))
+		return
+	}
+
+	secret, err := newRefreshToken()
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	raw := apiKeyPrefix + secret
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	key := &APIKey{
+		UserId:    userId,
+		Name:      req.Name,
+		Prefix:    raw[:len(apiKeyPrefix)+6],
+		Hash:      hashAPIKey(raw),
+		Scopes:    slices.Compact(scopes),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := s.store.CreateAPIKey(key); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s created api key %d", claims.Email, key.Id)
+	WriteJSON(w, http.StatusCreated, struct {
+		*APIKey
+		Key string `json:"key"`
+	}{key, raw})
+}
+
+// handleListAPIKeys lists the caller's keys, without the keys themselves
+func (s *AuthServer) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	keys, err := s.store.ListAPIKeys(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string][]*APIKey{"keys": keys})
+}
+
+// handleRevokeAPIKey revokes one of the caller's keys
+func (s *AuthServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		WriteJSON(w, http.StatusNotFound, "api key not found")
+		return
+	}
+	err = s.store.RevokeAPIKey(userId, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "api key not found")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s revoked api key %d", claims.Email, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleVerifyAPIKey returns the identity and scopes of an API key for the
+// gateway, and records that the key was used. It is only reachable inside
+// the cluster.
+func (s *AuthServer) handleVerifyAPIKey(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Key string `json:"key"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.Key, apiKeyPrefix) {
+		WriteJSON(w, http.StatusUnauthorized, ErrAPIKeyInvalid.Error())
+		return
+	}
+
+	key, user, err := s.store.UseAPIKey(hashAPIKey(req.Key))
+	if errors.Is(err, ErrAPIKeyInvalid) {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":      strconv.FormatInt(user.Id, 10),
+		"email":    user.Email,
+		"roles":    []string{user.Role},
+		"verified": user.EmailVerified,
+		"scopes":   key.Scopes,
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The CBOR (RFC 8949) subset WebAuthn uses: integers, byte and text
+// strings, arrays, maps and the simple values. Authenticators encode
+// definite lengths only, so indefinite ones are refused, as are floats
+// and tags.
+
+// cborMaxDepth limits nesting, so a hostile message can not exhaust the
+// stack
+const cborMaxDepth = 16
+
+// cborDecode decodes the first CBOR item of data and returns it with the
+// bytes after it. Integers decode to int64, byte strings to []byte, text
+// to string, arrays to []any and maps to map[any]any.
+func cborDecode(data []byte) (any, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+func cborDecodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values carry no argument to read
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	case info == 31:
+		return nil, nil, fmt.Errorf("cbor: indefinite lengths are not supported")
+	default:
+		return nil, nil, fmt.Errorf("cbor: invalid argument")
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor: integer out of range")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor: integer out of range")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		if major == 2 {
+			return bytes.Clone(data[:arg]), data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the allocation
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		items := make([]any, arg)
+		for i := range items {
+			item, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[i], data = item, rest
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		items := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+			value, rest, err := cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key], data = value, rest
+		}
+		return items, data, nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
+
+// cborEncode encodes the values cborDecode returns, and int for
+// convenience. Map keys are sorted as in the canonical encoding.
+func cborEncode(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := cborEncodeItem(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func cborEncodeHead(b *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		b.WriteByte(major<<5 | byte(arg))
+	case arg <= math.MaxUint8:
+		b.Write([]byte{major<<5 | 24, byte(arg)})
+	case arg <= math.MaxUint16:
+		b.WriteByte(major<<5 | 25)
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		b.WriteByte(major<<5 | 26)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		b.WriteByte(major<<5 | 27)
+		b.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+func cborEncodeItem(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xf6)
+	case bool:
+		if v {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case int:
+		return cborEncodeItem(b, int64(v))
+	case int64:
+		if v >= 0 {
+			cborEncodeHead(b, 0, uint64(v))
+		} else {
+			cborEncodeHead(b, 1, uint64(-1-v))
+		}
+	case []byte:
+		cborEncodeHead(b, 2, uint64(len(v)))
+		b.Write(v)
+	case string:
+		cborEncodeHead(b, 3, uint64(len(v)))
+		b.WriteString(v)
+	case []any:
+		cborEncodeHead(b, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := cborEncodeItem(b, item); err != nil {
+				return err
+			}
+		}
+	case map[any]any:
+		// Canonical order sorts the encoded keys, shorter ones first
+		keys := make([][]byte, 0, len(v))
+		values := make(map[string]any, len(v))
+		for key, value := range v {
+			encoded, err := cborEncode(key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, encoded)
+			values[string(encoded)] = value
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+		cborEncodeHead(b, 5, uint64(len(v)))
+		for _, key := range keys {
+			b.Write(key)
+			if err := cborEncodeItem(b, values[string(key)]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// storeCheck is one behaviour every Store implementation must have
+type storeCheck struct {
+	name  string
+	check func(s Store, run string) error
+}
+
+// storeChecks is the conformance suite for Store implementations. Each
+// check gets a run id to keep its emails and tokens apart from those of
+// other runs, but the signing key check expects a store without keys.
+var storeChecks = []storeCheck{
+	{"users", checkUsers},
+	{"invites", checkInvites},
+	{"refresh tokens", checkRefreshTokens},
+	{"revocations", checkRevocations},
+	{"signing keys", checkSigningKeys},
+	{"api keys", checkAPIKeys},
+	{"login failures", checkLoginFailures},
+	{"password resets", checkPasswordResets},
+	{"email verification", checkEmailVerification},
+	{"totp", checkTOTP},
+	{"webauthn", checkWebAuthn},
+	{"device authorizations", checkDeviceAuthorizations},
+}
+
+// testStore runs the conformance suite against a store, one subtest per
+// check
+func testStore(t *testing.T, s Store) {
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	for _, c := range storeChecks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.check(s, run); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	testStore(t, store)
+}
+
+// TestPostgresStore runs against the database named by TEST_DATABASE_URL,
+// which must be a scratch database since the signing key check expects a
+// store without keys
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("POSTGRES_URL", url)
+	store, err := NewPostgersStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	testStore(t, store)
+}
+
+// expect returns an error unless err is want
+func expect(what string, err error, want error) error {
+	if !errors.Is(err, want) {
+		return fmt.Errorf("%s returned %v, want %v", what, err, want)
+	}
+	return nil
+}
+
+// sameTime reports whether two times are equal at the precision every
+// store keeps
+func sameTime(a, b time.Time) bool {
+	return a.Sub(b).Abs() < time.Millisecond
+}
+
+func checkUsers(s Store, run string) error {
+	email := "user-" + run + "@check.test"
+	if err := s.CreateUser(&User{Email: email, Password: "first password"}); err != nil {
+		return err
+	}
+	if err := expect("CreateUser with a taken email", s.CreateUser(&User{Email: email, Password: "x"}), ErrUserExists); err != nil {
+		return err
+	}
+	_, err := s.GetUser("missing-" + run + "@check.test")
+	if err := expect("GetUser of a missing user", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	if user.Email != email || user.Role != RoleUser || user.Id == 0 {
+		return fmt.Errorf("GetUser returned %+v", user)
+	}
+	if ok, _, _ := VerifyPassword(user.Password, "first password"); !ok || user.Password == "first password" {
+		return fmt.Errorf("the password is not stored hashed")
+	}
+	byId, err := s.GetUserById(user.Id)
+	if err != nil {
+		return err
+	}
+	if byId.Email != email {
+		return fmt.Errorf("GetUserById returned %+v", byId)
+	}
+	_, err = s.GetUserById(-1)
+	if err := expect("GetUserById of a missing user", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	if err := s.SetUserRole(user.Id, RoleAdmin); err != nil {
+		return err
+	}
+	if err := expect("SetUserRole of a missing user", s.SetUserRole(-1, RoleAdmin), sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := s.UpdatePassword(email, "second password"); err != nil {
+		return err
+	}
+	user, err = s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	if user.Role != RoleAdmin {
+		return fmt.Errorf("the role is %s after SetUserRole", user.Role)
+	}
+	if ok, _, _ := VerifyPassword(user.Password, "second password"); !ok {
+		return fmt.Errorf("the password was not updated")
+	}
+	return nil
+}
+
+func checkInvites(s Store, run string) error {
+	code := "code-" + run
+	email := "invited-" + run + "@check.test"
+	if err := s.CreateInvite(code); err != nil {
+		return err
+	}
+	if err := s.CreateInvite(code); err != nil {
+		return fmt.Errorf("CreateInvite of an existing code returned %v", err)
+	}
+	err := s.CreateInvitedUser(&User{Email: email, Password: "password"}, "missing-"+code)
+	if err := expect("CreateInvitedUser with a missing code", err, ErrInvalidInvite); err != nil {
+		return err
+	}
+	if _, err := s.GetUser(email); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("a user was created with a missing code")
+	}
+
+	// A taken email leaves the code unused
+	taken := "taken-" + run + "@check.test"
+	if err := s.CreateUser(&User{Email: taken, Password: "password"}); err != nil {
+		return err
+	}
+	err = s.CreateInvitedUser(&User{Email: taken, Password: "password"}, code)
+	if err := expect("CreateInvitedUser with a taken email", err, ErrUserExists); err != nil {
+		return err
+	}
+
+	if err := s.CreateInvitedUser(&User{Email: email, Password: "password"}, code); err != nil {
+		return err
+	}
+	if _, err := s.GetUser(email); err != nil {
+		return err
+	}
+	err = s.CreateInvitedUser(&User{Email: "again-" + email, Password: "password"}, code)
+	return expect("CreateInvitedUser with a used code", err, ErrInvalidInvite)
+}
+
+// checkUser creates a user for a check and returns its id
+func checkUser(s Store, email string) (int64, error) {
+	if err := s.CreateUser(&User{Email: email, Password: "password"}); err != nil {
+		return 0, err
+	}
+	user, err := s.GetUser(email)
+	if err != nil {
+		return 0, err
+	}
+	return user.Id, nil
+}
+
+func checkRefreshTokens(s Store, run string) error {
+	userId, err := checkUser(s, "refresh-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	expires := time.Now().UTC().Add(time.Hour)
+	if err := s.CreateRefreshToken(userId, run+"-a", run+"-family", expires); err != nil {
+		return err
+	}
+
+	id, err := s.RotateRefreshToken(run+"-a", run+"-b", expires)
+	if err != nil {
+		return err
+	}
+	if id != userId {
+		return fmt.Errorf("RotateRefreshToken returned user %d, want %d", id, userId)
+	}
+	_, err = s.RotateRefreshToken(run+"-a", run+"-c", expires)
+	if err := expect("RotateRefreshToken of a used token", err, ErrTokenReused); err != nil {
+		return err
+	}
+	_, err = s.RotateRefreshToken(run+"-b", run+"-c", expires)
+	if err := expect("RotateRefreshToken in a revoked family", err, ErrTokenInvalid); err != nil {
+		return err
+	}
+	_, err = s.RotateRefreshToken(run+"-missing", run+"-c", expires)
+	if err := expect("RotateRefreshToken of a missing token", err, ErrTokenInvalid); err != nil {
+		return err
+	}
+
+	if err := s.CreateRefreshToken(userId, run+"-expired", run+"-other", time.Now().UTC().Add(-time.Minute)); err != nil {
+		return err
+	}
+	_, err = s.RotateRefreshToken(run+"-expired", run+"-c", expires)
+	if err := expect("RotateRefreshToken of an expired token", err, ErrTokenInvalid); err != nil {
+		return err
+	}
+
+	if err := s.CreateRefreshToken(userId, run+"-d", run+"-logout", expires); err != nil {
+		return err
+	}
+	if err := s.RevokeRefreshToken(run+"-d", userId+1); err != nil {
+		return err
+	}
+	if _, err := s.RotateRefreshToken(run+"-d", run+"-e", expires); err != nil {
+		return fmt.Errorf("another user revoked a refresh token: %v", err)
+	}
+	if err := s.RevokeRefreshToken(run+"-e", userId); err != nil {
+		return err
+	}
+	_, err = s.RotateRefreshToken(run+"-e", run+"-f", expires)
+	if err := expect("RotateRefreshToken of a revoked token", err, ErrTokenInvalid); err != nil {
+		return err
+	}
+
+	if err := s.CreateRefreshToken(userId, run+"-g", run+"-sessions", expires); err != nil {
+		return err
+	}
+	if err := s.RevokeUserTokens(userId, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err = s.RotateRefreshToken(run+"-g", run+"-h", expires)
+	return expect("RotateRefreshToken after RevokeUserTokens", err, ErrTokenInvalid)
+}
+
+func checkRevocations(s Store, run string) error {
+	userId, err := checkUser(s, "revoked-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := s.RevokeToken(run+"-jti", userId, now.Add(time.Hour)); err != nil {
+		return err
+	}
+	if err := s.RevokeToken(run+"-jti", userId, now.Add(time.Hour)); err != nil {
+		return fmt.Errorf("RevokeToken of a revoked token returned %v", err)
+	}
+	if err := s.RevokeToken(run+"-expired", userId, now.Add(-time.Minute)); err != nil {
+		return err
+	}
+	if revoked, err := s.IsTokenRevoked(run+"-jti", userId, now); err != nil || !revoked {
+		return fmt.Errorf("a revoked token is not revoked: %v", err)
+	}
+	if revoked, err := s.IsTokenRevoked(run+"-other", userId, now); err != nil || revoked {
+		return fmt.Errorf("a token is revoked before its user's watermark: %v", err)
+	}
+
+	// The watermark is the exact time of the revocation, within the second
+	// of the tokens issued just before it
+	if err := s.RevokeUserTokens(userId, now.Add(500*time.Millisecond)); err != nil {
+		return err
+	}
+	// An older watermark does not move it back
+	if err := s.RevokeUserTokens(userId, now.Add(-time.Minute)); err != nil {
+		return err
+	}
+	if revoked, err := s.IsTokenRevoked(run+"-other", userId, now.Add(-time.Second)); err != nil || !revoked {
+		return fmt.Errorf("a token issued before the watermark is not revoked: %v", err)
+	}
+	if revoked, err := s.IsTokenRevoked(run+"-other", userId, now); err != nil || !revoked {
+		return fmt.Errorf("a token issued in the second of the watermark is not revoked: %v", err)
+	}
+	if revoked, err := s.IsTokenRevoked(run+"-other", userId, now.Add(time.Second)); err != nil || revoked {
+		return fmt.Errorf("a token issued in the second after the watermark is revoked: %v", err)
+	}
+
+	revocations, err := s.ListRevocations(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	tokens := map[string]time.Time{}
+	for _, token := range revocations.Tokens {
+		tokens[token.Id] = token.ExpiresAt
+	}
+	if exp, ok := tokens[run+"-jti"]; !ok || !sameTime(exp, now.Add(time.Hour)) {
+		return fmt.Errorf("ListRevocations is missing a revoked token")
+	}
+	if _, ok := tokens[run+"-expired"]; ok {
+		return fmt.Errorf("ListRevocations kept an expired token")
+	}
+	i := slices.IndexFunc(revocations.Users, func(w UserWatermark) bool {
+		return w.UserId == strconv.FormatInt(userId, 10)
+	})
+	if i < 0 || !sameTime(revocations.Users[i].IssuedBefore, now.Add(500*time.Millisecond)) {
+		return fmt.Errorf("ListRevocations is missing a watermark")
+	}
+	return nil
+}
+
+func checkSigningKeys(s Store, run string) error {
+	created := 0
+	newKey := func(activeFrom time.Time) (*StoredKey, error) {
+		created++
+		return &StoredKey{
+			Id:         run + "-" + strconv.Itoa(created),
+			Sealed:     []byte{byte(created)},
+			ActiveFrom: activeFrom,
+			CreatedAt:  time.Now().UTC(),
+		}, nil
+	}
+
+	now := time.Now().UTC()
+	keys, err := s.RotateSigningKeys(now, newKey)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 || created != 1 || !sameTime(keys[0].ActiveFrom, now) {
+		return fmt.Errorf("the store had signing keys, or the first key was not created")
+	}
+	keys, err = s.RotateSigningKeys(now.Add(time.Minute), newKey)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 || created != 1 {
+		return fmt.Errorf("a key was created before one was due")
+	}
+
+	// The next key is published ahead of time, and the first one is
+	// deleted once the tokens it signed have expired
+	later := now.Add(keyRotationInterval - keyPublishLead)
+	keys, err = s.RotateSigningKeys(later, newKey)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 2 || keys[0].Id != run+"-1" || keys[1].Id != run+"-2" || !slices.Equal(keys[1].Sealed, []byte{2}) {
+		return fmt.Errorf("the next key was not created")
+	}
+	keys, err = s.RotateSigningKeys(later.Add(keyPublishLead+tokenLifetime+keyPublishLead+time.Minute), newKey)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 || keys[0].Id != run+"-2" {
+		return fmt.Errorf("the expired key was not deleted")
+	}
+	return nil
+}
+
+func checkAPIKeys(s Store, run string) error {
+	email := "api-" + run + "@check.test"
+	userId, err := checkUser(s, email)
+	if err != nil {
+		return err
+	}
+
+	first := &APIKey{UserId: userId, Name: "first", Prefix: "mp3k_a", Hash: run + "-first", Scopes: []string{"upload"}}
+	if err := s.CreateAPIKey(first); err != nil {
+		return err
+	}
+	if first.Id == 0 || first.CreatedAt.IsZero() {
+		return fmt.Errorf("CreateAPIKey did not set the id and creation time")
+	}
+	expires := time.Now().UTC().Add(time.Hour)
+	second := &APIKey{UserId: userId, Name: "second", Prefix: "mp3k_b", Hash: run + "-second",
+		Scopes: []string{"download-own", "upload"}, ExpiresAt: &expires}
+	if err := s.CreateAPIKey(second); err != nil {
+		return err
+	}
+	expired := time.Now().UTC().Add(-time.Minute)
+	if err := s.CreateAPIKey(&APIKey{UserId: userId, Name: "expired", Prefix: "mp3k_c", Hash: run + "-expired",
+		Scopes: []string{"upload"}, ExpiresAt: &expired}); err != nil {
+		return err
+	}
+
+	keys, err := s.ListAPIKeys(userId)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 2 || keys[0].Id != second.Id || keys[1].Id != first.Id {
+		return fmt.Errorf("ListAPIKeys did not return the valid keys newest first")
+	}
+	if !slices.Equal(keys[0].Scopes, second.Scopes) || keys[0].ExpiresAt == nil || !sameTime(*keys[0].ExpiresAt, expires) {
+		return fmt.Errorf("ListAPIKeys returned %+v", keys[0])
+	}
+	if keys[1].LastUsedAt != nil {
+		return fmt.Errorf("an unused key has a last use")
+	}
+
+	key, user, err := s.UseAPIKey(run + "-first")
+	if err != nil {
+		return err
+	}
+	if key.Id != first.Id || user.Id != userId || user.Email != email || key.LastUsedAt == nil {
+		return fmt.Errorf("UseAPIKey returned %+v for %+v", key, user)
+	}
+	_, _, err = s.UseAPIKey(run + "-expired")
+	if err := expect("UseAPIKey of an expired key", err, ErrAPIKeyInvalid); err != nil {
+		return err
+	}
+
+	if err := expect("RevokeAPIKey of another user's key", s.RevokeAPIKey(userId+1, first.Id), sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := s.RevokeAPIKey(userId, first.Id); err != nil {
+		return err
+	}
+	if err := expect("RevokeAPIKey of a revoked key", s.RevokeAPIKey(userId, first.Id), sql.ErrNoRows); err != nil {
+		return err
+	}
+	_, _, err = s.UseAPIKey(run + "-first")
+	return expect("UseAPIKey of a revoked key", err, ErrAPIKeyInvalid)
+}
+
+func checkLoginFailures(s Store, run string) error {
+	email := "locked-" + run + "@check.test"
+	_, err := s.GetLoginLock(email)
+	if err := expect("GetLoginLock without failures", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for want := 1; want <= 3; want++ {
+		failures, err := s.RecordLoginFailure(email, now, now.Add(-time.Hour))
+		if err != nil {
+			return err
+		}
+		if failures != want {
+			return fmt.Errorf("RecordLoginFailure returned %d, want %d", failures, want)
+		}
+	}
+	// Failures before the window are forgotten
+	failures, err := s.RecordLoginFailure(email, now.Add(2*time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	if failures != 1 {
+		return fmt.Errorf("RecordLoginFailure after the window returned %d, want 1", failures)
+	}
+
+	until := now.Add(time.Hour)
+	if err := s.LockLogin(email, until); err != nil {
+		return err
+	}
+	if err := s.LockLogin(email, now.Add(time.Minute)); err != nil {
+		return err
+	}
+	lock, err := s.GetLoginLock(email)
+	if err != nil {
+		return err
+	}
+	if lock.Failures != 1 || !sameTime(lock.LockedUntil, until) {
+		return fmt.Errorf("GetLoginLock returned %+v", lock)
+	}
+	locks, err := s.ListLoginLocks(now)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(locks, func(l *LoginLock) bool { return l.Email == email }) {
+		return fmt.Errorf("ListLoginLocks is missing a locked account")
+	}
+
+	if err := s.ClearLoginFailures(email); err != nil {
+		return err
+	}
+	_, err = s.GetLoginLock(email)
+	return expect("GetLoginLock after ClearLoginFailures", err, sql.ErrNoRows)
+}
+
+func checkPasswordResets(s Store, run string) error {
+	email := "reset-" + run + "@check.test"
+	userId, err := checkUser(s, email)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().UTC().Add(time.Hour)
+	if err := s.CreatePasswordReset(userId, run+"-old", expires); err != nil {
+		return err
+	}
+	if err := s.CreatePasswordReset(userId, run+"-reset", expires); err != nil {
+		return err
+	}
+	_, err = s.GetPasswordReset(run + "-old")
+	if err := expect("GetPasswordReset of a replaced token", err, ErrResetInvalid); err != nil {
+		return err
+	}
+	if err := s.CreatePasswordReset(userId, run+"-expired", time.Now().UTC().Add(-time.Minute)); err != nil {
+		return err
+	}
+	_, err = s.GetPasswordReset(run + "-expired")
+	if err := expect("GetPasswordReset of an expired token", err, ErrResetInvalid); err != nil {
+		return err
+	}
+	err = s.ResetPassword(run+"-expired", "new password")
+	if err := expect("ResetPassword with an expired token", err, ErrResetInvalid); err != nil {
+		return err
+	}
+
+	// The expired token replaced the other one, so a new one is needed
+	if err := s.CreatePasswordReset(userId, run+"-reset", expires); err != nil {
+		return err
+	}
+	id, err := s.GetPasswordReset(run + "-reset")
+	if err != nil {
+		return err
+	}
+	if id != userId {
+		return fmt.Errorf("GetPasswordReset returned user %d, want %d", id, userId)
+	}
+	if err := s.ResetPassword(run+"-reset", "new password"); err != nil {
+		return err
+	}
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	if ok, _, _ := VerifyPassword(user.Password, "new password"); !ok {
+		return fmt.Errorf("ResetPassword did not change the password")
+	}
+	err = s.ResetPassword(run+"-reset", "another password")
+	return expect("ResetPassword with a used token", err, ErrResetInvalid)
+}
+
+func checkEmailVerification(s Store, run string) error {
+	email := "verify-" + run + "@check.test"
+	userId, err := checkUser(s, email)
+	if err != nil {
+		return err
+	}
+	user, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return fmt.Errorf("a new user is verified")
+	}
+
+	expires := time.Now().UTC().Add(time.Hour)
+	if err := s.CreateEmailVerification(userId, run+"-old", expires); err != nil {
+		return err
+	}
+	if err := s.CreateEmailVerification(userId, run+"-expired", time.Now().UTC().Add(-time.Minute)); err != nil {
+		return err
+	}
+	_, err = s.VerifyEmail(run + "-old")
+	if err := expect("VerifyEmail with a replaced token", err, ErrVerificationInvalid); err != nil {
+		return err
+	}
+	_, err = s.VerifyEmail(run + "-expired")
+	if err := expect("VerifyEmail with an expired token", err, ErrVerificationInvalid); err != nil {
+		return err
+	}
+	if user, err := s.GetUserById(userId); err != nil {
+		return err
+	} else if user.EmailVerified {
+		return fmt.Errorf("the user is verified after invalid tokens")
+	}
+
+	if err := s.CreateEmailVerification(userId, run+"-verify", expires); err != nil {
+		return err
+	}
+	id, err := s.VerifyEmail(run + "-verify")
+	if err != nil {
+		return err
+	}
+	if id != userId {
+		return fmt.Errorf("VerifyEmail returned user %d, want %d", id, userId)
+	}
+	if user, err := s.GetUserById(userId); err != nil {
+		return err
+	} else if !user.EmailVerified {
+		return fmt.Errorf("VerifyEmail did not verify the user")
+	}
+	_, err = s.VerifyEmail(run + "-verify")
+	if err := expect("VerifyEmail with a used token", err, ErrVerificationInvalid); err != nil {
+		return err
+	}
+
+	other, err := checkUser(s, "verify-other-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	if err := s.SetEmailVerified(other); err != nil {
+		return err
+	}
+	if user, err := s.GetUserById(other); err != nil {
+		return err
+	} else if !user.EmailVerified {
+		return fmt.Errorf("SetEmailVerified did not verify the user")
+	}
+	return expect("SetEmailVerified of a missing user", s.SetEmailVerified(-1), sql.ErrNoRows)
+}
+
+func checkTOTP(s Store, run string) error {
+	userId, err := checkUser(s, "totp-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	otherId, err := checkUser(s, "totp-other-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	_, err = s.GetTOTP(userId)
+	if err := expect("GetTOTP without a secret", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	err = s.ConfirmTOTP(userId, 1, nil)
+	if err := expect("ConfirmTOTP without a secret", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	// A pending secret can be replaced, and codes are refused until it is
+	// confirmed
+	if err := s.CreateTOTP(userId, "first"); err != nil {
+		return err
+	}
+	if err := s.CreateTOTP(userId, "second"); err != nil {
+		return err
+	}
+	totp, err := s.GetTOTP(userId)
+	if err != nil {
+		return err
+	}
+	if totp.UserId != userId || totp.Secret != "second" || totp.ConfirmedAt != nil {
+		return fmt.Errorf("GetTOTP of a pending secret returned %+v", totp)
+	}
+	if err := expect("UseTOTPStep of a pending secret", s.UseTOTPStep(userId, 5), ErrMFAInvalid); err != nil {
+		return err
+	}
+
+	if err := s.ConfirmTOTP(userId, 100, []string{run + "-code1", run + "-code2"}); err != nil {
+		return err
+	}
+	totp, err = s.GetTOTP(userId)
+	if err != nil {
+		return err
+	}
+	if totp.ConfirmedAt == nil || totp.LastStep != 100 {
+		return fmt.Errorf("GetTOTP of a confirmed secret returned %+v", totp)
+	}
+	if err := expect("CreateTOTP with a confirmed secret", s.CreateTOTP(userId, "third"), ErrMFAEnabled); err != nil {
+		return err
+	}
+	if err := expect("ConfirmTOTP of a confirmed secret", s.ConfirmTOTP(userId, 101, nil), ErrMFAEnabled); err != nil {
+		return err
+	}
+
+	// Steps only move forward
+	if err := expect("UseTOTPStep of the confirming step", s.UseTOTPStep(userId, 100), ErrMFAInvalid); err != nil {
+		return err
+	}
+	if err := s.UseTOTPStep(userId, 102); err != nil {
+		return err
+	}
+	if err := expect("UseTOTPStep of an earlier step", s.UseTOTPStep(userId, 101), ErrMFAInvalid); err != nil {
+		return err
+	}
+
+	if err := expect("UseRecoveryCode of another user", s.UseRecoveryCode(otherId, run+"-code1"), ErrMFAInvalid); err != nil {
+		return err
+	}
+	if err := s.UseRecoveryCode(userId, run+"-code1"); err != nil {
+		return err
+	}
+	if err := expect("UseRecoveryCode of a used code", s.UseRecoveryCode(userId, run+"-code1"), ErrMFAInvalid); err != nil {
+		return err
+	}
+
+	if err := s.DeleteTOTP(userId); err != nil {
+		return err
+	}
+	_, err = s.GetTOTP(userId)
+	if err := expect("GetTOTP after DeleteTOTP", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := expect("UseRecoveryCode after DeleteTOTP", s.UseRecoveryCode(userId, run+"-code2"), ErrMFAInvalid); err != nil {
+		return err
+	}
+	return expect("DeleteTOTP without a secret", s.DeleteTOTP(userId), sql.ErrNoRows)
+}
+
+func checkWebAuthn(s Store, run string) error {
+	userId, err := checkUser(s, "webauthn-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+	otherId, err := checkUser(s, "webauthn-other-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+
+	// Challenges are used once, for their purpose, before they expire
+	expires := time.Now().UTC().Add(time.Minute)
+	challenges := []*WebAuthnChallenge{
+		{Challenge: run + "-register", UserId: userId, Purpose: WebAuthnRegister, ExpiresAt: expires},
+		{Challenge: run + "-login", Purpose: WebAuthnLogin, ExpiresAt: expires},
+		{Challenge: run + "-expired", Purpose: WebAuthnLogin, ExpiresAt: time.Now().UTC().Add(-time.Minute)},
+	}
+	for _, challenge := range challenges {
+		if err := s.CreateWebAuthnChallenge(challenge); err != nil {
+			return err
+		}
+	}
+	_, err = s.UseWebAuthnChallenge(run+"-register", WebAuthnLogin)
+	if err := expect("UseWebAuthnChallenge for another purpose", err, ErrWebAuthnChallenge); err != nil {
+		return err
+	}
+	challenge, err := s.UseWebAuthnChallenge(run+"-register", WebAuthnRegister)
+	if err != nil {
+		return err
+	}
+	if challenge.UserId != userId || challenge.Purpose != WebAuthnRegister || !sameTime(challenge.ExpiresAt, expires) {
+		return fmt.Errorf("UseWebAuthnChallenge returned %+v", challenge)
+	}
+	_, err = s.UseWebAuthnChallenge(run+"-register", WebAuthnRegister)
+	if err := expect("UseWebAuthnChallenge of a used challenge", err, ErrWebAuthnChallenge); err != nil {
+		return err
+	}
+	if challenge, err := s.UseWebAuthnChallenge(run+"-login", WebAuthnLogin); err != nil {
+		return err
+	} else if challenge.UserId != 0 {
+		return fmt.Errorf("a login challenge has user %d", challenge.UserId)
+	}
+	_, err = s.UseWebAuthnChallenge(run+"-expired", WebAuthnLogin)
+	if err := expect("UseWebAuthnChallenge of an expired challenge", err, ErrWebAuthnChallenge); err != nil {
+		return err
+	}
+
+	credential := &WebAuthnCredential{
+		Id:          run + "-credential",
+		UserId:      userId,
+		Name:        "Laptop",
+		PublicKey:   []byte{0xa5, 0x01, 0x02},
+		SignCount:   5,
+		Attestation: "packed",
+	}
+	if err := s.CreateWebAuthnCredential(credential); err != nil {
+		return err
+	}
+	if credential.CreatedAt.IsZero() {
+		return fmt.Errorf("CreateWebAuthnCredential did not set the creation time")
+	}
+	duplicate := *credential
+	duplicate.UserId = otherId
+	if err := expect("CreateWebAuthnCredential of a taken id", s.CreateWebAuthnCredential(&duplicate), ErrCredentialExists); err != nil {
+		return err
+	}
+	found, err := s.GetWebAuthnCredential(credential.Id)
+	if err != nil {
+		return err
+	}
+	if found.UserId != userId || found.Name != "Laptop" || !slices.Equal(found.PublicKey, credential.PublicKey) ||
+		found.SignCount != 5 || found.Attestation != "packed" || found.LastUsedAt != nil {
+		return fmt.Errorf("GetWebAuthnCredential returned %+v", found)
+	}
+	_, err = s.GetWebAuthnCredential(run + "-missing")
+	if err := expect("GetWebAuthnCredential of a missing credential", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	// Counters only grow, except for authenticators that have none
+	if err := expect("UseWebAuthnCredential with the same counter", s.UseWebAuthnCredential(credential.Id, 5), ErrSignCount); err != nil {
+		return err
+	}
+	if err := s.UseWebAuthnCredential(credential.Id, 9); err != nil {
+		return err
+	}
+	if err := expect("UseWebAuthnCredential with a lower counter", s.UseWebAuthnCredential(credential.Id, 6), ErrSignCount); err != nil {
+		return err
+	}
+	if found, err := s.GetWebAuthnCredential(credential.Id); err != nil {
+		return err
+	} else if found.SignCount != 9 || found.LastUsedAt == nil {
+		return fmt.Errorf("UseWebAuthnCredential left %+v", found)
+	}
+	counterless := &WebAuthnCredential{Id: run + "-counterless", UserId: userId, Name: "Key", PublicKey: []byte{0xa0}, Attestation: "none"}
+	if err := s.CreateWebAuthnCredential(counterless); err != nil {
+		return err
+	}
+	if err := s.UseWebAuthnCredential(counterless.Id, 0); err != nil {
+		return fmt.Errorf("UseWebAuthnCredential without a counter returned %v", err)
+	}
+
+	credentials, err := s.ListWebAuthnCredentials(userId)
+	if err != nil {
+		return err
+	}
+	if len(credentials) != 2 {
+		return fmt.Errorf("ListWebAuthnCredentials returned %d credentials, want 2", len(credentials))
+	}
+	err = s.DeleteWebAuthnCredential(otherId, credential.Id)
+	if err := expect("DeleteWebAuthnCredential of another user", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := s.DeleteWebAuthnCredential(userId, credential.Id); err != nil {
+		return err
+	}
+	_, err = s.GetWebAuthnCredential(credential.Id)
+	return expect("GetWebAuthnCredential after DeleteWebAuthnCredential", err, sql.ErrNoRows)
+}
+
+func checkDeviceAuthorizations(s Store, run string) error {
+	userId, err := checkUser(s, "device-"+run+"@check.test")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	auths := []*DeviceAuthorization{
+		{DeviceCodeHash: run + "-hash", UserCode: run + "-code", ClientId: "check", Status: DevicePending,
+			Interval: devicePollInterval, ExpiresAt: now.Add(deviceCodeLifetime)},
+		{DeviceCodeHash: run + "-expired-hash", UserCode: run + "-expired", ClientId: "check", Status: DevicePending,
+			Interval: devicePollInterval, ExpiresAt: now.Add(-time.Minute)},
+	}
+	for _, auth := range auths {
+		if err := s.CreateDeviceAuthorization(auth); err != nil {
+			return err
+		}
+	}
+	err = s.CreateDeviceAuthorization(&DeviceAuthorization{DeviceCodeHash: run + "-other-hash", UserCode: run + "-code",
+		ClientId: "check", Status: DevicePending, Interval: devicePollInterval, ExpiresAt: now.Add(time.Minute)})
+	if err := expect("CreateDeviceAuthorization with a user code in use", err, ErrUserCodeTaken); err != nil {
+		return err
+	}
+
+	auth, err := s.GetDeviceAuthorization(run + "-code")
+	if err != nil {
+		return err
+	}
+	if auth.DeviceCodeHash != run+"-hash" || auth.ClientId != "check" || auth.Status != DevicePending ||
+		auth.UserId != 0 || auth.LastPolledAt != nil || !sameTime(auth.ExpiresAt, now.Add(deviceCodeLifetime)) {
+		return fmt.Errorf("GetDeviceAuthorization returned %+v", auth)
+	}
+	_, err = s.GetDeviceAuthorization(run + "-expired")
+	if err := expect("GetDeviceAuthorization of an expired code", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+
+	// Polling before the interval has passed makes it longer
+	if auth, err := s.PollDeviceAuthorization(run+"-hash", "check", now); err != nil {
+		return err
+	} else if auth.Status != DevicePending {
+		return fmt.Errorf("PollDeviceAuthorization returned %+v", auth)
+	}
+	_, err = s.PollDeviceAuthorization(run+"-hash", "check", now.Add(time.Second))
+	if err := expect("PollDeviceAuthorization too soon", err, ErrSlowDown); err != nil {
+		return err
+	}
+	interval := time.Duration(devicePollInterval+deviceSlowDown) * time.Second
+	if auth, err := s.PollDeviceAuthorization(run+"-hash", "check", now.Add(time.Second+interval)); err != nil {
+		return err
+	} else if auth.Interval != devicePollInterval+deviceSlowDown || auth.LastPolledAt == nil ||
+		!sameTime(*auth.LastPolledAt, now.Add(time.Second)) {
+		return fmt.Errorf("PollDeviceAuthorization after slowing down returned %+v", auth)
+	}
+
+	// Polls by another client or after expiry are refused and change nothing
+	_, err = s.PollDeviceAuthorization(run+"-hash", "other", now.Add(time.Minute))
+	if err := expect("PollDeviceAuthorization by another client", err, ErrDeviceClient); err != nil {
+		return err
+	}
+	_, err = s.PollDeviceAuthorization(run+"-hash", "check", now.Add(deviceCodeLifetime))
+	if err := expect("PollDeviceAuthorization after expiry", err, ErrDeviceExpired); err != nil {
+		return err
+	}
+
+	// A decision is made once, and the authorization is kept until it is
+	// consumed
+	err = s.DecideDeviceAuthorization(run+"-expired", userId, DeviceApproved)
+	if err := expect("DecideDeviceAuthorization of an expired code", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := s.DecideDeviceAuthorization(run+"-code", userId, DeviceApproved); err != nil {
+		return err
+	}
+	err = s.DecideDeviceAuthorization(run+"-code", userId, DeviceDenied)
+	if err := expect("DecideDeviceAuthorization of a decided code", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	for _, at := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if auth, err := s.PollDeviceAuthorization(run+"-hash", "check", now.Add(at)); err != nil {
+			return err
+		} else if auth.Status != DeviceApproved || auth.UserId != userId {
+			return fmt.Errorf("PollDeviceAuthorization after approval returned %+v", auth)
+		}
+	}
+	err = s.ConsumeDeviceAuthorization(run+"-hash", DeviceDenied)
+	if err := expect("ConsumeDeviceAuthorization with another status", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	if err := s.ConsumeDeviceAuthorization(run+"-hash", DeviceApproved); err != nil {
+		return err
+	}
+	err = s.ConsumeDeviceAuthorization(run+"-hash", DeviceApproved)
+	if err := expect("ConsumeDeviceAuthorization twice", err, sql.ErrNoRows); err != nil {
+		return err
+	}
+	_, err = s.PollDeviceAuthorization(run+"-hash", "check", now.Add(3*time.Minute))
+	return expect("PollDeviceAuthorization after ConsumeDeviceAuthorization", err, sql.ErrNoRows)
+}
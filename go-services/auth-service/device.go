@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The device authorization grant (RFC 8628) logs in clients that can not
+// show a login page, like the mp3conv command line client. The client gets
+// a device code and a short user code, the user approves the user code
+// while logged in elsewhere, and the client polls until it gets the same
+// tokens a login returns.
+
+const (
+	// deviceCodeLifetime is how long a user has to approve a device
+	deviceCodeLifetime = 10 * time.Minute
+	// devicePollInterval is how many seconds devices wait between polls.
+	// A device polling sooner is told to slow down, which adds
+	// deviceSlowDown seconds to its interval.
+	devicePollInterval = 5
+	deviceSlowDown     = 5
+	// userCodeAlphabet has no vowels, so user codes spell no words, and no
+	// letters that are easily confused
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// deviceCodeGrantType is the grant_type devices poll with
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Statuses of a device authorization
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+var (
+	// ErrUserCodeTaken is returned when a new device authorization gets a
+	// user code that is already in use
+	ErrUserCodeTaken = errors.New("user code already in use")
+	// ErrSlowDown is returned when a device polls before its interval has
+	// passed
+	ErrSlowDown = errors.New("device polled too soon")
+	// ErrDeviceClient is returned when a device code is polled by another
+	// client than the one it was issued to
+	ErrDeviceClient = errors.New("device code was issued to another client")
+	// ErrDeviceExpired is returned when a device code is polled after it
+	// expired
+	ErrDeviceExpired = errors.New("device code expired")
+)
+
+// DeviceAuthorization is a device authorization grant waiting to be
+// approved by a user and picked up by the device
+type DeviceAuthorization struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientId       string
+	UserId         int64 // user who approved or denied it
+	Status         string
+	Interval       int // seconds between polls
+	LastPolledAt   *time.Time
+	ExpiresAt      time.Time
+}
+
+// tooSoon reports whether a poll at now comes before the interval since
+// the last one has passed
+func (a *DeviceAuthorization) tooSoon(now time.Time) bool {
+	return a.LastPolledAt != nil && now.Before(a.LastPolledAt.Add(time.Duration(a.Interval)*time.Second))
+}
+
+// deviceClientIds returns the clients allowed to use the device grant,
+// configured as a comma separated list by DEVICE_CLIENT_IDS
+func deviceClientIds() []string {
+	ids := []string{}
+	for _, id := range strings.Split(os.Getenv("DEVICE_CLIENT_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return []string{"mp3conv"}
+	}
+	return ids
+}
+
+// deviceVerificationURL returns the page where users enter user codes,
+// configured by DEVICE_VERIFICATION_URL
+func deviceVerificationURL() string {
+	if u := os.Getenv("DEVICE_VERIFICATION_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:3000/device"
+}
+
+// deviceVerificationLink returns the verification page with a user code
+// filled in, so it can be opened without typing the code
+func deviceVerificationLink(userCode string) string {
+	u, err := url.Parse(deviceVerificationURL())
+	if err != nil {
+		return deviceVerificationURL()
+	}
+	q := u.Query()
+	q.Set("user_code", userCode)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// newUserCode returns a random user code like BCDF-GHJK
+func newUserCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate user code: %v", err)
+		}
+		b.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeUserCode returns a user code as typed by a user in the form
+// newUserCode returns, ignoring case, spaces and dashes
+func normalizeUserCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// writeOAuthError writes an error response of the OAuth token endpoint
+// (RFC 6749 section 5.2)
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, status, body)
+}
+
+// handleDeviceCode starts a device authorization for a client. Like the
+// token endpoint it takes a form, as OAuth clients send one.
+func (s *AuthServer) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	if ok, retry := s.loginIPs.allow(ip, time.Now()); !ok {
+		log.Printf("Too many device authorizations from %s", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		writeOAuthError(w, http.StatusTooManyRequests, "slow_down", "too many login attempts")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+	clientId := r.PostForm.Get("client_id")
+	if !slices.Contains(deviceClientIds(), clientId) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return
+	}
+
+	deviceCode, err := newRefreshToken()
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	auth := &DeviceAuthorization{
+		DeviceCodeHash: hashRefreshToken(deviceCode),
+		ClientId:       clientId,
+		Status:         DevicePending,
+		Interval:       devicePollInterval,
+		ExpiresAt:      time.Now().UTC().Add(deviceCodeLifetime),
+	}
+	// User codes are short, so a new one can collide with a pending one
+	for attempt := 0; ; attempt++ {
+		if auth.UserCode, err = newUserCode(); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = s.store.CreateDeviceAuthorization(auth)
+		if !errors.Is(err, ErrUserCodeTaken) || attempt == 2 {
+			break
+		}
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 auth.UserCode,
+		"verification_uri":          deviceVerificationURL(),
+		"verification_uri_complete": deviceVerificationLink(auth.UserCode),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  auth.Interval,
+	})
+}
+
+// handleDeviceToken is polled by a device until its user approves or
+// denies it. Once approved it returns the tokens of a login, in the shape
+// of an OAuth token response.
+func (s *AuthServer) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+	if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	clientId := r.PostForm.Get("client_id")
+	if !slices.Contains(deviceClientIds(), clientId) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return
+	}
+	deviceCode := r.PostForm.Get("device_code")
+	if deviceCode == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "missing device code")
+		return
+	}
+
+	now := time.Now().UTC()
+	deviceCodeHash := hashRefreshToken(deviceCode)
+	auth, err := s.store.PollDeviceAuthorization(deviceCodeHash, clientId, now)
+	if errors.Is(err, ErrSlowDown) {
+		writeOAuthError(w, http.StatusBadRequest, "slow_down", "")
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "unknown device code")
+		return
+	}
+	if errors.Is(err, ErrDeviceClient) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if errors.Is(err, ErrDeviceExpired) {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// A decided authorization is only consumed once the device has been
+	// given its outcome, so a failure on the way leaves it for the next
+	// poll
+	switch auth.Status {
+	case DevicePending:
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "")
+		return
+	case DeviceDenied:
+		if err := s.store.ConsumeDeviceAuthorization(deviceCodeHash, DeviceDenied); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			WriteJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "")
+		return
+	}
+
+	user, err := s.store.GetUserById(auth.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The user was deleted after approving the device
+		if err := s.store.ConsumeDeviceAuthorization(deviceCodeHash, DeviceApproved); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			WriteJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tokens, err := s.issueTokens(user)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Losing the race to another poll means these tokens are never handed
+	// out
+	err = s.store.ConsumeDeviceAuthorization(deviceCodeHash, DeviceApproved)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "device code already used")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s logged in on a device with %s", user.Email, clientId)
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  tokens.Token,
+		"token_type":    "Bearer",
+		"expires_in":    tokens.ExpiresIn,
+		"refresh_token": tokens.RefreshToken,
+	})
+}
+
+// handleGetDeviceAuthorization shows the caller which client a user code
+// belongs to, before they approve or deny it
+func (s *AuthServer) handleGetDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.authenticate(r); err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	auth, err := s.store.GetDeviceAuthorization(normalizeUserCode(r.PathValue("userCode")))
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "unknown or expired code")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"userCode":  auth.UserCode,
+		"clientId":  auth.ClientId,
+		"expiresIn": int(time.Until(auth.ExpiresAt).Seconds()),
+	})
+}
+
+// handleApproveDevice lets the device with a user code log in as the
+// caller
+func (s *AuthServer) handleApproveDevice(w http.ResponseWriter, r *http.Request) {
+	s.decideDevice(w, r, DeviceApproved)
+}
+
+// handleDenyDevice refuses the device with a user code
+func (s *AuthServer) handleDenyDevice(w http.ResponseWriter, r *http.Request) {
+	s.decideDevice(w, r, DeviceDenied)
+}
+
+// decideDevice records the caller's decision on the device authorization
+// of a user code
+func (s *AuthServer) decideDevice(w http.ResponseWriter, r *http.Request, status string) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	req := struct {
+		UserCode string `json:"userCode"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserCode == "" {
+		WriteJSON(w, http.StatusBadRequest, "missing user code")
+		return
+	}
+
+	err = s.store.DecideDeviceAuthorization(normalizeUserCode(req.UserCode), userId, status)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "unknown or expired code")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s %s a device", claims.Email, status)
+	WriteJSON(w, http.StatusOK, "device "+status)
+}
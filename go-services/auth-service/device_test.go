@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deviceTest is an auth server with a user and a pending device
+// authorization for the tv client
+type deviceTest struct {
+	t      *testing.T
+	server *AuthServer
+	store  *MemoryStore
+	userId int64
+}
+
+func newDeviceTest(t *testing.T) *deviceTest {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+	t.Setenv("DEVICE_CLIENT_IDS", "tv,radio")
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "device@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("device@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &deviceTest{t: t, server: NewAuthServer("", store, keys, mailer), store: store, userId: user.Id}
+	c.create("code", "USERCODE", time.Now().UTC().Add(deviceCodeLifetime))
+	return c
+}
+
+func (c *deviceTest) create(deviceCode string, userCode string, expiresAt time.Time) {
+	c.t.Helper()
+	err := c.store.CreateDeviceAuthorization(&DeviceAuthorization{DeviceCodeHash: hashRefreshToken(deviceCode),
+		UserCode: userCode, ClientId: "tv", Status: DevicePending, Interval: devicePollInterval, ExpiresAt: expiresAt})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// poll polls the token endpoint as a client, ignoring the poll interval,
+// and returns the status and the OAuth error code if there is one
+func (c *deviceTest) poll(clientId string, deviceCode string) (int, string) {
+	c.t.Helper()
+	c.store.mu.Lock()
+	if auth, ok := c.store.devices[hashRefreshToken(deviceCode)]; ok {
+		auth.LastPolledAt = nil
+	}
+	c.store.mu.Unlock()
+
+	form := url.Values{"grant_type": {deviceCodeGrantType}, "client_id": {clientId}, "device_code": {deviceCode}}
+	r := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	c.server.handleDeviceToken(w, r)
+
+	body := map[string]any{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		c.t.Fatal(err)
+	}
+	if w.Code == http.StatusOK {
+		if token, _ := body["access_token"].(string); token == "" {
+			c.t.Fatalf("token response without an access token: %s", w.Body)
+		}
+		return w.Code, ""
+	}
+	code, _ := body["error"].(string)
+	return w.Code, code
+}
+
+func (c *deviceTest) expectPoll(what string, clientId string, deviceCode string, wantStatus int, wantError string) {
+	c.t.Helper()
+	if status, code := c.poll(clientId, deviceCode); status != wantStatus || code != wantError {
+		c.t.Fatalf("%s returned %d %q, want %d %q", what, status, code, wantStatus, wantError)
+	}
+}
+
+func TestDeviceTokenApproved(t *testing.T) {
+	c := newDeviceTest(t)
+	c.expectPoll("pending poll", "tv", "code", http.StatusBadRequest, "authorization_pending")
+	if err := c.store.DecideDeviceAuthorization("USERCODE", c.userId, DeviceApproved); err != nil {
+		t.Fatal(err)
+	}
+	// Another client polling must not use up the approval
+	c.expectPoll("poll by another client", "radio", "code", http.StatusBadRequest, "invalid_grant")
+	c.expectPoll("approved poll", "tv", "code", http.StatusOK, "")
+	c.expectPoll("poll after pick up", "tv", "code", http.StatusBadRequest, "invalid_grant")
+}
+
+func TestDeviceTokenDenied(t *testing.T) {
+	c := newDeviceTest(t)
+	if err := c.store.DecideDeviceAuthorization("USERCODE", c.userId, DeviceDenied); err != nil {
+		t.Fatal(err)
+	}
+	c.expectPoll("poll by another client", "radio", "code", http.StatusBadRequest, "invalid_grant")
+	c.expectPoll("denied poll", "tv", "code", http.StatusBadRequest, "access_denied")
+	c.expectPoll("poll after pick up", "tv", "code", http.StatusBadRequest, "invalid_grant")
+}
+
+func TestDeviceTokenDeletedUser(t *testing.T) {
+	c := newDeviceTest(t)
+	// Approved by a user who no longer exists
+	if err := c.store.DecideDeviceAuthorization("USERCODE", c.userId+1, DeviceApproved); err != nil {
+		t.Fatal(err)
+	}
+	c.expectPoll("poll for a deleted user", "tv", "code", http.StatusBadRequest, "access_denied")
+	c.expectPoll("poll after pick up", "tv", "code", http.StatusBadRequest, "invalid_grant")
+}
+
+func TestDeviceTokenExpired(t *testing.T) {
+	c := newDeviceTest(t)
+	c.create("expired", "EXPIRED", time.Now().UTC().Add(-time.Second))
+	c.expectPoll("poll by another client", "radio", "expired", http.StatusBadRequest, "invalid_grant")
+	c.expectPoll("expired poll", "tv", "expired", http.StatusBadRequest, "expired_token")
+}
@@ -3,6 +3,10 @@ module github.com/muhreeowki/ds-mp4-mp3-converter
 go 1.22.5
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.26.0
 )
+
+require golang.org/x/sys v0.23.0 // indirect
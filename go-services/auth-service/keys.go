@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tokens are signed with Ed25519 keys that rotate on a schedule. A new key
+// is published in the JWKS keyPublishLead before it starts signing, so
+// verifiers that cache the JWKS know it by the time they see its tokens,
+// and an old key stays published until the last token it signed expires.
+const (
+	keyRotationInterval = 7 * 24 * time.Hour
+	keyPublishLead      = time.Hour
+	keyRefreshInterval  = 5 * time.Minute
+	// jwksMaxAge is how long verifiers may cache the JWKS. It must be
+	// shorter than keyPublishLead.
+	jwksMaxAge = 10 * time.Minute
+)
+
+// SigningKey is a key tokens are signed with from ActiveFrom on
+type SigningKey struct {
+	Id         string
+	PrivateKey ed25519.PrivateKey
+	ActiveFrom time.Time
+	CreatedAt  time.Time
+}
+
+// StoredKey is a signing key as kept in the store, with the private key
+// encrypted
+type StoredKey struct {
+	Id         string
+	Sealed     []byte
+	ActiveFrom time.Time
+	CreatedAt  time.Time
+}
+
+// JWK is an Ed25519 public key in the JSON Web Key format, RFC 8037
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// KeyRing holds the signing keys and rotates them. Keys are shared through
+// the store by every auth-service instance.
+type KeyRing struct {
+	store Store
+	aead  cipher.AEAD
+
+	mu   sync.RWMutex
+	keys []*SigningKey // ordered by ActiveFrom
+}
+
+// NewKeyRing creates a new KeyRing instance and loads the keys, creating
+// the first one if needed. Private keys are encrypted in the store with a
+// key derived from JWT_SECRET.
+func NewKeyRing(store Store) (*KeyRing, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("JWT_SECRET is not set")
+	}
+	kek := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(kek[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KeyRing{store: store, aead: aead}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	go k.run()
+	return k, nil
+}
+
+// run rotates the keys and picks up keys created by other instances
+func (k *KeyRing) run() {
+	for range time.Tick(keyRefreshInterval) {
+		if err := k.refresh(); err != nil {
+			log.Printf("Failed to refresh signing keys: %v", err)
+		}
+	}
+}
+
+// refresh rotates the keys in the store when due and reloads them
+func (k *KeyRing) refresh() error {
+	stored, err := k.store.RotateSigningKeys(time.Now().UTC(), k.newKey)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*SigningKey, 0, len(stored))
+	for _, sk := range stored {
+		seed, err := k.aead.Open(nil, sk.Sealed[:k.aead.NonceSize()], sk.Sealed[k.aead.NonceSize():], []byte(sk.Id))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("failed to decrypt signing key %s, was JWT_SECRET changed?", sk.Id)
+		}
+		keys = append(keys, &SigningKey{
+			Id:         sk.Id,
+			PrivateKey: ed25519.NewKeyFromSeed(seed),
+			ActiveFrom: sk.ActiveFrom,
+			CreatedAt:  sk.CreatedAt,
+		})
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// newKey generates a key that starts signing at activeFrom
+func (k *KeyRing) newKey(activeFrom time.Time) (*StoredKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newTokenId()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &StoredKey{
+		Id:         id,
+		Sealed:     k.aead.Seal(nonce, nonce, priv.Seed(), []byte(id)),
+		ActiveFrom: activeFrom,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// Current returns the key to sign with now
+func (k *KeyRing) Current() (*SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].ActiveFrom.After(now) {
+			return k.keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no active signing key")
+}
+
+// PublicKey returns the public key with the given id
+func (k *KeyRing) PublicKey(kid string) (ed25519.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Id == kid {
+			return key.PrivateKey.Public().(ed25519.PublicKey), true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the public keys in the JWK Set format
+func (k *KeyRing) JWKS() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks := make([]JWK, 0, len(k.keys))
+	for _, key := range k.keys {
+		jwks = append(jwks, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.PrivateKey.Public().(ed25519.PublicKey)),
+			Kid: key.Id,
+			Use: "sig",
+			Alg: "EdDSA",
+		})
+	}
+	return jwks
+}
+
+// handleJWKS publishes the public keys tokens are verified with
+func (s *AuthServer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	WriteJSON(w, http.StatusOK, map[string][]JWK{"keys": s.keys.JWKS()})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loginFreeFailures is how many failed logins an account gets before
+	// each further failure delays the next attempt, doubling every time
+	loginFreeFailures = 3
+	// loginMaxDelay caps the delay between attempts
+	loginMaxDelay = time.Minute
+	// loginLockoutFailures locks an account for loginLockout, until it runs
+	// out or an admin clears it
+	loginLockoutFailures = 10
+	loginLockout         = 30 * time.Minute
+	// loginFailureWindow is how long failures are remembered after the last
+	// one
+	loginFailureWindow = time.Hour
+
+	// loginIPLimit is how many logins a client IP can attempt per
+	// loginIPWindow, whichever accounts they are for
+	loginIPLimit  = 30
+	loginIPWindow = 5 * time.Minute
+	// maxTrackedIPs limits the memory used by the limiter
+	maxTrackedIPs = 100000
+)
+
+// LoginLock is the state of an account after failed logins. Attempts
+// before LockedUntil are refused without checking the password.
+type LoginLock struct {
+	Email         string    `json:"email"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+	LockedUntil   time.Time `json:"lockedUntil"`
+}
+
+// loginDelay returns how long an account is locked after its nth failure
+func loginDelay(failures int) time.Duration {
+	if failures >= loginLockoutFailures {
+		return loginLockout
+	}
+	if failures <= loginFreeFailures {
+		return 0
+	}
+	delay := time.Second << (failures - loginFreeFailures - 1)
+	return min(delay, loginMaxDelay)
+}
+
+// ipLimiter counts login attempts per client IP in fixed windows. It is
+// kept in memory, so each instance limits separately.
+type ipLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*ipWindow
+}
+
+type ipWindow struct {
+	start    time.Time
+	attempts int
+}
+
+// newIPLimiter creates a new ipLimiter instance
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{windows: make(map[string]*ipWindow)}
+}
+
+// allow counts an attempt from ip and reports whether it is within the
+// limit, and if not when the next one will be
+func (l *ipLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	window, ok := l.windows[ip]
+	if !ok || now.Sub(window.start) >= loginIPWindow {
+		if len(l.windows) >= maxTrackedIPs {
+			for k, w := range l.windows {
+				if now.Sub(w.start) >= loginIPWindow {
+					delete(l.windows, k)
+				}
+			}
+		}
+		window = &ipWindow{start: now}
+		l.windows[ip] = window
+	}
+	window.attempts++
+	if window.attempts > loginIPLimit {
+		return false, window.start.Add(loginIPWindow).Sub(now)
+	}
+	return true, 0
+}
+
+// trustedProxies returns the proxies allowed to pass the client IP in
+// X-Real-IP, configured as comma separated IPs or CIDR ranges by
+// TRUSTED_PROXIES. Nobody is trusted when it is empty.
+func trustedProxies() []netip.Prefix {
+	proxies := []netip.Prefix{}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(proxy, "/") {
+			prefix, err = netip.ParsePrefix(proxy)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(proxy)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			log.Printf("Ignoring trusted proxy %q: %v", proxy, err)
+			continue
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies
+}
+
+// clientIP returns the IP of the client of a request. The gateway passes
+// it in X-Real-IP, since it is the one connecting to the auth service, but
+// the header is only believed from a trusted proxy as anyone else could
+// set it to dodge the login limits.
+func (s *AuthServer) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if ip := r.Header.Get("X-Real-IP"); ip != "" && slices.ContainsFunc(s.proxies, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	}) {
+		return ip
+	}
+	return host
+}
+
+// recordLoginFailure counts a failed login for an account and locks it
+// for the resulting delay
+func (s *AuthServer) recordLoginFailure(email string) {
+	now := time.Now().UTC()
+	failures, err := s.store.RecordLoginFailure(email, now, now.Add(-loginFailureWindow))
+	if err != nil {
+		log.Printf("Failed to record a failed login of %s: %v", email, err)
+		return
+	}
+	if delay := loginDelay(failures); delay > 0 {
+		if err := s.store.LockLogin(email, now.Add(delay)); err != nil {
+			log.Printf("Failed to lock the login of %s: %v", email, err)
+		}
+		if failures >= loginLockoutFailures {
+			log.Printf("User %s is locked out after %d failed logins", email, failures)
+		}
+	}
+}
+
+// handleListLockouts lets an admin see the accounts that are currently
+// locked after failed logins
+func (s *AuthServer) handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !slices.Contains(claims.Roles, RoleAdmin) {
+		WriteJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	locks, err := s.store.ListLoginLocks(time.Now().UTC())
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string][]*LoginLock{"lockouts": locks})
+}
+
+// handleClearLockout lets an admin unlock a user and forget their failed
+// logins
+func (s *AuthServer) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !slices.Contains(claims.Roles, RoleAdmin) {
+		WriteJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	userId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+	user, err := s.store.GetUserById(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.store.ClearLoginFailures(strings.ToLower(user.Email)); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Admin %s cleared the lockout of user %d", claims.Email, userId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.244.0.0/16, 192.168.1.5,not a proxy")
+	s := NewAuthServer("", nil, nil, nil)
+
+	tests := []struct {
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"10.244.3.7:41000", "203.0.113.7", "203.0.113.7"},
+		{"192.168.1.5:41000", "203.0.113.7", "203.0.113.7"},
+		{"[::ffff:10.244.0.1]:41000", "203.0.113.7", "203.0.113.7"},
+		{"10.244.3.7:41000", "", "10.244.3.7"},
+		// Anyone else setting the header gets their own address
+		{"192.168.1.6:41000", "203.0.113.7", "192.168.1.6"},
+		{"203.0.113.9:41000", "10.244.3.7", "203.0.113.9"},
+		{"[2001:db8::1]:41000", "203.0.113.7", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("clientIP from %s with X-Real-IP %q = %s, want %s", tt.remoteAddr, tt.realIP, got, tt.want)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "")
+	s = NewAuthServer("", nil, nil, nil)
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = "10.244.3.7:41000"
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	if got := s.clientIP(r); got != "10.244.3.7" {
+		t.Errorf("clientIP without trusted proxies = %s, want 10.244.3.7", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is a plain text message to one recipient
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(email *Email) error
+}
+
+// NewMailer creates the Mailer chosen by MAILER, which is smtp or file.
+// The file mailer is the default, so development needs no mail server.
+func NewMailer() (Mailer, error) {
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "smtp":
+		return NewSMTPMailer()
+	case "", "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir)
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", mailer)
+	}
+}
+
+// mailFrom returns the sender of emails
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "no-reply@mp3-converter.local"
+}
+
+// message formats an email as an RFC 5322 message
+func (e *Email) message(from string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", e.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(e.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// SMTPMailer sends emails through an SMTP server, configured by SMTP_ADDR
+// as host:port and optionally SMTP_USERNAME and SMTP_PASSWORD
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a new SMTPMailer instance
+func NewSMTPMailer() (*SMTPMailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q: %v", addr, err)
+	}
+	mailer := &SMTPMailer{addr: addr, from: mailFrom()}
+	// PlainAuth refuses to send credentials without TLS, except to
+	// localhost
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		mailer.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return mailer, nil
+}
+
+// Send sends an email, using STARTTLS when the server offers it
+func (m *SMTPMailer) Send(email *Email) error {
+	if strings.ContainsAny(email.To, "\r\n") {
+		return fmt.Errorf("invalid recipient")
+	}
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{email.To}, email.message(m.from, time.Now())); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// FileMailer writes emails to files in a directory instead of sending
+// them, for development and tests
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer creates a new FileMailer instance writing to dir
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: mailFrom()}, nil
+}
+
+// Send writes an email to a new .eml file named after the time and the
+// recipient
+func (m *FileMailer) Send(email *Email) error {
+	if strings.ContainsAny(email.To, "\r\n") {
+		return fmt.Errorf("invalid recipient")
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), strings.ReplaceAll(email.To, "/", "_"))
+	return os.WriteFile(filepath.Join(m.dir, name), email.message(m.from, now), 0o600)
+}
@@ -2,18 +2,41 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
 func main() {
-	// Create a new PostgresStore instance
-	store, err := NewPostgersStore()
+	// Migrations can also be run and inspected on their own
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Create the Store configured by STORE_BACKEND
+	store, err := NewStore()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// Load the keys tokens are signed with
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// Create the Mailer configured by MAILER
+	mailer, err := NewMailer()
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
 	// Create a new Server instance
-	server := NewAuthServer(":8080", store)
+	server := NewAuthServer(":8080", store, keys, mailer)
 
 	// Start the server
 	if err := server.ListenAndServe(); err != nil {
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store kept in memory, for development and tests. It
+// loses everything on restart and can not be shared between replicas.
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         []*User
+	invites       map[string]bool // code to whether it was used
+	refreshTokens map[string]*memoryRefreshToken
+	revoked       map[string]RevokedToken
+	watermarks    map[int64]time.Time
+	signingKeys   []*StoredKey
+	apiKeys       []*memoryAPIKey
+	loginLocks    map[string]*LoginLock
+	resets        map[string]*memoryPasswordReset
+	verifications map[string]*memoryEmailVerification
+	totps         map[int64]*TOTP
+	recoveryCodes map[string]*memoryRecoveryCode
+	challenges    map[string]*WebAuthnChallenge
+	credentials   []*WebAuthnCredential
+	devices       map[string]*DeviceAuthorization // by device code hash
+}
+
+type memoryRefreshToken struct {
+	family    string
+	userId    int64
+	expiresAt time.Time
+	used      bool
+	revoked   bool
+}
+
+type memoryPasswordReset struct {
+	userId    int64
+	expiresAt time.Time
+	used      bool
+}
+
+type memoryEmailVerification struct {
+	userId    int64
+	expiresAt time.Time
+}
+
+type memoryRecoveryCode struct {
+	userId int64
+	used   bool
+}
+
+type memoryAPIKey struct {
+	APIKey
+	revoked bool
+}
+
+// NewMemoryStore creates a new MemoryStore instance
+func NewMemoryStore() (*MemoryStore, error) {
+	store := &MemoryStore{
+		invites:       make(map[string]bool),
+		refreshTokens: make(map[string]*memoryRefreshToken),
+		revoked:       make(map[string]RevokedToken),
+		watermarks:    make(map[int64]time.Time),
+		loginLocks:    make(map[string]*LoginLock),
+		resets:        make(map[string]*memoryPasswordReset),
+		verifications: make(map[string]*memoryEmailVerification),
+		totps:         make(map[int64]*TOTP),
+		recoveryCodes: make(map[string]*memoryRecoveryCode),
+		challenges:    make(map[string]*WebAuthnChallenge),
+		devices:       make(map[string]*DeviceAuthorization),
+	}
+	if err := seedStore(store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// user returns the user with the given email. Callers hold the lock.
+func (s *MemoryStore) user(email string) *User {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+// userById returns the user with the given id. Callers hold the lock.
+func (s *MemoryStore) userById(id int64) *User {
+	for _, user := range s.users {
+		if user.Id == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// addUser adds a user with a hashed password. Callers hold the lock.
+func (s *MemoryStore) addUser(user *User, hash string) error {
+	if s.user(user.Email) != nil {
+		return ErrUserExists
+	}
+	s.users = append(s.users, &User{
+		Id:       int64(len(s.users) + 1),
+		Email:    user.Email,
+		Password: hash,
+		Role:     RoleUser,
+	})
+	return nil
+}
+
+// GetUser retrieves a user by email
+func (s *MemoryStore) GetUser(email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.user(email)
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+	found := *user
+	return &found, nil
+}
+
+// GetUserById retrieves a user by id
+func (s *MemoryStore) GetUserById(id int64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userById(id)
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+	found := *user
+	return &found, nil
+}
+
+// CreateUser creates a new user, storing a hash of the password
+func (s *MemoryStore) CreateUser(user *User) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addUser(user, hash)
+}
+
+// CreateInvitedUser creates a new user and uses up an invite code. Neither
+// happens if the other fails.
+func (s *MemoryStore) CreateInvitedUser(user *User, code string) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if used, ok := s.invites[code]; !ok || used {
+		return ErrInvalidInvite
+	}
+	if err := s.addUser(user, hash); err != nil {
+		return err
+	}
+	s.invites[code] = true
+	return nil
+}
+
+// CreateInvite adds an invite code unless it already exists
+func (s *MemoryStore) CreateInvite(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.invites[code]; !ok {
+		s.invites[code] = false
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password of a user with a hash of password
+func (s *MemoryStore) UpdatePassword(email string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user := s.user(email); user != nil {
+		user.Password = hash
+	}
+	return nil
+}
+
+// SetUserRole changes the role of a user
+func (s *MemoryStore) SetUserRole(id int64, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userById(id)
+	if user == nil {
+		return sql.ErrNoRows
+	}
+	user.Role = role
+	return nil
+}
+
+// CreateRefreshToken stores the hash of a new refresh token
+func (s *MemoryStore) CreateRefreshToken(userId int64, hash string, family string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshTokens[hash] = &memoryRefreshToken{family: family, userId: userId, expiresAt: expiresAt}
+	return nil
+}
+
+// RotateRefreshToken marks a refresh token as used and stores its
+// replacement in the same family. A token that was already used revokes
+// its whole family.
+func (s *MemoryStore) RotateRefreshToken(hash string, newHash string, expiresAt time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[hash]
+	if !ok {
+		return 0, ErrTokenInvalid
+	}
+	if token.revoked || time.Now().After(token.expiresAt) {
+		return token.userId, ErrTokenInvalid
+	}
+	if token.used {
+		s.revokeFamily(token.family)
+		return token.userId, ErrTokenReused
+	}
+	token.used = true
+	s.refreshTokens[newHash] = &memoryRefreshToken{family: token.family, userId: token.userId, expiresAt: expiresAt}
+	return token.userId, nil
+}
+
+// revokeFamily revokes every refresh token of a family. Callers hold the
+// lock.
+func (s *MemoryStore) revokeFamily(family string) {
+	for _, token := range s.refreshTokens {
+		if token.family == family {
+			token.revoked = true
+		}
+	}
+}
+
+// RevokeRefreshToken revokes the family of a user's refresh token
+func (s *MemoryStore) RevokeRefreshToken(hash string, userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.refreshTokens[hash]; ok && token.userId == userId {
+		s.revokeFamily(token.family)
+	}
+	return nil
+}
+
+// RevokeToken revokes a single access token until it expires
+func (s *MemoryStore) RevokeToken(jti string, userId int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revoked[jti]; !ok {
+		s.revoked[jti] = RevokedToken{Id: jti, ExpiresAt: expiresAt}
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes the access tokens of a user issued at or before
+// issuedBefore, and all of their refresh tokens
+func (s *MemoryStore) RevokeUserTokens(userId int64, issuedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if issuedBefore.After(s.watermarks[userId]) {
+		s.watermarks[userId] = issuedBefore
+	}
+	for _, token := range s.refreshTokens {
+		if token.userId == userId {
+			token.revoked = true
+		}
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether an access token was revoked by id or by
+// its user's watermark
+func (s *MemoryStore) IsTokenRevoked(jti string, userId int64, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revoked[jti]; ok {
+		return true, nil
+	}
+	issuedBefore, ok := s.watermarks[userId]
+	return ok && !issuedBefore.Before(issuedAt), nil
+}
+
+// ListRevocations drops the revocations of tokens that have expired and
+// returns the others
+func (s *MemoryStore) ListRevocations(now time.Time) (*Revocations, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revocations := &Revocations{Tokens: []RevokedToken{}, Users: []UserWatermark{}}
+	for jti, token := range s.revoked {
+		if token.ExpiresAt.Before(now) {
+			delete(s.revoked, jti)
+			continue
+		}
+		revocations.Tokens = append(revocations.Tokens, token)
+	}
+	for userId, issuedBefore := range s.watermarks {
+		if issuedBefore.Before(now.Add(-tokenLifetime)) {
+			delete(s.watermarks, userId)
+			continue
+		}
+		revocations.Users = append(revocations.Users, UserWatermark{
+			UserId:       strconv.FormatInt(userId, 10),
+			IssuedBefore: issuedBefore,
+		})
+	}
+	return revocations, nil
+}
+
+// RotateSigningKeys creates the next signing key once the current one is
+// due to be replaced, deletes keys whose tokens have all expired, and
+// returns the remaining keys ordered by activation
+func (s *MemoryStore) RotateSigningKeys(now time.Time, newKey func(activeFrom time.Time) (*StoredKey, error)) ([]*StoredKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if activeFrom := nextKeyActivation(s.signingKeys, now); !activeFrom.IsZero() {
+		key, err := newKey(activeFrom)
+		if err != nil {
+			return nil, err
+		}
+		s.signingKeys = append(s.signingKeys, key)
+	}
+	s.signingKeys = s.signingKeys[expiredKeys(s.signingKeys, now):]
+	return slices.Clone(s.signingKeys), nil
+}
+
+// CreateAPIKey stores a new API key and sets its id and creation time
+func (s *MemoryStore) CreateAPIKey(key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key.Id = int64(len(s.apiKeys) + 1)
+	key.CreatedAt = time.Now().UTC()
+	stored := &memoryAPIKey{APIKey: *key}
+	stored.Scopes = slices.Clone(key.Scopes)
+	s.apiKeys = append(s.apiKeys, stored)
+	return nil
+}
+
+// valid reports whether a key can be used at now
+func (k *memoryAPIKey) valid(now time.Time) bool {
+	return !k.revoked && (k.ExpiresAt == nil || k.ExpiresAt.After(now))
+}
+
+// ListAPIKeys returns the keys of a user that are neither revoked nor
+// expired, newest first
+func (s *MemoryStore) ListAPIKeys(userId int64) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	keys := []*APIKey{}
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		if key := s.apiKeys[i]; key.UserId == userId && key.valid(now) {
+			found := key.APIKey
+			keys = append(keys, &found)
+		}
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes a key of a user. It returns sql.ErrNoRows when the
+// user has no such key.
+func (s *MemoryStore) RevokeAPIKey(userId int64, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.apiKeys {
+		if key.Id == id && key.UserId == userId && !key.revoked {
+			key.revoked = true
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// UseAPIKey looks up a valid key by its hash, records that it was used,
+// and returns it with the user it belongs to
+func (s *MemoryStore) UseAPIKey(hash string) (*APIKey, *User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for _, key := range s.apiKeys {
+		if key.Hash != hash || !key.valid(now) {
+			continue
+		}
+		user := s.userById(key.UserId)
+		if user == nil {
+			break
+		}
+		key.LastUsedAt = &now
+		foundKey, foundUser := key.APIKey, *user
+		return &foundKey, &foundUser, nil
+	}
+	return nil, nil, ErrAPIKeyInvalid
+}
+
+// RecordLoginFailure counts a failed login and returns the number of
+// failures in a row. Failures before since are forgotten.
+func (s *MemoryStore) RecordLoginFailure(email string, now time.Time, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.loginLocks[email]
+	if !ok {
+		lock = &LoginLock{Email: email}
+		s.loginLocks[email] = lock
+	}
+	if lock.LastFailureAt.Before(since) {
+		lock.Failures = 0
+	}
+	lock.Failures++
+	lock.LastFailureAt = now
+	return lock.Failures, nil
+}
+
+// LockLogin refuses logins to an account until the given time
+func (s *MemoryStore) LockLogin(email string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lock, ok := s.loginLocks[email]; ok && until.After(lock.LockedUntil) {
+		lock.LockedUntil = until
+	}
+	return nil
+}
+
+// GetLoginLock returns the failed logins of an account
+func (s *MemoryStore) GetLoginLock(email string) (*LoginLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.loginLocks[email]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *lock
+	return &found, nil
+}
+
+// ListLoginLocks returns the accounts locked at now, and drops failures
+// that have been forgotten
+func (s *MemoryStore) ListLoginLocks(now time.Time) ([]*LoginLock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locks := []*LoginLock{}
+	for email, lock := range s.loginLocks {
+		if lock.LockedUntil.Before(now) && lock.LastFailureAt.Before(now.Add(-loginFailureWindow)) {
+			delete(s.loginLocks, email)
+			continue
+		}
+		if lock.LockedUntil.After(now) {
+			found := *lock
+			locks = append(locks, &found)
+		}
+	}
+	slices.SortFunc(locks, func(a, b *LoginLock) int { return b.LockedUntil.Compare(a.LockedUntil) })
+	return locks, nil
+}
+
+// ClearLoginFailures unlocks an account and forgets its failed logins
+func (s *MemoryStore) ClearLoginFailures(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginLocks, email)
+	return nil
+}
+
+// CreatePasswordReset stores the hash of a new reset token, replacing the
+// unused ones of the user
+func (s *MemoryStore) CreatePasswordReset(userId int64, hash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, reset := range s.resets {
+		if reset.userId == userId && !reset.used {
+			delete(s.resets, h)
+		}
+	}
+	s.resets[hash] = &memoryPasswordReset{userId: userId, expiresAt: expiresAt}
+	return nil
+}
+
+// reset returns a reset token that can still be used. Callers hold the
+// lock.
+func (s *MemoryStore) reset(hash string) *memoryPasswordReset {
+	reset, ok := s.resets[hash]
+	if !ok || reset.used || !time.Now().Before(reset.expiresAt) {
+		return nil
+	}
+	return reset
+}
+
+// GetPasswordReset returns the user of a reset token that can still be
+// used
+func (s *MemoryStore) GetPasswordReset(hash string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset := s.reset(hash)
+	if reset == nil {
+		return 0, ErrResetInvalid
+	}
+	return reset.userId, nil
+}
+
+// ResetPassword uses up a reset token and replaces the password of its
+// user with a hash of password
+func (s *MemoryStore) ResetPassword(hash string, password string) error {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset := s.reset(hash)
+	if reset == nil {
+		return ErrResetInvalid
+	}
+	reset.used = true
+	if user := s.userById(reset.userId); user != nil {
+		user.Password = passwordHash
+	}
+	return nil
+}
+
+// CreateEmailVerification stores the hash of a new verification token,
+// replacing the other ones of the user
+func (s *MemoryStore) CreateEmailVerification(userId int64, hash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, verification := range s.verifications {
+		if verification.userId == userId {
+			delete(s.verifications, h)
+		}
+	}
+	s.verifications[hash] = &memoryEmailVerification{userId: userId, expiresAt: expiresAt}
+	return nil
+}
+
+// VerifyEmail uses up a verification token and marks the email address of
+// its user as verified, returning the id of the user
+func (s *MemoryStore) VerifyEmail(hash string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	verification, ok := s.verifications[hash]
+	if !ok || !time.Now().Before(verification.expiresAt) {
+		return 0, ErrVerificationInvalid
+	}
+	for h, other := range s.verifications {
+		if other.userId == verification.userId {
+			delete(s.verifications, h)
+		}
+	}
+	if user := s.userById(verification.userId); user != nil {
+		user.EmailVerified = true
+	}
+	return verification.userId, nil
+}
+
+// SetEmailVerified marks the email address of a user as verified without
+// a token
+func (s *MemoryStore) SetEmailVerified(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := s.userById(id)
+	if user == nil {
+		return sql.ErrNoRows
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+// CreateTOTP stores a pending authenticator secret for a user, replacing
+// a pending one. It fails with ErrMFAEnabled once one is confirmed.
+func (s *MemoryStore) CreateTOTP(userId int64, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if totp, ok := s.totps[userId]; ok && totp.ConfirmedAt != nil {
+		return ErrMFAEnabled
+	}
+	s.totps[userId] = &TOTP{UserId: userId, Secret: secret}
+	return nil
+}
+
+// GetTOTP returns the authenticator secret of a user
+func (s *MemoryStore) GetTOTP(userId int64) (*TOTP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totps[userId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *totp
+	return &found, nil
+}
+
+// ConfirmTOTP enables the pending secret of a user, with the time step of
+// the code that confirmed it, and replaces their recovery codes
+func (s *MemoryStore) ConfirmTOTP(userId int64, step int64, recoveryHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totps[userId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if totp.ConfirmedAt != nil {
+		return ErrMFAEnabled
+	}
+	now := time.Now().UTC()
+	totp.ConfirmedAt = &now
+	totp.LastStep = step
+	s.deleteRecoveryCodes(userId)
+	for _, hash := range recoveryHashes {
+		s.recoveryCodes[hash] = &memoryRecoveryCode{userId: userId}
+	}
+	return nil
+}
+
+// deleteRecoveryCodes removes the recovery codes of a user. Callers hold
+// the lock.
+func (s *MemoryStore) deleteRecoveryCodes(userId int64) {
+	for hash, code := range s.recoveryCodes {
+		if code.userId == userId {
+			delete(s.recoveryCodes, hash)
+		}
+	}
+}
+
+// UseTOTPStep records that the code of a time step was used. Codes of that
+// step or an earlier one fail with ErrMFAInvalid from then on.
+func (s *MemoryStore) UseTOTPStep(userId int64, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totps[userId]
+	if !ok || totp.ConfirmedAt == nil || totp.LastStep >= step {
+		return ErrMFAInvalid
+	}
+	totp.LastStep = step
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code of a user
+func (s *MemoryStore) UseRecoveryCode(userId int64, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.recoveryCodes[hash]
+	if !ok || code.userId != userId || code.used {
+		return ErrMFAInvalid
+	}
+	code.used = true
+	return nil
+}
+
+// DeleteTOTP removes the authenticator secret and recovery codes of a user
+func (s *MemoryStore) DeleteTOTP(userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.totps[userId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.totps, userId)
+	s.deleteRecoveryCodes(userId)
+	return nil
+}
+
+// CreateWebAuthnChallenge stores the challenge of a new ceremony, and
+// forgets expired ones
+func (s *MemoryStore) CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for c, found := range s.challenges {
+		if !now.Before(found.ExpiresAt) {
+			delete(s.challenges, c)
+		}
+	}
+	stored := *challenge
+	s.challenges[challenge.Challenge] = &stored
+	return nil
+}
+
+// UseWebAuthnChallenge uses up a challenge of a ceremony with the given
+// purpose and returns it
+func (s *MemoryStore) UseWebAuthnChallenge(challenge string, purpose string) (*WebAuthnChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.challenges[challenge]
+	if !ok || found.Purpose != purpose || !time.Now().Before(found.ExpiresAt) {
+		return nil, ErrWebAuthnChallenge
+	}
+	delete(s.challenges, challenge)
+	return found, nil
+}
+
+// credential returns the passkey with the given id. Callers hold the
+// lock.
+func (s *MemoryStore) credential(id string) *WebAuthnCredential {
+	for _, credential := range s.credentials {
+		if credential.Id == id {
+			return credential
+		}
+	}
+	return nil
+}
+
+// CreateWebAuthnCredential stores a new passkey and sets its creation
+// time
+func (s *MemoryStore) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credential(credential.Id) != nil {
+		return ErrCredentialExists
+	}
+	credential.CreatedAt = time.Now().UTC()
+	stored := *credential
+	s.credentials = append(s.credentials, &stored)
+	return nil
+}
+
+// GetWebAuthnCredential returns a passkey by its credential id
+func (s *MemoryStore) GetWebAuthnCredential(id string) (*WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credential := s.credential(id)
+	if credential == nil {
+		return nil, sql.ErrNoRows
+	}
+	found := *credential
+	return &found, nil
+}
+
+// ListWebAuthnCredentials returns the passkeys of a user, newest first
+func (s *MemoryStore) ListWebAuthnCredentials(userId int64) ([]*WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credentials := []*WebAuthnCredential{}
+	for i := len(s.credentials) - 1; i >= 0; i-- {
+		if s.credentials[i].UserId == userId {
+			found := *s.credentials[i]
+			credentials = append(credentials, &found)
+		}
+	}
+	return credentials, nil
+}
+
+// UseWebAuthnCredential records a login with a passkey and its new
+// signature counter. A counter that did not grow fails with ErrSignCount,
+// unless the authenticator has none and it stays 0.
+func (s *MemoryStore) UseWebAuthnCredential(id string, signCount uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credential := s.credential(id)
+	if credential == nil || !(credential.SignCount < signCount || (credential.SignCount == 0 && signCount == 0)) {
+		return ErrSignCount
+	}
+	now := time.Now().UTC()
+	credential.SignCount = signCount
+	credential.LastUsedAt = &now
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user. It returns
+// sql.ErrNoRows when the user has no such passkey.
+func (s *MemoryStore) DeleteWebAuthnCredential(userId int64, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.credentials, func(c *WebAuthnCredential) bool {
+		return c.Id == id && c.UserId == userId
+	})
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	s.credentials = slices.Delete(s.credentials, i, i+1)
+	return nil
+}
+
+// device returns the unexpired device authorization of a user code.
+// Callers hold the lock.
+func (s *MemoryStore) device(userCode string) *DeviceAuthorization {
+	now := time.Now()
+	for _, auth := range s.devices {
+		if auth.UserCode == userCode && now.Before(auth.ExpiresAt) {
+			return auth
+		}
+	}
+	return nil
+}
+
+// CreateDeviceAuthorization stores a new device authorization, and
+// forgets expired ones. It returns ErrUserCodeTaken when its user code is
+// in use.
+func (s *MemoryStore) CreateDeviceAuthorization(auth *DeviceAuthorization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, found := range s.devices {
+		if !now.Before(found.ExpiresAt) {
+			delete(s.devices, hash)
+		}
+	}
+	if s.device(auth.UserCode) != nil {
+		return ErrUserCodeTaken
+	}
+	stored := *auth
+	s.devices[auth.DeviceCodeHash] = &stored
+	return nil
+}
+
+// GetDeviceAuthorization returns the unexpired device authorization of a
+// user code
+func (s *MemoryStore) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth := s.device(userCode)
+	if auth == nil {
+		return nil, sql.ErrNoRows
+	}
+	found := *auth
+	return &found, nil
+}
+
+// DecideDeviceAuthorization approves or denies the pending device
+// authorization of a user code on behalf of a user. It returns
+// sql.ErrNoRows when there is none, or it expired.
+func (s *MemoryStore) DecideDeviceAuthorization(userCode string, userId int64, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth := s.device(userCode)
+	if auth == nil || auth.Status != DevicePending {
+		return sql.ErrNoRows
+	}
+	auth.UserId = userId
+	auth.Status = status
+	return nil
+}
+
+// PollDeviceAuthorization records a poll of a device by a client and
+// returns its authorization. It fails with ErrDeviceClient when the device
+// code belongs to another client and ErrDeviceExpired once it expired. A
+// poll before the interval has passed slows the device down and fails with
+// ErrSlowDown.
+func (s *MemoryStore) PollDeviceAuthorization(deviceCodeHash string, clientId string, now time.Time) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.devices[deviceCodeHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if auth.ClientId != clientId {
+		return nil, ErrDeviceClient
+	}
+	if !now.Before(auth.ExpiresAt) {
+		return nil, ErrDeviceExpired
+	}
+	found := *auth
+	polledAt := now
+	auth.LastPolledAt = &polledAt
+	if found.tooSoon(now) {
+		auth.Interval += deviceSlowDown
+		return nil, ErrSlowDown
+	}
+	return &found, nil
+}
+
+// ConsumeDeviceAuthorization removes a device authorization with the given
+// status once the device has been told the outcome. It returns
+// sql.ErrNoRows when another poll consumed it first.
+func (s *MemoryStore) ConsumeDeviceAuthorization(deviceCodeHash string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.devices[deviceCodeHash]
+	if !ok || auth.Status != status {
+		return sql.ErrNoRows
+	}
+	delete(s.devices, deviceCodeHash)
+	return nil
+}
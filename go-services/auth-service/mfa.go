@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// totpPeriod is the length of a time step in seconds. Codes have six
+	// digits and use SHA-1, the RFC 6238 defaults authenticator apps
+	// expect.
+	totpPeriod = 30
+	// totpSkew is how many time steps a code can be off by, for clocks
+	// that drift
+	totpSkew = 1
+
+	// recoveryCodeCount is how many recovery codes are issued at once
+	recoveryCodeCount = 10
+
+	// mfaTokenLifetime is how long the second step of a login can take
+	mfaTokenLifetime = 5 * time.Minute
+)
+
+var (
+	// ErrMFAEnabled is returned when enrolling an account that already has
+	// two-factor authentication
+	ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFAInvalid is returned for a wrong, reused or unknown code
+	ErrMFAInvalid = errors.New("invalid two-factor code")
+)
+
+// totpEncoding is how secrets are shown to authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the authenticator secret of a user. It is pending until the
+// user confirms it with a first code, which sets ConfirmedAt. LastStep is
+// the time step of the last code used, so a code can not be used twice.
+type TOTP struct {
+	UserId      int64
+	Secret      string
+	ConfirmedAt *time.Time
+	LastStep    int64
+}
+
+// MFAClaims are the claims of a token proving the password step of a
+// login. Enroll is set when the user has to set up two-factor
+// authentication before logging in.
+type MFAClaims struct {
+	Email  string `json:"email"`
+	Enroll bool   `json:"enroll"`
+	jwt.RegisteredClaims
+}
+
+// MFAChallenge is returned by login instead of tokens when a second factor
+// is needed
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+	Enroll      bool   `json:"enroll"`
+	ExpiresIn   int    `json:"expiresIn"` // MFA token lifetime in seconds
+}
+
+// adminMFARequired tells whether admins have to use two-factor
+// authentication, as set by ADMIN_MFA_REQUIRED
+func adminMFARequired() bool {
+	required, _ := strconv.ParseBool(os.Getenv("ADMIN_MFA_REQUIRED"))
+	return required
+}
+
+// mfaAudience is the audience of MFA tokens, so they are never accepted as
+// access tokens
+func mfaAudience() string {
+	return jwtAudience() + "/mfa"
+}
+
+// newTOTPSecret returns a random secret for an authenticator app
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %v", err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the code of a secret for a time step, as in RFC 4226
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP checks a code against the time steps around now and returns
+// the step it matches
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != 6 {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI authenticator apps read, usually from a
+// QR code. TOTP_ISSUER is the name the app shows for the service.
+func totpURI(email string, secret string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "MP3 Converter"
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", "6")
+	query.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + email,
+		// Apps expect spaces as %20 rather than +
+		RawQuery: strings.ReplaceAll(query.Encode(), "+", "%20"),
+	}
+	return uri.String()
+}
+
+// newRecoveryCodes returns a set of random one time recovery codes
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the hash recovery codes are stored as. Case,
+// dashes and spaces do not matter when a code is typed in.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashRefreshToken(code)
+}
+
+// createMFAToken creates the token proving the password step of a login
+func createMFAToken(user *User, keys *KeyRing, enroll bool) (string, error) {
+	jti, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+
+	claims := &MFAClaims{
+		Email:  user.Email,
+		Enroll: enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.FormatInt(user.Id, 10),
+			Issuer:    jwtIssuer(),
+			Audience:  jwt.ClaimStrings{mfaAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenLifetime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	return signJWT(claims, keys)
+}
+
+// verifyMFAToken verifies an MFA token and that the login it belongs to
+// has not completed yet
+func (s *AuthServer) verifyMFAToken(tokenString string) (*MFAClaims, int64, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &MFAClaims{}, jwtKeyFunc(s.keys),
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwtIssuer()),
+		jwt.WithAudience(mfaAudience()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	claims := token.Claims.(*MFAClaims)
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || claims.ID == "" {
+		return nil, 0, fmt.Errorf("token is missing the subject or id")
+	}
+
+	revoked, err := s.store.IsTokenRevoked(claims.ID, userId, claims.IssuedAt.Time)
+	if err != nil {
+		return nil, 0, err
+	}
+	if revoked {
+		return nil, 0, fmt.Errorf("token has been used")
+	}
+	return claims, userId, nil
+}
+
+// useMFAToken revokes an MFA token once the login it belongs to completes
+func (s *AuthServer) useMFAToken(claims *MFAClaims, userId int64) {
+	if err := s.store.RevokeToken(claims.ID, userId, claims.ExpiresAt.Time); err != nil {
+		log.Printf("Failed to revoke the mfa token of user %d: %v", userId, err)
+	}
+}
+
+// mfaChallenge returns the challenge a user gets after their password when
+// they have two-factor authentication, or have to set it up as an admin.
+// It is nil when the password is enough.
+func (s *AuthServer) mfaChallenge(user *User) (*MFAChallenge, error) {
+	totp, err := s.store.GetTOTP(user.Id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	enabled := totp != nil && totp.ConfirmedAt != nil
+	if !enabled && (user.Role != RoleAdmin || !adminMFARequired()) {
+		return nil, nil
+	}
+
+	token, err := createMFAToken(user, s.keys, !enabled)
+	if err != nil {
+		return nil, err
+	}
+	return &MFAChallenge{
+		MFARequired: true,
+		MFAToken:    token,
+		Enroll:      !enabled,
+		ExpiresIn:   int(mfaTokenLifetime.Seconds()),
+	}, nil
+}
+
+// checkSecondFactor checks a code from the authenticator app, or else a
+// recovery code, and uses it up
+func (s *AuthServer) checkSecondFactor(userId int64, code string, recoveryCode string) error {
+	if recoveryCode != "" {
+		return s.store.UseRecoveryCode(userId, hashRecoveryCode(recoveryCode))
+	}
+
+	totp, err := s.store.GetTOTP(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrMFAInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if totp.ConfirmedAt == nil {
+		return ErrMFAInvalid
+	}
+	step, ok := matchTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return ErrMFAInvalid
+	}
+	return s.store.UseTOTPStep(userId, step)
+}
+
+// enrollingUser returns the id of the user setting up two-factor
+// authentication. They send an access token, or the MFA token of a login
+// that requires them to enroll first, which is returned as well.
+func (s *AuthServer) enrollingUser(r *http.Request) (int64, *MFAClaims, error) {
+	if claims, err := s.authenticate(r); err == nil {
+		userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+		return userId, nil, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return 0, nil, fmt.Errorf("missing token")
+	}
+	claims, userId, err := s.verifyMFAToken(token)
+	if err != nil || !claims.Enroll {
+		return 0, nil, fmt.Errorf("invalid token")
+	}
+	return userId, claims, nil
+}
+
+// handleEnrollTOTP creates a new authenticator secret for the caller. It
+// stays pending, and replaceable, until it is confirmed with a code.
+func (s *AuthServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userId, _, err := s.enrollingUser(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = s.store.CreateTOTP(userId, secret)
+	if errors.Is(err, ErrMFAEnabled) {
+		WriteJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    totpURI(user.Email, secret),
+	})
+}
+
+// handleConfirmTOTP enables two-factor authentication once the caller
+// proves their app has the secret, and returns their recovery codes. They
+// are shown only once. A login that was waiting for enrollment completes.
+func (s *AuthServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userId, pending, err := s.enrollingUser(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	totp, err := s.store.GetTOTP(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusBadRequest, "enroll an authenticator app first")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if totp.ConfirmedAt != nil {
+		WriteJSON(w, http.StatusConflict, ErrMFAEnabled.Error())
+		return
+	}
+	step, ok := matchTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		WriteJSON(w, http.StatusBadRequest, ErrMFAInvalid.Error())
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	err = s.store.ConfirmTOTP(userId, step, hashes)
+	if errors.Is(err, ErrMFAEnabled) {
+		WriteJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("User %d enabled two-factor authentication", userId)
+
+	resp := struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+		*TokenResponse
+	}{RecoveryCodes: codes}
+	if pending != nil {
+		s.useMFAToken(pending, userId)
+		user, err := s.store.GetUserById(userId)
+		if err != nil {
+			WriteJSON(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if resp.TokenResponse, err = s.issueTokens(user); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("User %s logged in", user.Email)
+	}
+	WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleLoginMFA completes a login with the MFA token from the password
+// step and a code from the authenticator app or a recovery code. Wrong
+// codes count as failed logins of the account.
+func (s *AuthServer) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		WriteJSON(w, http.StatusBadRequest, "a code or a recovery code is required")
+		return
+	}
+
+	claims, userId, err := s.verifyMFAToken(req.MFAToken)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, "invalid or expired mfa token")
+		return
+	}
+	if claims.Enroll {
+		WriteJSON(w, http.StatusForbidden, "set up two-factor authentication to log in")
+		return
+	}
+
+	lock, err := s.store.GetLoginLock(claims.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to get the login lock of %s: %v", claims.Email, err)
+		WriteJSON(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if lock != nil && time.Now().Before(lock.LockedUntil) {
+		log.Printf("User %s tried a two-factor code while locked", claims.Email)
+		WriteJSON(w, http.StatusUnauthorized, ErrMFAInvalid.Error())
+		return
+	}
+
+	err = s.checkSecondFactor(userId, req.Code, req.RecoveryCode)
+	if errors.Is(err, ErrMFAInvalid) {
+		log.Printf("User %s failed the second factor", claims.Email)
+		s.recordLoginFailure(claims.Email)
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to check the second factor of %s: %v", claims.Email, err)
+		WriteJSON(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	s.useMFAToken(claims, userId)
+	if lock != nil {
+		if err := s.store.ClearLoginFailures(claims.Email); err != nil {
+			log.Printf("Failed to clear the failed logins of %s: %v", claims.Email, err)
+		}
+	}
+	if req.RecoveryCode != "" {
+		log.Printf("User %s used a recovery code", claims.Email)
+	}
+
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, "invalid or expired mfa token")
+		return
+	}
+	tokens, err := s.issueTokens(user)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s logged in", user.Email)
+	WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handleDisableTOTP turns two-factor authentication off for the caller,
+// given a current code or a recovery code. Admins can not turn it off
+// while it is mandatory for them.
+func (s *AuthServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+	if slices.Contains(claims.Roles, RoleAdmin) && adminMFARequired() {
+		WriteJSON(w, http.StatusForbidden, "two-factor authentication is mandatory for admins")
+		return
+	}
+
+	req := struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		WriteJSON(w, http.StatusBadRequest, "a code or a recovery code is required")
+		return
+	}
+
+	lock, err := s.store.GetLoginLock(claims.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if lock != nil && time.Now().Before(lock.LockedUntil) {
+		WriteJSON(w, http.StatusForbidden, ErrMFAInvalid.Error())
+		return
+	}
+	err = s.checkSecondFactor(userId, req.Code, req.RecoveryCode)
+	if errors.Is(err, ErrMFAInvalid) {
+		s.recordLoginFailure(claims.Email)
+		WriteJSON(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := s.store.DeleteTOTP(userId); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("User %s disabled two-factor authentication", claims.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
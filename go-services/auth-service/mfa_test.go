@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238 appendix B, which have eight
+	// digits. The six digit codes are their last six.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		if got := totpCode(secret, test.time/totpPeriod); got != test.code[2:] {
+			t.Errorf("code at %d is %s, want %s", test.time, got, test.code[2:])
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for _, offset := range []int64{-totpSkew, 0, totpSkew} {
+		step, ok := matchTOTP(secret, totpCode(key, current+offset), now)
+		if !ok || step != current+offset {
+			t.Errorf("code of step %+d matched %v at step %d", offset, ok, step-current)
+		}
+	}
+	for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+		if _, ok := matchTOTP(secret, totpCode(key, current+offset), now); ok {
+			t.Errorf("code of step %+d matched", offset)
+		}
+	}
+	for _, code := range []string{"", "1234567", totpCode(key, current)[1:]} {
+		if _, ok := matchTOTP(secret, code, now); ok {
+			t.Errorf("code %q matched", code)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", totpCode(key, current), now); ok {
+		t.Error("a code matched an invalid secret")
+	}
+}
+
+func TestSecondFactorSingleUse(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "mfa@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("mfa@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewAuthServer("", store, keys, mailer)
+
+	totpSecret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(totpSecret)
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err := store.CreateTOTP(user.Id, totpSecret); err != nil {
+		t.Fatal(err)
+	}
+	// The code confirming the secret was of an earlier step
+	current := time.Now().Unix() / totpPeriod
+	if err := store.ConfirmTOTP(user.Id, current-totpSkew-1, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	// A recovery code works once, however it is typed in
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))
+	if err := server.checkSecondFactor(user.Id, "", typed); err != nil {
+		t.Fatalf("first use of a recovery code: %v", err)
+	}
+	if err := server.checkSecondFactor(user.Id, "", codes[0]); !errors.Is(err, ErrMFAInvalid) {
+		t.Errorf("second use of a recovery code returned %v, want ErrMFAInvalid", err)
+	}
+	if err := server.checkSecondFactor(user.Id, "", codes[1]); err != nil {
+		t.Errorf("another recovery code after the first was used: %v", err)
+	}
+	if err := server.checkSecondFactor(user.Id, "", "aaaa-aaaa"); !errors.Is(err, ErrMFAInvalid) {
+		t.Errorf("unknown recovery code returned %v, want ErrMFAInvalid", err)
+	}
+
+	// So does an authenticator code, and the codes of earlier steps are
+	// used up with it
+	code := totpCode(key, current)
+	if err := server.checkSecondFactor(user.Id, code, ""); err != nil {
+		t.Fatalf("first use of a code: %v", err)
+	}
+	if err := server.checkSecondFactor(user.Id, code, ""); !errors.Is(err, ErrMFAInvalid) {
+		t.Errorf("second use of a code returned %v, want ErrMFAInvalid", err)
+	}
+	if err := server.checkSecondFactor(user.Id, totpCode(key, current-1), ""); !errors.Is(err, ErrMFAInvalid) {
+		t.Errorf("code of an earlier step returned %v, want ErrMFAInvalid", err)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Each backend has its own migrations, since their SQL differs
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationsLock is the advisory lock that keeps replicas from migrating
+// at the same time
+const migrationsLock = 0x6d696772
+
+// migrationName matches migration files, such as 0001_create_users.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered change to the schema and the statements that
+// undo it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was
+type MigrationStatus struct {
+	*Migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the migrations in a directory of fsys ordered by
+// version. Every migration needs both an up and a down file.
+func loadMigrations(fsys fs.FS, dir string) ([]*Migration, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := migrationName.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", file)
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database and records them in the
+// schema_migrations table
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+	postgres   bool
+}
+
+// NewMigrator creates a new Migrator instance for the embedded Postgres
+// migrations
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/postgres")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, postgres: true}, nil
+}
+
+// NewSQLiteMigrator creates a new Migrator instance for the embedded SQLite
+// migrations
+func NewSQLiteMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Latest returns the version of the last migration
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// withLock runs f on a connection holding the migrations lock, after
+// making sure the schema_migrations table exists
+func (m *Migrator) withLock(f func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The lock belongs to the session, so it is taken and released on the
+	// same connection. SQLite databases are only opened by one process.
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations(
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL)`
+	if m.postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLock)
+
+		query = `CREATE TABLE IF NOT EXISTS schema_migrations(
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// applied returns the applied versions and when they were applied
+func applied(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// run applies one migration, or reverts it, in a transaction
+func run(conn *sql.Conn, m *Migration, up bool) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			m.Version, m.Name, time.Now().UTC()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Up applies the migrations up to and including version that have not
+// been applied yet, writing a line for each to out
+func (m *Migrator) Up(version int, out io.Writer) error {
+	return m.withLock(func(conn *sql.Conn) error {
+		done, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if migration.Version > version {
+				break
+			}
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if err := run(conn, migration, true); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "applied %d_%s\n", migration.Version, migration.Name)
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations, writing a line for each
+// to out
+func (m *Migrator) Down(steps int, out io.Writer) error {
+	return m.withLock(func(conn *sql.Conn) error {
+		done, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			if err := run(conn, migration, false); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "reverted %d_%s\n", migration.Version, migration.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status returns every migration and whether it has been applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	err := m.withLock(func(conn *sql.Conn) error {
+		done, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+			if appliedAt, ok := done[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// migrateCommand runs the migrate subcommand:
+//
+//	auth-service migrate up [version]
+//	auth-service migrate down [steps]
+//	auth-service migrate status
+func migrateCommand(args []string) error {
+	usage := fmt.Errorf("usage: auth-service migrate up [version] | down [steps] | status")
+	if len(args) == 0 || len(args) > 2 {
+		return usage
+	}
+	number := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, usage
+		}
+		return n, nil
+	}
+
+	var migrator *Migrator
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "postgres":
+		db, err := openPostgres()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if migrator, err = NewMigrator(db); err != nil {
+			return err
+		}
+	case "sqlite":
+		db, err := openSQLite(sqlitePath())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if migrator, err = NewSQLiteMigrator(db); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the %s store backend has no migrations", backend)
+	}
+
+	switch args[0] {
+	case "up":
+		version, err := number(migrator.Latest())
+		if err != nil {
+			return err
+		}
+		return migrator.Up(version, os.Stdout)
+	case "down":
+		steps, err := number(1)
+		if err != nil {
+			return err
+		}
+		return migrator.Down(steps, os.Stdout)
+	case "status":
+		if len(args) != 1 {
+			return usage
+		}
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,5 @@
+-- An invite code can be used once
+CREATE TABLE IF NOT EXISTS invites(
+    code TEXT PRIMARY KEY,
+    used_by TEXT,
+    used_at TIMESTAMPTZ);
@@ -0,0 +1,12 @@
+-- Tokens are stored hashed, and all tokens rotated from the same login
+-- share a family
+CREATE TABLE IF NOT EXISTS refresh_tokens(
+    hash TEXT PRIMARY KEY,
+    family TEXT NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens (family);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS signing_keys(
+    kid TEXT PRIMARY KEY,
+    sealed BYTEA NOT NULL,
+    active_from TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens(
+    jti TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL);
+
+CREATE TABLE IF NOT EXISTS token_watermarks(
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    issued_before TIMESTAMPTZ NOT NULL);
@@ -0,0 +1,6 @@
+-- Rows are keyed by the email tried, whether or not such a user exists
+CREATE TABLE IF NOT EXISTS login_failures(
+    email TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ NOT NULL DEFAULT 'epoch');
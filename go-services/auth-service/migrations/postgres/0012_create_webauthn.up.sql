@@ -0,0 +1,21 @@
+-- Passkeys of users. id is the base64url credential id, and public_key
+-- the COSE key the authenticator created.
+CREATE TABLE webauthn_credentials(
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    attestation TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ);
+
+CREATE INDEX webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+-- Challenges of ceremonies in progress. Login challenges have no user
+-- until a credential answers them.
+CREATE TABLE webauthn_challenges(
+    challenge TEXT PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL);
@@ -0,0 +1,8 @@
+DROP TABLE login_failures;
+DROP TABLE api_keys;
+DROP TABLE token_watermarks;
+DROP TABLE revoked_tokens;
+DROP TABLE signing_keys;
+DROP TABLE refresh_tokens;
+DROP TABLE invites;
+DROP TABLE users;
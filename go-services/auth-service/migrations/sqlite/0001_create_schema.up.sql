@@ -0,0 +1,63 @@
+-- SQLite support started at the Postgres schema of 0008, so it begins
+-- with all of it. Times are stored in UTC.
+CREATE TABLE users(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user');
+
+-- An invite code can be used once
+CREATE TABLE invites(
+    code TEXT PRIMARY KEY,
+    used_by TEXT,
+    used_at TIMESTAMP);
+
+-- Tokens are stored hashed, and all tokens rotated from the same login
+-- share a family
+CREATE TABLE refresh_tokens(
+    hash TEXT PRIMARY KEY,
+    family TEXT NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP);
+
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+
+CREATE TABLE signing_keys(
+    kid TEXT PRIMARY KEY,
+    sealed BLOB NOT NULL,
+    active_from TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL);
+
+CREATE TABLE revoked_tokens(
+    jti TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL);
+
+CREATE TABLE token_watermarks(
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    issued_before TIMESTAMP NOT NULL);
+
+-- Keys are stored hashed, and scopes as a JSON array
+CREATE TABLE api_keys(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP);
+
+CREATE INDEX api_keys_user_id ON api_keys (user_id);
+
+-- Rows are keyed by the email tried, whether or not such a user exists
+CREATE TABLE login_failures(
+    email TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP NOT NULL);
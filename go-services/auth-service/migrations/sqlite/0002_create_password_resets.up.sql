@@ -0,0 +1,9 @@
+-- Reset tokens are stored hashed and can be used once
+CREATE TABLE password_resets(
+    hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP);
+
+CREATE INDEX password_resets_user_id ON password_resets (user_id);
@@ -0,0 +1,13 @@
+-- Accounts created before verification existed keep uploading, except the
+-- test account every earlier deployment seeded with a well known password
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+UPDATE users SET email_verified = true WHERE email <> 'bob@bob.bob';
+
+-- Verification tokens are stored hashed
+CREATE TABLE email_verifications(
+    hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL);
+
+CREATE INDEX email_verifications_user_id ON email_verifications (user_id);
@@ -0,0 +1,17 @@
+-- A secret is pending until the user confirms it with a first code.
+-- last_step is the time step of the last code used, which can not be used
+-- again.
+CREATE TABLE totp_secrets(
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT NOT NULL DEFAULT 0);
+
+-- Recovery codes are stored hashed and can be used once
+CREATE TABLE recovery_codes(
+    hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    used_at TIMESTAMP);
+
+CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id);
@@ -0,0 +1,12 @@
+-- Device authorization grants (RFC 8628) waiting to be approved and
+-- picked up. The device code is stored hashed, and user_id is set once
+-- the user approves or denies the device.
+CREATE TABLE device_authorizations(
+    device_code_hash TEXT PRIMARY KEY,
+    user_code TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    poll_interval INTEGER NOT NULL,
+    last_polled_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL);
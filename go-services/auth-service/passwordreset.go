@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// passwordResetLifetime is how long a reset link can be used
+const passwordResetLifetime = time.Hour
+
+// ErrResetInvalid is returned for an unknown, used or expired reset token
+var ErrResetInvalid = errors.New("invalid or expired reset token")
+
+// resetLink returns the link sent to reset a password. PASSWORD_RESET_URL
+// is the page of the client that asks for the new password.
+func resetLink(token string) string {
+	return tokenLink(os.Getenv("PASSWORD_RESET_URL"), token)
+}
+
+// tokenLink adds a token to the query of a link. Without a base the token
+// is sent on its own.
+func tokenLink(base string, token string) string {
+	if base == "" {
+		return token
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return token
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// handleForgotPassword emails a reset link to a user. The response is the
+// same whether or not the account exists, so it can not be used to find
+// accounts.
+func (s *AuthServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	if ok, retry := s.loginIPs.allow(ip, time.Now()); !ok {
+		log.Printf("Too many password resets from %s", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		WriteJSON(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	req := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The email is sent in the background so the response takes as long
+	// for unknown accounts
+	go s.sendPasswordReset(email)
+
+	WriteJSON(w, http.StatusAccepted, map[string]string{
+		"message": "if an account exists for this email, a reset link has been sent to it",
+	})
+}
+
+// sendPasswordReset creates a reset token for a user and emails it to them
+func (s *AuthServer) sendPasswordReset(email string) {
+	user, err := s.store.GetUser(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Password reset requested for unknown user %s", email)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", email, err)
+		return
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		log.Printf("Failed to create a reset token: %v", err)
+		return
+	}
+	expires := time.Now().UTC().Add(passwordResetLifetime)
+	if err := s.store.CreatePasswordReset(user.Id, hashRefreshToken(token), expires); err != nil {
+		log.Printf("Failed to store the reset token of %s: %v", email, err)
+		return
+	}
+
+	err = s.mailer.Send(&Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account. If it was you, "+
+			"use this link within %d minutes:\n\n%s\n\nOtherwise you can ignore this email.\n",
+			int(passwordResetLifetime.Minutes()), resetLink(token)),
+	})
+	if err != nil {
+		log.Printf("Failed to email the reset link to %s: %v", email, err)
+		return
+	}
+	log.Printf("Sent a password reset link to %s", email)
+}
+
+// handleResetPassword sets a new password with a reset token. The user's
+// sessions end, and any lockout after failed logins is cleared.
+func (s *AuthServer) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	hash := hashRefreshToken(req.Token)
+
+	userId, err := s.store.GetPasswordReset(hash)
+	if errors.Is(err, ErrResetInvalid) {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, ErrResetInvalid.Error())
+		return
+	}
+	if err := CheckPasswordPolicy(user.Email, req.Password); err != nil {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The token is checked again as it is used, in case it was used in the
+	// meantime
+	if err := s.store.ResetPassword(hash, req.Password); errors.Is(err, ErrResetInvalid) {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.store.RevokeUserTokens(userId, time.Now().UTC()); err != nil {
+		log.Printf("Failed to revoke the sessions of user %d: %v", userId, err)
+	}
+	if err := s.store.ClearLoginFailures(user.Email); err != nil {
+		log.Printf("Failed to clear the failed logins of %s: %v", user.Email, err)
+	}
+
+	log.Printf("User %s reset their password", user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
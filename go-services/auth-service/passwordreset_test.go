@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetTest is an auth server with a user and a mailbox for their reset
+// links
+type resetTest struct {
+	t      *testing.T
+	server *AuthServer
+	store  *MemoryStore
+	mail   mailbox
+	user   *User
+}
+
+func newResetTest(t *testing.T) *resetTest {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+	t.Setenv("PASSWORD_RESET_URL", "https://app.example.com/reset")
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "reset@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("reset@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := make(mailbox, 10)
+	return &resetTest{t: t, server: NewAuthServer("", store, keys, mail), store: store, mail: mail, user: user}
+}
+
+// forgot asks for a reset link and returns the token emailed
+func (c *resetTest) forgot() string {
+	c.t.Helper()
+	w := httptest.NewRecorder()
+	c.server.handleForgotPassword(w, httptest.NewRequest(http.MethodPost, "/forgot-password",
+		strings.NewReader(`{"email":"Reset@Example.com"}`)))
+	if w.Code != http.StatusAccepted {
+		c.t.Fatalf("forgot password: got %d, want 202", w.Code)
+	}
+	var email *Email
+	select {
+	case email = <-c.mail:
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no reset link was sent")
+	}
+	for _, line := range strings.Split(email.Body, "\n") {
+		if link, err := url.Parse(line); err == nil && strings.HasPrefix(line, "https://app.example.com/reset?") {
+			return link.Query().Get("token")
+		}
+	}
+	c.t.Fatalf("no reset link in %q", email.Body)
+	return ""
+}
+
+// reset sets a new password with a token and returns the status
+func (c *resetTest) reset(token string, password string) int {
+	c.t.Helper()
+	body, _ := json.Marshal(map[string]string{"token": token, "password": password})
+	w := httptest.NewRecorder()
+	c.server.handleResetPassword(w, httptest.NewRequest(http.MethodPost, "/reset-password", strings.NewReader(string(body))))
+	return w.Code
+}
+
+func (c *resetTest) passwordIs(password string) bool {
+	c.t.Helper()
+	user, err := c.store.GetUser(c.user.Email)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ok, _, _ := VerifyPassword(user.Password, password)
+	return ok
+}
+
+func TestResetPasswordSingleUse(t *testing.T) {
+	c := newResetTest(t)
+	session, err := c.server.issueTokens(c.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := c.forgot()
+
+	// A password the policy refuses does not use up the token
+	if code := c.reset(token, "password"); code != http.StatusBadRequest {
+		t.Errorf("common password: got %d, want 400", code)
+	}
+	if code := c.reset(token, "new horse battery"); code != http.StatusNoContent {
+		t.Fatalf("reset: got %d, want 204", code)
+	}
+	if !c.passwordIs("new horse battery") {
+		t.Error("reset did not change the password")
+	}
+	if code := c.reset(token, "third horse battery"); code != http.StatusBadRequest {
+		t.Errorf("second use of a reset token: got %d, want 400", code)
+	}
+	if !c.passwordIs("new horse battery") {
+		t.Error("a used reset token changed the password")
+	}
+
+	// The sessions from before the reset end
+	if _, err := c.store.RotateRefreshToken(hashRefreshToken(session.RefreshToken), "next", time.Now().Add(time.Hour)); err == nil {
+		t.Error("a refresh token from before the reset still works")
+	}
+	parsed, err := VerifyJWT(session.Token, c.server.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := parsed.Claims.(*AuthClaims)
+	if revoked, err := c.store.IsTokenRevoked(claims.ID, c.user.Id, claims.IssuedAt.Time); err != nil || !revoked {
+		t.Errorf("an access token from before the reset is not revoked: %v", err)
+	}
+}
+
+func TestResetPasswordExpiry(t *testing.T) {
+	c := newResetTest(t)
+
+	// Links last passwordResetLifetime
+	token := c.forgot()
+	c.store.mu.Lock()
+	reset := c.store.resets[hashRefreshToken(token)]
+	expiresIn := time.Until(reset.expiresAt)
+	c.store.mu.Unlock()
+	if expiresIn > passwordResetLifetime || expiresIn < passwordResetLifetime-time.Minute {
+		t.Errorf("reset token expires in %v, want %v", expiresIn, passwordResetLifetime)
+	}
+
+	// A newer link replaces it
+	newer := c.forgot()
+	if code := c.reset(token, "new horse battery"); code != http.StatusBadRequest {
+		t.Errorf("replaced reset token: got %d, want 400", code)
+	}
+
+	// And stops working once it expires
+	c.store.mu.Lock()
+	c.store.resets[hashRefreshToken(newer)].expiresAt = time.Now().Add(-time.Second)
+	c.store.mu.Unlock()
+	if code := c.reset(newer, "new horse battery"); code != http.StatusBadRequest {
+		t.Errorf("expired reset token: got %d, want 400", code)
+	}
+	if code := c.reset("unknown", "new horse battery"); code != http.StatusBadRequest {
+		t.Errorf("unknown reset token: got %d, want 400", code)
+	}
+	if !c.passwordIs("correct horse battery") {
+		t.Error("an invalid reset token changed the password")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with argon2id and stored in the PHC string format,
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<lanes>$<salt>$<hash>, so the
+// algorithm and its parameters can change without breaking stored hashes.
+// Rows written before hashing was introduced hold the plaintext password.
+const argon2idPrefix = "$argon2id$"
+
+// argon2Params are the cost parameters of a hash
+type argon2Params struct {
+	memory  uint32 // in KiB
+	time    uint32
+	threads uint8
+}
+
+// defaultArgon2Params follow the OWASP recommendation for argon2id
+var defaultArgon2Params = argon2Params{memory: 19 * 1024, time: 2, threads: 1}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// dummyPasswordHash is checked against when a user does not exist, so the
+// response takes as long as for a wrong password
+var dummyPasswordHash, _ = HashPassword("dummy password")
+
+// HashPassword hashes a password with the current parameters
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	p := defaultArgon2Params
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		p.memory, p.time, p.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches a stored hash, and
+// whether the stored value should be replaced by a new hash because it is
+// plaintext or uses outdated parameters
+func VerifyPassword(stored, password string) (ok bool, rehash bool, err error) {
+	if !strings.HasPrefix(stored, argon2idPrefix) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok, nil
+	}
+
+	p, salt, key, err := decodeArgon2Hash(stored)
+	if err != nil {
+		return false, false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(key, other) == 1
+	return ok, ok && p != defaultArgon2Params, nil
+}
+
+// decodeArgon2Hash parses a hash written by HashPassword
+func decodeArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, fmt.Errorf("malformed password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed password hash version")
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed password hash parameters")
+	}
+
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("malformed password hash salt")
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("hash %s does not have the current parameters", hash)
+	}
+	if other, _ := HashPassword("correct horse battery"); other == hash {
+		t.Error("two hashes of a password are the same")
+	}
+
+	// A hash with parameters that are no longer used
+	salt := []byte("0123456789abcdef")
+	b64 := base64.RawStdEncoding
+	outdated := fmt.Sprintf("$argon2id$v=19$m=8192,t=1,p=1$%s$%s", b64.EncodeToString(salt),
+		b64.EncodeToString(argon2.IDKey([]byte("correct horse battery"), salt, 1, 8192, 1, argon2KeyLen)))
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"hash", hash, "correct horse battery", true, false},
+		{"wrong password", hash, "correct horse staple", false, false},
+		{"outdated parameters", outdated, "correct horse battery", true, true},
+		{"wrong password with outdated parameters", outdated, "correct horse staple", false, false},
+		{"plaintext", "correct horse battery", "correct horse battery", true, true},
+		{"wrong plaintext", "correct horse battery", "correct horse staple", false, false},
+		{"empty password", hash, "", false, false},
+	}
+	for _, test := range tests {
+		ok, rehash, err := VerifyPassword(test.stored, test.password)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if ok != test.ok || rehash != test.rehash {
+			t.Errorf("%s: ok %v rehash %v, want ok %v rehash %v", test.name, ok, rehash, test.ok, test.rehash)
+		}
+	}
+
+	parts := strings.Split(hash, "$")
+	for _, malformed := range []string{
+		"$argon2id$",
+		"$argon2id$v=16$" + strings.Join(parts[3:], "$"),
+		"$argon2id$v=19$m=x$" + strings.Join(parts[4:], "$"),
+		"$argon2id$v=19$" + parts[3] + "$!$" + parts[5],
+		"$argon2id$v=19$" + parts[3] + "$" + parts[4] + "$",
+	} {
+		if ok, _, err := VerifyPassword(malformed, "correct horse battery"); ok || err == nil {
+			t.Errorf("%s: ok %v err %v, want an error", malformed, ok, err)
+		}
+	}
+}
+
+func TestLoginUpgradesPlaintext(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A row written before passwords were hashed
+	store.mu.Lock()
+	err = store.addUser(&User{Email: "plain@example.com"}, "correct horse battery")
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewAuthServer("", store, keys, mailer)
+
+	login := func(password string) int {
+		body := fmt.Sprintf(`{"email":"Plain@example.com","password":%q}`, password)
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		server.handleLogin(w, r)
+		return w.Code
+	}
+	stored := func() string {
+		user, err := store.GetUser("plain@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Password
+	}
+
+	// A wrong password leaves the row as it is
+	if code := login("correct horse staple"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d, want 401", code)
+	}
+	if stored() != "correct horse battery" {
+		t.Fatal("a failed login changed the stored password")
+	}
+
+	if code := login("correct horse battery"); code != http.StatusOK {
+		t.Fatalf("login with a plaintext row: got %d, want 200", code)
+	}
+	hash := stored()
+	if ok, rehash, err := VerifyPassword(hash, "correct horse battery"); !strings.HasPrefix(hash, argon2idPrefix) || !ok || rehash || err != nil {
+		t.Fatalf("stored password after login %q: ok %v rehash %v err %v", hash, ok, rehash, err)
+	}
+
+	// Later logins check the hash and keep it
+	if code := login("correct horse battery"); code != http.StatusOK {
+		t.Fatalf("login with the upgraded row: got %d, want 200", code)
+	}
+	if code := login(hash); code != http.StatusUnauthorized {
+		t.Errorf("login with the hash as the password: got %d, want 401", code)
+	}
+	if stored() != hash {
+		t.Error("a login with a current hash rehashed it")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Registration modes, set with the REGISTRATION_MODE environment variable
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+	maxEmailLength    = 254
+)
+
+// commonPasswords are rejected outright since they are the first ones
+// tried in guessing attacks
+var commonPasswords = []string{
+	"password", "password1", "password123", "12345678", "123456789",
+	"1234567890", "qwertyuiop", "qwerty123", "iloveyou", "11111111",
+	"abc12345", "abcd1234", "letmein1", "welcome1", "sunshine",
+	"football", "baseball", "princess", "superman", "trustno1",
+}
+
+// RegisterRequest is the body of a registration request. InviteCode is
+// only needed when registration is restricted to invites.
+type RegisterRequest struct {
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	InviteCode string `json:"inviteCode,omitempty"`
+}
+
+// registrationMode returns the configured registration mode, open by
+// default
+func registrationMode() string {
+	switch mode := strings.ToLower(os.Getenv("REGISTRATION_MODE")); mode {
+	case RegistrationInvite, RegistrationClosed:
+		return mode
+	default:
+		return RegistrationOpen
+	}
+}
+
+// handleRegister creates a new account
+func (s *AuthServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	mode := registrationMode()
+	if mode == RegistrationClosed {
+		WriteJSON(w, http.StatusForbidden, "registration is disabled")
+		return
+	}
+
+	req := &RegisterRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := CheckPasswordPolicy(email, req.Password); err != nil {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := &User{Email: email, Password: req.Password}
+	if mode == RegistrationInvite {
+		if req.InviteCode == "" {
+			WriteJSON(w, http.StatusForbidden, "an invite code is required")
+			return
+		}
+		err = s.store.CreateInvitedUser(user, req.InviteCode)
+	} else {
+		err = s.store.CreateUser(user)
+	}
+	switch {
+	case errors.Is(err, ErrInvalidInvite):
+		WriteJSON(w, http.StatusForbidden, "invalid invite code")
+		return
+	case errors.Is(err, ErrUserExists):
+		WriteJSON(w, http.StatusConflict, "an account with this email already exists")
+		return
+	case err != nil:
+		log.Printf("Failed to register user %s: %v", email, err)
+		WriteJSON(w, http.StatusInternalServerError, "failed to create account")
+		return
+	}
+
+	log.Printf("User %s registered", email)
+	go s.sendVerification(email)
+	WriteJSON(w, http.StatusCreated, map[string]string{
+		"email":   email,
+		"message": "a verification link has been sent to " + email,
+	})
+}
+
+// NormalizeEmail validates an email address and returns it trimmed and in
+// lower case, so addresses differing only in case map to one account
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", fmt.Errorf("email is required")
+	}
+	addr, err := mail.ParseAddress(email)
+	// Display names and comments are not part of an account's address
+	if err != nil || addr.Address != email || len(email) > maxEmailLength {
+		return "", fmt.Errorf("invalid email address")
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") {
+		return "", fmt.Errorf("invalid email address")
+	}
+	return email, nil
+}
+
+// CheckPasswordPolicy checks a new password against the password policy
+func CheckPasswordPolicy(email, password string) error {
+	n := utf8.RuneCountInString(password)
+	if n < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if n > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d characters", maxPasswordLength)
+	}
+	lower := strings.ToLower(password)
+	if slices.Contains(commonPasswords, lower) {
+		return fmt.Errorf("password is too common")
+	}
+	if lower == email || lower == email[:strings.LastIndex(email, "@")] {
+		return fmt.Errorf("password must not be the email address")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"correct horse battery", true},
+		{"8 chars!", true},
+		{"7 chars", false},
+		{"", false},
+		// Length is counted in characters, not bytes
+		{"ééééééé", false},
+		{"éééééééé", true},
+		{strings.Repeat("a", maxPasswordLength), true},
+		{strings.Repeat("a", maxPasswordLength+1), false},
+		{"password", false},
+		{"Password123", false},
+		{"TRUSTNO1", false},
+		// Neither the address nor its local part
+		{"jane.doe@example.com", false},
+		{"Jane.Doe@Example.com", false},
+		{"jane.doe", false},
+		{"jane.doe1", true},
+	}
+	for _, test := range tests {
+		if err := CheckPasswordPolicy("jane.doe@example.com", test.password); (err == nil) != test.ok {
+			t.Errorf("password %q: got %v, want ok %v", test.password, err, test.ok)
+		}
+	}
+}
+
+// mailbox is a Mailer that keeps the emails sent
+type mailbox chan *Email
+
+func (m mailbox) Send(email *Email) error {
+	m <- email
+	return nil
+}
+
+func TestRegistrationModes(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+	t.Setenv("INVITE_CODES", "first-invite, second-invite")
+
+	type attempt struct {
+		email  string
+		invite string
+		want   int
+	}
+	tests := []struct {
+		mode     string
+		attempts []attempt
+	}{
+		{"", []attempt{
+			{"open@example.com", "", http.StatusCreated},
+			{" Open@Example.com ", "", http.StatusConflict},
+			{"invited@example.com", "not an invite", http.StatusCreated},
+		}},
+		{"open", []attempt{{"open@example.com", "", http.StatusCreated}}},
+		{"unknown", []attempt{{"open@example.com", "", http.StatusCreated}}},
+		{"invite", []attempt{
+			{"nocode@example.com", "", http.StatusForbidden},
+			{"wrong@example.com", "third-invite", http.StatusForbidden},
+			{"first@example.com", "first-invite", http.StatusCreated},
+			// An invite code works once
+			{"again@example.com", "first-invite", http.StatusForbidden},
+			{"first@example.com", "second-invite", http.StatusConflict},
+			{"second@example.com", "second-invite", http.StatusCreated},
+		}},
+		{"Closed", []attempt{
+			{"closed@example.com", "", http.StatusForbidden},
+			{"closed@example.com", "first-invite", http.StatusForbidden},
+		}},
+	}
+	for _, test := range tests {
+		t.Setenv("REGISTRATION_MODE", test.mode)
+		store, err := NewMemoryStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := seedStore(store); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := NewKeyRing(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mail := make(mailbox, len(test.attempts))
+		server := NewAuthServer("", store, keys, mail)
+
+		for _, a := range test.attempts {
+			body, _ := json.Marshal(&RegisterRequest{Email: a.email, Password: "correct horse battery", InviteCode: a.invite})
+			w := httptest.NewRecorder()
+			server.handleRegister(w, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(string(body))))
+			if w.Code != a.want {
+				t.Errorf("mode %q: registering %s with invite %q got %d, want %d: %s", test.mode, a.email, a.invite, w.Code, a.want, w.Body)
+				continue
+			}
+			email := strings.ToLower(strings.TrimSpace(a.email))
+			_, err := store.GetUser(email)
+			switch {
+			case a.want == http.StatusCreated && err != nil:
+				t.Errorf("mode %q: %s was not created: %v", test.mode, email, err)
+			case a.want == http.StatusForbidden && !errors.Is(err, sql.ErrNoRows):
+				t.Errorf("mode %q: refused registration of %s created it", test.mode, email)
+			}
+			if a.want == http.StatusCreated {
+				if sent := <-mail; sent.To != email || sent.Subject != "Verify your email address" {
+					t.Errorf("mode %q: sent %q to %s after registering %s", test.mode, sent.Subject, sent.To, email)
+				}
+			}
+		}
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	t.Setenv("REGISTRATION_MODE", "open")
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewAuthServer("", store, nil, make(mailbox, 1))
+
+	for _, body := range []string{
+		`not json`,
+		`{"email":"","password":"correct horse battery"}`,
+		`{"email":"Jane <jane@example.com>","password":"correct horse battery"}`,
+		`{"email":"jane@localhost","password":"correct horse battery"}`,
+		`{"email":"jane@example.com","password":"short"}`,
+		`{"email":"jane@example.com","password":"password123"}`,
+	} {
+		w := httptest.NewRecorder()
+		server.handleRegister(w, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, w.Code)
+		}
+	}
+	if _, err := store.GetUser("jane@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("an invalid registration created the account")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Revocations are the access tokens that were revoked before they expired.
+// Single tokens are revoked by id on logout, and all tokens of a user
+// issued up to a point in time when an admin revokes their sessions.
+// Entries are dropped once the tokens they cover have expired anyway.
+type Revocations struct {
+	Tokens []RevokedToken  `json:"tokens"`
+	Users  []UserWatermark `json:"users"`
+}
+
+// RevokedToken is a revoked access token, kept until it expires
+type RevokedToken struct {
+	Id        string    `json:"jti"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// UserWatermark revokes the tokens of a user issued at or before
+// IssuedBefore. It is the exact time of the revocation, while token times
+// have a precision of a second, so tokens issued in the same second just
+// after the revocation are revoked too, but none issued later.
+type UserWatermark struct {
+	UserId       string    `json:"sub"`
+	IssuedBefore time.Time `json:"issuedBefore"`
+}
+
+// authenticate verifies the bearer token of a request and checks that it
+// has not been revoked
+func (s *AuthServer) authenticate(r *http.Request) (*AuthClaims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("missing token")
+	}
+
+	jwtToken, err := VerifyJWT(token, s.keys)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwtToken.Claims.(*AuthClaims)
+
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject")
+	}
+	revoked, err := s.store.IsTokenRevoked(claims.ID, userId, claims.IssuedAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+	return claims, nil
+}
+
+// handleLogout revokes the access token of the request. When the refresh
+// token is sent as well, the session it belongs to ends too.
+func (s *AuthServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	req := struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := s.store.RevokeToken(claims.ID, userId, claims.ExpiresAt.Time); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.RefreshToken != "" {
+		if err := s.store.RevokeRefreshToken(hashRefreshToken(req.RefreshToken), userId); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	log.Printf("User %s logged out", claims.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeSessions lets an admin end every session of a user. Their
+// access tokens stop working and their refresh tokens are revoked.
+func (s *AuthServer) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !slices.Contains(claims.Roles, RoleAdmin) {
+		WriteJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	userId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if _, err := s.store.GetUserById(userId); err != nil {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	if err := s.store.RevokeUserTokens(userId, time.Now().UTC()); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Admin %s revoked the sessions of user %d", claims.Email, userId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevocations lists the current revocations for services that verify
+// tokens themselves. It is only reachable inside the cluster.
+func (s *AuthServer) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	revocations, err := s.store.ListRevocations(time.Now().UTC())
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, revocations)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRevokeUserTokensSameSecond(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "revoked@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("revoked@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewAuthServer("", store, keys, mailer)
+
+	// The token is issued and revoked within a second or so, which is what
+	// happens when a password reset follows a login
+	token, err := CreateJWT(user, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if _, err := server.authenticate(r); err != nil {
+		t.Fatalf("authenticate before revoking: %v", err)
+	}
+	if err := store.RevokeUserTokens(user.Id, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.authenticate(r); err == nil {
+		t.Fatal("authenticate accepted a token issued in the second of its revocation")
+	}
+}
+
+func TestRevocationWatermark(t *testing.T) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watermark is the exact time of the revocation, and token times
+	// have a precision of a second. Tokens issued in the second of the
+	// revocation are revoked whether they came before or after it, and
+	// those issued from the next second on are not.
+	revokedAt := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	if err := store.RevokeUserTokens(1, revokedAt); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{revokedAt.Add(-time.Minute).Truncate(time.Second), true},
+		{revokedAt.Truncate(time.Second), true},
+		{revokedAt.Truncate(time.Second).Add(time.Second), false},
+	}
+	for _, test := range tests {
+		revoked, err := store.IsTokenRevoked("jti", 1, test.issuedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != test.revoked {
+			t.Errorf("token issued at %v revoked %v, want %v", test.issuedAt.Format(time.TimeOnly), revoked, test.revoked)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Roles a user can have. Users sign up with RoleUser, admins manage other
+// users, and services are backends acting on behalf of any user.
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleService = "service"
+)
+
+var roles = []string{RoleUser, RoleAdmin, RoleService}
+
+// handleSetRole lets an admin change the role of a user. The user's
+// sessions are revoked so their tokens carry the new role.
+func (s *AuthServer) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !slices.Contains(claims.Roles, RoleAdmin) {
+		WriteJSON(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	req := struct {
+		Role string `json:"role"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !slices.Contains(roles, req.Role) {
+		WriteJSON(w, http.StatusBadRequest, "role must be one of user, admin, service")
+		return
+	}
+
+	userId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+	err = s.store.SetUserRole(userId, req.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.store.RevokeUserTokens(userId, time.Now().UTC()); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Admin %s set the role of user %d to %s", claims.Email, userId, req.Role)
+	WriteJSON(w, http.StatusOK, map[string]string{"role": req.Role})
+}
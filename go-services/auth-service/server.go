@@ -1,22 +1,35 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // AuthServer represents the HTTP server instance for the auth service
 type AuthServer struct {
 	store      Store
+	keys       *KeyRing
+	mailer     Mailer
+	loginIPs   *ipLimiter
+	proxies    []netip.Prefix
 	listenAddr string
 }
 
 // NewAuthServer creates a new Server instance
-func NewAuthServer(listenAddr string, store Store) *AuthServer {
+func NewAuthServer(listenAddr string, store Store, keys *KeyRing, mailer Mailer) *AuthServer {
 	return &AuthServer{
 		store:      store,
+		keys:       keys,
+		mailer:     mailer,
+		loginIPs:   newIPLimiter(),
+		proxies:    trustedProxies(),
 		listenAddr: listenAddr,
 	}
 }
@@ -26,7 +39,39 @@ func (s *AuthServer) ListenAndServe() error {
 	router := http.NewServeMux()
 	router.HandleFunc("GET /healthz", s.handleHealth)
 	router.HandleFunc("POST /login", s.handleLogin)
+	router.HandleFunc("POST /login/mfa", s.handleLoginMFA)
+	router.HandleFunc("POST /register", s.handleRegister)
+	router.HandleFunc("POST /token/refresh", s.handleRefresh)
+	router.HandleFunc("POST /password/forgot", s.handleForgotPassword)
+	router.HandleFunc("POST /password/reset", s.handleResetPassword)
+	router.HandleFunc("POST /email/verify", s.handleVerifyEmail)
+	router.HandleFunc("POST /email/verify/resend", s.handleResendVerification)
+	router.HandleFunc("POST /mfa/totp/enroll", s.handleEnrollTOTP)
+	router.HandleFunc("POST /mfa/totp/confirm", s.handleConfirmTOTP)
+	router.HandleFunc("DELETE /mfa/totp", s.handleDisableTOTP)
+	router.HandleFunc("POST /webauthn/register/begin", s.handleWebAuthnRegisterBegin)
+	router.HandleFunc("POST /webauthn/register/finish", s.handleWebAuthnRegisterFinish)
+	router.HandleFunc("POST /webauthn/login/begin", s.handleWebAuthnLoginBegin)
+	router.HandleFunc("POST /webauthn/login/finish", s.handleWebAuthnLoginFinish)
+	router.HandleFunc("GET /webauthn/credentials", s.handleListWebAuthnCredentials)
+	router.HandleFunc("DELETE /webauthn/credentials/{id}", s.handleDeleteWebAuthnCredential)
+	router.HandleFunc("POST /device/code", s.handleDeviceCode)
+	router.HandleFunc("POST /device/token", s.handleDeviceToken)
+	router.HandleFunc("GET /device/{userCode}", s.handleGetDeviceAuthorization)
+	router.HandleFunc("POST /device/approve", s.handleApproveDevice)
+	router.HandleFunc("POST /device/deny", s.handleDenyDevice)
 	router.HandleFunc("GET /validate", s.handleValidate)
+	router.HandleFunc("GET /.well-known/jwks.json", s.handleJWKS)
+	router.HandleFunc("POST /logout", s.handleLogout)
+	router.HandleFunc("POST /users/{id}/revoke-sessions", s.handleRevokeSessions)
+	router.HandleFunc("PUT /users/{id}/role", s.handleSetRole)
+	router.HandleFunc("GET /lockouts", s.handleListLockouts)
+	router.HandleFunc("DELETE /users/{id}/lockout", s.handleClearLockout)
+	router.HandleFunc("GET /revocations", s.handleRevocations)
+	router.HandleFunc("POST /api-keys", s.handleCreateAPIKey)
+	router.HandleFunc("GET /api-keys", s.handleListAPIKeys)
+	router.HandleFunc("DELETE /api-keys/{id}", s.handleRevokeAPIKey)
+	router.HandleFunc("POST /api-keys/verify", s.handleVerifyAPIKey)
 
 	log.Printf("Server is listening on %s...", s.listenAddr)
 	return http.ListenAndServe(s.listenAddr, router)
@@ -38,64 +83,121 @@ func (s *AuthServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // handleLogin handles the login request and returns a JWT token if the user is valid
 func (s *AuthServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	// Limit attempts per client before doing any work for them
+	ip := s.clientIP(r)
+	if ok, retry := s.loginIPs.allow(ip, time.Now()); !ok {
+		log.Printf("Too many logins from %s", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		WriteJSON(w, http.StatusTooManyRequests, "too many login attempts")
+		return
+	}
+
 	// Get the user from the request body
 	user := &User{}
 	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
-		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
-	// Check if the user has provided the email and password
+	// Check if the user has provided the email and password. Emails are
+	// stored in lower case since registration normalizes them.
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
 	if user.Email == "" || user.Password == "" {
-		WriteJSON(w, http.StatusInternalServerError, fmt.Errorf("missing credentials"))
+		WriteJSON(w, http.StatusBadRequest, "missing credentials")
 		return
 	}
 
-	// Check if the user exists in the store
+	// Refuse accounts locked after failed logins without checking the
+	// password, and with the same response as a wrong one
+	lock, err := s.store.GetLoginLock(user.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to get the login lock of %s: %v", user.Email, err)
+		WriteJSON(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if lock != nil && time.Now().Before(lock.LockedUntil) {
+		log.Printf("User %s tried to log in while locked", user.Email)
+		WriteJSON(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	// Check if the user exists in the store. Unknown users are checked
+	// against a dummy hash so they cannot be told apart by timing.
 	dbUser, err := s.store.GetUser(user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		VerifyPassword(dummyPasswordHash, user.Password)
+		log.Printf("Unknown user %s failed to log in", user.Email)
+		s.recordLoginFailure(user.Email)
+		WriteJSON(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
 	if err != nil {
-		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		log.Printf("Failed to get user %s: %v", user.Email, err)
+		WriteJSON(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
 
 	// Chech if the password is correct
-	if dbUser.Password != user.Password {
+	ok, rehash, err := VerifyPassword(dbUser.Password, user.Password)
+	if err != nil {
+		log.Printf("User %s has an invalid password hash: %v", user.Email, err)
+	}
+	if !ok {
 		log.Printf("User %s failed to log in", user.Email)
+		s.recordLoginFailure(user.Email)
 		WriteJSON(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
+	if lock != nil {
+		if err := s.store.ClearLoginFailures(user.Email); err != nil {
+			log.Printf("Failed to clear the failed logins of %s: %v", user.Email, err)
+		}
+	}
+
+	// Plaintext and outdated hashes are replaced now that the password is
+	// known. A failure is retried on the next login.
+	if rehash {
+		if err := s.store.UpdatePassword(user.Email, user.Password); err != nil {
+			log.Printf("Failed to rehash the password of user %s: %v", user.Email, err)
+		}
+	}
 
-	// Return a success message and a jwt token
-	token, err := CreateJWT(user)
+	// Accounts with two-factor authentication get a challenge instead of
+	// tokens
+	challenge, err := s.mfaChallenge(dbUser)
 	if err != nil {
-		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		log.Printf("Failed to check the two-factor authentication of %s: %v", user.Email, err)
+		WriteJSON(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
-
-	log.Printf("User %s logged in with token: %s\n", user.Email, token)
-	WriteJSON(w, http.StatusOK, map[string]string{"token": token})
-}
-
-func (s *AuthServer) handleValidate(w http.ResponseWriter, r *http.Request) {
-	// Get the token from the request
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		WriteJSON(w, http.StatusUnauthorized, "missing token")
+	if challenge != nil {
+		log.Printf("User %s passed the password step", user.Email)
+		WriteJSON(w, http.StatusOK, challenge)
 		return
 	}
 
-	// Check if the token is a bearer token
-	if string(token[:7]) != "Bearer " {
-		WriteJSON(w, http.StatusUnauthorized, "invalid authorization header")
+	// Return a jwt token and a refresh token
+	tokens, err := s.issueTokens(dbUser)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	token = token[7:]
 
-	// Verify the token
-	_, err := VerifyJWT(token)
+	log.Printf("User %s logged in", user.Email)
+	WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handleValidate returns the identity of a valid, unrevoked token
+func (s *AuthServer) handleValidate(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
 	if err != nil {
 		WriteJSON(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	WriteJSON(w, http.StatusOK, "valid token")
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":      claims.Subject,
+		"email":    claims.Email,
+		"roles":    claims.Roles,
+		"verified": claims.Verified,
+	})
 }
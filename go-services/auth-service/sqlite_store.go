@@ -0,0 +1,1035 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a Store in a SQLite database file, for running the auth
+// service on its own. It is meant for a single replica.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqlitePath returns the database file configured by SQLITE_PATH
+func sqlitePath() string {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return path
+	}
+	return "auth.db"
+}
+
+// openSQLite opens a SQLite database file, creating it if needed
+func openSQLite(path string) (*sql.DB, error) {
+	// Write transactions take the lock when they begin, so concurrent ones
+	// wait for each other instead of failing halfway
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, and in memory databases are per
+	// connection
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// NewSQLiteStore creates a new SQLiteStore instance for the database at
+// path
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &SQLiteStore{db: db}
+	if err := store.Init(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Init migrates the schema to the latest version and seeds the store
+func (s *SQLiteStore) Init() error {
+	migrator, err := NewSQLiteMigrator(s.db)
+	if err != nil {
+		return err
+	}
+	if err := migrator.Up(migrator.Latest(), log.Writer()); err != nil {
+		return err
+	}
+	return seedStore(s)
+}
+
+// sqliteUserError maps a unique violation on the users table to
+// ErrUserExists
+func sqliteUserError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserExists
+	}
+	return err
+}
+
+// GetUser retrieves a user from the database. Password holds the stored
+// hash.
+func (s *SQLiteStore) GetUser(email string) (*User, error) {
+	query := `SELECT id, email, password, role, email_verified FROM users WHERE email = ?`
+
+	user := &User{}
+	if err := s.db.QueryRow(query, email).Scan(&user.Id, &user.Email, &user.Password, &user.Role, &user.EmailVerified); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserById retrieves a user from the database by id
+func (s *SQLiteStore) GetUserById(id int64) (*User, error) {
+	query := `SELECT id, email, password, role, email_verified FROM users WHERE id = ?`
+
+	user := &User{}
+	if err := s.db.QueryRow(query, id).Scan(&user.Id, &user.Email, &user.Password, &user.Role, &user.EmailVerified); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateUser creates a new user in the database, storing a hash of the
+// password
+func (s *SQLiteStore) CreateUser(user *User) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO users (email, password) VALUES (?, ?)`, user.Email, hash)
+	return sqliteUserError(err)
+}
+
+// CreateInvitedUser creates a new user and uses up an invite code. Neither
+// happens if the other fails.
+func (s *SQLiteStore) CreateInvitedUser(user *User, code string) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE invites SET used_by = ?, used_at = ?
+    WHERE code = ? AND used_by IS NULL`, user.Email, time.Now().UTC(), code)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidInvite
+	}
+
+	if _, err := tx.Exec(`INSERT INTO users (email, password) VALUES (?, ?)`, user.Email, hash); err != nil {
+		return sqliteUserError(err)
+	}
+	return tx.Commit()
+}
+
+// CreateInvite adds an invite code unless it already exists
+func (s *SQLiteStore) CreateInvite(code string) error {
+	_, err := s.db.Exec(`INSERT INTO invites (code) VALUES (?) ON CONFLICT (code) DO NOTHING`, code)
+	return err
+}
+
+// UpdatePassword replaces the password of a user with a hash of password
+func (s *SQLiteStore) UpdatePassword(email string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE users SET password = ? WHERE email = ?`, hash, email)
+	return err
+}
+
+// SetUserRole changes the role of a user
+func (s *SQLiteStore) SetUserRole(id int64, role string) error {
+	res, err := s.db.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateRefreshToken stores the hash of a new refresh token
+func (s *SQLiteStore) CreateRefreshToken(userId int64, hash string, family string, expiresAt time.Time) error {
+	query := `INSERT INTO refresh_tokens (hash, family, user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`
+
+	_, err := s.db.Exec(query, hash, family, userId, time.Now().UTC(), expiresAt.UTC())
+	return err
+}
+
+// RotateRefreshToken marks a refresh token as used and stores its
+// replacement in the same family, returning the id of the user it belongs
+// to. A token that was already used revokes its whole family.
+func (s *SQLiteStore) RotateRefreshToken(hash string, newHash string, expiresAt time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		family            string
+		userId            int64
+		expires           time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	row := tx.QueryRow(`SELECT family, user_id, expires_at, used_at, revoked_at
+    FROM refresh_tokens WHERE hash = ?`, hash)
+	err = row.Scan(&family, &userId, &expires, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	if revokedAt.Valid || now.After(expires) {
+		return userId, ErrTokenInvalid
+	}
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ?
+    WHERE family = ? AND revoked_at IS NULL`, now, family); err != nil {
+			return userId, err
+		}
+		if err := tx.Commit(); err != nil {
+			return userId, err
+		}
+		return userId, ErrTokenReused
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE hash = ?`, now, hash); err != nil {
+		return userId, err
+	}
+	query := `INSERT INTO refresh_tokens (hash, family, user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, newHash, family, userId, now, expiresAt.UTC()); err != nil {
+		return userId, err
+	}
+	return userId, tx.Commit()
+}
+
+// RevokeRefreshToken revokes the family of a user's refresh token
+func (s *SQLiteStore) RevokeRefreshToken(hash string, userId int64) error {
+	query := `UPDATE refresh_tokens SET revoked_at = ?
+    WHERE family = (SELECT family FROM refresh_tokens WHERE hash = ? AND user_id = ?)
+    AND revoked_at IS NULL`
+
+	_, err := s.db.Exec(query, time.Now().UTC(), hash, userId)
+	return err
+}
+
+// RevokeToken revokes a single access token until it expires
+func (s *SQLiteStore) RevokeToken(jti string, userId int64, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)
+    ON CONFLICT (jti) DO NOTHING`
+
+	_, err := s.db.Exec(query, jti, userId, expiresAt.UTC())
+	return err
+}
+
+// RevokeUserTokens revokes the access tokens of a user issued at or before
+// issuedBefore, and all of their refresh tokens
+func (s *SQLiteStore) RevokeUserTokens(userId int64, issuedBefore time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO token_watermarks (user_id, issued_before) VALUES (?, ?)
+    ON CONFLICT (user_id) DO UPDATE
+    SET issued_before = MAX(token_watermarks.issued_before, excluded.issued_before)`,
+		userId, issuedBefore.UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ?
+    WHERE user_id = ? AND revoked_at IS NULL`, time.Now().UTC(), userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsTokenRevoked reports whether an access token was revoked by id or by
+// its user's watermark
+func (s *SQLiteStore) IsTokenRevoked(jti string, userId int64, issuedAt time.Time) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+    OR EXISTS (SELECT 1 FROM token_watermarks WHERE user_id = ? AND issued_before >= ?)`
+
+	var revoked bool
+	err := s.db.QueryRow(query, jti, userId, issuedAt.UTC()).Scan(&revoked)
+	return revoked, err
+}
+
+// ListRevocations drops the revocations of tokens that have expired and
+// returns the others
+func (s *SQLiteStore) ListRevocations(now time.Time) (*Revocations, error) {
+	now = now.UTC()
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, now); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec(`DELETE FROM token_watermarks WHERE issued_before < ?`, now.Add(-tokenLifetime)); err != nil {
+		return nil, err
+	}
+
+	revocations := &Revocations{Tokens: []RevokedToken{}, Users: []UserWatermark{}}
+	rows, err := s.db.Query(`SELECT jti, expires_at FROM revoked_tokens`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		token := RevokedToken{}
+		if err := rows.Scan(&token.Id, &token.ExpiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revocations.Tokens = append(revocations.Tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT user_id, issued_before FROM token_watermarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId int64
+		watermark := UserWatermark{}
+		if err := rows.Scan(&userId, &watermark.IssuedBefore); err != nil {
+			return nil, err
+		}
+		watermark.UserId = strconv.FormatInt(userId, 10)
+		revocations.Users = append(revocations.Users, watermark)
+	}
+	return revocations, rows.Err()
+}
+
+// RotateSigningKeys creates the next signing key once the current one is
+// due to be replaced, deletes keys whose tokens have all expired, and
+// returns the remaining keys ordered by activation
+func (s *SQLiteStore) RotateSigningKeys(now time.Time, newKey func(activeFrom time.Time) (*StoredKey, error)) ([]*StoredKey, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT kid, sealed, active_from, created_at FROM signing_keys ORDER BY active_from`)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*StoredKey{}
+	for rows.Next() {
+		key := &StoredKey{}
+		if err := rows.Scan(&key.Id, &key.Sealed, &key.ActiveFrom, &key.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if activeFrom := nextKeyActivation(keys, now); !activeFrom.IsZero() {
+		key, err := newKey(activeFrom)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO signing_keys (kid, sealed, active_from, created_at) VALUES (?, ?, ?, ?)`,
+			key.Id, key.Sealed, key.ActiveFrom.UTC(), key.CreatedAt.UTC()); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	expired := expiredKeys(keys, now)
+	for _, key := range keys[:expired] {
+		if _, err := tx.Exec(`DELETE FROM signing_keys WHERE kid = ?`, key.Id); err != nil {
+			return nil, err
+		}
+	}
+	keys = keys[expired:]
+	return keys, tx.Commit()
+}
+
+// scanAPIKey reads an API key whose scopes are stored as JSON
+func scanAPIKey(row interface{ Scan(...any) error }, key *APIKey) error {
+	var scopes string
+	if err := row.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &scopes,
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(scopes), &key.Scopes)
+}
+
+// CreateAPIKey stores a new API key and sets its id and creation time
+func (s *SQLiteStore) CreateAPIKey(key *APIKey) error {
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return err
+	}
+	var expiresAt *time.Time
+	if key.ExpiresAt != nil {
+		t := key.ExpiresAt.UTC()
+		expiresAt = &t
+	}
+	createdAt := time.Now().UTC()
+	query := `INSERT INTO api_keys (user_id, name, prefix, hash, scopes, created_at, expires_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	res, err := s.db.Exec(query, key.UserId, key.Name, key.Prefix, key.Hash, string(scopes), createdAt, expiresAt)
+	if err != nil {
+		return err
+	}
+	if key.Id, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	key.CreatedAt = createdAt
+	return nil
+}
+
+// ListAPIKeys returns the keys of a user that are neither revoked nor
+// expired, newest first
+func (s *SQLiteStore) ListAPIKeys(userId int64) ([]*APIKey, error) {
+	query := `SELECT id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at
+    FROM api_keys WHERE user_id = ? AND revoked_at IS NULL
+    AND (expires_at IS NULL OR expires_at > ?)
+    ORDER BY created_at DESC, id DESC`
+
+	rows, err := s.db.Query(query, userId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := &APIKey{}
+		if err := scanAPIKey(rows, key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key of a user. It returns sql.ErrNoRows when the
+// user has no such key.
+func (s *SQLiteStore) RevokeAPIKey(userId int64, id int64) error {
+	query := `UPDATE api_keys SET revoked_at = ?
+    WHERE id = ? AND user_id = ? AND revoked_at IS NULL`
+
+	res, err := s.db.Exec(query, time.Now().UTC(), id, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseAPIKey looks up a valid key by its hash, records that it was used,
+// and returns it with the user it belongs to
+func (s *SQLiteStore) UseAPIKey(hash string) (*APIKey, *User, error) {
+	now := time.Now().UTC()
+	query := `UPDATE api_keys SET last_used_at = ?
+    WHERE hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+    RETURNING id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at`
+
+	key := &APIKey{}
+	err := scanAPIKey(s.db.QueryRow(query, now, hash, now), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.GetUserById(key.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, user, nil
+}
+
+// RecordLoginFailure counts a failed login and returns the number of
+// failures in a row. Failures before since are forgotten.
+func (s *SQLiteStore) RecordLoginFailure(email string, now time.Time, since time.Time) (int, error) {
+	query := `INSERT INTO login_failures (email, failures, last_failure_at, locked_until) VALUES (?, 1, ?, ?)
+    ON CONFLICT (email) DO UPDATE
+    SET failures = CASE WHEN login_failures.last_failure_at < ? THEN 1 ELSE login_failures.failures + 1 END,
+    last_failure_at = excluded.last_failure_at
+    RETURNING failures`
+
+	var failures int
+	err := s.db.QueryRow(query, email, now.UTC(), time.Unix(0, 0).UTC(), since.UTC()).Scan(&failures)
+	return failures, err
+}
+
+// LockLogin refuses logins to an account until the given time
+func (s *SQLiteStore) LockLogin(email string, until time.Time) error {
+	query := `UPDATE login_failures SET locked_until = MAX(locked_until, ?) WHERE email = ?`
+
+	_, err := s.db.Exec(query, until.UTC(), email)
+	return err
+}
+
+// GetLoginLock returns the failed logins of an account
+func (s *SQLiteStore) GetLoginLock(email string) (*LoginLock, error) {
+	query := `SELECT email, failures, last_failure_at, locked_until FROM login_failures WHERE email = ?`
+
+	lock := &LoginLock{}
+	err := s.db.QueryRow(query, email).Scan(&lock.Email, &lock.Failures, &lock.LastFailureAt, &lock.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// ListLoginLocks returns the accounts locked at now, and drops failures
+// that have been forgotten
+func (s *SQLiteStore) ListLoginLocks(now time.Time) ([]*LoginLock, error) {
+	now = now.UTC()
+	if _, err := s.db.Exec(`DELETE FROM login_failures WHERE locked_until < ? AND last_failure_at < ?`,
+		now, now.Add(-loginFailureWindow)); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT email, failures, last_failure_at, locked_until FROM login_failures
+    WHERE locked_until > ? ORDER BY locked_until DESC`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locks := []*LoginLock{}
+	for rows.Next() {
+		lock := &LoginLock{}
+		if err := rows.Scan(&lock.Email, &lock.Failures, &lock.LastFailureAt, &lock.LockedUntil); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, rows.Err()
+}
+
+// ClearLoginFailures unlocks an account and forgets its failed logins
+func (s *SQLiteStore) ClearLoginFailures(email string) error {
+	_, err := s.db.Exec(`DELETE FROM login_failures WHERE email = ?`, email)
+	return err
+}
+
+// CreatePasswordReset stores the hash of a new reset token, replacing the
+// unused ones of the user
+func (s *SQLiteStore) CreatePasswordReset(userId int64, hash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, userId); err != nil {
+		return err
+	}
+	query := `INSERT INTO password_resets (hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, hash, userId, time.Now().UTC(), expiresAt.UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordReset returns the user of a reset token that can still be
+// used
+func (s *SQLiteStore) GetPasswordReset(hash string) (int64, error) {
+	query := `SELECT user_id FROM password_resets
+    WHERE hash = ? AND used_at IS NULL AND expires_at > ?`
+
+	var userId int64
+	err := s.db.QueryRow(query, hash, time.Now().UTC()).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetInvalid
+	}
+	return userId, err
+}
+
+// ResetPassword uses up a reset token and replaces the password of its
+// user with a hash of password
+func (s *SQLiteStore) ResetPassword(hash string, password string) error {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var userId int64
+	err = tx.QueryRow(`UPDATE password_resets SET used_at = ?
+    WHERE hash = ? AND used_at IS NULL AND expires_at > ?
+    RETURNING user_id`, now, hash, now).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrResetInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, passwordHash, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEmailVerification stores the hash of a new verification token,
+// replacing the other ones of the user
+func (s *SQLiteStore) CreateEmailVerification(userId int64, hash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	query := `INSERT INTO email_verifications (hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(query, hash, userId, time.Now().UTC(), expiresAt.UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyEmail uses up a verification token and marks the email address of
+// its user as verified, returning the id of the user
+func (s *SQLiteStore) VerifyEmail(hash string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	err = tx.QueryRow(`DELETE FROM email_verifications
+    WHERE hash = ? AND expires_at > ?
+    RETURNING user_id`, hash, time.Now().UTC()).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrVerificationInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userId); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified = true WHERE id = ?`, userId); err != nil {
+		return 0, err
+	}
+	return userId, tx.Commit()
+}
+
+// SetEmailVerified marks the email address of a user as verified without
+// a token
+func (s *SQLiteStore) SetEmailVerified(id int64) error {
+	res, err := s.db.Exec(`UPDATE users SET email_verified = true WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateTOTP stores a pending authenticator secret for a user, replacing
+// a pending one. It fails with ErrMFAEnabled once one is confirmed.
+func (s *SQLiteStore) CreateTOTP(userId int64, secret string) error {
+	query := `INSERT INTO totp_secrets (user_id, secret, created_at) VALUES (?, ?, ?)
+    ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at
+    WHERE totp_secrets.confirmed_at IS NULL`
+
+	res, err := s.db.Exec(query, userId, secret, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAEnabled
+	}
+	return nil
+}
+
+// GetTOTP returns the authenticator secret of a user
+func (s *SQLiteStore) GetTOTP(userId int64) (*TOTP, error) {
+	query := `SELECT user_id, secret, confirmed_at, last_step FROM totp_secrets WHERE user_id = ?`
+
+	totp := &TOTP{}
+	err := s.db.QueryRow(query, userId).Scan(&totp.UserId, &totp.Secret, &totp.ConfirmedAt, &totp.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// ConfirmTOTP enables the pending secret of a user, with the time step of
+// the code that confirmed it, and replaces their recovery codes
+func (s *SQLiteStore) ConfirmTOTP(userId int64, step int64, recoveryHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmedAt *time.Time
+	err = tx.QueryRow(`SELECT confirmed_at FROM totp_secrets WHERE user_id = ?`, userId).Scan(&confirmedAt)
+	if err != nil {
+		return err
+	}
+	if confirmedAt != nil {
+		return ErrMFAEnabled
+	}
+	query := `UPDATE totp_secrets SET confirmed_at = ?, last_step = ? WHERE user_id = ?`
+	if _, err := tx.Exec(query, time.Now().UTC(), step, userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (hash, user_id) VALUES (?, ?)`, hash, userId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of a time step was used. Codes of that
+// step or an earlier one fail with ErrMFAInvalid from then on.
+func (s *SQLiteStore) UseTOTPStep(userId int64, step int64) error {
+	query := `UPDATE totp_secrets SET last_step = ?
+    WHERE user_id = ? AND confirmed_at IS NOT NULL AND last_step < ?`
+
+	res, err := s.db.Exec(query, step, userId, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAInvalid
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code of a user
+func (s *SQLiteStore) UseRecoveryCode(userId int64, hash string) error {
+	query := `UPDATE recovery_codes SET used_at = ?
+    WHERE hash = ? AND user_id = ? AND used_at IS NULL`
+
+	res, err := s.db.Exec(query, time.Now().UTC(), hash, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAInvalid
+	}
+	return nil
+}
+
+// DeleteTOTP removes the authenticator secret and recovery codes of a user
+func (s *SQLiteStore) DeleteTOTP(userId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM totp_secrets WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// CreateWebAuthnChallenge stores the challenge of a new ceremony, and
+// forgets expired ones
+func (s *SQLiteStore) CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at <= ?`, now); err != nil {
+		return err
+	}
+	var userId *int64
+	if challenge.UserId != 0 {
+		userId = &challenge.UserId
+	}
+	query := `INSERT INTO webauthn_challenges (challenge, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)`
+
+	_, err := s.db.Exec(query, challenge.Challenge, userId, challenge.Purpose, challenge.ExpiresAt.UTC())
+	return err
+}
+
+// UseWebAuthnChallenge uses up a challenge of a ceremony with the given
+// purpose and returns it
+func (s *SQLiteStore) UseWebAuthnChallenge(challenge string, purpose string) (*WebAuthnChallenge, error) {
+	query := `DELETE FROM webauthn_challenges
+    WHERE challenge = ? AND purpose = ? AND expires_at > ?
+    RETURNING challenge, user_id, purpose, expires_at`
+
+	found := &WebAuthnChallenge{}
+	var userId sql.NullInt64
+	err := s.db.QueryRow(query, challenge, purpose, time.Now().UTC()).Scan(&found.Challenge, &userId, &found.Purpose, &found.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebAuthnChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	found.UserId = userId.Int64
+	return found, nil
+}
+
+// CreateWebAuthnCredential stores a new passkey and sets its creation
+// time
+func (s *SQLiteStore) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	createdAt := time.Now().UTC()
+	query := `INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count, attestation, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := s.db.Exec(query, credential.Id, credential.UserId, credential.Name, credential.PublicKey,
+		int64(credential.SignCount), credential.Attestation, createdAt)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrCredentialExists
+	}
+	if err != nil {
+		return err
+	}
+	credential.CreatedAt = createdAt
+	return nil
+}
+
+// GetWebAuthnCredential returns a passkey by its credential id
+func (s *SQLiteStore) GetWebAuthnCredential(id string) (*WebAuthnCredential, error) {
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials WHERE id = ?`
+
+	credential := &WebAuthnCredential{}
+	if err := scanWebAuthnCredential(s.db.QueryRow(query, id), credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// ListWebAuthnCredentials returns the passkeys of a user, newest first
+func (s *SQLiteStore) ListWebAuthnCredentials(userId int64) ([]*WebAuthnCredential, error) {
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials
+    WHERE user_id = ? ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+	for rows.Next() {
+		credential := &WebAuthnCredential{}
+		if err := scanWebAuthnCredential(rows, credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+// UseWebAuthnCredential records a login with a passkey and its new
+// signature counter. A counter that did not grow fails with ErrSignCount,
+// unless the authenticator has none and it stays 0.
+func (s *SQLiteStore) UseWebAuthnCredential(id string, signCount uint32) error {
+	query := `UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ?
+    WHERE id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))`
+
+	count := int64(signCount)
+	res, err := s.db.Exec(query, count, time.Now().UTC(), id, count, count)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSignCount
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user. It returns
+// sql.ErrNoRows when the user has no such passkey.
+func (s *SQLiteStore) DeleteWebAuthnCredential(userId int64, id string) error {
+	res, err := s.db.Exec(`DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateDeviceAuthorization stores a new device authorization, and
+// forgets expired ones. It returns ErrUserCodeTaken when its user code is
+// in use.
+func (s *SQLiteStore) CreateDeviceAuthorization(auth *DeviceAuthorization) error {
+	if _, err := s.db.Exec(`DELETE FROM device_authorizations WHERE expires_at <= ?`, time.Now().UTC()); err != nil {
+		return err
+	}
+	query := `INSERT INTO device_authorizations (device_code_hash, user_code, client_id, status, poll_interval, expires_at)
+    VALUES (?, ?, ?, ?, ?, ?)`
+
+	_, err := s.db.Exec(query, auth.DeviceCodeHash, auth.UserCode, auth.ClientId, auth.Status, auth.Interval, auth.ExpiresAt.UTC())
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserCodeTaken
+	}
+	return err
+}
+
+// GetDeviceAuthorization returns the unexpired device authorization of a
+// user code
+func (s *SQLiteStore) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	query := `SELECT ` + deviceAuthorizationColumns + ` FROM device_authorizations
+    WHERE user_code = ? AND expires_at > ?`
+
+	auth := &DeviceAuthorization{}
+	if err := scanDeviceAuthorization(s.db.QueryRow(query, userCode, time.Now().UTC()), auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// DecideDeviceAuthorization approves or denies the pending device
+// authorization of a user code on behalf of a user. It returns
+// sql.ErrNoRows when there is none, or it expired.
+func (s *SQLiteStore) DecideDeviceAuthorization(userCode string, userId int64, status string) error {
+	query := `UPDATE device_authorizations SET user_id = ?, status = ?
+    WHERE user_code = ? AND status = ? AND expires_at > ?`
+
+	res, err := s.db.Exec(query, userId, status, userCode, DevicePending, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PollDeviceAuthorization records a poll of a device by a client and
+// returns its authorization. It fails with ErrDeviceClient when the device
+// code belongs to another client and ErrDeviceExpired once it expired. A
+// poll before the interval has passed slows the device down and fails with
+// ErrSlowDown.
+func (s *SQLiteStore) PollDeviceAuthorization(deviceCodeHash string, clientId string, now time.Time) (*DeviceAuthorization, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + deviceAuthorizationColumns + ` FROM device_authorizations
+    WHERE device_code_hash = ?`
+
+	auth := &DeviceAuthorization{}
+	if err := scanDeviceAuthorization(tx.QueryRow(query, deviceCodeHash), auth); err != nil {
+		return nil, err
+	}
+	if auth.ClientId != clientId {
+		return nil, ErrDeviceClient
+	}
+	if !now.Before(auth.ExpiresAt) {
+		return nil, ErrDeviceExpired
+	}
+	if auth.tooSoon(now) {
+		query := `UPDATE device_authorizations SET poll_interval = poll_interval + ?, last_polled_at = ?
+    WHERE device_code_hash = ?`
+		if _, err := tx.Exec(query, deviceSlowDown, now.UTC(), deviceCodeHash); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrSlowDown
+	}
+
+	query = `UPDATE device_authorizations SET last_polled_at = ? WHERE device_code_hash = ?`
+	if _, err := tx.Exec(query, now.UTC(), deviceCodeHash); err != nil {
+		return nil, err
+	}
+	return auth, tx.Commit()
+}
+
+// ConsumeDeviceAuthorization removes a device authorization with the given
+// status once the device has been told the outcome. It returns
+// sql.ErrNoRows when another poll consumed it first.
+func (s *SQLiteStore) ConsumeDeviceAuthorization(deviceCodeHash string, status string) error {
+	query := `DELETE FROM device_authorizations WHERE device_code_hash = ? AND status = ?`
+
+	res, err := s.db.Exec(query, deviceCodeHash, status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
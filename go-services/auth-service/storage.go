@@ -2,21 +2,153 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrUserExists is returned when creating a user whose email is taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrInvalidInvite is returned for an unknown or used invite code
+	ErrInvalidInvite = errors.New("invalid invite code")
 )
 
 // User represents a user in the system
 type User struct {
+	Id       int64  `json:"id"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
+	// EmailVerified is set once the user follows the link emailed to them
+	EmailVerified bool `json:"email_verified"`
 }
 
 // Store represents a data store for the auth service
 type Store interface {
 	GetUser(string) (*User, error)
 	CreateUser(*User) error
+	CreateInvitedUser(user *User, code string) error
+	CreateInvite(code string) error
+	UpdatePassword(email string, password string) error
+	SetUserRole(id int64, role string) error
+	GetUserById(id int64) (*User, error)
+	CreateRefreshToken(userId int64, hash string, family string, expiresAt time.Time) error
+	RotateRefreshToken(hash string, newHash string, expiresAt time.Time) (int64, error)
+	RevokeRefreshToken(hash string, userId int64) error
+	RevokeToken(jti string, userId int64, expiresAt time.Time) error
+	RevokeUserTokens(userId int64, issuedBefore time.Time) error
+	IsTokenRevoked(jti string, userId int64, issuedAt time.Time) (bool, error)
+	ListRevocations(now time.Time) (*Revocations, error)
+	RotateSigningKeys(now time.Time, newKey func(activeFrom time.Time) (*StoredKey, error)) ([]*StoredKey, error)
+	CreateAPIKey(key *APIKey) error
+	ListAPIKeys(userId int64) ([]*APIKey, error)
+	RevokeAPIKey(userId int64, id int64) error
+	UseAPIKey(hash string) (*APIKey, *User, error)
+	RecordLoginFailure(email string, now time.Time, since time.Time) (int, error)
+	LockLogin(email string, until time.Time) error
+	GetLoginLock(email string) (*LoginLock, error)
+	ListLoginLocks(now time.Time) ([]*LoginLock, error)
+	ClearLoginFailures(email string) error
+	CreatePasswordReset(userId int64, hash string, expiresAt time.Time) error
+	GetPasswordReset(hash string) (int64, error)
+	ResetPassword(hash string, password string) error
+	CreateEmailVerification(userId int64, hash string, expiresAt time.Time) error
+	VerifyEmail(hash string) (int64, error)
+	SetEmailVerified(id int64) error
+	CreateTOTP(userId int64, secret string) error
+	GetTOTP(userId int64) (*TOTP, error)
+	ConfirmTOTP(userId int64, step int64, recoveryHashes []string) error
+	UseTOTPStep(userId int64, step int64) error
+	UseRecoveryCode(userId int64, hash string) error
+	DeleteTOTP(userId int64) error
+	CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error
+	UseWebAuthnChallenge(challenge string, purpose string) (*WebAuthnChallenge, error)
+	CreateWebAuthnCredential(credential *WebAuthnCredential) error
+	GetWebAuthnCredential(id string) (*WebAuthnCredential, error)
+	ListWebAuthnCredentials(userId int64) ([]*WebAuthnCredential, error)
+	UseWebAuthnCredential(id string, signCount uint32) error
+	DeleteWebAuthnCredential(userId int64, id string) error
+	CreateDeviceAuthorization(auth *DeviceAuthorization) error
+	GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error)
+	DecideDeviceAuthorization(userCode string, userId int64, status string) error
+	PollDeviceAuthorization(deviceCodeHash string, clientId string, now time.Time) (*DeviceAuthorization, error)
+	ConsumeDeviceAuthorization(deviceCodeHash string, status string) error
+}
+
+// NewStore creates the Store chosen by STORE_BACKEND, which is postgres,
+// sqlite or memory. Postgres is the default.
+func NewStore() (Store, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "postgres":
+		return NewPostgersStore()
+	case "sqlite":
+		return NewSQLiteStore(sqlitePath())
+	case "memory":
+		return NewMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+// seedStore adds the configured invite codes and admins, and with
+// SEED_TEST_USER=1 a default user for testing, to a new or existing store
+func seedStore(s Store) error {
+	// Invite codes are configured as a comma separated list
+	for _, code := range strings.Split(os.Getenv("INVITE_CODES"), ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			if err := s.CreateInvite(code); err != nil {
+				return err
+			}
+		}
+	}
+	// Admins are configured as a comma separated list of emails, so the
+	// first admin does not need another one to promote them. Only verified
+	// addresses are promoted, since anyone can register an unverified one.
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			user, err := s.GetUser(email)
+			if errors.Is(err, sql.ErrNoRows) {
+				log.Printf("not promoting %s to admin: no such user", email)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !user.EmailVerified {
+				log.Printf("not promoting %s to admin: email address is not verified", email)
+				continue
+			}
+			if err := s.SetUserRole(user.Id, RoleAdmin); err != nil {
+				return err
+			}
+		}
+	}
+	// Create a default user for local testing if asked to. Its address is
+	// verified so it can upload, which is why it is never created by default.
+	if os.Getenv("SEED_TEST_USER") != "1" {
+		return nil
+	}
+	user, err := s.GetUser("bob@bob.bob")
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := s.CreateUser(&User{Email: "bob@bob.bob", Password: "password"}); err != nil {
+			return err
+		}
+		user, err = s.GetUser("bob@bob.bob")
+	}
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	return s.SetEmailVerified(user.Id)
 }
 
 // PostgersStore represents a PostgreSQL data store
@@ -24,10 +156,14 @@ type PostgersStore struct {
 	db *sql.DB
 }
 
+// openPostgres opens the database named by POSTGRES_URL
+func openPostgres() (*sql.DB, error) {
+	return sql.Open("postgres", os.Getenv("POSTGRES_URL"))
+}
+
 // NewPostgersStore creates a new PostgerSQL Store instance
 func NewPostgersStore() (*PostgersStore, error) {
-	conStr := os.Getenv("POSTGRES_URL")
-	db, err := sql.Open("postgres", conStr)
+	db, err := openPostgres()
 	if err != nil {
 		return nil, err
 	}
@@ -42,46 +178,1016 @@ func NewPostgersStore() (*PostgersStore, error) {
 	return store, nil
 }
 
-// Init initializes the PostgersStore instance
+// Init initializes the PostgersStore instance. The schema is migrated to
+// the latest version, which replicas starting together do one at a time.
 func (s *PostgersStore) Init() error {
-	err := s.CreateUserTable()
+	migrator, err := NewMigrator(s.db)
 	if err != nil {
 		return err
 	}
-	// Create a default user if it does not exist for testing
-	if _, err := s.GetUser(""); err == nil {
-		return s.CreateUser(&User{Email: "bob@bob.bob", Password: "password"})
+	if err := migrator.Up(migrator.Latest(), log.Writer()); err != nil {
+		return err
 	}
-
-	return nil
+	return seedStore(s)
 }
 
-// CreateUserTable creates the user table in the database
-func (s *PostgersStore) CreateUserTable() error {
-	query := `CREATE TABLE IF NOT EXISTS users(
-    id SERIAL PRIMARY KEY,
-    email TEXT NOT NULL UNIQUE,
-    password TEXT NOT NULL)`
+// CreateInvite adds an invite code unless it already exists
+func (s *PostgersStore) CreateInvite(code string) error {
+	query := `INSERT INTO invites (code) VALUES ($1) ON CONFLICT (code) DO NOTHING`
 
-	_, err := s.db.Exec(query)
+	_, err := s.db.Exec(query, code)
 	return err
 }
 
-// CreateUser creates a new user in the database
+// CreateUser creates a new user in the database, storing a hash of the
+// password
 func (s *PostgersStore) CreateUser(user *User) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
 	query := `INSERT INTO users (email, password) VALUES ($1, $2)`
 
-	_, err := s.db.Exec(query, user.Email, user.Password)
+	_, err = s.db.Exec(query, user.Email, hash)
+	return userError(err)
+}
+
+// CreateInvitedUser creates a new user and uses up an invite code. Neither
+// happens if the other fails.
+func (s *PostgersStore) CreateInvitedUser(user *User, code string) error {
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE invites SET used_by = $2, used_at = now()
+    WHERE code = $1 AND used_by IS NULL`, code, user.Email)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidInvite
+	}
+
+	query := `INSERT INTO users (email, password) VALUES ($1, $2)`
+	if _, err := tx.Exec(query, user.Email, hash); err != nil {
+		return userError(err)
+	}
+	return tx.Commit()
+}
+
+// GetUserById retrieves a user from the database by id
+func (s *PostgersStore) GetUserById(id int64) (*User, error) {
+	query := `SELECT id, email, password, role, email_verified FROM users WHERE id = $1`
+
+	row := s.db.QueryRow(query, id)
+	user := &User{}
+	if err := row.Scan(&user.Id, &user.Email, &user.Password, &user.Role, &user.EmailVerified); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// CreateRefreshToken stores the hash of a new refresh token
+func (s *PostgersStore) CreateRefreshToken(userId int64, hash string, family string, expiresAt time.Time) error {
+	query := `INSERT INTO refresh_tokens (hash, family, user_id, expires_at) VALUES ($1, $2, $3, $4)`
+
+	_, err := s.db.Exec(query, hash, family, userId, expiresAt)
+	return err
+}
+
+// RotateRefreshToken marks a refresh token as used and stores its
+// replacement in the same family, returning the id of the user it belongs
+// to. A token that was already used revokes its whole family, since
+// either it or its replacement has been stolen.
+func (s *PostgersStore) RotateRefreshToken(hash string, newHash string, expiresAt time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		family            string
+		userId            int64
+		expires           time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	row := tx.QueryRow(`SELECT family, user_id, expires_at, used_at, revoked_at
+    FROM refresh_tokens WHERE hash = $1 FOR UPDATE`, hash)
+	err = row.Scan(&family, &userId, &expires, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if revokedAt.Valid || time.Now().After(expires) {
+		return userId, ErrTokenInvalid
+	}
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = now()
+    WHERE family = $1 AND revoked_at IS NULL`, family); err != nil {
+			return userId, err
+		}
+		if err := tx.Commit(); err != nil {
+			return userId, err
+		}
+		return userId, ErrTokenReused
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = now() WHERE hash = $1`, hash); err != nil {
+		return userId, err
+	}
+	query := `INSERT INTO refresh_tokens (hash, family, user_id, expires_at) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, newHash, family, userId, expiresAt); err != nil {
+		return userId, err
+	}
+	return userId, tx.Commit()
+}
+
+// RevokeRefreshToken revokes the family of a user's refresh token
+func (s *PostgersStore) RevokeRefreshToken(hash string, userId int64) error {
+	query := `UPDATE refresh_tokens SET revoked_at = now()
+    WHERE family = (SELECT family FROM refresh_tokens WHERE hash = $1 AND user_id = $2)
+    AND revoked_at IS NULL`
+
+	_, err := s.db.Exec(query, hash, userId)
+	return err
+}
+
+// RevokeToken revokes a single access token until it expires
+func (s *PostgersStore) RevokeToken(jti string, userId int64, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES ($1, $2, $3)
+    ON CONFLICT (jti) DO NOTHING`
+
+	_, err := s.db.Exec(query, jti, userId, expiresAt)
+	return err
+}
+
+// RevokeUserTokens revokes the access tokens of a user issued at or before
+// issuedBefore, and all of their refresh tokens
+func (s *PostgersStore) RevokeUserTokens(userId int64, issuedBefore time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Postgres rounds to microseconds, which could carry the watermark into
+	// the next second and revoke the tokens issued in it
+	if _, err := tx.Exec(`INSERT INTO token_watermarks (user_id, issued_before) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE
+    SET issued_before = GREATEST(token_watermarks.issued_before, EXCLUDED.issued_before)`,
+		userId, issuedBefore.Truncate(time.Microsecond)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = now()
+    WHERE user_id = $1 AND revoked_at IS NULL`, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsTokenRevoked reports whether an access token was revoked by id or by
+// its user's watermark
+func (s *PostgersStore) IsTokenRevoked(jti string, userId int64, issuedAt time.Time) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+    OR EXISTS (SELECT 1 FROM token_watermarks WHERE user_id = $2 AND issued_before >= $3)`
+
+	var revoked bool
+	err := s.db.QueryRow(query, jti, userId, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+// ListRevocations drops the revocations of tokens that have expired and
+// returns the others
+func (s *PostgersStore) ListRevocations(now time.Time) (*Revocations, error) {
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < $1`, now); err != nil {
+		return nil, err
+	}
+	// Tokens issued before a watermark have all expired once it is older
+	// than their lifetime
+	if _, err := s.db.Exec(`DELETE FROM token_watermarks WHERE issued_before < $1`, now.Add(-tokenLifetime)); err != nil {
+		return nil, err
+	}
+
+	revocations := &Revocations{Tokens: []RevokedToken{}, Users: []UserWatermark{}}
+	rows, err := s.db.Query(`SELECT jti, expires_at FROM revoked_tokens`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token := RevokedToken{}
+		if err := rows.Scan(&token.Id, &token.ExpiresAt); err != nil {
+			return nil, err
+		}
+		revocations.Tokens = append(revocations.Tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`SELECT user_id, issued_before FROM token_watermarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId int64
+		watermark := UserWatermark{}
+		if err := rows.Scan(&userId, &watermark.IssuedBefore); err != nil {
+			return nil, err
+		}
+		watermark.UserId = strconv.FormatInt(userId, 10)
+		revocations.Users = append(revocations.Users, watermark)
+	}
+	return revocations, rows.Err()
+}
+
+// signingKeysLock is the advisory lock that serializes key rotation
+// between instances
+const signingKeysLock = 0x6a776b73
+
+// nextKeyActivation returns when the next signing key should become
+// active, given the keys ordered by activation, or the zero time if none
+// is due yet. The first key signs right away. Later ones are published
+// ahead of time, and later than planned if no instance was running.
+func nextKeyActivation(keys []*StoredKey, now time.Time) time.Time {
+	if len(keys) == 0 {
+		return now
+	}
+	latest := keys[len(keys)-1]
+	if now.Before(latest.ActiveFrom.Add(keyRotationInterval - keyPublishLead)) {
+		return time.Time{}
+	}
+	activeFrom := latest.ActiveFrom.Add(keyRotationInterval)
+	if lead := now.Add(keyPublishLead); activeFrom.Before(lead) {
+		activeFrom = lead
+	}
+	return activeFrom
+}
+
+// expiredKeys returns how many of the oldest keys can be deleted. A key
+// stops signing when the next one becomes active, and is kept until the
+// tokens it signed have expired.
+func expiredKeys(keys []*StoredKey, now time.Time) int {
+	n := 0
+	for n+1 < len(keys) && now.After(keys[n+1].ActiveFrom.Add(tokenLifetime+keyPublishLead)) {
+		n++
+	}
+	return n
+}
+
+// RotateSigningKeys creates the next signing key once the current one is
+// due to be replaced, deletes keys whose tokens have all expired, and
+// returns the remaining keys ordered by activation
+func (s *PostgersStore) RotateSigningKeys(now time.Time, newKey func(activeFrom time.Time) (*StoredKey, error)) ([]*StoredKey, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, signingKeysLock); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT kid, sealed, active_from, created_at FROM signing_keys ORDER BY active_from`)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*StoredKey{}
+	for rows.Next() {
+		key := &StoredKey{}
+		if err := rows.Scan(&key.Id, &key.Sealed, &key.ActiveFrom, &key.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if activeFrom := nextKeyActivation(keys, now); !activeFrom.IsZero() {
+		key, err := newKey(activeFrom)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO signing_keys (kid, sealed, active_from, created_at) VALUES ($1, $2, $3, $4)`,
+			key.Id, key.Sealed, key.ActiveFrom, key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	expired := expiredKeys(keys, now)
+	for _, key := range keys[:expired] {
+		if _, err := tx.Exec(`DELETE FROM signing_keys WHERE kid = $1`, key.Id); err != nil {
+			return nil, err
+		}
+	}
+	keys = keys[expired:]
+	return keys, tx.Commit()
+}
+
+// CreateAPIKey stores a new API key and sets its id and creation time
+func (s *PostgersStore) CreateAPIKey(key *APIKey) error {
+	query := `INSERT INTO api_keys (user_id, name, prefix, hash, scopes, expires_at)
+    VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+
+	row := s.db.QueryRow(query, key.UserId, key.Name, key.Prefix, key.Hash, pq.Array(key.Scopes), key.ExpiresAt)
+	return row.Scan(&key.Id, &key.CreatedAt)
+}
+
+// ListAPIKeys returns the keys of a user that are neither revoked nor
+// expired, newest first
+func (s *PostgersStore) ListAPIKeys(userId int64) ([]*APIKey, error) {
+	query := `SELECT id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at
+    FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL
+    AND (expires_at IS NULL OR expires_at > now())
+    ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := &APIKey{}
+		if err := rows.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+			&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key of a user. It returns sql.ErrNoRows when the
+// user has no such key.
+func (s *PostgersStore) RevokeAPIKey(userId int64, id int64) error {
+	query := `UPDATE api_keys SET revoked_at = now()
+    WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	res, err := s.db.Exec(query, id, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseAPIKey looks up a valid key by its hash, records that it was used,
+// and returns it with the user it belongs to
+func (s *PostgersStore) UseAPIKey(hash string) (*APIKey, *User, error) {
+	query := `UPDATE api_keys k SET last_used_at = now()
+    FROM users u
+    WHERE k.hash = $1 AND k.user_id = u.id AND k.revoked_at IS NULL
+    AND (k.expires_at IS NULL OR k.expires_at > now())
+    RETURNING k.id, k.name, k.prefix, k.scopes, k.created_at, k.expires_at, k.last_used_at,
+    u.id, u.email, u.role, u.email_verified`
+
+	key, user := &APIKey{}, &User{}
+	err := s.db.QueryRow(query, hash).Scan(&key.Id, &key.Name, &key.Prefix, pq.Array(&key.Scopes),
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt, &user.Id, &user.Email, &user.Role, &user.EmailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key.UserId = user.Id
+	return key, user, nil
+}
+
+// RecordLoginFailure counts a failed login and returns the number of
+// failures in a row. Failures before since are forgotten.
+func (s *PostgersStore) RecordLoginFailure(email string, now time.Time, since time.Time) (int, error) {
+	query := `INSERT INTO login_failures (email, failures, last_failure_at) VALUES ($1, 1, $2)
+    ON CONFLICT (email) DO UPDATE
+    SET failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+    last_failure_at = EXCLUDED.last_failure_at
+    RETURNING failures`
+
+	var failures int
+	err := s.db.QueryRow(query, email, now, since).Scan(&failures)
+	return failures, err
+}
+
+// LockLogin refuses logins to an account until the given time
+func (s *PostgersStore) LockLogin(email string, until time.Time) error {
+	query := `UPDATE login_failures SET locked_until = GREATEST(locked_until, $2) WHERE email = $1`
+
+	_, err := s.db.Exec(query, email, until)
+	return err
+}
+
+// GetLoginLock returns the failed logins of an account
+func (s *PostgersStore) GetLoginLock(email string) (*LoginLock, error) {
+	query := `SELECT email, failures, last_failure_at, locked_until FROM login_failures WHERE email = $1`
+
+	lock := &LoginLock{}
+	err := s.db.QueryRow(query, email).Scan(&lock.Email, &lock.Failures, &lock.LastFailureAt, &lock.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// ListLoginLocks returns the accounts locked at now, and drops failures
+// that have been forgotten
+func (s *PostgersStore) ListLoginLocks(now time.Time) ([]*LoginLock, error) {
+	if _, err := s.db.Exec(`DELETE FROM login_failures WHERE locked_until < $1 AND last_failure_at < $2`,
+		now, now.Add(-loginFailureWindow)); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT email, failures, last_failure_at, locked_until FROM login_failures
+    WHERE locked_until > $1 ORDER BY locked_until DESC`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locks := []*LoginLock{}
+	for rows.Next() {
+		lock := &LoginLock{}
+		if err := rows.Scan(&lock.Email, &lock.Failures, &lock.LastFailureAt, &lock.LockedUntil); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, rows.Err()
+}
+
+// ClearLoginFailures unlocks an account and forgets its failed logins
+func (s *PostgersStore) ClearLoginFailures(email string) error {
+	_, err := s.db.Exec(`DELETE FROM login_failures WHERE email = $1`, email)
+	return err
+}
+
+// CreatePasswordReset stores the hash of a new reset token, replacing the
+// unused ones of the user
+func (s *PostgersStore) CreatePasswordReset(userId int64, hash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL`, userId); err != nil {
+		return err
+	}
+	query := `INSERT INTO password_resets (hash, user_id, expires_at) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, hash, userId, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordReset returns the user of a reset token that can still be
+// used
+func (s *PostgersStore) GetPasswordReset(hash string) (int64, error) {
+	query := `SELECT user_id FROM password_resets
+    WHERE hash = $1 AND used_at IS NULL AND expires_at > now()`
+
+	var userId int64
+	err := s.db.QueryRow(query, hash).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetInvalid
+	}
+	return userId, err
+}
+
+// ResetPassword uses up a reset token and replaces the password of its
+// user with a hash of password
+func (s *PostgersStore) ResetPassword(hash string, password string) error {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	err = tx.QueryRow(`UPDATE password_resets SET used_at = now()
+    WHERE hash = $1 AND used_at IS NULL AND expires_at > now()
+    RETURNING user_id`, hash).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrResetInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password = $2 WHERE id = $1`, userId, passwordHash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEmailVerification stores the hash of a new verification token,
+// replacing the other ones of the user
+func (s *PostgersStore) CreateEmailVerification(userId int64, hash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+	query := `INSERT INTO email_verifications (hash, user_id, expires_at) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, hash, userId, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyEmail uses up a verification token and marks the email address of
+// its user as verified, returning the id of the user
+func (s *PostgersStore) VerifyEmail(hash string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	err = tx.QueryRow(`DELETE FROM email_verifications
+    WHERE hash = $1 AND expires_at > now()
+    RETURNING user_id`, hash).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrVerificationInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = $1`, userId); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified = true WHERE id = $1`, userId); err != nil {
+		return 0, err
+	}
+	return userId, tx.Commit()
+}
+
+// SetEmailVerified marks the email address of a user as verified without
+// a token
+func (s *PostgersStore) SetEmailVerified(id int64) error {
+	res, err := s.db.Exec(`UPDATE users SET email_verified = true WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateTOTP stores a pending authenticator secret for a user, replacing
+// a pending one. It fails with ErrMFAEnabled once one is confirmed.
+func (s *PostgersStore) CreateTOTP(userId int64, secret string) error {
+	query := `INSERT INTO totp_secrets (user_id, secret) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = now()
+    WHERE totp_secrets.confirmed_at IS NULL`
+
+	res, err := s.db.Exec(query, userId, secret)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAEnabled
+	}
+	return nil
+}
+
+// GetTOTP returns the authenticator secret of a user
+func (s *PostgersStore) GetTOTP(userId int64) (*TOTP, error) {
+	query := `SELECT user_id, secret, confirmed_at, last_step FROM totp_secrets WHERE user_id = $1`
+
+	totp := &TOTP{}
+	err := s.db.QueryRow(query, userId).Scan(&totp.UserId, &totp.Secret, &totp.ConfirmedAt, &totp.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// ConfirmTOTP enables the pending secret of a user, with the time step of
+// the code that confirmed it, and replaces their recovery codes
+func (s *PostgersStore) ConfirmTOTP(userId int64, step int64, recoveryHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmedAt *time.Time
+	err = tx.QueryRow(`SELECT confirmed_at FROM totp_secrets WHERE user_id = $1 FOR UPDATE`, userId).Scan(&confirmedAt)
+	if err != nil {
+		return err
+	}
+	if confirmedAt != nil {
+		return ErrMFAEnabled
+	}
+	query := `UPDATE totp_secrets SET confirmed_at = now(), last_step = $2 WHERE user_id = $1`
+	if _, err := tx.Exec(query, userId, step); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, hash, userId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of a time step was used. Codes of that
+// step or an earlier one fail with ErrMFAInvalid from then on.
+func (s *PostgersStore) UseTOTPStep(userId int64, step int64) error {
+	query := `UPDATE totp_secrets SET last_step = $2
+    WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_step < $2`
+
+	res, err := s.db.Exec(query, userId, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAInvalid
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code of a user
+func (s *PostgersStore) UseRecoveryCode(userId int64, hash string) error {
+	query := `UPDATE recovery_codes SET used_at = now()
+    WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	res, err := s.db.Exec(query, hash, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAInvalid
+	}
+	return nil
+}
+
+// DeleteTOTP removes the authenticator secret and recovery codes of a user
+func (s *PostgersStore) DeleteTOTP(userId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM totp_secrets WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// CreateWebAuthnChallenge stores the challenge of a new ceremony, and
+// forgets expired ones
+func (s *PostgersStore) CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error {
+	if _, err := s.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at <= now()`); err != nil {
+		return err
+	}
+	var userId *int64
+	if challenge.UserId != 0 {
+		userId = &challenge.UserId
+	}
+	query := `INSERT INTO webauthn_challenges (challenge, user_id, purpose, expires_at) VALUES ($1, $2, $3, $4)`
+
+	_, err := s.db.Exec(query, challenge.Challenge, userId, challenge.Purpose, challenge.ExpiresAt)
+	return err
+}
+
+// UseWebAuthnChallenge uses up a challenge of a ceremony with the given
+// purpose and returns it
+func (s *PostgersStore) UseWebAuthnChallenge(challenge string, purpose string) (*WebAuthnChallenge, error) {
+	query := `DELETE FROM webauthn_challenges
+    WHERE challenge = $1 AND purpose = $2 AND expires_at > now()
+    RETURNING challenge, user_id, purpose, expires_at`
+
+	found := &WebAuthnChallenge{}
+	var userId sql.NullInt64
+	err := s.db.QueryRow(query, challenge, purpose).Scan(&found.Challenge, &userId, &found.Purpose, &found.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebAuthnChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	found.UserId = userId.Int64
+	return found, nil
+}
+
+// CreateWebAuthnCredential stores a new passkey and sets its creation
+// time
+func (s *PostgersStore) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	query := `INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count, attestation)
+    VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`
+
+	err := s.db.QueryRow(query, credential.Id, credential.UserId, credential.Name, credential.PublicKey,
+		int64(credential.SignCount), credential.Attestation).Scan(&credential.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrCredentialExists
+	}
+	return err
+}
+
+// scanWebAuthnCredential scans the columns of webauthnCredentialColumns
+func scanWebAuthnCredential(row interface{ Scan(...any) error }, credential *WebAuthnCredential) error {
+	var signCount int64
+	err := row.Scan(&credential.Id, &credential.UserId, &credential.Name, &credential.PublicKey, &signCount,
+		&credential.Attestation, &credential.CreatedAt, &credential.LastUsedAt)
+	credential.SignCount = uint32(signCount)
+	return err
+}
+
+// webauthnCredentialColumns are the columns scanWebAuthnCredential reads
+const webauthnCredentialColumns = `id, user_id, name, public_key, sign_count, attestation, created_at, last_used_at`
+
+// GetWebAuthnCredential returns a passkey by its credential id
+func (s *PostgersStore) GetWebAuthnCredential(id string) (*WebAuthnCredential, error) {
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials WHERE id = $1`
+
+	credential := &WebAuthnCredential{}
+	if err := scanWebAuthnCredential(s.db.QueryRow(query, id), credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// ListWebAuthnCredentials returns the passkeys of a user, newest first
+func (s *PostgersStore) ListWebAuthnCredentials(userId int64) ([]*WebAuthnCredential, error) {
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials
+    WHERE user_id = $1 ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+	for rows.Next() {
+		credential := &WebAuthnCredential{}
+		if err := scanWebAuthnCredential(rows, credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+// UseWebAuthnCredential records a login with a passkey and its new
+// signature counter. A counter that did not grow fails with ErrSignCount,
+// unless the authenticator has none and it stays 0.
+func (s *PostgersStore) UseWebAuthnCredential(id string, signCount uint32) error {
+	query := `UPDATE webauthn_credentials SET sign_count = $2, last_used_at = now()
+    WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))`
+
+	res, err := s.db.Exec(query, id, int64(signCount))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSignCount
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user. It returns
+// sql.ErrNoRows when the user has no such passkey.
+func (s *PostgersStore) DeleteWebAuthnCredential(userId int64, id string) error {
+	res, err := s.db.Exec(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateDeviceAuthorization stores a new device authorization, and
+// forgets expired ones. It returns ErrUserCodeTaken when its user code is
+// in use.
+func (s *PostgersStore) CreateDeviceAuthorization(auth *DeviceAuthorization) error {
+	if _, err := s.db.Exec(`DELETE FROM device_authorizations WHERE expires_at <= now()`); err != nil {
+		return err
+	}
+	query := `INSERT INTO device_authorizations (device_code_hash, user_code, client_id, status, poll_interval, expires_at)
+    VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := s.db.Exec(query, auth.DeviceCodeHash, auth.UserCode, auth.ClientId, auth.Status, auth.Interval, auth.ExpiresAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrUserCodeTaken
+	}
+	return err
+}
+
+// scanDeviceAuthorization scans the columns of deviceAuthorizationColumns
+func scanDeviceAuthorization(row interface{ Scan(...any) error }, auth *DeviceAuthorization) error {
+	var userId sql.NullInt64
+	err := row.Scan(&auth.DeviceCodeHash, &auth.UserCode, &auth.ClientId, &userId, &auth.Status,
+		&auth.Interval, &auth.LastPolledAt, &auth.ExpiresAt)
+	auth.UserId = userId.Int64
+	return err
+}
+
+// deviceAuthorizationColumns are the columns scanDeviceAuthorization reads
+const deviceAuthorizationColumns = `device_code_hash, user_code, client_id, user_id, status, poll_interval,
+    last_polled_at, expires_at`
+
+// GetDeviceAuthorization returns the unexpired device authorization of a
+// user code
+func (s *PostgersStore) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	query := `SELECT ` + deviceAuthorizationColumns + ` FROM device_authorizations
+    WHERE user_code = $1 AND expires_at > now()`
+
+	auth := &DeviceAuthorization{}
+	if err := scanDeviceAuthorization(s.db.QueryRow(query, userCode), auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// DecideDeviceAuthorization approves or denies the pending device
+// authorization of a user code on behalf of a user. It returns
+// sql.ErrNoRows when there is none, or it expired.
+func (s *PostgersStore) DecideDeviceAuthorization(userCode string, userId int64, status string) error {
+	query := `UPDATE device_authorizations SET user_id = $2, status = $3
+    WHERE user_code = $1 AND status = $4 AND expires_at > now()`
+
+	res, err := s.db.Exec(query, userCode, userId, status, DevicePending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PollDeviceAuthorization records a poll of a device by a client and
+// returns its authorization. It fails with ErrDeviceClient when the device
+// code belongs to another client and ErrDeviceExpired once it expired. A
+// poll before the interval has passed slows the device down and fails with
+// ErrSlowDown.
+func (s *PostgersStore) PollDeviceAuthorization(deviceCodeHash string, clientId string, now time.Time) (*DeviceAuthorization, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + deviceAuthorizationColumns + ` FROM device_authorizations
+    WHERE device_code_hash = $1 FOR UPDATE`
+
+	auth := &DeviceAuthorization{}
+	if err := scanDeviceAuthorization(tx.QueryRow(query, deviceCodeHash), auth); err != nil {
+		return nil, err
+	}
+	if auth.ClientId != clientId {
+		return nil, ErrDeviceClient
+	}
+	if !now.Before(auth.ExpiresAt) {
+		return nil, ErrDeviceExpired
+	}
+	if auth.tooSoon(now) {
+		query := `UPDATE device_authorizations SET poll_interval = poll_interval + $2, last_polled_at = $3
+    WHERE device_code_hash = $1`
+		if _, err := tx.Exec(query, deviceCodeHash, deviceSlowDown, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrSlowDown
+	}
+
+	query = `UPDATE device_authorizations SET last_polled_at = $2 WHERE device_code_hash = $1`
+	if _, err := tx.Exec(query, deviceCodeHash, now); err != nil {
+		return nil, err
+	}
+	return auth, tx.Commit()
+}
+
+// ConsumeDeviceAuthorization removes a device authorization with the given
+// status once the device has been told the outcome. It returns
+// sql.ErrNoRows when another poll consumed it first.
+func (s *PostgersStore) ConsumeDeviceAuthorization(deviceCodeHash string, status string) error {
+	query := `DELETE FROM device_authorizations WHERE device_code_hash = $1 AND status = $2`
+
+	res, err := s.db.Exec(query, deviceCodeHash, status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// userError maps a unique violation on the users table to ErrUserExists
+func userError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrUserExists
+	}
+	return err
+}
+
+// SetUserRole changes the role of a user
+func (s *PostgersStore) SetUserRole(id int64, role string) error {
+	res, err := s.db.Exec(`UPDATE users SET role = $2 WHERE id = $1`, id, role)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password of a user with a hash of password
+func (s *PostgersStore) UpdatePassword(email string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET password = $2 WHERE email = $1`
+
+	_, err = s.db.Exec(query, email, hash)
 	return err
 }
 
-// GetUser retrieves a user from the database
+// GetUser retrieves a user from the database. Password holds the stored
+// hash.
 func (s *PostgersStore) GetUser(email string) (*User, error) {
-	query := `SELECT email, password FROM users WHERE email = $1`
+	query := `SELECT id, email, password, role, email_verified FROM users WHERE email = $1`
 
 	row := s.db.QueryRow(query, email)
 	user := &User{}
-	if err := row.Scan(&user.Email, &user.Password); err != nil {
+	if err := row.Scan(&user.Id, &user.Email, &user.Password, &user.Role, &user.EmailVerified); err != nil {
 		return nil, err
 	}
 
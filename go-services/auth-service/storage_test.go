@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeedStoreAdmins(t *testing.T) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"verified@example.com", "unverified@example.com"} {
+		if err := store.CreateUser(&User{Email: email, Password: "correct horse battery"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verified, err := store.GetUser("verified@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetEmailVerified(verified.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ADMIN_EMAILS", "Verified@example.com, unverified@example.com,missing@example.com")
+	if err := seedStore(store); err != nil {
+		t.Fatal(err)
+	}
+	for email, want := range map[string]bool{"verified@example.com": true, "unverified@example.com": false} {
+		user, err := store.GetUser(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if admin := user.Role == RoleAdmin; admin != want {
+			t.Errorf("%s has role %q, want admin %v", email, user.Role, want)
+		}
+	}
+}
+
+func TestSeedStoreTestUser(t *testing.T) {
+	t.Setenv("SEED_TEST_USER", "")
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUser("bob@bob.bob"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("GetUser without SEED_TEST_USER returned %v, want sql.ErrNoRows", err)
+	}
+
+	t.Setenv("SEED_TEST_USER", "1")
+	if err := seedStore(store); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("bob@bob.bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Error("the test user's email address is not verified")
+	}
+	// Seeding again keeps the existing user
+	if err := seedStore(store); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmailVerificationMigration(t *testing.T) {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := NewSQLiteMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(2, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// Users created before addresses were verified, including the seeded
+	// test user with its well known password
+	for _, email := range []string{"alice@example.com", "bob@bob.bob"} {
+		if _, err := db.Exec("INSERT INTO users (email, password) VALUES (?, 'password')", email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := migrator.Up(3, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for email, want := range map[string]bool{"alice@example.com": true, "bob@bob.bob": false} {
+		var verified bool
+		if err := db.QueryRow("SELECT email_verified FROM users WHERE email = ?", email).Scan(&verified); err != nil {
+			t.Fatal(err)
+		}
+		if verified != want {
+			t.Errorf("%s has email_verified %v after migrating, want %v", email, verified, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// refreshTokenLifetime is how long a refresh token can be used. Every
+// refresh issues a new one, so a session lasts as long as it is used at
+// least this often.
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+var (
+	// ErrTokenInvalid is returned for an unknown, expired or revoked
+	// refresh token
+	ErrTokenInvalid = errors.New("invalid refresh token")
+	// ErrTokenReused is returned when a refresh token that was already
+	// rotated is presented again. Its whole family is revoked.
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// TokenResponse is returned by login and refresh
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // access token lifetime in seconds
+}
+
+// newRefreshToken returns a random opaque refresh token
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken returns the hash refresh tokens are stored as. The
+// tokens are random, so a fast hash is enough.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access token and a refresh token in a new family
+// for a user who just logged in
+func (s *AuthServer) issueTokens(user *User) (*TokenResponse, error) {
+	family, err := newTokenId()
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().UTC().Add(refreshTokenLifetime)
+	if err := s.store.CreateRefreshToken(user.Id, hashRefreshToken(refresh), family, expires); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %v", err)
+	}
+
+	token, err := CreateJWT(user, s.keys)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(tokenLifetime.Seconds()),
+	}, nil
+}
+
+// handleRefresh exchanges a refresh token for a new access token and a new
+// refresh token. The old refresh token can not be used again.
+func (s *AuthServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		WriteJSON(w, http.StatusBadRequest, "missing refresh token")
+		return
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	expires := time.Now().UTC().Add(refreshTokenLifetime)
+	userId, err := s.store.RotateRefreshToken(hashRefreshToken(req.RefreshToken), hashRefreshToken(refresh), expires)
+	if errors.Is(err, ErrTokenReused) {
+		log.Printf("Refresh token reused for user %d, revoked its family", userId)
+		WriteJSON(w, http.StatusUnauthorized, ErrTokenInvalid.Error())
+		return
+	}
+	if errors.Is(err, ErrTokenInvalid) {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, ErrTokenInvalid.Error())
+		return
+	}
+	token, err := CreateJWT(user, s.keys)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, &TokenResponse{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(tokenLifetime.Seconds()),
+	})
+}
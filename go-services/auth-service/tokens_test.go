@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenReuse(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "refresh@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("refresh@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewAuthServer("", store, keys, mailer)
+
+	// refresh exchanges a refresh token and returns the status and the
+	// new tokens
+	refresh := func(token string) (int, *TokenResponse) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"refreshToken": token})
+		w := httptest.NewRecorder()
+		server.handleRefresh(w, httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(string(body))))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		tokens := &TokenResponse{}
+		if err := json.NewDecoder(w.Body).Decode(tokens); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyJWT(tokens.Token, keys); err != nil {
+			t.Fatalf("refresh returned an invalid access token: %v", err)
+		}
+		return w.Code, tokens
+	}
+
+	login, err := server.issueTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := server.issueTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, first := refresh(login.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("first refresh: got %d, want 200", code)
+	}
+	code, second := refresh(first.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh with the rotated token: got %d, want 200", code)
+	}
+	if second.RefreshToken == first.RefreshToken || first.RefreshToken == login.RefreshToken {
+		t.Error("refresh returned the same refresh token")
+	}
+
+	// Presenting a rotated token again means it was stolen. It fails, and
+	// so does the latest token of its family, while other sessions of the
+	// user keep working.
+	if code, _ := refresh(login.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused token: got %d, want 401", code)
+	}
+	if code, _ := refresh(second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("latest token of a family with a reused token: got %d, want 401", code)
+	}
+	if code, _ := refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("rotated token of a revoked family: got %d, want 401", code)
+	}
+	if code, _ := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("token of another session: got %d, want 200", code)
+	}
+
+	expired, _ := newRefreshToken()
+	if err := store.CreateRefreshToken(user.Id, hashRefreshToken(expired), "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := refresh(expired); code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %d, want 401", code)
+	}
+	if code, _ := refresh("unknown"); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: got %d, want 401", code)
+	}
+	if code, _ := refresh(""); code != http.StatusBadRequest {
+		t.Errorf("missing token: got %d, want 400", code)
+	}
+}
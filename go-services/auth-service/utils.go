@@ -1,43 +1,98 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// AuthClaims represents the JWT claims for the auth service
+// AuthClaims represents the JWT claims for the auth service. The subject
+// is the user's id, which unlike the email never changes.
 type AuthClaims struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Admin    bool
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+	// Verified tells whether the user had verified their email address
+	// when the token was issued
+	Verified bool `json:"verified"`
 	jwt.RegisteredClaims
 }
 
-// CreateJWT creates a new JWT token for the user
-func CreateJWT(user *User) (string, error) {
-	secret := []byte(os.Getenv("JWT_SECRET"))
+// tokenLifetime is how long an access token is valid. Clients get a new
+// one with their refresh token.
+const tokenLifetime = 15 * time.Minute
+
+// jwtIssuer returns the issuer tokens are created with and must carry
+func jwtIssuer() string {
+	if iss := os.Getenv("JWT_ISSUER"); iss != "" {
+		return iss
+	}
+	return "auth-service"
+}
+
+// jwtAudience returns the audience tokens are created for and must carry
+func jwtAudience() string {
+	if aud := os.Getenv("JWT_AUDIENCE"); aud != "" {
+		return aud
+	}
+	return "mp3-converter"
+}
+
+// newTokenId returns a random token id for the jti claim
+func newTokenId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateJWT creates a new JWT token for the user, signed with the current
+// key of the key ring
+func CreateJWT(user *User, keys *KeyRing) (string, error) {
+	jti, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
 
 	// Create the Claims
 	claims := &AuthClaims{
 		Email:    user.Email,
-		Password: user.Password,
-		Admin:    true,
+		Roles:    []string{user.Role},
+		Verified: user.EmailVerified,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Hour * 3)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			Subject:   strconv.FormatInt(user.Id, 10),
+			Issuer:    jwtIssuer(),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenLifetime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
+	return signJWT(claims, keys)
+}
+
+// signJWT signs claims with the current key of the key ring
+func signJWT(claims jwt.Claims, keys *KeyRing) (string, error) {
+	key, err := keys.Current()
+	if err != nil {
+		return "", err
+	}
+
 	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	// Sign the token with the secret
-	tokenString, err := token.SignedString(secret)
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.Id
+	// Sign the token with the private key
+	tokenString, err := token.SignedString(key.PrivateKey)
 	if err != nil {
 		return "", err
 	}
@@ -45,21 +100,42 @@ func CreateJWT(user *User) (string, error) {
 	return tokenString, nil
 }
 
-// VerifyJWT verifies the JWT token and returns the token if it is valid
-func VerifyJWT(tokenString string) (*jwt.Token, error) {
-	secret := []byte(os.Getenv("JWT_SECRET"))
-	token, err := jwt.ParseWithClaims(tokenString, &AuthClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+// jwtKeyFunc looks up the public key of a token in the key ring by its key
+// id
+func jwtKeyFunc(keys *KeyRing) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keys.PublicKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+}
+
+// VerifyJWT verifies the JWT token and returns the token if it is valid.
+// Only EdDSA is accepted, so a token cannot pick its own algorithm, and
+// the key id, issuer, audience, expiry and subject must be present.
+func VerifyJWT(tokenString string, keys *KeyRing) (*jwt.Token, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &AuthClaims{}, jwtKeyFunc(keys),
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwtIssuer()),
+		jwt.WithAudience(jwtAudience()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	// Check if there was an error parsing the token
 	if err != nil {
 		return nil, err
-	} else if claims, ok := token.Claims.(*AuthClaims); ok {
-		log.Println(claims.Email, claims.IssuedAt.Time)
-		return token, nil
-	} else {
-		return nil, fmt.Errorf("unknown claims type: %+v", claims)
 	}
+	claims, ok := token.Claims.(*AuthClaims)
+	if !ok {
+		return nil, fmt.Errorf("unknown claims type: %T", token.Claims)
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, fmt.Errorf("token is missing the subject or id")
+	}
+	return token, nil
 }
 
 // WriteJSON writes a JSON response to the http.ResponseWriter with the given status code
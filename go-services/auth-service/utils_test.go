@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyJWT(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := keys.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	// sign signs the claims of a valid token, changed by edit, with the
+	// method, key and key id given
+	sign := func(edit func(*AuthClaims), method jwt.SigningMethod, key interface{}, kid interface{}) string {
+		t.Helper()
+		now := time.Now().UTC()
+		claims := &AuthClaims{
+			Email: "jwt@example.com",
+			Roles: []string{RoleUser},
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "jti",
+				Subject:   "1",
+				Issuer:    jwtIssuer(),
+				Audience:  jwt.ClaimStrings{jwtAudience()},
+				ExpiresAt: jwt.NewNumericDate(now.Add(tokenLifetime)),
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+			},
+		}
+		if edit != nil {
+			edit(claims)
+		}
+		token := jwt.NewWithClaims(method, claims)
+		if kid != nil {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	eddsa := func(edit func(*AuthClaims)) string {
+		return sign(edit, jwt.SigningMethodEdDSA, current.PrivateKey, current.Id)
+	}
+	publicKey := current.PrivateKey.Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", eddsa(nil), true},
+		{"several audiences", eddsa(func(c *AuthClaims) { c.Audience = append(c.Audience, "other") }), true},
+		{"other issuer", eddsa(func(c *AuthClaims) { c.Issuer = "other" }), false},
+		{"no issuer", eddsa(func(c *AuthClaims) { c.Issuer = "" }), false},
+		{"other audience", eddsa(func(c *AuthClaims) { c.Audience = jwt.ClaimStrings{"other"} }), false},
+		{"no audience", eddsa(func(c *AuthClaims) { c.Audience = nil }), false},
+		{"MFA token", eddsa(func(c *AuthClaims) { c.Audience = jwt.ClaimStrings{mfaAudience()} }), false},
+		{"expired", eddsa(func(c *AuthClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }), false},
+		{"no expiry", eddsa(func(c *AuthClaims) { c.ExpiresAt = nil }), false},
+		{"issued in the future", eddsa(func(c *AuthClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) }), false},
+		{"not yet valid", eddsa(func(c *AuthClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) }), false},
+		{"no subject", eddsa(func(c *AuthClaims) { c.Subject = "" }), false},
+		{"no id", eddsa(func(c *AuthClaims) { c.ID = "" }), false},
+		// The key is chosen by kid, and only EdDSA is accepted whatever
+		// the token says
+		{"no kid", sign(nil, jwt.SigningMethodEdDSA, current.PrivateKey, nil), false},
+		{"kid not a string", sign(nil, jwt.SigningMethodEdDSA, current.PrivateKey, 1), false},
+		{"unknown kid", sign(nil, jwt.SigningMethodEdDSA, current.PrivateKey, "unknown"), false},
+		{"other key", sign(nil, jwt.SigningMethodEdDSA, other, current.Id), false},
+		{"HS256 with the public key", sign(nil, jwt.SigningMethodHS256, []byte(publicKey), current.Id), false},
+		{"HS256 with JWT_SECRET", sign(nil, jwt.SigningMethodHS256, []byte(hex.EncodeToString(secret)), current.Id), false},
+		{"none", sign(nil, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, current.Id), false},
+	}
+	for _, test := range tests {
+		token, err := VerifyJWT(test.token, keys)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+		if err == nil && token.Claims.(*AuthClaims).Email != "jwt@example.com" {
+			t.Errorf("%s: claims %+v", test.name, token.Claims)
+		}
+	}
+
+	// Tokens of the service are only accepted where it has the same issuer
+	// and audience
+	user := &User{Id: 1, Email: "jwt@example.com", Role: RoleUser}
+	token, err := CreateJWT(user, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyJWT(token, keys); err != nil {
+		t.Fatalf("CreateJWT token: %v", err)
+	}
+	t.Setenv("JWT_ISSUER", "other-issuer")
+	if _, err := VerifyJWT(token, keys); err == nil {
+		t.Error("a token was accepted after JWT_ISSUER changed")
+	}
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "other-audience")
+	if _, err := VerifyJWT(token, keys); err == nil {
+		t.Error("a token was accepted after JWT_AUDIENCE changed")
+	}
+}
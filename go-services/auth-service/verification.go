@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// emailVerificationLifetime is how long a verification link can be used
+const emailVerificationLifetime = 24 * time.Hour
+
+// ErrVerificationInvalid is returned for an unknown or expired
+// verification token
+var ErrVerificationInvalid = errors.New("invalid or expired verification token")
+
+// verificationLink returns the link sent to verify an email address.
+// EMAIL_VERIFICATION_URL is the page of the client that confirms it.
+func verificationLink(token string) string {
+	return tokenLink(os.Getenv("EMAIL_VERIFICATION_URL"), token)
+}
+
+// sendVerification creates a verification token for a user and emails it
+// to them
+func (s *AuthServer) sendVerification(email string) {
+	user, err := s.store.GetUser(email)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", email, err)
+		return
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		log.Printf("Failed to create a verification token: %v", err)
+		return
+	}
+	expires := time.Now().UTC().Add(emailVerificationLifetime)
+	if err := s.store.CreateEmailVerification(user.Id, hashRefreshToken(token), expires); err != nil {
+		log.Printf("Failed to store the verification token of %s: %v", user.Email, err)
+		return
+	}
+
+	err = s.mailer.Send(&Email{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Welcome! Confirm that this is your email address to start converting "+
+			"videos, within %d hours:\n\n%s\n\nIf you did not create an account you can ignore this email.\n",
+			int(emailVerificationLifetime.Hours()), verificationLink(token)),
+	})
+	if err != nil {
+		log.Printf("Failed to email the verification link to %s: %v", user.Email, err)
+		return
+	}
+	log.Printf("Sent a verification link to %s", user.Email)
+}
+
+// handleVerifyEmail marks the email address of a user as verified. Tokens
+// issued before carry verified false until they are refreshed.
+func (s *AuthServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	userId, err := s.store.VerifyEmail(hashRefreshToken(req.Token))
+	if errors.Is(err, ErrVerificationInvalid) {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %d verified their email address", userId)
+	WriteJSON(w, http.StatusOK, map[string]string{
+		"message": "email address verified, refresh your token to start uploading",
+	})
+}
+
+// handleResendVerification sends the caller a new verification link
+func (s *AuthServer) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if user.EmailVerified {
+		WriteJSON(w, http.StatusConflict, "email address is already verified")
+		return
+	}
+
+	go s.sendVerification(user.Email)
+	WriteJSON(w, http.StatusAccepted, map[string]string{
+		"message": "a verification link has been sent to " + user.Email,
+	})
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webauthnChallengeLifetime is how long a ceremony can take
+	webauthnChallengeLifetime = 5 * time.Minute
+
+	maxWebAuthnCredentials    = 10
+	maxWebAuthnCredentialName = 100
+
+	// Purposes of a challenge
+	WebAuthnRegister = "register"
+	WebAuthnLogin    = "login"
+
+	// COSE algorithms credentials can use
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+
+	// Flags of the authenticator data
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+	authFlagExtensions   = 0x80
+)
+
+var (
+	// ErrWebAuthnChallenge is returned for an unknown, used or expired
+	// challenge
+	ErrWebAuthnChallenge = errors.New("invalid or expired webauthn challenge")
+	// ErrCredentialExists is returned when registering a credential twice
+	ErrCredentialExists = errors.New("credential is already registered")
+	// ErrSignCount is returned when the signature counter of a credential
+	// goes back, which happens when an authenticator was cloned
+	ErrSignCount = errors.New("signature counter did not increase")
+)
+
+// webauthnAlgorithms are the COSE algorithms offered to authenticators, in
+// order of preference
+var webauthnAlgorithms = []int64{coseES256, coseEdDSA, coseRS256}
+
+// oidAAGUID is the extension of packed attestation certificates holding
+// the authenticator model
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// WebAuthnCredential is a passkey of a user. PublicKey is the COSE key the
+// authenticator created, and Attestation the format it was registered
+// with.
+type WebAuthnCredential struct {
+	Id          string     `json:"id"` // base64url credential id
+	UserId      int64      `json:"-"`
+	Name        string     `json:"name"`
+	PublicKey   []byte     `json:"-"`
+	SignCount   uint32     `json:"signCount"`
+	Attestation string     `json:"attestation"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+}
+
+// WebAuthnChallenge is a challenge handed to the client for a ceremony.
+// Registration challenges belong to a user, login ones to nobody until a
+// credential answers them.
+type WebAuthnChallenge struct {
+	Challenge string
+	UserId    int64
+	Purpose   string
+	ExpiresAt time.Time
+}
+
+// webauthnRPID returns the relying party id, the domain credentials are
+// bound to, configured by WEBAUTHN_RP_ID
+func webauthnRPID() string {
+	if id := os.Getenv("WEBAUTHN_RP_ID"); id != "" {
+		return id
+	}
+	return "localhost"
+}
+
+// webauthnOrigins returns the origins ceremonies can come from, configured
+// as a comma separated list by WEBAUTHN_ORIGINS
+func webauthnOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		return []string{"https://" + webauthnRPID()}
+	}
+	return origins
+}
+
+// webauthnUserHandle returns the user handle credentials are created
+// with. It is the user's id, which unlike the email never changes.
+func webauthnUserHandle(userId int64) []byte {
+	return []byte(strconv.FormatInt(userId, 10))
+}
+
+// decodeBase64URL decodes the base64url fields of the WebAuthn API, with or
+// without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// authenticatorData is the data an authenticator signs. The attested
+// credential is only there after registration.
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialId []byte
+	publicKey    []byte // COSE key
+}
+
+// parseAuthenticatorData parses authenticator data as laid out in the
+// WebAuthn specification
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data is too short")
+	}
+	auth := &authenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if auth.flags&authFlagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("attested credential data is too short")
+		}
+		auth.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n > 1023 || len(rest) < n {
+			return nil, fmt.Errorf("invalid credential id length")
+		}
+		auth.credentialId, rest = rest[:n], rest[n:]
+
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %v", err)
+		}
+		auth.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if auth.flags&authFlagExtensions != 0 {
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extensions: %v", err)
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected data after authenticator data")
+	}
+	return auth, nil
+}
+
+// check verifies the parts of authenticator data every ceremony checks:
+// the relying party, and that the user was present and verified
+func (a *authenticatorData) check() error {
+	rpIdHash := sha256.Sum256([]byte(webauthnRPID()))
+	if !bytes.Equal(a.rpIdHash, rpIdHash[:]) {
+		return fmt.Errorf("credential is for another relying party")
+	}
+	if a.flags&authFlagUserPresent == 0 {
+		return fmt.Errorf("user was not present")
+	}
+	if a.flags&authFlagUserVerified == 0 {
+		return fmt.Errorf("user was not verified")
+	}
+	return nil
+}
+
+// parseCOSEKey parses a COSE public key of one of webauthnAlgorithms and
+// returns it with its algorithm
+func parseCOSEKey(data []byte) (int64, crypto.PublicKey, error) {
+	v, rest, err := cborDecode(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	key, ok := v.(map[any]any)
+	if !ok || len(rest) > 0 {
+		return 0, nil, fmt.Errorf("invalid COSE key")
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, fmt.Errorf("invalid P-256 key")
+		}
+		// ecdh refuses points that are not on the curve
+		point := append([]byte{4}, append(x, y...)...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return 0, nil, fmt.Errorf("invalid P-256 key: %v", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return alg, pub, nil
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, fmt.Errorf("invalid RSA key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+}
+
+// verifySignature verifies a signature made with a COSE algorithm
+func verifySignature(alg int64, pub crypto.PublicKey, msg []byte, sig []byte) error {
+	hash := sha256.Sum256(msg)
+	switch alg {
+	case coseES256:
+		if key, ok := pub.(*ecdsa.PublicKey); ok && ecdsa.VerifyASN1(key, hash[:], sig) {
+			return nil
+		}
+	case coseEdDSA:
+		if key, ok := pub.(ed25519.PublicKey); ok && ed25519.Verify(key, msg, sig) {
+			return nil
+		}
+	case coseRS256:
+		if key, ok := pub.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+// verifyAttestation verifies the attestation statement of a new
+// credential. Formats none and packed are supported. Packed certificates
+// are checked as the specification requires, but not against a list of
+// trusted authenticator vendors, so attestation proves the key is held by
+// the authenticator, not which one it is.
+func verifyAttestation(format string, stmt map[any]any, authData []byte, auth *authenticatorData, clientDataHash []byte) error {
+	switch format {
+	case "none":
+		if len(stmt) != 0 {
+			return fmt.Errorf("attestation none has a statement")
+		}
+		return nil
+	case "packed":
+	default:
+		return fmt.Errorf("unsupported attestation format %q", format)
+	}
+
+	alg, _ := stmt["alg"].(int64)
+	sig, _ := stmt["sig"].([]byte)
+	if len(sig) == 0 {
+		return fmt.Errorf("packed attestation has no signature")
+	}
+	msg := append(bytes.Clone(authData), clientDataHash...)
+
+	x5c, ok := stmt["x5c"].([]any)
+	if !ok {
+		// Self attestation is signed with the credential key itself
+		credAlg, pub, err := parseCOSEKey(auth.publicKey)
+		if err != nil {
+			return err
+		}
+		if alg != credAlg {
+			return fmt.Errorf("self attestation algorithm does not match the credential")
+		}
+		return verifySignature(alg, pub, msg, sig)
+	}
+
+	if len(x5c) == 0 {
+		return fmt.Errorf("packed attestation has no certificate")
+	}
+	der, _ := x5c[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("invalid attestation certificate: %v", err)
+	}
+	if cert.Version != 3 || !slices.Contains(cert.Subject.OrganizationalUnit, "Authenticator Attestation") ||
+		len(cert.Subject.Country) == 0 || len(cert.Subject.Organization) == 0 || cert.Subject.CommonName == "" {
+		return fmt.Errorf("attestation certificate has an invalid subject")
+	}
+	if !cert.BasicConstraintsValid || cert.IsCA {
+		return fmt.Errorf("attestation certificate is a CA")
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, auth.aaguid) {
+			return fmt.Errorf("attestation certificate is for another authenticator model")
+		}
+	}
+	return verifySignature(alg, cert.PublicKey, msg, sig)
+}
+
+// clientData is the part of clientDataJSON checked by the server
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// useClientData checks the client data of a ceremony and uses up its
+// challenge, which is returned
+func (s *AuthServer) useClientData(raw []byte, ceremony string, purpose string) (*WebAuthnChallenge, error) {
+	data := &clientData{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, fmt.Errorf("invalid client data")
+	}
+	if data.Type != ceremony {
+		return nil, fmt.Errorf("client data is for %q", data.Type)
+	}
+	if !slices.Contains(webauthnOrigins(), data.Origin) || data.CrossOrigin {
+		return nil, fmt.Errorf("origin %q is not allowed", data.Origin)
+	}
+	return s.store.UseWebAuthnChallenge(data.Challenge, purpose)
+}
+
+// newWebAuthnChallenge creates and stores a challenge for a ceremony
+func (s *AuthServer) newWebAuthnChallenge(userId int64, purpose string) (string, error) {
+	challenge, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = s.store.CreateWebAuthnChallenge(&WebAuthnChallenge{
+		Challenge: challenge,
+		UserId:    userId,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().UTC().Add(webauthnChallengeLifetime),
+	})
+	return challenge, err
+}
+
+// credentialResponse is a PublicKeyCredential as the browser returns it,
+// with the binary fields base64url encoded. Registration fills
+// AttestationObject, login AuthenticatorData, Signature and UserHandle.
+type credentialResponse struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name"` // chosen by the user at registration
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// handleWebAuthnRegisterBegin returns the options for creating a passkey
+// for the caller
+func (s *AuthServer) handleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	credentials, err := s.store.ListWebAuthnCredentials(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(credentials) >= maxWebAuthnCredentials {
+		WriteJSON(w, http.StatusConflict, fmt.Sprintf("at most %d passkeys can be registered", maxWebAuthnCredentials))
+		return
+	}
+	challenge, err := s.newWebAuthnChallenge(userId, WebAuthnRegister)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	params := []map[string]interface{}{}
+	for _, alg := range webauthnAlgorithms {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+	// Authenticators already holding a passkey of the user are not asked
+	// to create another one
+	exclude := []map[string]string{}
+	for _, credential := range credentials {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": credential.Id})
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": webauthnRPID(), "name": "MP3 Converter"},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString(webauthnUserHandle(userId)),
+				"name":        claims.Email,
+				"displayName": claims.Email,
+			},
+			"pubKeyCredParams":   params,
+			"timeout":            webauthnChallengeLifetime.Milliseconds(),
+			"attestation":        "direct",
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]interface{}{
+				"residentKey":        "required",
+				"requireResidentKey": true,
+				"userVerification":   "required",
+			},
+		},
+	})
+}
+
+// handleWebAuthnRegisterFinish verifies a new passkey of the caller and
+// stores it
+func (s *AuthServer) handleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	req := &credentialResponse{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Type != "public-key" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxWebAuthnCredentialName {
+		WriteJSON(w, http.StatusBadRequest, fmt.Sprintf("name is longer than %d characters", maxWebAuthnCredentialName))
+		return
+	}
+
+	credential, err := s.verifyRegistration(userId, req)
+	if errors.Is(err, ErrWebAuthnChallenge) {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("User %s failed to register a passkey: %v", claims.Email, err)
+		WriteJSON(w, http.StatusBadRequest, fmt.Sprintf("invalid passkey: %v", err))
+		return
+	}
+	credential.Name = name
+
+	err = s.store.CreateWebAuthnCredential(credential)
+	if errors.Is(err, ErrCredentialExists) {
+		WriteJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s registered a passkey with %s attestation", claims.Email, credential.Attestation)
+	WriteJSON(w, http.StatusCreated, credential)
+}
+
+// verifyRegistration runs the checks of the registration ceremony and
+// returns the new credential
+func (s *AuthServer) verifyRegistration(userId int64, req *credentialResponse) (*WebAuthnCredential, error) {
+	rawClientData, err := decodeBase64URL(req.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client data")
+	}
+	challenge, err := s.useClientData(rawClientData, "webauthn.create", WebAuthnRegister)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserId != userId {
+		return nil, ErrWebAuthnChallenge
+	}
+
+	rawAttestation, err := decodeBase64URL(req.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object")
+	}
+	v, rest, err := cborDecode(rawAttestation)
+	attestation, ok := v.(map[any]any)
+	if err != nil || !ok || len(rest) > 0 {
+		return nil, fmt.Errorf("invalid attestation object")
+	}
+	format, _ := attestation["fmt"].(string)
+	stmt, _ := attestation["attStmt"].(map[any]any)
+	authData, _ := attestation["authData"].([]byte)
+
+	auth, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.check(); err != nil {
+		return nil, err
+	}
+	if auth.flags&authFlagAttested == 0 {
+		return nil, fmt.Errorf("no credential was attested")
+	}
+	id := base64.RawURLEncoding.EncodeToString(auth.credentialId)
+	if id != strings.TrimRight(req.Id, "=") {
+		return nil, fmt.Errorf("credential id does not match")
+	}
+	if _, _, err := parseCOSEKey(auth.publicKey); err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err := verifyAttestation(format, stmt, authData, auth, clientDataHash[:]); err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		Id:          id,
+		UserId:      userId,
+		PublicKey:   auth.publicKey,
+		SignCount:   auth.signCount,
+		Attestation: format,
+	}, nil
+}
+
+// handleListWebAuthnCredentials lists the caller's passkeys
+func (s *AuthServer) handleListWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	credentials, err := s.store.ListWebAuthnCredentials(userId)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, credentials)
+}
+
+// handleDeleteWebAuthnCredential removes a passkey of the caller
+func (s *AuthServer) handleDeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId, _ := strconv.ParseInt(claims.Subject, 10, 64)
+
+	err = s.store.DeleteWebAuthnCredential(userId, r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		WriteJSON(w, http.StatusNotFound, "passkey not found")
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("User %s removed a passkey", claims.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWebAuthnLoginBegin returns the options for logging in with a
+// passkey. Any passkey of the relying party can answer, so the user does
+// not type their email.
+func (s *AuthServer) handleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	if ok, retry := s.loginIPs.allow(ip, time.Now()); !ok {
+		log.Printf("Too many passkey logins from %s", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		WriteJSON(w, http.StatusTooManyRequests, "too many login attempts")
+		return
+	}
+
+	challenge, err := s.newWebAuthnChallenge(0, WebAuthnLogin)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             webauthnRPID(),
+			"timeout":          webauthnChallengeLifetime.Milliseconds(),
+			"userVerification": "required",
+			"allowCredentials": []string{},
+		},
+	})
+}
+
+// handleWebAuthnLoginFinish verifies a passkey assertion and returns
+// tokens for its user. A verified passkey is two factors already, so no
+// TOTP code is asked for.
+func (s *AuthServer) handleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	req := &credentialResponse{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Type != "public-key" {
+		WriteJSON(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	credential, err := s.verifyAssertion(req)
+	if errors.Is(err, ErrWebAuthnChallenge) {
+		WriteJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Passkey login failed: %v", err)
+		WriteJSON(w, http.StatusUnauthorized, "invalid passkey")
+		return
+	}
+
+	user, err := s.store.GetUserById(credential.UserId)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, "invalid passkey")
+		return
+	}
+	tokens, err := s.issueTokens(user)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("User %s logged in with a passkey", user.Email)
+	WriteJSON(w, http.StatusOK, tokens)
+}
+
+// verifyAssertion runs the checks of the login ceremony, records the new
+// signature counter and returns the credential that answered
+func (s *AuthServer) verifyAssertion(req *credentialResponse) (*WebAuthnCredential, error) {
+	rawClientData, err := decodeBase64URL(req.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client data")
+	}
+	if _, err := s.useClientData(rawClientData, "webauthn.get", WebAuthnLogin); err != nil {
+		return nil, err
+	}
+
+	credential, err := s.store.GetWebAuthnCredential(strings.TrimRight(req.Id, "="))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unknown credential")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Response.UserHandle != "" {
+		handle, err := decodeBase64URL(req.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, webauthnUserHandle(credential.UserId)) {
+			return nil, fmt.Errorf("user handle does not match the credential")
+		}
+	}
+
+	authData, err := decodeBase64URL(req.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authenticator data")
+	}
+	auth, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.check(); err != nil {
+		return nil, err
+	}
+	sig, err := decodeBase64URL(req.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	alg, pub, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err := verifySignature(alg, pub, append(authData, clientDataHash[:]...), sig); err != nil {
+		return nil, err
+	}
+
+	// Authenticators without a counter always send 0. Otherwise it has to
+	// grow, or the credential may have been cloned.
+	if err := s.store.UseWebAuthnCredential(credential.Id, auth.signCount); err != nil {
+		if errors.Is(err, ErrSignCount) {
+			log.Printf("Passkey %s of user %d sent counter %d after %d, it may be cloned",
+				credential.Id, credential.UserId, auth.signCount, credential.SignCount)
+		}
+		return nil, err
+	}
+	return credential, nil
+}
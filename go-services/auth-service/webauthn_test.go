@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// softAuthenticator creates and uses passkeys in software the way a
+// hardware authenticator does, so the WebAuthn ceremonies can be tested
+// without a device. attestation is none, packed for self attestation or
+// packed-x5c for a certificate.
+type softAuthenticator struct {
+	origin      string
+	attestation string
+	aaguid      []byte
+	credentials map[string]*softCredential
+	// flags replaces the flags of the next assertion when set
+	flags byte
+}
+
+type softCredential struct {
+	key        *ecdsa.PrivateKey
+	userHandle []byte
+	signCount  uint32
+}
+
+// newSoftAuthenticator creates an authenticator answering for origin
+func newSoftAuthenticator(origin string, attestation string) *softAuthenticator {
+	aaguid := make([]byte, 16)
+	rand.Read(aaguid)
+	return &softAuthenticator{
+		origin:      origin,
+		attestation: attestation,
+		aaguid:      aaguid,
+		credentials: make(map[string]*softCredential),
+	}
+}
+
+// clientData returns the clientDataJSON a browser sends for a ceremony
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(&clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+// coseKey encodes a P-256 public key as a COSE key
+func coseKey(key *ecdsa.PublicKey) ([]byte, error) {
+	return cborEncode(map[any]any{
+		1:  2,
+		3:  coseES256,
+		-1: 1,
+		-2: key.X.FillBytes(make([]byte, 32)),
+		-3: key.Y.FillBytes(make([]byte, 32)),
+	})
+}
+
+// attestationCert creates a packed attestation certificate for the
+// authenticator's model, with its key
+func (a *softAuthenticator) attestationCert() ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	aaguid, err := asn1.Marshal(a.aaguid)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"US"},
+			Organization:       []string{"Software Authenticator"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+			CommonName:         "Software Authenticator Attestation",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAAGUID, Value: aaguid}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	return der, key, err
+}
+
+// create answers the options of a registration ceremony with a new
+// credential
+func (a *softAuthenticator) create(rpId string, challenge string, userHandle []byte) (*credentialResponse, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	publicKey, err := coseKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	authData := append(rpIdHash[:], authFlagUserPresent|authFlagUserVerified|authFlagAttested, 0, 0, 0, 0)
+	authData = append(authData, a.aaguid...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, publicKey...)
+
+	clientDataJSON := a.clientData("webauthn.create", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+
+	format, stmt := "none", map[any]any{}
+	switch a.attestation {
+	case "packed":
+		sig, err := ecdsa.SignASN1(rand.Reader, key, signed[:])
+		if err != nil {
+			return nil, err
+		}
+		format, stmt = "packed", map[any]any{"alg": coseES256, "sig": sig}
+	case "packed-x5c":
+		cert, certKey, err := a.attestationCert()
+		if err != nil {
+			return nil, err
+		}
+		sig, err := ecdsa.SignASN1(rand.Reader, certKey, signed[:])
+		if err != nil {
+			return nil, err
+		}
+		format, stmt = "packed", map[any]any{"alg": coseES256, "sig": sig, "x5c": []any{cert}}
+	}
+	attestation, err := cborEncode(map[any]any{"fmt": format, "attStmt": stmt, "authData": authData})
+	if err != nil {
+		return nil, err
+	}
+
+	encodedId := base64.RawURLEncoding.EncodeToString(id)
+	a.credentials[encodedId] = &softCredential{key: key, userHandle: userHandle}
+	resp := &credentialResponse{Id: encodedId, Type: "public-key"}
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	resp.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestation)
+	return resp, nil
+}
+
+// get answers the options of a login ceremony with a credential, counting
+// the signature
+func (a *softAuthenticator) get(rpId string, challenge string, id string) (*credentialResponse, error) {
+	credential, ok := a.credentials[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown credential %s", id)
+	}
+	credential.signCount++
+
+	flags := byte(authFlagUserPresent | authFlagUserVerified)
+	if a.flags != 0 {
+		flags = a.flags
+	}
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	authData := append(rpIdHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, credential.signCount)
+
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, credential.key, signed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &credentialResponse{Id: id, Type: "public-key"}
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	resp.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	resp.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	resp.Response.UserHandle = base64.RawURLEncoding.EncodeToString(credential.userHandle)
+	return resp, nil
+}
+
+// webauthnTest drives the ceremonies of an auth server with software
+// authenticators
+type webauthnTest struct {
+	t      *testing.T
+	server *AuthServer
+	token  string // access token of the user registering passkeys
+}
+
+// newWebAuthnTest creates an auth server with a memory store and signs in
+// a user of its own
+func newWebAuthnTest(t *testing.T) *webauthnTest {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	t.Setenv("JWT_SECRET", hex.EncodeToString(secret))
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewFileMailer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(&User{Email: "passkeys@example.com", Password: "correct horse battery"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("passkeys@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := CreateJWT(user, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webauthnTest{t: t, server: NewAuthServer("", store, keys, mailer), token: token}
+}
+
+// call calls a handler as the HTTP server would and decodes the JSON
+// response into out
+func (c *webauthnTest) call(handler http.HandlerFunc, body any, token string, out any) int {
+	c.t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+// expectStatus fails the test unless a step returned the wanted status
+func (c *webauthnTest) expectStatus(what string, code int, want int) {
+	c.t.Helper()
+	if code != want {
+		c.t.Fatalf("%s returned %d, want %d", what, code, want)
+	}
+}
+
+// register runs a registration ceremony with an authenticator and returns
+// the status of the finish step and the credential id
+func (c *webauthnTest) register(a *softAuthenticator) (int, string) {
+	c.t.Helper()
+	options := struct {
+		PublicKey struct {
+			Challenge string            `json:"challenge"`
+			RP        map[string]string `json:"rp"`
+			User      map[string]string `json:"user"`
+		} `json:"publicKey"`
+	}{}
+	code := c.call(c.server.handleWebAuthnRegisterBegin, nil, c.token, &options)
+	c.expectStatus("register begin", code, http.StatusOK)
+	userHandle, err := decodeBase64URL(options.PublicKey.User["id"])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	credential, err := a.create(options.PublicKey.RP["id"], options.PublicKey.Challenge, userHandle)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.call(c.server.handleWebAuthnRegisterFinish, credential, c.token, nil), credential.Id
+}
+
+// mustRegister registers a new passkey of an authenticator and returns
+// its credential id
+func (c *webauthnTest) mustRegister(a *softAuthenticator) string {
+	c.t.Helper()
+	code, id := c.register(a)
+	c.expectStatus("register", code, http.StatusCreated)
+	return id
+}
+
+// loginChallenge starts a login ceremony and returns its challenge
+func (c *webauthnTest) loginChallenge() (challenge string, rpId string) {
+	c.t.Helper()
+	options := struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+		} `json:"publicKey"`
+	}{}
+	code := c.call(c.server.handleWebAuthnLoginBegin, nil, "", &options)
+	c.expectStatus("login begin", code, http.StatusOK)
+	return options.PublicKey.Challenge, options.PublicKey.RPID
+}
+
+// finishLogin answers a login challenge with a credential of an
+// authenticator, asserting for rpId, and returns the status
+func (c *webauthnTest) finishLogin(a *softAuthenticator, id string, rpId string, challenge string) int {
+	c.t.Helper()
+	assertion, err := a.get(rpId, challenge, id)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tokens := &TokenResponse{}
+	code := c.call(c.server.handleWebAuthnLoginFinish, assertion, "", tokens)
+	if code == http.StatusOK && tokens.Token == "" {
+		c.t.Fatal("login returned no token")
+	}
+	return code
+}
+
+// login runs a login ceremony with a credential of an authenticator and
+// returns the status of the finish step
+func (c *webauthnTest) login(a *softAuthenticator, id string) int {
+	c.t.Helper()
+	challenge, rpId := c.loginChallenge()
+	return c.finishLogin(a, id, rpId, challenge)
+}
+
+// TestWebAuthnAttestation registers a passkey with each attestation format
+// and logs in with it twice
+func TestWebAuthnAttestation(t *testing.T) {
+	for _, attestation := range []string{"none", "packed", "packed-x5c"} {
+		t.Run(attestation, func(t *testing.T) {
+			c := newWebAuthnTest(t)
+			a := newSoftAuthenticator(webauthnOrigins()[0], attestation)
+			id := c.mustRegister(a)
+			for i := 0; i < 2; i++ {
+				c.expectStatus("login", c.login(a, id), http.StatusOK)
+			}
+		})
+	}
+}
+
+// TestWebAuthnSignCount logs in with a clone of an authenticator, whose
+// counter lags behind
+func TestWebAuthnSignCount(t *testing.T) {
+	c := newWebAuthnTest(t)
+	a := newSoftAuthenticator(webauthnOrigins()[0], "none")
+	id := c.mustRegister(a)
+	clone := *a.credentials[id]
+	for i := 0; i < 2; i++ {
+		c.expectStatus("login", c.login(a, id), http.StatusOK)
+	}
+	a.credentials[id] = &clone
+	c.expectStatus("login with a cloned authenticator", c.login(a, id), http.StatusUnauthorized)
+}
+
+// TestWebAuthnRefusedAssertions checks that assertions from another
+// origin, without user verification, for another relying party or with a
+// replayed challenge are refused
+func TestWebAuthnRefusedAssertions(t *testing.T) {
+	c := newWebAuthnTest(t)
+	a := newSoftAuthenticator(webauthnOrigins()[0], "none")
+	id := c.mustRegister(a)
+
+	a.origin = "https://phishing.example"
+	c.expectStatus("login from another origin", c.login(a, id), http.StatusUnauthorized)
+	a.origin = webauthnOrigins()[0]
+
+	a.flags = authFlagUserPresent
+	c.expectStatus("login without user verification", c.login(a, id), http.StatusUnauthorized)
+	a.flags = 0
+
+	challenge, _ := c.loginChallenge()
+	c.expectStatus("login for another relying party",
+		c.finishLogin(a, id, "phishing.example", challenge), http.StatusUnauthorized)
+
+	// The challenge of a successful login can not be used again
+	challenge, rpId := c.loginChallenge()
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		c.expectStatus(fmt.Sprintf("login %d with one challenge", i+1),
+			c.finishLogin(a, id, rpId, challenge), want)
+	}
+}
+
+// TestWebAuthnDeletedPasskey checks that a deleted passkey can not log in
+func TestWebAuthnDeletedPasskey(t *testing.T) {
+	c := newWebAuthnTest(t)
+	a := newSoftAuthenticator(webauthnOrigins()[0], "none")
+	id := c.mustRegister(a)
+
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.SetPathValue("id", id)
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	w := httptest.NewRecorder()
+	c.server.handleDeleteWebAuthnCredential(w, r)
+	c.expectStatus("delete", w.Code, http.StatusNoContent)
+
+	c.expectStatus("login with a deleted passkey", c.login(a, id), http.StatusUnauthorized)
+}
@@ -0,0 +1,56 @@
+package aac
+
+// bitReader reads big-endian bit fields from an access unit. The first
+// read past the end sets err and every later read returns zero.
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+// read returns the next n bits, n at most 32
+func (r *bitReader) read(n int) uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if n > len(r.b)*8-r.pos {
+		r.err = ErrTruncated
+		return 0
+	}
+	var v uint32
+	for n > 0 {
+		byteOff, bitOff := r.pos>>3, r.pos&7
+		take := 8 - bitOff
+		if take > n {
+			take = n
+		}
+		bits := uint32(r.b[byteOff]>>(8-bitOff-take)) & (1<<take - 1)
+		v = v<<take | bits
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+func (r *bitReader) bit() bool { return r.read(1) == 1 }
+
+func (r *bitReader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+	if n < 0 || n > len(r.b)*8-r.pos {
+		r.err = ErrTruncated
+		return
+	}
+	r.pos += n
+}
+
+// align skips to the next byte boundary
+func (r *bitReader) align() {
+	r.skip(-r.pos & 7)
+}
+
+// remaining returns the number of unread bits
+func (r *bitReader) remaining() int {
+	return len(r.b)*8 - r.pos
+}
@@ -0,0 +1,147 @@
+package aac
+
+import "fmt"
+
+// Audio object types this package handles
+const (
+	objectTypeLC  = 2
+	objectTypeSBR = 5
+	objectTypePS  = 29
+	objectTypeEsc = 31
+)
+
+// Config is a parsed AudioSpecificConfig from ISO/IEC 14496-3 1.6.2.1
+type Config struct {
+	// ObjectType is the audio object type of the core coder
+	ObjectType int
+	// SampleRate is the sampling frequency of the core coder in Hz. For
+	// HE-AAC streams the decoder ignores the SBR data and outputs the core
+	// at this rate.
+	SampleRate int
+	// Channels is the number of output channels
+	Channels int
+	// ExtensionSampleRate is the output rate signalled for SBR, or zero
+	ExtensionSampleRate int
+
+	rateIndex     int
+	channelConfig int
+}
+
+// channelConfigs is the number of channels for each channelConfiguration
+var channelConfigs = [8]int{0, 1, 2, 3, 4, 5, 6, 8}
+
+// ParseConfig parses an AudioSpecificConfig, such as the Config of an AAC
+// track returned by the mp4 package
+func ParseConfig(asc []byte) (*Config, error) {
+	r := &bitReader{b: asc}
+	c := &Config{}
+	c.ObjectType = readObjectType(r)
+	c.rateIndex, c.SampleRate = readSampleRate(r)
+	c.channelConfig = int(r.read(4))
+	if c.ObjectType == objectTypeSBR || c.ObjectType == objectTypePS {
+		// Explicit hierarchical signalling puts the core after the SBR rate
+		_, c.ExtensionSampleRate = readSampleRate(r)
+		c.ObjectType = readObjectType(r)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("aac: audio specific config: %w", r.err)
+	}
+	if c.ObjectType != objectTypeLC {
+		return nil, fmt.Errorf("%w: audio object type %d", ErrUnsupported, c.ObjectType)
+	}
+	if c.rateIndex < 0 {
+		return nil, fmt.Errorf("%w: sample rate %d Hz", ErrUnsupported, c.SampleRate)
+	}
+
+	// GASpecificConfig
+	if r.bit() {
+		return nil, fmt.Errorf("%w: 960 sample frames", ErrUnsupported)
+	}
+	if r.bit() {
+		r.skip(14) // coreCoderDelay
+	}
+	r.skip(1) // extensionFlag, no extra fields for AAC LC
+	if c.channelConfig == 0 {
+		pce, err := readProgramConfig(r)
+		if err != nil {
+			return nil, err
+		}
+		c.Channels = pce.channels
+	} else if c.channelConfig < len(channelConfigs) {
+		c.Channels = channelConfigs[c.channelConfig]
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("aac: audio specific config: %w", r.err)
+	}
+	if c.Channels == 0 {
+		return nil, fmt.Errorf("%w: channel configuration %d", ErrUnsupported, c.channelConfig)
+	}
+	return c, nil
+}
+
+func readObjectType(r *bitReader) int {
+	t := int(r.read(5))
+	if t == objectTypeEsc {
+		t = 32 + int(r.read(6))
+	}
+	return t
+}
+
+// readSampleRate reads a sampling frequency index or an explicit rate. The
+// index is -1 for rates without scalefactor band tables.
+func readSampleRate(r *bitReader) (int, int) {
+	index := int(r.read(4))
+	if index == 0xf {
+		rate := int(r.read(24))
+		for i, sr := range sampleRates {
+			if sr == rate {
+				return i, rate
+			}
+		}
+		return -1, rate
+	}
+	if index >= len(sampleRates) {
+		r.err = ErrInvalid
+		return -1, 0
+	}
+	return index, sampleRates[index]
+}
+
+// programConfig holds the parts of a program_config_element the decoder
+// uses
+type programConfig struct {
+	channels int
+}
+
+// readProgramConfig parses a program_config_element, Table 4.2
+func readProgramConfig(r *bitReader) (*programConfig, error) {
+	p := &programConfig{}
+	r.skip(4 + 2 + 4) // element_instance_tag, object_type, sampling_frequency_index
+	front, side, back := int(r.read(4)), int(r.read(4)), int(r.read(4))
+	lfe, assoc, cc := int(r.read(2)), int(r.read(3)), int(r.read(4))
+	if r.bit() {
+		r.skip(4) // mono_mixdown_element_number
+	}
+	if r.bit() {
+		r.skip(4) // stereo_mixdown_element_number
+	}
+	if r.bit() {
+		r.skip(3) // matrix_mixdown_idx, pseudo_surround_enable
+	}
+	for i := 0; i < front+side+back; i++ {
+		if r.bit() {
+			p.channels += 2
+		} else {
+			p.channels++
+		}
+		r.skip(4)
+	}
+	p.channels += lfe
+	r.skip(4*lfe + 4*assoc + 5*cc)
+	r.align()
+	r.skip(8 * int(r.read(8))) // comment_field_data
+	if r.err != nil {
+		return nil, fmt.Errorf("aac: program config: %w", r.err)
+	}
+	return p, nil
+}
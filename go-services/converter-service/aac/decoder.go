@@ -0,0 +1,232 @@
+// Package aac implements an AAC-LC decoder in pure Go.
+//
+// A Decoder is created from an AudioSpecificConfig and turns raw access
+// units, as stored in MP4 files, into interleaved 16-bit PCM. HE-AAC
+// streams decode to their AAC-LC core at half the output rate since the
+// SBR and PS extensions are skipped. Main, LTP and SSR profile tools and
+// coupling channel elements are not supported.
+package aac
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrUnsupported is returned for streams that use tools this package
+	// does not implement
+	ErrUnsupported = errors.New("aac: unsupported stream")
+	// ErrInvalid is returned for malformed access units
+	ErrInvalid = errors.New("aac: invalid bitstream")
+	// ErrTruncated is returned when an access unit ends too early
+	ErrTruncated = errors.New("aac: truncated bitstream")
+)
+
+// Syntactic elements of raw_data_block, Table 4.85
+const (
+	elemSCE = iota
+	elemCPE
+	elemCCE
+	elemLFE
+	elemDSE
+	elemPCE
+	elemFIL
+	elemEND
+)
+
+// Decoder decodes AAC-LC access units
+type Decoder struct {
+	cfg      *Config
+	channels []channelState
+	left     ics
+	right    ics
+	noise    noiseGen
+	pcm      [frameLength]float64
+	out      []int16
+}
+
+// NewDecoder creates a new Decoder instance from an AudioSpecificConfig
+func NewDecoder(asc []byte) (*Decoder, error) {
+	cfg, err := ParseConfig(asc)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{
+		cfg:      cfg,
+		channels: make([]channelState, cfg.Channels),
+		noise:    noiseGen{state: 0x1f2e3d4c},
+	}, nil
+}
+
+// Config returns the parsed AudioSpecificConfig
+func (d *Decoder) Config() *Config {
+	return d.cfg
+}
+
+// SampleRate returns the output sample rate in Hz
+func (d *Decoder) SampleRate() int {
+	return d.cfg.SampleRate
+}
+
+// Channels returns the number of interleaved output channels
+func (d *Decoder) Channels() int {
+	return d.cfg.Channels
+}
+
+// Decode decodes one access unit into 1024 interleaved samples per
+// channel. The returned slice is reused by the next call.
+func (d *Decoder) Decode(au []byte) ([]int16, error) {
+	n := frameLength * len(d.channels)
+	if cap(d.out) < n {
+		d.out = make([]int16, n)
+	}
+	d.out = d.out[:n]
+	for i := range d.out {
+		d.out[i] = 0
+	}
+
+	r := &bitReader{b: au}
+	ch := 0
+	for {
+		id := int(r.read(3))
+		if r.err != nil {
+			return nil, r.err
+		}
+		if id == elemEND {
+			break
+		}
+		switch id {
+		case elemSCE, elemLFE:
+			r.skip(4) // element_instance_tag
+			if err := d.left.read(r, d.cfg.rateIndex, false); err != nil {
+				return nil, err
+			}
+			if ch+1 > len(d.channels) {
+				return nil, fmt.Errorf("%w: more channels than configured", ErrInvalid)
+			}
+			d.left.dequantize()
+			d.left.fillNoise(&d.noise, nil, nil)
+			d.left.applyTNS(d.cfg.rateIndex)
+			d.output(ch, &d.left)
+			ch++
+		case elemCPE:
+			if err := d.readPair(r); err != nil {
+				return nil, err
+			}
+			if ch+2 > len(d.channels) {
+				return nil, fmt.Errorf("%w: more channels than configured", ErrInvalid)
+			}
+			d.output(ch, &d.left)
+			d.output(ch+1, &d.right)
+			ch += 2
+		case elemCCE:
+			return nil, fmt.Errorf("%w: coupling channel element", ErrUnsupported)
+		case elemDSE:
+			r.skip(4)
+			align := r.bit()
+			count := int(r.read(8))
+			if count == 255 {
+				count += int(r.read(8))
+			}
+			if align {
+				r.align()
+			}
+			r.skip(8 * count)
+		case elemPCE:
+			if _, err := readProgramConfig(r); err != nil {
+				return nil, err
+			}
+		case elemFIL:
+			// Fill data, including any SBR extension payload, is skipped
+			count := int(r.read(4))
+			if count == 15 {
+				count += int(r.read(8)) - 1
+			}
+			r.skip(8 * count)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	return d.out, nil
+}
+
+// readPair parses and reconstructs a channel_pair_element into left and
+// right
+func (d *Decoder) readPair(r *bitReader) error {
+	r.skip(4) // element_instance_tag
+	common := r.bit()
+	var msMask int
+	var used [maxWindows][maxBands]bool
+	if common {
+		if err := d.left.readInfo(r, d.cfg.rateIndex); err != nil {
+			return err
+		}
+		d.right.info = d.left.info
+		msMask = int(r.read(2))
+		switch msMask {
+		case 1:
+			for g := 0; g < d.left.info.groups; g++ {
+				for b := 0; b < d.left.info.maxSFB; b++ {
+					used[g][b] = r.bit()
+				}
+			}
+		case 2:
+			for g := range used {
+				for b := range used[g] {
+					used[g][b] = true
+				}
+			}
+		case 3:
+			return fmt.Errorf("%w: reserved ms_mask_present", ErrInvalid)
+		}
+	}
+	if err := d.left.read(r, d.cfg.rateIndex, common); err != nil {
+		return err
+	}
+	if err := d.right.read(r, d.cfg.rateIndex, common); err != nil {
+		return err
+	}
+
+	d.left.dequantize()
+	d.right.dequantize()
+	d.left.fillNoise(&d.noise, nil, nil)
+	if msMask != 0 {
+		// Noise in both channels of a mid/side band is the same noise
+		var shared [maxWindows][maxBands]bool
+		for g := range shared {
+			for b := range shared[g] {
+				shared[g][b] = used[g][b] && d.left.cb[g][b] == noiseHCB && d.right.cb[g][b] == noiseHCB
+			}
+		}
+		d.right.fillNoise(&d.noise, &d.left, &shared)
+		applyMidSide(&d.left, &d.right, &used)
+	} else {
+		d.right.fillNoise(&d.noise, nil, nil)
+	}
+	applyIntensity(&d.left, &d.right, msMask == 1, &used)
+	d.left.applyTNS(d.cfg.rateIndex)
+	d.right.applyTNS(d.cfg.rateIndex)
+	return nil
+}
+
+// output runs the filter bank for a channel and interleaves the result
+func (d *Decoder) output(ch int, s *ics) {
+	d.channels[ch].synthesize(s, d.pcm[:])
+	stride := len(d.channels)
+	for i, v := range d.pcm {
+		d.out[i*stride+ch] = clip16(v)
+	}
+}
+
+func clip16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
@@ -0,0 +1,140 @@
+package aac
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Reference tolerance, see testdata/README.md
+const (
+	maxSampleDiff = 1
+	maxRMSDiff    = 0.2887 // 1/√12
+)
+
+var fixtures = []struct {
+	name       string
+	sampleRate int
+	channels   int
+}{
+	{"mono_8000", 8000, 1},
+	{"mono_22050", 22050, 1},
+	{"mono_44100", 44100, 1},
+	{"stereo_16000", 16000, 2},
+	{"stereo_32000", 32000, 2},
+	{"stereo_48000", 48000, 2},
+	{"stereo_96000", 96000, 2},
+}
+
+// readADTS splits an ADTS stream into an AudioSpecificConfig and its raw
+// access units
+func readADTS(t *testing.T, path string) ([]byte, [][]byte) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var asc []byte
+	var aus [][]byte
+	for len(b) > 0 {
+		if len(b) < 7 || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+			t.Fatalf("%s: bad ADTS header at frame %d", path, len(aus))
+		}
+		headerLen := 7
+		if b[1]&1 == 0 {
+			headerLen = 9 // crc_check
+		}
+		frameLen := int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5)
+		if b[6]&3 != 0 || frameLen < headerLen || frameLen > len(b) {
+			t.Fatalf("%s: bad ADTS frame %d", path, len(aus))
+		}
+		if asc == nil {
+			objectType := int(b[2]>>6) + 1
+			rateIndex := int(b[2]>>2) & 15
+			channelConfig := int(b[2]&1)<<2 | int(b[3]>>6)
+			v := objectType<<11 | rateIndex<<7 | channelConfig<<3
+			asc = []byte{byte(v >> 8), byte(v)}
+		}
+		aus = append(aus, b[headerLen:frameLen])
+		b = b[frameLen:]
+	}
+	return asc, aus
+}
+
+func readPCM(t *testing.T, path string) []int16 {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]int16, len(b)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return pcm
+}
+
+func TestDecodeReference(t *testing.T) {
+	for _, fx := range fixtures {
+		t.Run(fx.name, func(t *testing.T) {
+			asc, aus := readADTS(t, filepath.Join("testdata", fx.name+".aac"))
+			want := readPCM(t, filepath.Join("testdata", fx.name+".pcm"))
+
+			d, err := NewDecoder(asc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.SampleRate() != fx.sampleRate || d.Channels() != fx.channels {
+				t.Fatalf("got %d Hz, %d channels, want %d Hz, %d channels",
+					d.SampleRate(), d.Channels(), fx.sampleRate, fx.channels)
+			}
+
+			var got []int16
+			for i, au := range aus {
+				pcm, err := d.Decode(au)
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if len(pcm) != frameLength*fx.channels {
+					t.Fatalf("frame %d: got %d samples, want %d", i, len(pcm), frameLength*fx.channels)
+				}
+				// The reference starts at the second frame
+				if i > 0 {
+					got = append(got, pcm...)
+				}
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d samples, want %d", len(got), len(want))
+			}
+
+			var sum float64
+			for i := range want {
+				diff := math.Abs(float64(got[i]) - float64(want[i]))
+				if diff > maxSampleDiff {
+					frame := i/(frameLength*fx.channels) + 1
+					t.Fatalf("frame %d sample %d: got %d, want %d", frame, i, got[i], want[i])
+				}
+				sum += diff * diff
+			}
+			if rms := math.Sqrt(sum / float64(len(want))); rms > maxRMSDiff {
+				t.Errorf("RMS difference %.4f, want at most %.4f", rms, maxRMSDiff)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	asc, aus := readADTS(t, filepath.Join("testdata", "stereo_48000.aac"))
+	for i, au := range aus {
+		d, err := NewDecoder(asc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Decode(au[:len(au)/2]); !errors.Is(err, ErrTruncated) {
+			t.Errorf("frame %d: got %v, want ErrTruncated", i, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package aac
+
+// channelState is the part of a channel that carries over between frames
+type channelState struct {
+	overlap   [frameLength]float64
+	prevShape int
+}
+
+var (
+	longIMDCT  = newIMDCT(2 * frameLength)
+	shortIMDCT = newIMDCT(2 * shortLength)
+)
+
+// synthesize runs the inverse filter bank of 4.6.11 for one channel and
+// writes frameLength samples to out
+func (c *channelState) synthesize(s *ics, out []float64) {
+	var buf [2 * frameLength]float64
+	info := &s.info
+	long := &longWindows
+	short := &shortWindows
+	prev, cur := c.prevShape, info.windowShape
+
+	switch info.windowSequence {
+	case eightShortSequence:
+		var tmp [2 * shortLength]float64
+		for w := 0; w < 8; w++ {
+			shortIMDCT.transform(s.coef[w*shortLength:(w+1)*shortLength], tmp[:])
+			left := &short[cur]
+			if w == 0 {
+				left = &short[prev]
+			}
+			off := 448 + w*shortLength
+			for i := 0; i < shortLength; i++ {
+				buf[off+i] += tmp[i] * left[i]
+				buf[off+shortLength+i] += tmp[shortLength+i] * short[cur][shortLength-1-i]
+			}
+		}
+	default:
+		longIMDCT.transform(s.coef[:], buf[:])
+		// Left half
+		if info.windowSequence == longStopSequence {
+			for i := 0; i < 448; i++ {
+				buf[i] = 0
+			}
+			for i := 0; i < shortLength; i++ {
+				buf[448+i] *= short[prev][i]
+			}
+		} else {
+			for i := 0; i < frameLength; i++ {
+				buf[i] *= long[prev][i]
+			}
+		}
+		// Right half
+		if info.windowSequence == longStartSequence {
+			for i := 0; i < shortLength; i++ {
+				buf[frameLength+448+i] *= short[cur][shortLength-1-i]
+			}
+			for i := frameLength + 448 + shortLength; i < 2*frameLength; i++ {
+				buf[i] = 0
+			}
+		} else {
+			for i := 0; i < frameLength; i++ {
+				buf[frameLength+i] *= long[cur][frameLength-1-i]
+			}
+		}
+	}
+
+	for i := 0; i < frameLength; i++ {
+		out[i] = buf[i] + c.overlap[i]
+	}
+	copy(c.overlap[:], buf[frameLength:])
+	c.prevShape = cur
+}
@@ -0,0 +1,143 @@
+package aac
+
+// codebook is a Huffman decoding tree. Each node holds two children; a
+// negative child is a leaf holding the bitwise complement of the index.
+type codebook struct {
+	nodes    [][2]int32
+	dim      int  // values per codeword, 4 or 2
+	unsigned bool // signs follow the codeword
+	lav      int  // largest absolute value
+	mod      int  // base the values are packed in
+}
+
+const (
+	zeroHCB       = 0
+	firstPairHCB  = 5
+	escHCB        = 11
+	noiseHCB      = 13
+	intensityHCB2 = 14
+	intensityHCB  = 15
+
+	// escValue marks an escape in codebook 11
+	escValue = 16
+)
+
+var (
+	sfBook        codebook
+	spectralBooks [escHCB + 1]*codebook
+)
+
+func init() {
+	sfBook = buildCodebook(sfCodes[:], sfLens[:])
+	codes := [...][]uint32{nil, spectralCodes1, spectralCodes2, spectralCodes3, spectralCodes4,
+		spectralCodes5, spectralCodes6, spectralCodes7, spectralCodes8, spectralCodes9,
+		spectralCodes10, spectralCodes11}
+	lens := [...][]uint8{nil, spectralLens1, spectralLens2, spectralLens3, spectralLens4,
+		spectralLens5, spectralLens6, spectralLens7, spectralLens8, spectralLens9,
+		spectralLens10, spectralLens11}
+	lavs := [...]int{0, 1, 1, 2, 2, 4, 4, 7, 7, 12, 12, 16}
+	for i := 1; i <= escHCB; i++ {
+		b := buildCodebook(codes[i], lens[i])
+		b.dim = 2
+		if i < firstPairHCB {
+			b.dim = 4
+		}
+		b.unsigned = i != 1 && i != 2 && i != 5 && i != 6
+		b.lav = lavs[i]
+		b.mod = 2*b.lav + 1
+		if b.unsigned {
+			b.mod = b.lav + 1
+		}
+		spectralBooks[i] = &b
+	}
+}
+
+// buildCodebook builds the decoding tree for a table of codes
+func buildCodebook(codes []uint32, lens []uint8) codebook {
+	b := codebook{nodes: make([][2]int32, 1, 2*len(codes))}
+	for i, code := range codes {
+		n := int32(0)
+		for bit := int(lens[i]) - 1; bit >= 0; bit-- {
+			c := code >> uint(bit) & 1
+			if bit == 0 {
+				b.nodes[n][c] = ^int32(i)
+				break
+			}
+			if b.nodes[n][c] == 0 {
+				b.nodes = append(b.nodes, [2]int32{})
+				b.nodes[n][c] = int32(len(b.nodes) - 1)
+			}
+			n = b.nodes[n][c]
+		}
+	}
+	return b
+}
+
+// decode reads one codeword and returns its index
+func (b *codebook) decode(r *bitReader) int {
+	n := int32(0)
+	for {
+		next := b.nodes[n][r.read(1)]
+		if next < 0 {
+			return int(^next)
+		}
+		if next == 0 || r.err != nil {
+			// Only reachable on a corrupt stream
+			if r.err == nil {
+				r.err = ErrInvalid
+			}
+			return 0
+		}
+		n = next
+	}
+}
+
+// decodeScalefactor reads a scalefactor difference
+func decodeScalefactor(r *bitReader) int {
+	return sfBook.decode(r) - 60
+}
+
+// decodeSpectral reads one codeword of quantized values into out, which
+// must hold b.dim values
+func (b *codebook) decodeSpectral(r *bitReader, out []int) {
+	idx := b.decode(r)
+	for i := b.dim - 1; i >= 0; i-- {
+		out[i] = idx % b.mod
+		idx /= b.mod
+	}
+	if !b.unsigned {
+		for i := 0; i < b.dim; i++ {
+			out[i] -= b.lav
+		}
+		return
+	}
+	for i := 0; i < b.dim; i++ {
+		if out[i] != 0 && r.bit() {
+			out[i] = -out[i]
+		}
+	}
+	if b.lav == escValue {
+		for i := 0; i < b.dim; i++ {
+			if out[i] == escValue || out[i] == -escValue {
+				v := escape(r)
+				if out[i] < 0 {
+					v = -v
+				}
+				out[i] = v
+			}
+		}
+	}
+}
+
+// escape reads an escape sequence of codebook 11
+func escape(r *bitReader) int {
+	n := 4
+	for r.bit() {
+		n++
+		if n > 12 {
+			r.err = ErrInvalid
+			return 0
+		}
+	}
+	return 1<<n + int(r.read(n))
+}
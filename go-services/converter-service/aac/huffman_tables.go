@@ -0,0 +1,276 @@
+package aac
+
+// Huffman codebooks from ISO/IEC 14496-3 Tables 4.A.1 to 4.A.12. Spectral
+// codes are stored by codebook index, the values written in base LAV+1
+// (unsigned books) or 2*LAV+1 (signed books), most significant first.
+// Scalefactor codes are indexed by the scalefactor difference plus 60.
+
+var sfCodes = [121]uint32{
+	262120, 262118, 262119, 262117, 524277, 524273, 524269, 524278, 524270, 524271, 524272, 524284,
+	524285, 524287, 524286, 524279, 524280, 524283, 524281, 262116, 524282, 262115, 131055, 131056,
+	65525, 131054, 65522, 65523, 65524, 65521, 32758, 32759, 16377, 16373, 16375, 16371,
+	16374, 16370, 8183, 8181, 4089, 4087, 4086, 2041, 4084, 2040, 1017, 1015,
+	1013, 504, 503, 250, 248, 246, 121, 58, 56, 26, 11, 4,
+	0, 10, 12, 27, 57, 59, 120, 122, 247, 249, 502, 505,
+	1012, 1014, 1016, 2037, 2036, 2038, 2039, 4085, 4088, 8180, 8182, 8184,
+	16376, 16372, 65520, 32756, 65526, 32757, 262114, 524249, 524250, 524251, 524252, 524253,
+	524254, 524248, 524242, 524243, 524244, 524245, 524246, 524274, 524255, 524263, 524264, 524265,
+	524266, 524267, 524262, 524256, 524257, 524258, 524259, 524260, 524261, 524247, 524268, 524276,
+	524275,
+}
+
+var sfLens = [121]uint8{
+	18, 18, 18, 18, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 18,
+	19, 18, 17, 17, 16, 17, 16, 16, 16, 16, 15, 15, 14, 14, 14, 14, 14, 14, 13, 13,
+	12, 12, 12, 11, 12, 11, 10, 10, 10, 9, 9, 8, 8, 8, 7, 6, 6, 5, 4, 3,
+	1, 4, 4, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 10, 11, 11, 11, 11, 12,
+	12, 13, 13, 13, 14, 14, 16, 15, 16, 15, 18, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+	19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19,
+	19,
+}
+
+var spectralCodes1 = []uint32{
+	2040, 497, 2045, 1013, 104, 1008, 2039, 492, 2037, 1009, 114, 1012,
+	116, 17, 118, 491, 108, 1014, 2044, 481, 2033, 496, 97, 502,
+	2034, 490, 2043, 498, 105, 493, 119, 23, 111, 486, 100, 485,
+	103, 21, 98, 18, 0, 20, 101, 22, 109, 489, 99, 484,
+	107, 19, 113, 483, 112, 499, 2046, 487, 2035, 495, 96, 494,
+	2032, 482, 2042, 1011, 106, 488, 117, 16, 115, 500, 110, 1015,
+	2038, 480, 2041, 1010, 102, 501, 2047, 503, 2036,
+}
+
+var spectralLens1 = []uint8{
+	11, 9, 11, 10, 7, 10, 11, 9, 11, 10, 7, 10, 7, 5, 7, 9, 7, 10, 11, 9,
+	11, 9, 7, 9, 11, 9, 11, 9, 7, 9, 7, 5, 7, 9, 7, 9, 7, 5, 7, 5,
+	1, 5, 7, 5, 7, 9, 7, 9, 7, 5, 7, 9, 7, 9, 11, 9, 11, 9, 7, 9,
+	11, 9, 11, 10, 7, 9, 7, 5, 7, 9, 7, 10, 11, 9, 11, 10, 7, 9, 11, 9,
+	11,
+}
+
+var spectralCodes2 = []uint32{
+	499, 111, 509, 235, 35, 234, 503, 232, 506, 242, 45, 112,
+	32, 6, 43, 110, 40, 233, 505, 102, 248, 231, 27, 241,
+	500, 107, 501, 236, 42, 108, 44, 10, 39, 103, 26, 245,
+	36, 8, 31, 9, 0, 7, 29, 11, 48, 239, 28, 100,
+	30, 12, 41, 243, 47, 240, 508, 113, 498, 244, 33, 230,
+	247, 104, 504, 238, 34, 101, 49, 2, 38, 237, 37, 106,
+	507, 114, 510, 105, 46, 246, 511, 109, 502,
+}
+
+var spectralLens2 = []uint8{
+	9, 7, 9, 8, 6, 8, 9, 8, 9, 8, 6, 7, 6, 5, 6, 7, 6, 8, 9, 7,
+	8, 8, 6, 8, 9, 7, 9, 8, 6, 7, 6, 5, 6, 7, 6, 8, 6, 5, 6, 5,
+	3, 5, 6, 5, 6, 8, 6, 7, 6, 5, 6, 8, 6, 8, 9, 7, 9, 8, 6, 8,
+	8, 7, 9, 8, 6, 7, 6, 4, 6, 8, 6, 7, 9, 7, 9, 7, 6, 8, 9, 7,
+	9,
+}
+
+var spectralCodes3 = []uint32{
+	0, 9, 239, 11, 25, 240, 491, 486, 1010, 10, 53, 495,
+	52, 55, 489, 493, 487, 1011, 494, 1005, 8186, 492, 498, 2041,
+	2040, 1016, 4088, 8, 56, 1014, 54, 117, 1009, 1003, 1004, 4084,
+	24, 118, 2036, 57, 116, 1007, 499, 500, 2038, 488, 1002, 8188,
+	242, 497, 4091, 1013, 2035, 4092, 238, 1015, 32766, 496, 2037, 32765,
+	8187, 16378, 65535, 241, 1008, 16380, 490, 1006, 16379, 4086, 4090, 32764,
+	2034, 4085, 65534, 1012, 2039, 32763, 4087, 4089, 32762,
+}
+
+var spectralLens3 = []uint8{
+	1, 4, 8, 4, 5, 8, 9, 9, 10, 4, 6, 9, 6, 6, 9, 9, 9, 10, 9, 10,
+	13, 9, 9, 11, 11, 10, 12, 4, 6, 10, 6, 7, 10, 10, 10, 12, 5, 7, 11, 6,
+	7, 10, 9, 9, 11, 9, 10, 13, 8, 9, 12, 10, 11, 12, 8, 10, 15, 9, 11, 15,
+	13, 14, 16, 8, 10, 14, 9, 10, 14, 12, 12, 15, 11, 12, 16, 10, 11, 15, 12, 12,
+	15,
+}
+
+var spectralCodes4 = []uint32{
+	7, 22, 246, 24, 8, 239, 495, 243, 2040, 25, 23, 237,
+	21, 1, 226, 240, 112, 1008, 494, 241, 2042, 238, 228, 1010,
+	2038, 1007, 2045, 5, 20, 242, 9, 4, 229, 244, 232, 1012,
+	6, 2, 231, 3, 0, 107, 227, 105, 499, 235, 230, 1014,
+	110, 106, 500, 1004, 496, 1017, 245, 236, 2043, 234, 111, 1015,
+	2041, 1011, 4095, 233, 109, 1016, 108, 104, 501, 1006, 498, 2036,
+	2039, 1009, 4094, 1005, 497, 2037, 2046, 1013, 2044,
+}
+
+var spectralLens4 = []uint8{
+	4, 5, 8, 5, 4, 8, 9, 8, 11, 5, 5, 8, 5, 4, 8, 8, 7, 10, 9, 8,
+	11, 8, 8, 10, 11, 10, 11, 4, 5, 8, 4, 4, 8, 8, 8, 10, 4, 4, 8, 4,
+	4, 7, 8, 7, 9, 8, 8, 10, 7, 7, 9, 10, 9, 10, 8, 8, 11, 8, 7, 10,
+	11, 10, 12, 8, 7, 10, 7, 7, 9, 10, 9, 11, 11, 10, 12, 10, 9, 11, 11, 10,
+	11,
+}
+
+var spectralCodes5 = []uint32{
+	8191, 4087, 2036, 2024, 1009, 2030, 2041, 4088, 8189, 4093, 2033, 1000,
+	488, 240, 492, 1006, 2034, 4090, 4084, 1007, 498, 232, 112, 236,
+	496, 1002, 2035, 2027, 491, 234, 26, 8, 25, 238, 495, 2029,
+	1008, 242, 115, 11, 0, 10, 113, 243, 2025, 2031, 494, 239,
+	24, 9, 27, 235, 489, 2028, 2038, 1003, 499, 237, 114, 233,
+	497, 1005, 2039, 4086, 2032, 1001, 493, 241, 490, 1004, 2040, 4089,
+	8188, 4092, 4085, 2026, 1011, 1010, 2037, 4091, 8190,
+}
+
+var spectralLens5 = []uint8{
+	13, 12, 11, 11, 10, 11, 11, 12, 13, 12, 11, 10, 9, 8, 9, 10, 11, 12, 12, 10,
+	9, 8, 7, 8, 9, 10, 11, 11, 9, 8, 5, 4, 5, 8, 9, 11, 10, 8, 7, 4,
+	1, 4, 7, 8, 11, 11, 9, 8, 5, 4, 5, 8, 9, 11, 11, 10, 9, 8, 7, 8,
+	9, 10, 11, 12, 11, 10, 9, 8, 9, 10, 11, 12, 13, 12, 12, 11, 10, 10, 11, 12,
+	13,
+}
+
+var spectralCodes6 = []uint32{
+	2046, 1021, 497, 491, 500, 490, 496, 1020, 2045, 1014, 485, 234,
+	108, 113, 104, 240, 486, 1015, 499, 239, 50, 39, 40, 38,
+	49, 235, 503, 488, 111, 46, 8, 4, 6, 41, 107, 494,
+	495, 114, 45, 2, 0, 3, 47, 115, 506, 487, 110, 43,
+	7, 1, 5, 44, 109, 492, 505, 238, 48, 36, 42, 37,
+	51, 236, 498, 1016, 484, 237, 106, 112, 105, 116, 241, 1018,
+	2047, 1017, 502, 493, 504, 489, 501, 1019, 2044,
+}
+
+var spectralLens6 = []uint8{
+	11, 10, 9, 9, 9, 9, 9, 10, 11, 10, 9, 8, 7, 7, 7, 8, 9, 10, 9, 8,
+	6, 6, 6, 6, 6, 8, 9, 9, 7, 6, 4, 4, 4, 6, 7, 9, 9, 7, 6, 4,
+	4, 4, 6, 7, 9, 9, 7, 6, 4, 4, 4, 6, 7, 9, 9, 8, 6, 6, 6, 6,
+	6, 8, 9, 10, 9, 8, 7, 7, 7, 7, 8, 10, 11, 10, 9, 9, 9, 9, 9, 10,
+	11,
+}
+
+var spectralCodes7 = []uint32{
+	0, 5, 55, 116, 242, 491, 1005, 2039, 4, 12, 53, 113,
+	236, 238, 494, 501, 54, 52, 114, 234, 241, 489, 499, 1013,
+	115, 112, 235, 240, 497, 496, 1004, 1018, 243, 237, 488, 495,
+	1007, 1009, 1017, 2043, 493, 239, 490, 498, 1011, 1016, 2041, 2044,
+	1006, 492, 500, 1012, 1015, 2040, 4093, 4094, 2038, 1008, 1010, 1014,
+	2042, 2045, 4092, 4095,
+}
+
+var spectralLens7 = []uint8{
+	1, 3, 6, 7, 8, 9, 10, 11, 3, 4, 6, 7, 8, 8, 9, 9, 6, 6, 7, 8,
+	8, 9, 9, 10, 7, 7, 8, 8, 9, 9, 10, 10, 8, 8, 9, 9, 10, 10, 10, 11,
+	9, 8, 9, 9, 10, 10, 11, 11, 10, 9, 9, 10, 10, 11, 12, 12, 11, 10, 10, 10,
+	11, 11, 12, 12,
+}
+
+var spectralCodes8 = []uint32{
+	14, 5, 16, 48, 111, 241, 506, 1022, 3, 0, 4, 18,
+	44, 106, 117, 248, 15, 2, 6, 20, 46, 105, 114, 245,
+	47, 17, 19, 42, 50, 108, 236, 250, 113, 43, 45, 49,
+	109, 112, 242, 505, 239, 104, 51, 107, 110, 238, 249, 1020,
+	504, 116, 115, 237, 240, 246, 502, 509, 1021, 243, 244, 247,
+	503, 507, 508, 1023,
+}
+
+var spectralLens8 = []uint8{
+	5, 4, 5, 6, 7, 8, 9, 10, 4, 3, 4, 5, 6, 7, 7, 8, 5, 4, 4, 5,
+	6, 7, 7, 8, 6, 5, 5, 6, 6, 7, 8, 8, 7, 6, 6, 6, 7, 7, 8, 9,
+	8, 7, 6, 7, 7, 8, 8, 10, 9, 7, 7, 8, 8, 8, 9, 9, 10, 8, 8, 8,
+	9, 9, 9, 10,
+}
+
+var spectralCodes9 = []uint32{
+	0, 5, 55, 231, 478, 974, 985, 1992, 1997, 4040, 4061, 8164,
+	8172, 4, 12, 53, 114, 234, 237, 482, 977, 979, 992, 2008,
+	4047, 4053, 54, 52, 113, 232, 236, 481, 975, 989, 987, 2000,
+	4039, 4052, 4068, 230, 112, 233, 477, 483, 978, 988, 1996, 1994,
+	2014, 4056, 4074, 8155, 479, 235, 476, 486, 981, 990, 1995, 2013,
+	2012, 4045, 4066, 4071, 8161, 976, 480, 484, 982, 1989, 2001, 2011,
+	4050, 2016, 4057, 4075, 8163, 8169, 1988, 485, 983, 1990, 1999, 2010,
+	4043, 4058, 4067, 4073, 8166, 8179, 8183, 2003, 984, 993, 2004, 2009,
+	4051, 4062, 8157, 8153, 8162, 8170, 8177, 8182, 2002, 980, 986, 1991,
+	2007, 2018, 4046, 4059, 8152, 8174, 16368, 8180, 16370, 2017, 991, 1993,
+	2006, 4042, 4048, 4069, 4070, 8171, 8175, 16371, 16372, 16373, 4064, 1998,
+	2005, 4038, 4049, 4065, 8160, 8168, 8176, 16369, 16376, 16374, 32764, 4072,
+	2015, 4041, 4055, 4060, 8156, 8159, 8173, 8181, 16377, 16379, 32765, 32766,
+	8167, 4044, 4054, 4063, 8158, 8154, 8165, 8178, 16378, 16375, 16380, 16381,
+	32767,
+}
+
+var spectralLens9 = []uint8{
+	1, 3, 6, 8, 9, 10, 10, 11, 11, 12, 12, 13, 13, 3, 4, 6, 7, 8, 8, 9,
+	10, 10, 10, 11, 12, 12, 6, 6, 7, 8, 8, 9, 10, 10, 10, 11, 12, 12, 12, 8,
+	7, 8, 9, 9, 10, 10, 11, 11, 11, 12, 12, 13, 9, 8, 9, 9, 10, 10, 11, 11,
+	11, 12, 12, 12, 13, 10, 9, 9, 10, 11, 11, 11, 12, 11, 12, 12, 13, 13, 11, 9,
+	10, 11, 11, 11, 12, 12, 12, 12, 13, 13, 13, 11, 10, 10, 11, 11, 12, 12, 13, 13,
+	13, 13, 13, 13, 11, 10, 10, 11, 11, 11, 12, 12, 13, 13, 14, 13, 14, 11, 10, 11,
+	11, 12, 12, 12, 12, 13, 13, 14, 14, 14, 12, 11, 11, 12, 12, 12, 13, 13, 13, 14,
+	14, 14, 15, 12, 11, 12, 12, 12, 13, 13, 13, 13, 14, 14, 15, 15, 13, 12, 12, 12,
+	13, 13, 13, 13, 14, 14, 14, 14, 15,
+}
+
+var spectralCodes10 = []uint32{
+	34, 8, 29, 38, 95, 211, 463, 976, 983, 1005, 2032, 2038,
+	4093, 7, 0, 1, 9, 32, 84, 96, 213, 220, 468, 973,
+	990, 2023, 28, 2, 6, 12, 30, 40, 91, 205, 217, 462,
+	476, 985, 1009, 37, 11, 10, 13, 36, 87, 97, 204, 221,
+	460, 478, 979, 999, 93, 33, 31, 35, 39, 89, 100, 216,
+	223, 466, 482, 989, 1006, 209, 85, 41, 86, 88, 98, 206,
+	224, 226, 474, 980, 995, 2027, 457, 94, 90, 92, 99, 202,
+	218, 455, 458, 480, 987, 1000, 2028, 483, 210, 203, 208, 215,
+	219, 454, 469, 472, 970, 986, 2026, 2033, 481, 212, 207, 214,
+	222, 225, 464, 470, 977, 981, 1010, 2030, 2043, 1001, 461, 456,
+	459, 465, 471, 479, 975, 992, 1007, 2022, 2040, 4090, 1003, 477,
+	467, 473, 475, 978, 972, 988, 1002, 2029, 2035, 2041, 4089, 2034,
+	974, 484, 971, 984, 982, 994, 997, 2024, 2036, 2037, 2039, 4091,
+	2042, 1004, 991, 993, 996, 998, 1008, 2025, 2031, 4088, 4094, 4092,
+	4095,
+}
+
+var spectralLens10 = []uint8{
+	6, 5, 6, 6, 7, 8, 9, 10, 10, 10, 11, 11, 12, 5, 4, 4, 5, 6, 7, 7,
+	8, 8, 9, 10, 10, 11, 6, 4, 5, 5, 6, 6, 7, 8, 8, 9, 9, 10, 10, 6,
+	5, 5, 5, 6, 7, 7, 8, 8, 9, 9, 10, 10, 7, 6, 6, 6, 6, 7, 7, 8,
+	8, 9, 9, 10, 10, 8, 7, 6, 7, 7, 7, 8, 8, 8, 9, 10, 10, 11, 9, 7,
+	7, 7, 7, 8, 8, 9, 9, 9, 10, 10, 11, 9, 8, 8, 8, 8, 8, 9, 9, 9,
+	10, 10, 11, 11, 9, 8, 8, 8, 8, 8, 9, 9, 10, 10, 10, 11, 11, 10, 9, 9,
+	9, 9, 9, 9, 10, 10, 10, 11, 11, 12, 10, 9, 9, 9, 9, 10, 10, 10, 10, 11,
+	11, 11, 12, 11, 10, 9, 10, 10, 10, 10, 10, 11, 11, 11, 11, 12, 11, 10, 10, 10,
+	10, 10, 10, 11, 11, 12, 12, 12, 12,
+}
+
+var spectralCodes11 = []uint32{
+	0, 6, 25, 61, 156, 198, 423, 912, 962, 991, 2022, 2035,
+	4091, 2028, 4090, 4094, 910, 5, 1, 8, 20, 55, 66, 146,
+	175, 401, 421, 437, 926, 960, 930, 973, 2006, 174, 23, 7,
+	9, 24, 57, 64, 142, 163, 184, 409, 428, 449, 945, 918,
+	958, 970, 157, 60, 21, 22, 26, 59, 68, 145, 165, 190,
+	406, 430, 441, 929, 913, 933, 981, 148, 154, 54, 56, 58,
+	65, 140, 155, 176, 195, 414, 427, 444, 927, 911, 937, 975,
+	147, 191, 62, 63, 67, 69, 158, 167, 185, 404, 418, 442,
+	451, 934, 935, 955, 980, 159, 416, 143, 141, 144, 152, 166,
+	182, 196, 415, 431, 447, 921, 959, 948, 969, 999, 168, 438,
+	171, 164, 170, 178, 194, 197, 408, 420, 440, 908, 932, 964,
+	966, 989, 1000, 173, 943, 402, 189, 188, 398, 407, 410, 419,
+	433, 909, 920, 951, 979, 977, 987, 2013, 180, 990, 425, 411,
+	412, 417, 426, 429, 435, 907, 946, 952, 974, 993, 992, 2002,
+	2021, 183, 2019, 443, 424, 422, 432, 434, 439, 923, 922, 954,
+	949, 982, 2007, 996, 2008, 2026, 186, 2024, 928, 445, 436, 906,
+	452, 914, 938, 944, 956, 983, 2004, 2012, 2011, 2005, 2032, 193,
+	2043, 968, 931, 917, 925, 940, 942, 965, 984, 994, 998, 2020,
+	2023, 2016, 2025, 2039, 400, 2034, 915, 446, 448, 916, 919, 941,
+	963, 961, 978, 2010, 2009, 2015, 2027, 2036, 2042, 405, 2040, 957,
+	924, 939, 936, 947, 953, 976, 995, 997, 2018, 2014, 2029, 2033,
+	2041, 2044, 403, 4093, 988, 950, 967, 972, 971, 985, 986, 2003,
+	2017, 2030, 2031, 2037, 2038, 4092, 4095, 413, 450, 181, 161, 150,
+	151, 149, 153, 160, 162, 172, 169, 177, 179, 187, 192, 399,
+	4,
+}
+
+var spectralLens11 = []uint8{
+	4, 5, 6, 7, 8, 8, 9, 10, 10, 10, 11, 11, 12, 11, 12, 12, 10, 5, 4, 5,
+	6, 7, 7, 8, 8, 9, 9, 9, 10, 10, 10, 10, 11, 8, 6, 5, 5, 6, 7, 7,
+	8, 8, 8, 9, 9, 9, 10, 10, 10, 10, 8, 7, 6, 6, 6, 7, 7, 8, 8, 8,
+	9, 9, 9, 10, 10, 10, 10, 8, 8, 7, 7, 7, 7, 8, 8, 8, 8, 9, 9, 9,
+	10, 10, 10, 10, 8, 8, 7, 7, 7, 7, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10,
+	10, 8, 9, 8, 8, 8, 8, 8, 8, 8, 9, 9, 9, 10, 10, 10, 10, 10, 8, 9,
+	8, 8, 8, 8, 8, 8, 9, 9, 9, 10, 10, 10, 10, 10, 10, 8, 10, 9, 8, 8,
+	9, 9, 9, 9, 9, 10, 10, 10, 10, 10, 10, 11, 8, 10, 9, 9, 9, 9, 9, 9,
+	9, 10, 10, 10, 10, 10, 10, 11, 11, 8, 11, 9, 9, 9, 9, 9, 9, 10, 10, 10,
+	10, 10, 11, 10, 11, 11, 8, 11, 10, 9, 9, 10, 9, 10, 10, 10, 10, 10, 11, 11,
+	11, 11, 11, 8, 11, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 11, 11, 11, 11, 11,
+	9, 11, 10, 9, 9, 10, 10, 10, 10, 10, 10, 11, 11, 11, 11, 11, 11, 9, 11, 10,
+	10, 10, 10, 10, 10, 10, 10, 10, 11, 11, 11, 11, 11, 11, 9, 12, 10, 10, 10, 10,
+	10, 10, 10, 11, 11, 11, 11, 11, 11, 12, 12, 9, 9, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 9, 5,
+}
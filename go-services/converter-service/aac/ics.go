@@ -0,0 +1,365 @@
+package aac
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	frameLength = 1024
+	shortLength = 128
+	maxBands    = 64
+	maxWindows  = 8
+)
+
+// Window sequences
+const (
+	onlyLongSequence = iota
+	longStartSequence
+	eightShortSequence
+	longStopSequence
+)
+
+// pow43 holds x^(4/3) for every quantized magnitude
+var pow43 [8192]float64
+
+func init() {
+	for i := range pow43 {
+		pow43[i] = math.Pow(float64(i), 4.0/3.0)
+	}
+}
+
+// icsInfo is the window layout of a channel, Table 4.6
+type icsInfo struct {
+	windowSequence int
+	windowShape    int
+	maxSFB         int
+	numWindows     int
+	groups         int
+	groupLen       [maxWindows]int
+	swb            []int // band offsets within a window
+	numSWB         int
+}
+
+// tnsFilter is one TNS filter of a window
+type tnsFilter struct {
+	length int
+	order  int
+	up     bool // direction 0 filters upwards in frequency
+	lpc    [tnsMaxOrderLong + 1]float64
+}
+
+// ics holds one decoded individual_channel_stream
+type ics struct {
+	info       icsInfo
+	globalGain int
+	cb         [maxWindows][maxBands]int // section codebook by group and band
+	sf         [maxWindows][maxBands]int // scalefactor, intensity position or noise energy
+
+	tns      [maxWindows][]tnsFilter
+	tnsOn    bool
+	coef     [frameLength]float64
+	quant    [frameLength]int
+	pulse    bool
+	pulseSFB int
+	pulseOff [4]int
+	pulseAmp [4]int
+}
+
+// readInfo parses ics_info
+func (s *ics) readInfo(r *bitReader, rateIndex int) error {
+	info := &s.info
+	r.skip(1) // ics_reserved_bit
+	info.windowSequence = int(r.read(2))
+	info.windowShape = int(r.read(1))
+	if info.windowSequence == eightShortSequence {
+		info.maxSFB = int(r.read(4))
+		info.numWindows = 8
+		info.groups = 1
+		info.groupLen = [maxWindows]int{1}
+		for w := 1; w < 8; w++ {
+			if r.bit() {
+				info.groupLen[info.groups-1]++
+			} else {
+				info.groupLen[info.groups] = 1
+				info.groups++
+			}
+		}
+		info.swb = swbShort[rateIndex]
+	} else {
+		info.maxSFB = int(r.read(6))
+		info.numWindows = 1
+		info.groups = 1
+		info.groupLen = [maxWindows]int{1}
+		info.swb = swbLong[rateIndex]
+		if r.bit() {
+			return fmt.Errorf("%w: prediction", ErrUnsupported)
+		}
+	}
+	info.numSWB = len(info.swb) - 1
+	if info.maxSFB > info.numSWB {
+		return fmt.Errorf("%w: max_sfb %d", ErrInvalid, info.maxSFB)
+	}
+	return r.err
+}
+
+// read parses an individual_channel_stream. With a common window the
+// caller has already filled in the ics_info.
+func (s *ics) read(r *bitReader, rateIndex int, commonWindow bool) error {
+	s.globalGain = int(r.read(8))
+	if !commonWindow {
+		if err := s.readInfo(r, rateIndex); err != nil {
+			return err
+		}
+	}
+	if err := s.readSections(r); err != nil {
+		return err
+	}
+	if err := s.readScalefactors(r); err != nil {
+		return err
+	}
+
+	s.pulse = r.bit()
+	if s.pulse {
+		if s.info.windowSequence == eightShortSequence {
+			return fmt.Errorf("%w: pulse data in short window", ErrInvalid)
+		}
+		s.readPulses(r)
+	}
+	s.tnsOn = r.bit()
+	if s.tnsOn {
+		s.readTNS(r)
+	}
+	if r.bit() {
+		return fmt.Errorf("%w: gain control", ErrUnsupported)
+	}
+	if err := s.readSpectrum(r); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// readSections parses section_data
+func (s *ics) readSections(r *bitReader) error {
+	info := &s.info
+	bits := 5
+	if info.windowSequence == eightShortSequence {
+		bits = 3
+	}
+	esc := uint32(1)<<bits - 1
+	for g := 0; g < info.groups; g++ {
+		for k := 0; k < info.maxSFB; {
+			cb := int(r.read(4))
+			if cb == 12 {
+				return fmt.Errorf("%w: reserved codebook", ErrInvalid)
+			}
+			end := k
+			for {
+				incr := r.read(bits)
+				end += int(incr)
+				if incr != esc || r.err != nil {
+					break
+				}
+			}
+			if r.err != nil {
+				return r.err
+			}
+			if end > info.maxSFB || end == k {
+				return fmt.Errorf("%w: section length", ErrInvalid)
+			}
+			for ; k < end; k++ {
+				s.cb[g][k] = cb
+			}
+		}
+	}
+	return r.err
+}
+
+// readScalefactors parses scale_factor_data
+func (s *ics) readScalefactors(r *bitReader) error {
+	sf := s.globalGain
+	isPos := 0
+	noise := s.globalGain - 90
+	firstNoise := true
+	for g := 0; g < s.info.groups; g++ {
+		for b := 0; b < s.info.maxSFB; b++ {
+			switch s.cb[g][b] {
+			case zeroHCB:
+				s.sf[g][b] = 0
+			case intensityHCB, intensityHCB2:
+				isPos += decodeScalefactor(r)
+				s.sf[g][b] = isPos
+			case noiseHCB:
+				if firstNoise {
+					noise += int(r.read(9)) - 256
+					firstNoise = false
+				} else {
+					noise += decodeScalefactor(r)
+				}
+				s.sf[g][b] = noise
+			default:
+				sf += decodeScalefactor(r)
+				if sf < 0 || sf > 255 {
+					return fmt.Errorf("%w: scalefactor %d", ErrInvalid, sf)
+				}
+				s.sf[g][b] = sf
+			}
+		}
+	}
+	return r.err
+}
+
+// readPulses parses pulse_data
+func (s *ics) readPulses(r *bitReader) {
+	n := int(r.read(2)) + 1
+	s.pulseSFB = int(r.read(6))
+	for i := range s.pulseOff {
+		s.pulseOff[i], s.pulseAmp[i] = 0, 0
+	}
+	for i := 0; i < n; i++ {
+		s.pulseOff[i] = int(r.read(5))
+		s.pulseAmp[i] = int(r.read(4))
+	}
+}
+
+// readTNS parses tns_data and converts the coefficients to LPC filters
+func (s *ics) readTNS(r *bitReader) {
+	short := s.info.windowSequence == eightShortSequence
+	filtBits, lenBits, orderBits := 2, 6, 5
+	if short {
+		filtBits, lenBits, orderBits = 1, 4, 3
+	}
+	for w := 0; w < s.info.numWindows; w++ {
+		n := int(r.read(filtBits))
+		s.tns[w] = s.tns[w][:0]
+		if n == 0 {
+			continue
+		}
+		res := int(r.read(1)) + 3
+		for f := 0; f < n; f++ {
+			filt := tnsFilter{length: int(r.read(lenBits)), order: int(r.read(orderBits))}
+			if filt.order > 0 {
+				filt.up = !r.bit()
+				compress := int(r.read(1))
+				bits := res - compress
+				var refl [1 << 5]float64
+				for i := 0; i < filt.order; i++ {
+					refl[i] = tnsCoefficient(int(r.read(bits)), bits, res)
+				}
+				filt.order = min(filt.order, tnsMaxOrderLong)
+				if short {
+					filt.order = min(filt.order, tnsMaxOrderShort)
+				}
+				filt.lpc = reflectionToLPC(refl[:filt.order])
+			}
+			s.tns[w] = append(s.tns[w], filt)
+		}
+	}
+}
+
+// tnsCoefficient dequantizes a TNS reflection coefficient of the given bit
+// width and resolution
+func tnsCoefficient(v, bits, res int) float64 {
+	if v >= 1<<(bits-1) {
+		v -= 1 << bits
+	}
+	if v >= 0 {
+		return math.Sin(float64(v) / ((float64(int(1)<<(res-1)) - 0.5) / (math.Pi / 2)))
+	}
+	return math.Sin(float64(v) / ((float64(int(1)<<(res-1)) + 0.5) / (math.Pi / 2)))
+}
+
+// reflectionToLPC converts reflection coefficients to a direct form filter
+func reflectionToLPC(refl []float64) [tnsMaxOrderLong + 1]float64 {
+	var a, b [tnsMaxOrderLong + 1]float64
+	a[0] = 1
+	for m := 1; m <= len(refl); m++ {
+		for i := 1; i < m; i++ {
+			b[i] = a[i] + refl[m-1]*a[m-i]
+		}
+		copy(a[1:m], b[1:m])
+		a[m] = refl[m-1]
+	}
+	return a
+}
+
+// readSpectrum parses spectral_data into quantized values
+func (s *ics) readSpectrum(r *bitReader) error {
+	info := &s.info
+	for i := range s.quant {
+		s.quant[i] = 0
+	}
+	var vals [4]int
+	win := 0
+	for g := 0; g < info.groups; g++ {
+		for b := 0; b < info.maxSFB; b++ {
+			cb := s.cb[g][b]
+			if cb == zeroHCB || cb >= noiseHCB {
+				continue
+			}
+			book := spectralBooks[cb]
+			start, end := info.swb[b], info.swb[b+1]
+			for w := win; w < win+info.groupLen[g]; w++ {
+				base := w * shortLength
+				for i := start; i < end; i += book.dim {
+					book.decodeSpectral(r, vals[:book.dim])
+					copy(s.quant[base+i:], vals[:book.dim])
+				}
+				if r.err != nil {
+					return r.err
+				}
+			}
+		}
+		win += info.groupLen[g]
+	}
+
+	if s.pulse {
+		if s.pulseSFB >= info.numSWB {
+			return fmt.Errorf("%w: pulse band %d", ErrInvalid, s.pulseSFB)
+		}
+		k := info.swb[s.pulseSFB]
+		for i, off := range s.pulseOff {
+			k += off
+			if k >= frameLength {
+				return fmt.Errorf("%w: pulse offset", ErrInvalid)
+			}
+			if s.quant[k] > 0 {
+				s.quant[k] += s.pulseAmp[i]
+			} else {
+				s.quant[k] -= s.pulseAmp[i]
+			}
+		}
+	}
+	return nil
+}
+
+// dequantize scales the quantized values into spectral coefficients.
+// Noise and intensity bands are left at zero for the stereo tools.
+func (s *ics) dequantize() {
+	info := &s.info
+	for i := range s.coef {
+		s.coef[i] = 0
+	}
+	win := 0
+	for g := 0; g < info.groups; g++ {
+		for b := 0; b < info.maxSFB; b++ {
+			cb := s.cb[g][b]
+			if cb == zeroHCB || cb >= noiseHCB {
+				continue
+			}
+			gain := math.Pow(2, 0.25*float64(s.sf[g][b]-100))
+			for w := win; w < win+info.groupLen[g]; w++ {
+				base := w * shortLength
+				for i := base + info.swb[b]; i < base+info.swb[b+1]; i++ {
+					q := s.quant[i]
+					if q < 0 {
+						s.coef[i] = -pow43[min(-q, len(pow43)-1)] * gain
+					} else {
+						s.coef[i] = pow43[min(q, len(pow43)-1)] * gain
+					}
+				}
+			}
+		}
+		win += info.groupLen[g]
+	}
+}
@@ -0,0 +1,102 @@
+package aac
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// imdct computes the inverse MDCT of n/2 coefficients into n samples
+// through an n/4 point complex FFT
+type imdct struct {
+	n       int
+	twiddle []complex128 // pre and post rotation
+	roots   []complex128 // FFT roots of unity
+	rev     []int        // FFT bit reversal permutation
+	buf     []complex128
+	dct     []float64
+}
+
+// newIMDCT creates a new imdct instance for n output samples
+func newIMDCT(n int) *imdct {
+	m := n / 2 // coefficients
+	q := m / 2 // FFT size
+	t := &imdct{
+		n:       n,
+		twiddle: make([]complex128, q),
+		roots:   make([]complex128, q/2),
+		rev:     make([]int, q),
+		buf:     make([]complex128, q),
+		dct:     make([]float64, m),
+	}
+	for k := range t.twiddle {
+		t.twiddle[k] = cmplx.Rect(1, -math.Pi*(float64(k)+0.125)/float64(m))
+	}
+	for k := range t.roots {
+		t.roots[k] = cmplx.Rect(1, -2*math.Pi*float64(k)/float64(q))
+	}
+	bits := 0
+	for 1<<bits < q {
+		bits++
+	}
+	for i := range t.rev {
+		r := 0
+		for b := 0; b < bits; b++ {
+			r |= (i >> b & 1) << (bits - 1 - b)
+		}
+		t.rev[i] = r
+	}
+	return t
+}
+
+// fft transforms buf in place
+func (t *imdct) fft() {
+	buf := t.buf
+	for i, r := range t.rev {
+		if i < r {
+			buf[i], buf[r] = buf[r], buf[i]
+		}
+	}
+	q := len(buf)
+	for size := 2; size <= q; size <<= 1 {
+		half, step := size/2, q/size
+		for start := 0; start < q; start += size {
+			for k := 0; k < half; k++ {
+				w := t.roots[k*step] * buf[start+k+half]
+				buf[start+k+half] = buf[start+k] - w
+				buf[start+k] += w
+			}
+		}
+	}
+}
+
+// transform writes the inverse MDCT of in, which holds n/2 coefficients,
+// to out, which holds n samples. The output is scaled by 2/n as in
+// ISO/IEC 14496-3 4.6.11.3.1.
+func (t *imdct) transform(in, out []float64) {
+	m := t.n / 2
+	q := m / 2
+
+	// A DCT-IV of size m through an m/2 point FFT
+	for k := 0; k < q; k++ {
+		t.buf[k] = complex(in[2*k], in[m-1-2*k]) * t.twiddle[k]
+	}
+	t.fft()
+	scale := complex(2/float64(t.n), 0)
+	for k := 0; k < q; k++ {
+		v := t.buf[k] * t.twiddle[k] * scale
+		t.dct[2*k] = real(v)
+		t.dct[m-1-2*k] = -imag(v)
+	}
+
+	// Unfold the DCT-IV output into the time aliased MDCT output
+	h := m / 2
+	for i := 0; i < h; i++ {
+		out[i] = t.dct[h+i]
+	}
+	for i := h; i < 3*h; i++ {
+		out[i] = -t.dct[3*h-1-i]
+	}
+	for i := 3 * h; i < t.n; i++ {
+		out[i] = -t.dct[i-3*h]
+	}
+}
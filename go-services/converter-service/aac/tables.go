@@ -0,0 +1,133 @@
+package aac
+
+import "math"
+
+// sampleRates lists the sampling frequencies by sampling_frequency_index
+var sampleRates = [13]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// Scalefactor band offsets for long windows, Tables 4.129 to 4.147
+var (
+	swbLong96 = []int{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 64, 72, 80, 88, 96, 108,
+		120, 132, 144, 156, 172, 188, 212, 240, 276, 320, 384, 448, 512, 576, 640, 704,
+		768, 832, 896, 960, 1024,
+	}
+	swbLong64 = []int{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52, 56, 64, 72, 80, 88, 100, 112,
+		124, 140, 156, 172, 192, 216, 240, 268, 304, 344, 384, 424, 464, 504, 544, 584,
+		624, 664, 704, 744, 784, 824, 864, 904, 944, 984, 1024,
+	}
+	swbLong48 = []int{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48, 56, 64, 72, 80, 88, 96, 108, 120, 132,
+		144, 160, 176, 196, 216, 240, 264, 292, 320, 352, 384, 416, 448, 480, 512, 544,
+		576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896, 928, 1024,
+	}
+	swbLong32 = []int{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 48, 56, 64, 72, 80, 88, 96, 108, 120, 132,
+		144, 160, 176, 196, 216, 240, 264, 292, 320, 352, 384, 416, 448, 480, 512, 544,
+		576, 608, 640, 672, 704, 736, 768, 800, 832, 864, 896, 928, 960, 992, 1024,
+	}
+	swbLong24 = []int{
+		0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 52, 60, 68, 76, 84, 92, 100, 108, 116,
+		124, 136, 148, 160, 172, 188, 204, 220, 240, 260, 284, 308, 336, 364, 396, 432,
+		468, 508, 552, 600, 652, 704, 768, 832, 896, 960, 1024,
+	}
+	swbLong16 = []int{
+		0, 8, 16, 24, 32, 40, 48, 56, 64, 72, 80, 88, 100, 112, 124, 136, 148, 160, 172,
+		184, 196, 212, 228, 244, 260, 280, 300, 320, 344, 368, 396, 424, 456, 492, 532,
+		572, 616, 664, 716, 772, 832, 896, 960, 1024,
+	}
+	swbLong8 = []int{
+		0, 12, 24, 36, 48, 60, 72, 84, 96, 108, 120, 132, 144, 156, 172, 188, 204, 220,
+		236, 252, 268, 288, 308, 328, 348, 372, 396, 420, 448, 476, 508, 544, 580, 620,
+		664, 712, 764, 820, 880, 944, 1024,
+	}
+)
+
+// Scalefactor band offsets for short windows
+var (
+	swbShort96 = []int{0, 4, 8, 12, 16, 20, 24, 32, 40, 48, 64, 92, 128}
+	swbShort48 = []int{0, 4, 8, 12, 16, 20, 28, 36, 44, 56, 68, 80, 96, 112, 128}
+	swbShort24 = []int{0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 64, 76, 92, 108, 128}
+	swbShort16 = []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 40, 48, 60, 72, 88, 108, 128}
+	swbShort8  = []int{0, 4, 8, 12, 16, 20, 24, 28, 36, 44, 52, 60, 72, 88, 108, 128}
+)
+
+// swbLong and swbShort give the band offsets by sampling frequency index
+var (
+	swbLong = [13][]int{
+		swbLong96, swbLong96, swbLong64, swbLong48, swbLong48, swbLong32, swbLong24,
+		swbLong24, swbLong16, swbLong16, swbLong16, swbLong8, swbLong8,
+	}
+	swbShort = [13][]int{
+		swbShort96, swbShort96, swbShort96, swbShort48, swbShort48, swbShort48, swbShort24,
+		swbShort24, swbShort16, swbShort16, swbShort16, swbShort8, swbShort8,
+	}
+)
+
+// tnsMaxBandsLong and tnsMaxBandsShort limit the bands TNS filters in the
+// LC profile, Table 4.156
+var (
+	tnsMaxBandsLong  = [13]int{31, 31, 34, 40, 42, 51, 46, 46, 42, 42, 42, 39, 39}
+	tnsMaxBandsShort = [13]int{9, 9, 10, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14}
+)
+
+const (
+	tnsMaxOrderLong  = 12
+	tnsMaxOrderShort = 7
+)
+
+// The window shapes and their halves. Index 0 is the sine window and 1
+// the Kaiser-Bessel derived window; each holds the rising half.
+var (
+	longWindows  [2][1024]float64
+	shortWindows [2][128]float64
+)
+
+func init() {
+	sineWindow(longWindows[0][:])
+	sineWindow(shortWindows[0][:])
+	kbdWindow(longWindows[1][:], 4)
+	kbdWindow(shortWindows[1][:], 6)
+}
+
+// sineWindow fills the rising half of a sine window of length 2*len(w)
+func sineWindow(w []float64) {
+	n := float64(2 * len(w))
+	for i := range w {
+		w[i] = math.Sin(math.Pi / n * (float64(i) + 0.5))
+	}
+}
+
+// kbdWindow fills the rising half of a Kaiser-Bessel derived window of
+// length 2*len(w)
+func kbdWindow(w []float64, alpha float64) {
+	half := len(w)
+	kernel := make([]float64, half+1)
+	var total float64
+	for i := range kernel {
+		x := float64(i-half/2) / float64(half/2)
+		kernel[i] = besselI0(math.Pi * alpha * math.Sqrt(1-x*x))
+		total += kernel[i]
+	}
+	var sum float64
+	for i := range w {
+		sum += kernel[i]
+		w[i] = math.Sqrt(sum / total)
+	}
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
@@ -0,0 +1,147 @@
+package aac
+
+import "math"
+
+// noiseGen is the random generator for perceptual noise substitution
+type noiseGen struct {
+	state uint32
+}
+
+func (n *noiseGen) next() float64 {
+	n.state = n.state*1664525 + 1013904223
+	return float64(int32(n.state))
+}
+
+// bandRange returns the coefficient range of band b in window w
+func (info *icsInfo) bandRange(w, b int) (int, int) {
+	base := w * shortLength
+	return base + info.swb[b], base + info.swb[b+1]
+}
+
+// forBands calls fn for every window, group and band up to max_sfb
+func (info *icsInfo) forBands(fn func(g, w, b int)) {
+	win := 0
+	for g := 0; g < info.groups; g++ {
+		for w := win; w < win+info.groupLen[g]; w++ {
+			for b := 0; b < info.maxSFB; b++ {
+				fn(g, w, b)
+			}
+		}
+		win += info.groupLen[g]
+	}
+}
+
+// fillNoise replaces noise bands with scaled random values. When shared
+// is set, bands flagged in it copy the noise of src before scaling so a
+// mid/side coded pair stays correlated.
+func (s *ics) fillNoise(gen *noiseGen, src *ics, shared *[maxWindows][maxBands]bool) {
+	s.info.forBands(func(g, w, b int) {
+		if s.cb[g][b] != noiseHCB {
+			return
+		}
+		start, end := s.info.bandRange(w, b)
+		var energy float64
+		for i := start; i < end; i++ {
+			if shared != nil && shared[g][b] {
+				s.coef[i] = src.coef[i]
+			} else {
+				s.coef[i] = gen.next()
+			}
+			energy += s.coef[i] * s.coef[i]
+		}
+		if energy == 0 {
+			return
+		}
+		scale := math.Pow(2, 0.25*float64(s.sf[g][b])) / math.Sqrt(energy)
+		for i := start; i < end; i++ {
+			s.coef[i] *= scale
+		}
+	})
+}
+
+// applyMidSide turns mid/side coded bands back into left and right
+func applyMidSide(l, r *ics, used *[maxWindows][maxBands]bool) {
+	l.info.forBands(func(g, w, b int) {
+		if !used[g][b] || l.cb[g][b] == noiseHCB || r.cb[g][b] == intensityHCB || r.cb[g][b] == intensityHCB2 {
+			return
+		}
+		start, end := l.info.bandRange(w, b)
+		for i := start; i < end; i++ {
+			m, s := l.coef[i], r.coef[i]
+			l.coef[i], r.coef[i] = m+s, m-s
+		}
+	})
+}
+
+// applyIntensity reconstructs the right channel of intensity coded bands
+// from the left
+func applyIntensity(l, r *ics, msPresent bool, used *[maxWindows][maxBands]bool) {
+	r.info.forBands(func(g, w, b int) {
+		cb := r.cb[g][b]
+		if cb != intensityHCB && cb != intensityHCB2 {
+			return
+		}
+		scale := math.Pow(0.5, 0.25*float64(r.sf[g][b]))
+		if cb == intensityHCB2 {
+			scale = -scale
+		}
+		if msPresent && used[g][b] {
+			scale = -scale
+		}
+		start, end := r.info.bandRange(w, b)
+		for i := start; i < end; i++ {
+			r.coef[i] = l.coef[i] * scale
+		}
+	})
+}
+
+// applyTNS runs the TNS synthesis filters over the spectrum
+func (s *ics) applyTNS(rateIndex int) {
+	if !s.tnsOn {
+		return
+	}
+	info := &s.info
+	maxBands := tnsMaxBandsLong[rateIndex]
+	if info.windowSequence == eightShortSequence {
+		maxBands = tnsMaxBandsShort[rateIndex]
+	}
+	maxBands = min(maxBands, info.maxSFB)
+
+	for w := 0; w < info.numWindows; w++ {
+		bottom := info.numSWB
+		for _, f := range s.tns[w] {
+			top := bottom
+			bottom = max(top-f.length, 0)
+			if f.order == 0 {
+				continue
+			}
+			start := w*shortLength + info.swb[min(bottom, maxBands)]
+			end := w*shortLength + info.swb[min(top, maxBands)]
+			if end <= start {
+				continue
+			}
+			tnsFilterRange(s.coef[start:end], f.lpc[:f.order+1], f.up)
+		}
+	}
+}
+
+// tnsFilterRange applies an all-pole filter along x, upwards or downwards
+// in frequency
+func tnsFilterRange(x []float64, lpc []float64, up bool) {
+	order := len(lpc) - 1
+	var state [tnsMaxOrderLong]float64
+	n := len(x)
+	for j := 0; j < n; j++ {
+		i := j
+		if !up {
+			i = n - 1 - j
+		}
+		y := x[i]
+		for k := 0; k < order; k++ {
+			y -= lpc[k+1] * state[k]
+		}
+		copy(state[1:order], state[:order-1])
+		state[0] = y
+		x[i] = y
+	}
+}
@@ -1,13 +1,350 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/aac"
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/mp3"
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/mp4"
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/resample"
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/wav"
+)
+
+// Converter turns uploaded videos into MP3 files
 type Converter struct {
-	store *MongoStore
-	queue *MessageQueue
+	store Store
+	queue MessageQueue
 }
 
-func NewConverter(store *MongoStore, queue *MessageQueue) *Converter {
+// NewConverter creates a new Converter instance
+func NewConverter(store Store, queue MessageQueue) *Converter {
 	return &Converter{
 		store: store,
 		queue: queue,
 	}
 }
+
+// HandleMessage converts the video referenced by a queued message and
+// announces the resulting MP3 on the mp3 queue
+func (c *Converter) HandleMessage(body []byte) error {
+	msg := &VideoMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return fmt.Errorf("failed to decode video message: %v", err)
+	}
+	if msg.VideoId == "" {
+		return fmt.Errorf("video message is missing a videoId")
+	}
+
+	job := c.newJobReporter(msg.JobId)
+	mp3Id, err := c.ConvertVideo(msg, job)
+	if err != nil {
+		job.update(JobUpdate{Status: JobFailed, Error: err.Error()})
+		return err
+	}
+
+	if err := c.queue.SendMP3ConvertedMessage(mp3Id, msg.VideoId, msg.UserId, msg.Username); err != nil {
+		c.store.DeleteMP3File(mp3Id)
+		job.update(JobUpdate{Status: JobFailed, Error: "failed to announce the converted file"})
+		return err
+	}
+	job.update(JobUpdate{Status: JobDone, Mp3Id: mp3Id})
+	return nil
+}
+
+// conversion holds the state of one video being converted
+type conversion struct {
+	job      *jobReporter
+	videoId  string
+	owner    string
+	username string
+	opts     ConversionOptions
+	track    *mp4.AudioTrack
+	dec      *aac.Decoder
+	out      *outputFormat
+}
+
+// ConvertVideo extracts the audio track of the video a message refers to,
+// transcodes it with the requested options and stores the result,
+// returning the id of the new audio file. Progress is reported to job.
+func (c *Converter) ConvertVideo(msg *VideoMessage, job *jobReporter) (string, error) {
+	conv := &conversion{
+		job:      job,
+		videoId:  msg.VideoId,
+		owner:    msg.UserId,
+		username: msg.Username,
+	}
+	// Messages queued before user ids were introduced only have the email
+	if conv.owner == "" {
+		conv.owner = msg.Username
+	}
+	if msg.Options != nil {
+		conv.opts = *msg.Options
+	}
+	videoId := msg.VideoId
+
+	conv.job.update(JobUpdate{Status: JobDownloading})
+	video, err := c.store.GetVideoFile(videoId)
+	if err != nil {
+		return "", fmt.Errorf("failed to open video %s: %v", videoId, err)
+	}
+	defer video.Close()
+
+	// The moov box of an MP4 is often at the end of the file, so the video
+	// is spooled to disk where the demuxer can seek rather than held in
+	// memory.
+	tmp, err := os.CreateTemp("", "video-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, video); err != nil {
+		return "", fmt.Errorf("failed to download video %s: %v", videoId, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	conv.job.update(JobUpdate{Status: JobConverting})
+	file, err := mp4.Open(tmp)
+	if err != nil {
+		return "", fmt.Errorf("failed to read video %s: %v", videoId, err)
+	}
+	if conv.track, err = findAudioTrack(file); err != nil {
+		return "", fmt.Errorf("failed to convert video %s: %v", videoId, err)
+	}
+	if conv.dec, err = aac.NewDecoder(conv.track.Config); err != nil {
+		return "", fmt.Errorf("failed to convert video %s: %v", videoId, err)
+	}
+	if conv.out, err = conv.opts.resolve(conv.dec.SampleRate(), conv.dec.Channels()); err != nil {
+		return "", fmt.Errorf("failed to convert video %s: %v", videoId, err)
+	}
+
+	var mp3Id string
+	if conv.out.format == FormatWAV {
+		mp3Id, err = c.convertToWAV(conv)
+	} else {
+		mp3Id, err = c.convertToMP3(conv)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Converted video %s to %s %s for user %s", videoId, conv.out.format, mp3Id, conv.username)
+	return mp3Id, nil
+}
+
+// convertToMP3 streams the encoder output straight into GridFS. A
+// transcoding error closes the pipe with that error, which aborts the
+// upload.
+func (c *Converter) convertToMP3(conv *conversion) (string, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := func() error {
+			enc, err := mp3.NewEncoder(pw, conv.out.mp3)
+			if err != nil {
+				return err
+			}
+			if err := transcode(conv, enc); err != nil {
+				return err
+			}
+			// What is left is flushing the upload
+			conv.job.update(JobUpdate{Status: JobStoring})
+			return nil
+		}()
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	metadata := AudioMetadata{Owner: conv.owner, VideoId: conv.videoId, ContentType: "audio/mpeg"}
+	mp3Id, saveErr := c.store.SaveMP3File(conv.videoId+".mp3", pr, metadata)
+	// Unblock the transcoder if the upload stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err := <-done; err != nil {
+		if saveErr == nil {
+			c.store.DeleteMP3File(mp3Id)
+		}
+		return "", fmt.Errorf("failed to convert video %s: %v", conv.videoId, err)
+	}
+	if saveErr != nil {
+		return "", fmt.Errorf("failed to save mp3 for video %s: %v", conv.videoId, saveErr)
+	}
+	return mp3Id, nil
+}
+
+// convertToWAV writes the audio to a temp file first since the WAVE header
+// is only complete once the length is known
+func (c *Converter) convertToWAV(conv *conversion) (string, error) {
+	tmp, err := os.CreateTemp("", "audio-*.wav")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	enc, err := wav.NewEncoder(tmp, conv.out.sampleRate, conv.out.channels)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert video %s: %v", conv.videoId, err)
+	}
+	if err := transcode(conv, enc); err != nil {
+		return "", fmt.Errorf("failed to convert video %s: %v", conv.videoId, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	conv.job.update(JobUpdate{Status: JobStoring})
+	metadata := AudioMetadata{Owner: conv.owner, VideoId: conv.videoId, ContentType: "audio/wav"}
+	id, err := c.store.SaveMP3File(conv.videoId+".wav", tmp, metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to save wav for video %s: %v", conv.videoId, err)
+	}
+	return id, nil
+}
+
+// findAudioTrack returns the first AAC audio track of a video
+func findAudioTrack(file *mp4.File) (*mp4.AudioTrack, error) {
+	if len(file.AudioTracks) == 0 {
+		return nil, fmt.Errorf("video has no audio track")
+	}
+	for _, track := range file.AudioTracks {
+		if track.Codec == mp4.CodecAAC {
+			return track, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported audio codec %s", file.AudioTracks[0].Codec)
+}
+
+// frameSamples is the number of samples per channel in an AAC frame
+const frameSamples = 1024
+
+// audioEncoder is implemented by the encoders of every output format
+type audioEncoder interface {
+	Encode(pcm []int16) error
+	Close() error
+}
+
+// transcode decodes the samples of an AAC track, trims, remixes and
+// resamples them as requested and feeds them to enc, closing it at the end
+func transcode(conv *conversion, enc audioEncoder) error {
+	dec, opts, out := conv.dec, conv.opts, conv.out
+	rate, channels := dec.SampleRate(), dec.Channels()
+	var resampler *resample.Resampler
+	if out.sampleRate != rate {
+		var err error
+		resampler, err = resample.New(rate, out.sampleRate, out.channels)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Trim points in samples per channel at the source rate
+	start := int64(math.Round(opts.Start * float64(rate)))
+	end := int64(math.MaxInt64)
+	if opts.End > 0 {
+		end = int64(math.Round(opts.End * float64(rate)))
+	}
+
+	// Progress is measured over the part of the track being converted
+	length := min(end, int64(conv.track.SampleCount)*frameSamples) - start
+
+	var pos int64 // position of the next decoded sample
+	var mixed []int16
+	it := conv.track.Samples()
+	for pos < end && it.Next() {
+		if length > 0 && pos > start {
+			conv.job.progress(min(100*float64(pos-start)/float64(length), 100))
+		}
+		pcm, err := dec.Decode(it.Sample().Data)
+		if err != nil {
+			return fmt.Errorf("sample %d: %v", it.Sample().Index, err)
+		}
+		n := int64(len(pcm) / channels)
+		from, to := max(start-pos, 0), min(end-pos, n)
+		pos += n
+		if from >= to {
+			continue
+		}
+
+		pcm = pcm[from*int64(channels) : to*int64(channels)]
+		if channels != out.channels {
+			mixed = remix(mixed[:0], pcm, channels, out.channels)
+			pcm = mixed
+		}
+		if resampler != nil {
+			pcm = resampler.Process(pcm)
+		}
+		if err := enc.Encode(pcm); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if pos <= start {
+		return fmt.Errorf("trim start %gs is past the end of the audio", opts.Start)
+	}
+	if resampler != nil {
+		if err := enc.Encode(resampler.Flush()); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// remix converts interleaved PCM between channel counts. Multichannel
+// input in the AAC channel order (centre, front left, front right, ...)
+// is folded down to stereo first.
+func remix(dst, pcm []int16, in, out int) []int16 {
+	for i := 0; i+in <= len(pcm); i += in {
+		frame := pcm[i : i+in]
+		var l, r float64
+		switch in {
+		case 1:
+			l, r = float64(frame[0]), float64(frame[0])
+		case 2:
+			l, r = float64(frame[0]), float64(frame[1])
+		default:
+			l, r = downmix(frame)
+		}
+		if out == 1 {
+			dst = append(dst, clip16((l+r)/2))
+		} else {
+			dst = append(dst, clip16(l), clip16(r))
+		}
+	}
+	return dst
+}
+
+// downmix folds one multichannel frame down to stereo
+func downmix(frame []int16) (float64, float64) {
+	centre := float64(frame[0]) * 0.7071
+	l := centre + float64(frame[1])
+	r := centre + float64(frame[2])
+	// Remaining channels come in left/right pairs, with a trailing LFE
+	// channel that is dropped
+	for c := 3; c+1 < len(frame); c += 2 {
+		l += float64(frame[c]) * 0.7071
+		r += float64(frame[c+1]) * 0.7071
+	}
+	// Scale so a full scale signal in every channel stays in range
+	gain := 1 / (1 + 0.7071*float64(1+(len(frame)-3)/2))
+	return l * gain, r * gain
+}
+
+func clip16(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
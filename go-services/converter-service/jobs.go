@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Job statuses, in the order a successful job goes through them
+const (
+	JobQueued      = "queued"
+	JobDownloading = "downloading"
+	JobConverting  = "converting"
+	JobStoring     = "storing"
+	JobDone        = "done"
+	JobFailed      = "failed"
+)
+
+// JobUpdate describes a status change of a job
+type JobUpdate struct {
+	Status string
+	Mp3Id  string // set when the job is done
+	Error  string // set when the job failed
+}
+
+// JobEvent is published on the broker for every status change and for
+// progress while converting. Seq increases with every event of a job so
+// clients can resume a stream of events.
+type JobEvent struct {
+	JobId   string    `json:"jobId"`
+	Seq     int64     `json:"seq"`
+	Status  string    `json:"status"`
+	Percent float64   `json:"percent"`
+	Mp3Id   string    `json:"mp3Id,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+const (
+	// progressInterval and progressStep throttle progress events to one
+	// per interval unless the percentage moved by at least a step
+	progressInterval = time.Second
+	progressStep     = 5.0
+)
+
+// jobReporter records the status of a job in the store and publishes its
+// events. Failing to report does not fail the conversion.
+type jobReporter struct {
+	store Store
+	queue MessageQueue
+	jobId string
+
+	mu       sync.Mutex
+	seq      int64
+	status   string
+	percent  float64
+	lastSent time.Time
+}
+
+// newJobReporter creates a new jobReporter instance. Messages queued
+// before jobs existed have no job id and are not tracked.
+func (c *Converter) newJobReporter(jobId string) *jobReporter {
+	return &jobReporter{store: c.store, queue: c.queue, jobId: jobId}
+}
+
+// update moves the job to a new status
+func (j *jobReporter) update(update JobUpdate) {
+	if j.jobId == "" {
+		return
+	}
+	if err := j.store.UpdateJob(j.jobId, update); err != nil {
+		log.Printf("failed to update job %s to %s: %v", j.jobId, update.Status, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = update.Status
+	if update.Status == JobDone {
+		j.percent = 100
+	}
+	j.publish(&JobEvent{Mp3Id: update.Mp3Id, Error: update.Error})
+}
+
+// progress reports how much of the audio has been converted
+func (j *jobReporter) progress(percent float64) {
+	if j.jobId == "" {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if percent-j.percent < progressStep && time.Since(j.lastSent) < progressInterval {
+		return
+	}
+	j.percent = percent
+	j.publish(&JobEvent{})
+}
+
+// publish fills in the job state and sends an event. The caller holds mu.
+func (j *jobReporter) publish(event *JobEvent) {
+	j.seq++
+	event.JobId = j.jobId
+	event.Seq = j.seq
+	event.Status = j.status
+	event.Percent = j.percent
+	event.Time = time.Now().UTC()
+	j.lastSent = event.Time
+	if err := j.queue.PublishJobEvent(event); err != nil {
+		log.Printf("failed to publish event for job %s: %v", j.jobId, err)
+	}
+}
@@ -30,7 +30,9 @@ func main() {
 		false,  // no-wait
 		nil,    // args
 	)
-	failOnError(err, "failed to consume a RabbitMQ message: %v")
+	failOnError(err, "failed to consume a RabbitMQ message")
+
+	converter := NewConverter(store, mq)
 
 	var forever chan struct{}
 
@@ -38,7 +40,7 @@ func main() {
 		// Convert the video
 		for d := range msgs {
 			log.Printf("Received a message: %s", d.Body)
-			if err := ConvertVideo(store, string(d.Body), "admin"); err != nil {
+			if err := converter.HandleMessage(d.Body); err != nil {
 				log.Printf("failed to convert a video: %v", err)
 			}
 		}
@@ -47,15 +49,3 @@ func main() {
 	log.Printf(" Converter is Waiting for videos to convert...")
 	<-forever
 }
-
-func ConvertVideo(store Store, id string, username string) error {
-	video, err := store.GetVideoFile(id)
-	if err != nil {
-		return err
-	}
-	buf := make([]byte, 2040)
-	video.Read(buf)
-	log.Printf("Converted a Video: %v", buf)
-
-	return nil
-}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -14,13 +16,23 @@ import (
 
 type Store interface {
 	GetVideoFile(objectId string) (io.ReadCloser, error)
-	SaveMP3File(filename string, file io.Reader) (string, error)
+	SaveMP3File(filename string, file io.Reader, metadata AudioMetadata) (string, error)
 	DeleteMP3File(objectId string) error
+	UpdateJob(jobId string, update JobUpdate) error
+}
+
+// AudioMetadata is stored with every converted file so the gateway can
+// check ownership and serve it with the right content type
+type AudioMetadata struct {
+	Owner       string `bson:"owner"`
+	VideoId     string `bson:"videoId"`
+	ContentType string `bson:"contentType"`
 }
 
 type MongoStore struct {
 	gfsVideo *gridfs.Bucket
 	gfsMp3   *gridfs.Bucket
+	jobs     *mongo.Collection
 	client   *mongo.Client
 }
 
@@ -41,13 +53,13 @@ func NewMongoStore(conStr string) (*MongoStore, error) {
 
 	// Check the connection for the databases
 	var result bson.M
-	if err := videos_db.RunCommand(context.Background(), bson.D{{"ping", 1}}).Decode(&result); err != nil {
+	if err := videos_db.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}}).Decode(&result); err != nil {
 		log.Println(result)
 		return nil, fmt.Errorf("failed to ping videos database: %v", err)
 	}
-	if err := mp3_db.RunCommand(context.Background(), bson.D{{"ping", 1}}).Decode(&result); err != nil {
+	if err := mp3_db.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}}).Decode(&result); err != nil {
 		log.Println(result)
-		return nil, fmt.Errorf("failed to ping videos database: %v", err)
+		return nil, fmt.Errorf("failed to ping mp3 database: %v", err)
 	}
 	log.Println("Successfully connected to Videos and MP3 DBs.")
 
@@ -56,7 +68,7 @@ func NewMongoStore(conStr string) (*MongoStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create GridFS bucket: %v", err)
 	}
-	gfsMp3, err := gridfs.NewBucket(videos_db)
+	gfsMp3, err := gridfs.NewBucket(mp3_db)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create GridFS bucket: %v", err)
 	}
@@ -64,22 +76,53 @@ func NewMongoStore(conStr string) (*MongoStore, error) {
 	return &MongoStore{
 		gfsVideo: gfsVideo,
 		gfsMp3:   gfsMp3,
+		jobs:     videos_db.Collection("jobs"),
 		client:   client,
 	}, nil
 }
 
 func (s *MongoStore) GetVideoFile(objectId string) (io.ReadCloser, error) {
-	return s.gfsVideo.OpenDownloadStream(objectId)
+	id, err := primitive.ObjectIDFromHex(objectId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid video id %q: %v", objectId, err)
+	}
+	return s.gfsVideo.OpenDownloadStream(id)
 }
 
-func (s *MongoStore) SaveMP3File(filename string, file io.Reader) (string, error) {
-	objectId, err := s.gfsMp3.UploadFromStream(filename, file)
+func (s *MongoStore) SaveMP3File(filename string, file io.Reader, metadata AudioMetadata) (string, error) {
+	opts := options.GridFSUpload().SetMetadata(metadata)
+	objectId, err := s.gfsMp3.UploadFromStream(filename, file, opts)
 	if err != nil {
 		return "", err
 	}
-	return objectId.String(), nil
+	return objectId.Hex(), nil
 }
 
 func (s *MongoStore) DeleteMP3File(objectId string) error {
-	return s.gfsMp3.Delete(objectId)
+	id, err := primitive.ObjectIDFromHex(objectId)
+	if err != nil {
+		return fmt.Errorf("invalid mp3 id %q: %v", objectId, err)
+	}
+	return s.gfsMp3.Delete(id)
+}
+
+// UpdateJob moves a job to a new status and records the transition
+func (s *MongoStore) UpdateJob(jobId string, update JobUpdate) error {
+	id, err := primitive.ObjectIDFromHex(jobId)
+	if err != nil {
+		return fmt.Errorf("invalid job id %q: %v", jobId, err)
+	}
+	now := time.Now().UTC()
+	set := bson.M{"status": update.Status, "updatedAt": now}
+	if update.Mp3Id != "" {
+		set["mp3Id"] = update.Mp3Id
+	}
+	if update.Error != "" {
+		set["error"] = update.Error
+	}
+	_, err = s.jobs.UpdateByID(context.Background(), id, bson.M{
+		"$set":  set,
+		"$push": bson.M{"history": bson.M{"status": update.Status, "time": now}},
+	})
+	return err
 }
@@ -0,0 +1,46 @@
+package mp3
+
+// bitWriter packs values most significant bit first into a byte slice
+type bitWriter struct {
+	buf   []byte
+	cache uint64
+	n     uint // bits held in cache
+}
+
+// write appends the low nbits bits of v
+func (w *bitWriter) write(v uint32, nbits int) {
+	for nbits > 0 {
+		take := nbits
+		if take > 24 {
+			take = 24
+		}
+		nbits -= take
+		w.cache = w.cache<<uint(take) | uint64(v>>uint(nbits))&(1<<uint(take)-1)
+		w.n += uint(take)
+		for w.n >= 8 {
+			w.n -= 8
+			w.buf = append(w.buf, byte(w.cache>>w.n))
+		}
+	}
+}
+
+// bits returns the number of bits written so far
+func (w *bitWriter) bits() int {
+	return len(w.buf)*8 + int(w.n)
+}
+
+// align pads the output with zero bits up to the next byte boundary
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.write(0, int(8-w.n))
+	}
+}
+
+// bytes returns the byte aligned output and resets the writer
+func (w *bitWriter) bytes() []byte {
+	w.align()
+	b := w.buf
+	w.buf = nil
+	w.cache = 0
+	return b
+}
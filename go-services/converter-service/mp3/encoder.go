@@ -0,0 +1,606 @@
+// Package mp3 implements an MPEG-1 and MPEG-2 Layer III encoder in pure Go.
+//
+// The encoder takes interleaved 16-bit PCM and writes a stream of MP3
+// frames to an io.Writer. It supports constant, variable and average
+// bitrates and mono, stereo and joint (mid/side) stereo output. MPEG-1 is
+// used for 32, 44.1 and 48 kHz and MPEG-2 for 16, 22.05 and 24 kHz.
+package mp3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Mode is the channel mode of the encoded stream
+type Mode int
+
+const (
+	// JointStereo switches each frame between left/right and mid/side
+	// coding, whichever suits the signal
+	JointStereo Mode = iota
+	// Stereo codes the left and right channels independently
+	Stereo
+	// Mono downmixes the input to a single channel
+	Mono
+)
+
+// BitrateMode selects how the encoder spends bits
+type BitrateMode int
+
+const (
+	// CBR gives every frame the same bitrate
+	CBR BitrateMode = iota
+	// VBR picks each frame's bitrate to reach the quality setting
+	VBR
+	// ABR varies the bitrate per frame but holds the average near Bitrate
+	ABR
+)
+
+// Options configures an Encoder
+type Options struct {
+	SampleRate  int // input and output sample rate in Hz
+	Channels    int // interleaved input channels, 1 or 2
+	Mode        Mode
+	BitrateMode BitrateMode
+	// Bitrate is the bitrate in kbit/s for CBR and the target for ABR.
+	// Zero picks 128 kbit/s, or 64 kbit/s at MPEG-2 sample rates.
+	Bitrate int
+	// Quality goes from 0, the best, to 9. For VBR it sets the target
+	// quality; for CBR and ABR higher values trade quality for speed.
+	Quality int
+}
+
+var (
+	// ErrSampleRate is returned for sample rates Layer III cannot code
+	ErrSampleRate = errors.New("mp3: unsupported sample rate")
+	// ErrClosed is returned when encoding after Close
+	ErrClosed = errors.New("mp3: encoder closed")
+)
+
+const (
+	// maxMainDataBits bounds the main data a frame may use including the
+	// reservoir, the decoder input buffer of ISO/IEC 11172-3
+	maxMainDataBits = 7680
+	// vbrOffset and its step map VBR quality 0..9 to a mask offset in dB
+	vbrOffset     = 24.0
+	vbrOffsetStep = 2.0
+	// cbrOffset is the mask offset used to shape the noise at fixed
+	// bitrates, where the bit budget then sets the overall level
+	cbrOffset = 12.0
+	// maxABRAdjust bounds how far ABR moves the mask offset in dB, and
+	// abrDecay makes it follow the recent bitrate rather than the whole
+	// stream so far
+	maxABRAdjust = 30.0
+	abrDecay     = 0.995
+	// msThreshold is the side to mid energy ratio below which joint
+	// stereo codes a frame as mid/side
+	msThreshold = 0.5
+)
+
+// Encoder encodes PCM into MP3 frames
+type Encoder struct {
+	w    io.Writer
+	opts Options
+
+	version     int // 0 for MPEG-1, 1 for MPEG-2
+	rateIndex   int
+	granules    int // granules per frame
+	channels    int // output channels
+	sideBytes   int
+	bitrateIdx  int // CBR bitrate index
+	frameFactor int // bytes per frame are frameFactor*kbps*1000/rate
+
+	fb  [2]filterbank
+	psy *psyModel
+	q   quantizer
+	gr  [2][2]granule
+
+	// pcm holds buffered input samples per output channel
+	pcm  [2][]float64
+	slot int // CBR padding accumulator
+
+	// reservoir is the number of bytes at the end of the frames written
+	// so far that main data has not filled yet
+	reservoir int
+	pending   []pendingFrame
+	data      []byte
+
+	abrError float64 // bits spent above the ABR target so far
+
+	closed bool
+	err    error
+}
+
+// pendingFrame is a frame whose main data slots are not filled yet
+type pendingFrame struct {
+	head  []byte // header and side information
+	slots int    // bytes of main data the frame carries
+}
+
+// SampleRates returns the sample rates the encoder supports in Hz
+func SampleRates() []int {
+	var rates []int
+	for _, version := range sampleRates {
+		rates = append(rates, version[:]...)
+	}
+	return rates
+}
+
+// Bitrates returns the CBR bitrates in kbit/s available at a sample rate,
+// or nil if the rate is not supported
+func Bitrates(sampleRate int) []int {
+	for v := range sampleRates {
+		for _, rate := range sampleRates[v] {
+			if rate == sampleRate {
+				return append([]int(nil), bitrates[v][1:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// NewEncoder creates a new Encoder instance that writes to w
+func NewEncoder(w io.Writer, opts Options) (*Encoder, error) {
+	e := &Encoder{w: w, opts: opts, version: -1}
+	for v := range sampleRates {
+		for i, rate := range sampleRates[v] {
+			if rate == opts.SampleRate {
+				e.version, e.rateIndex = v, i
+			}
+		}
+	}
+	if e.version < 0 {
+		return nil, fmt.Errorf("%w: %d Hz", ErrSampleRate, opts.SampleRate)
+	}
+	if opts.Channels != 1 && opts.Channels != 2 {
+		return nil, fmt.Errorf("mp3: unsupported channel count %d", opts.Channels)
+	}
+	if opts.Mode < JointStereo || opts.Mode > Mono {
+		return nil, fmt.Errorf("mp3: invalid mode %d", opts.Mode)
+	}
+	if opts.BitrateMode < CBR || opts.BitrateMode > ABR {
+		return nil, fmt.Errorf("mp3: invalid bitrate mode %d", opts.BitrateMode)
+	}
+	if opts.Quality < 0 || opts.Quality > 9 {
+		return nil, fmt.Errorf("mp3: quality %d out of range 0-9", opts.Quality)
+	}
+
+	table := bitrates[e.version]
+	if e.opts.Bitrate == 0 {
+		e.opts.Bitrate = 128
+		if e.version == 1 {
+			e.opts.Bitrate = 64
+		}
+	}
+	switch opts.BitrateMode {
+	case CBR:
+		for i := 1; i < len(table); i++ {
+			if table[i] == e.opts.Bitrate {
+				e.bitrateIdx = i
+			}
+		}
+		if e.bitrateIdx == 0 {
+			return nil, fmt.Errorf("mp3: unsupported bitrate %d kbit/s", e.opts.Bitrate)
+		}
+	case ABR:
+		if e.opts.Bitrate < table[1] || e.opts.Bitrate > table[len(table)-1] {
+			return nil, fmt.Errorf("mp3: bitrate %d kbit/s out of range %d-%d",
+				e.opts.Bitrate, table[1], table[len(table)-1])
+		}
+	}
+
+	e.channels = 2
+	if opts.Mode == Mono {
+		e.channels = 1
+	}
+	if e.version == 0 {
+		e.granules, e.frameFactor = 2, 144
+		e.sideBytes = 32
+		if e.channels == 1 {
+			e.sideBytes = 17
+		}
+	} else {
+		e.granules, e.frameFactor = 1, 72
+		e.sideBytes = 17
+		if e.channels == 1 {
+			e.sideBytes = 9
+		}
+	}
+
+	sfb := sfbLong[e.version][e.rateIndex]
+	e.q = quantizer{sfb: sfb, lsf: e.version == 1, fast: opts.Quality >= 7 && opts.BitrateMode != VBR}
+	e.psy = newPsyModel(sfb, opts.SampleRate, e.lowpass())
+	return e, nil
+}
+
+// lowpassTable maps kbit/s per channel to a lowpass frequency in Hz
+var lowpassTable = [][2]float64{
+	{8, 2000}, {16, 3700}, {24, 5800}, {32, 8000}, {40, 10500}, {48, 13000},
+	{56, 15000}, {64, 17000}, {80, 18500}, {96, 19500}, {112, 20000}, {128, 20500},
+}
+
+// lowpass picks the lowpass frequency for the bitrate or VBR quality
+func (e *Encoder) lowpass() float64 {
+	kbps := float64(e.opts.Bitrate)
+	if e.opts.BitrateMode == VBR {
+		// Roughly the average bitrate each quality level ends up at
+		kbps = 256 - 20*float64(e.opts.Quality)
+		if e.version == 1 {
+			kbps /= 2
+		}
+	}
+	kbps /= float64(e.channels)
+	if e.opts.Mode == JointStereo {
+		// Mid/side frames spend most bits on the mid channel
+		kbps *= 1.25
+	}
+
+	f := lowpassTable[len(lowpassTable)-1][1]
+	for i, p := range lowpassTable {
+		if kbps <= p[0] {
+			if i == 0 {
+				f = p[1]
+			} else {
+				q := lowpassTable[i-1]
+				f = q[1] + (p[1]-q[1])*(kbps-q[0])/(p[0]-q[0])
+			}
+			break
+		}
+	}
+	return math.Min(f, 0.48*float64(e.opts.SampleRate))
+}
+
+// samplesPerFrame returns the PCM samples per channel in each frame
+func (e *Encoder) samplesPerFrame() int {
+	return e.granules * granuleSize
+}
+
+// Encode encodes interleaved PCM samples. Samples that do not fill a
+// whole frame are kept until the next call or Close.
+func (e *Encoder) Encode(pcm []int16) error {
+	if e.closed {
+		return ErrClosed
+	}
+	if e.err != nil {
+		return e.err
+	}
+	in := e.opts.Channels
+	for i := 0; i+in <= len(pcm); i += in {
+		l := float64(pcm[i]) / 32768
+		r := l
+		if in == 2 {
+			r = float64(pcm[i+1]) / 32768
+		}
+		if e.channels == 1 {
+			e.pcm[0] = append(e.pcm[0], (l+r)/2)
+		} else {
+			e.pcm[0] = append(e.pcm[0], l)
+			e.pcm[1] = append(e.pcm[1], r)
+		}
+	}
+
+	n := e.samplesPerFrame()
+	done := 0
+	for len(e.pcm[0])-done >= n {
+		var frame [2][]float64
+		for ch := 0; ch < e.channels; ch++ {
+			frame[ch] = e.pcm[ch][done : done+n]
+		}
+		if err := e.encodeFrame(frame); err != nil {
+			e.err = err
+			return err
+		}
+		done += n
+	}
+	for ch := 0; ch < e.channels; ch++ {
+		e.pcm[ch] = append(e.pcm[ch][:0], e.pcm[ch][done:]...)
+	}
+	return nil
+}
+
+// Close encodes the buffered samples padded with silence, flushes the
+// filter bank and writes the remaining frames. It does not close the
+// underlying writer.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err != nil {
+		return e.err
+	}
+
+	// One extra frame of silence pushes the filter bank delay out
+	n := e.samplesPerFrame()
+	pad := 2*n - len(e.pcm[0])%n
+	if len(e.pcm[0])%n == 0 {
+		pad = n
+	}
+	for ch := 0; ch < e.channels; ch++ {
+		e.pcm[ch] = append(e.pcm[ch], make([]float64, pad)...)
+	}
+	for done := 0; done+n <= len(e.pcm[0]); done += n {
+		var frame [2][]float64
+		for ch := 0; ch < e.channels; ch++ {
+			frame[ch] = e.pcm[ch][done : done+n]
+		}
+		if err := e.encodeFrame(frame); err != nil {
+			e.err = err
+			return err
+		}
+	}
+
+	// Fill the slots left in the last frames
+	for _, f := range e.pending {
+		if len(e.data) < f.slots {
+			e.data = append(e.data, make([]byte, f.slots-len(e.data))...)
+		}
+		if err := e.emit(f); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	e.pending = nil
+	return nil
+}
+
+// frameBytes returns the size of a frame at a bitrate index
+func (e *Encoder) frameBytes(index, padding int) int {
+	return e.frameFactor*bitrates[e.version][index]*1000/e.opts.SampleRate + padding
+}
+
+// maxReservoir returns how many bytes of the reservoir a frame of the
+// given size may use
+func (e *Encoder) maxReservoir(frameBytes int) int {
+	limit := 511
+	if e.version == 1 {
+		limit = 255
+	}
+	return max(0, min(limit, maxMainDataBits/8-frameBytes))
+}
+
+// encodeFrame encodes one frame of PCM, one slice per output channel
+func (e *Encoder) encodeFrame(pcm [2][]float64) error {
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &e.gr[gr][ch]
+			e.fb[ch].granule(pcm[ch][gr*granuleSize:], &g.xr)
+			e.psy.lowpass(&g.xr)
+		}
+	}
+
+	ms := e.opts.Mode == JointStereo && e.useMidSide()
+	if ms {
+		for gr := 0; gr < e.granules; gr++ {
+			l, r := &e.gr[gr][0].xr, &e.gr[gr][1].xr
+			for i := range l {
+				m := (l[i] + r[i]) * math.Sqrt2 / 2
+				s := (l[i] - r[i]) * math.Sqrt2 / 2
+				l[i], r[i] = m, s
+			}
+		}
+	}
+
+	offset := cbrOffset
+	switch e.opts.BitrateMode {
+	case VBR:
+		offset = vbrOffset - vbrOffsetStep*float64(e.opts.Quality)
+	case ABR:
+		adjust := e.abrError / float64(e.meanFrameBits())
+		offset = cbrOffset - math.Max(-maxABRAdjust, math.Min(maxABRAdjust, adjust))
+	}
+
+	desired := 0
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &e.gr[gr][ch]
+			e.q.prepare(g)
+			e.psy.threshold(g, offset)
+			e.q.shape(g)
+			if g.part23Bits > maxPart23Bits {
+				e.q.fit(g, maxPart23Bits)
+			}
+			desired += g.part23Bits
+		}
+	}
+
+	index, padding := e.bitrateIdx, 0
+	if e.opts.BitrateMode == CBR {
+		e.slot += e.frameFactor * bitrates[e.version][index] * 1000 % e.opts.SampleRate
+		if e.slot >= e.opts.SampleRate {
+			e.slot -= e.opts.SampleRate
+			padding = 1
+		}
+	} else {
+		index = e.pickBitrate(desired)
+	}
+	size := e.frameBytes(index, padding)
+	slots := size - 4 - e.sideBytes
+
+	// Bytes beyond what main_data_begin can reach are stuffed with zeros
+	limit := e.maxReservoir(size)
+	if e.reservoir > limit {
+		e.data = append(e.data, make([]byte, e.reservoir-limit)...)
+		e.reservoir = limit
+	}
+	e.allocate(desired, (slots+e.reservoir)*8, limit*8)
+
+	head := e.writeHeader(index, padding, ms)
+	var main bitWriter
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &e.gr[gr][ch]
+			e.q.writeScalefactors(&main, g)
+			e.q.writeHuffman(&main, g)
+		}
+	}
+	body := main.bytes()
+
+	e.data = append(e.data, body...)
+	e.reservoir += slots - len(body)
+	e.pending = append(e.pending, pendingFrame{head: head, slots: slots})
+	if e.opts.BitrateMode == ABR {
+		e.abrError = e.abrError*abrDecay + float64(size*8-e.meanFrameBits())
+	}
+
+	for len(e.pending) > 0 && len(e.data) >= e.pending[0].slots {
+		if err := e.emit(e.pending[0]); err != nil {
+			return err
+		}
+		e.pending = e.pending[1:]
+	}
+	return nil
+}
+
+// emit writes a frame whose main data slots are available
+func (e *Encoder) emit(f pendingFrame) error {
+	if _, err := e.w.Write(f.head); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(e.data[:f.slots]); err != nil {
+		return err
+	}
+	e.data = append(e.data[:0], e.data[f.slots:]...)
+	return nil
+}
+
+// meanFrameBits returns the frame size in bits at the ABR target bitrate
+func (e *Encoder) meanFrameBits() int {
+	return e.frameFactor * e.opts.Bitrate * 1000 / e.opts.SampleRate * 8
+}
+
+// pickBitrate returns the lowest bitrate index whose frame holds the
+// desired bits together with the reservoir
+func (e *Encoder) pickBitrate(desired int) int {
+	table := bitrates[e.version]
+	for i := 1; i < len(table); i++ {
+		size := e.frameBytes(i, 0)
+		avail := size - 4 - e.sideBytes + min(e.reservoir, e.maxReservoir(size))
+		if desired <= avail*8 {
+			return i
+		}
+	}
+	return len(table) - 1
+}
+
+// useMidSide decides whether the frame is coded as mid/side
+func (e *Encoder) useMidSide() bool {
+	var mid, side float64
+	for gr := 0; gr < e.granules; gr++ {
+		l, r := &e.gr[gr][0].xr, &e.gr[gr][1].xr
+		for i := range l {
+			m, s := l[i]+r[i], l[i]-r[i]
+			mid += m * m
+			side += s * s
+		}
+	}
+	return side < msThreshold*mid
+}
+
+// allocate fits the granules into avail bits. Bits that would overflow
+// the reservoir are spent on finer quantization instead.
+func (e *Encoder) allocate(desired, avail, maxReservoir int) {
+	n := e.granules * e.channels
+	if desired > avail {
+		for gr := 0; gr < e.granules; gr++ {
+			for ch := 0; ch < e.channels; ch++ {
+				g := &e.gr[gr][ch]
+				budget := avail / n
+				if desired > 0 {
+					budget = int(int64(avail) * int64(g.part23Bits) / int64(desired))
+				}
+				e.q.fit(g, budget)
+			}
+		}
+	} else if extra := avail - desired - maxReservoir; extra > 0 && e.opts.BitrateMode == CBR {
+		for gr := 0; gr < e.granules; gr++ {
+			for ch := 0; ch < e.channels; ch++ {
+				g := &e.gr[gr][ch]
+				e.q.fit(g, g.part23Bits+extra/n)
+			}
+		}
+	}
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			e.q.finish(&e.gr[gr][ch])
+		}
+	}
+}
+
+// writeHeader returns the frame header followed by the side information
+func (e *Encoder) writeHeader(index, padding int, ms bool) []byte {
+	var w bitWriter
+	w.write(0x7ff, 11)
+	if e.version == 0 {
+		w.write(3, 2)
+	} else {
+		w.write(2, 2)
+	}
+	w.write(1, 2) // Layer III
+	w.write(1, 1) // no CRC
+	w.write(uint32(index), 4)
+	w.write(uint32(e.rateIndex), 2)
+	w.write(uint32(padding), 1)
+	w.write(0, 1) // private bit
+
+	switch {
+	case e.channels == 1:
+		w.write(3, 2)
+		w.write(0, 2)
+	case e.opts.Mode == JointStereo:
+		w.write(1, 2)
+		if ms {
+			w.write(2, 2)
+		} else {
+			w.write(0, 2)
+		}
+	default:
+		w.write(0, 2)
+		w.write(0, 2)
+	}
+	w.write(0, 1) // copyright
+	w.write(1, 1) // original
+	w.write(0, 2) // no emphasis
+
+	if e.version == 0 {
+		w.write(uint32(e.reservoir), 9)
+		if e.channels == 1 {
+			w.write(0, 5)
+		} else {
+			w.write(0, 3)
+		}
+		// No scalefactor sharing between granules
+		w.write(0, 4*e.channels)
+	} else {
+		w.write(uint32(e.reservoir), 8)
+		w.write(0, e.channels)
+	}
+
+	for gr := 0; gr < e.granules; gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &e.gr[gr][ch]
+			w.write(uint32(g.part23Bits), 12)
+			w.write(uint32(g.bigValues), 9)
+			w.write(uint32(g.globalGain), 8)
+			if e.version == 0 {
+				w.write(uint32(g.sfCompress), 4)
+			} else {
+				w.write(uint32(g.sfCompress), 9)
+			}
+			w.write(0, 1) // long blocks only
+			for _, t := range g.tableSelect {
+				w.write(uint32(t), 5)
+			}
+			w.write(uint32(g.region0), 4)
+			w.write(uint32(g.region1), 3)
+			if e.version == 0 {
+				w.write(0, 1) // no preflag
+			}
+			w.write(uint32(g.scalefacScale), 1)
+			w.write(uint32(g.count1Table), 1)
+		}
+	}
+	return w.bytes()
+}
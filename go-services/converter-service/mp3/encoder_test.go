@@ -0,0 +1,343 @@
+package mp3
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	gomp3 "github.com/hajimehoshi/go-mp3"
+)
+
+// frameHeader holds the fields of a frame header the tests check
+type frameHeader struct {
+	version       int // 0 for MPEG-1, 1 for MPEG-2
+	sampleRate    int
+	bitrate       int // kbit/s
+	mode          int // channel_mode
+	modeExt       int // mode_extension, 2 for mid/side
+	mainDataBegin int
+	size          int
+}
+
+// parseFrames splits an encoded stream into frames, failing on a lost
+// sync, a header the encoder does not write or main data that starts
+// before the stream does
+func parseFrames(t *testing.T, b []byte) []frameHeader {
+	t.Helper()
+	var frames []frameHeader
+	mainData := 0 // main data bytes in the frames so far
+	for len(b) > 0 {
+		if len(b) < 6 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+			t.Fatalf("lost sync at frame %d", len(frames))
+		}
+		var f frameHeader
+		switch b[1] >> 3 & 3 {
+		case 3:
+			f.version = 0
+		case 2:
+			f.version = 1
+		default:
+			t.Fatalf("frame %d: bad version bits %02x", len(frames), b[1])
+		}
+		if b[1]>>1&3 != 1 || b[1]&1 != 1 {
+			t.Fatalf("frame %d: not Layer III without CRC: %02x", len(frames), b[1])
+		}
+		bitrateIdx, rateIdx, padding := int(b[2]>>4), int(b[2]>>2&3), int(b[2]>>1&1)
+		if bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+			t.Fatalf("frame %d: bad bitrate or sample rate index %02x", len(frames), b[2])
+		}
+		f.bitrate = bitrates[f.version][bitrateIdx]
+		f.sampleRate = sampleRates[f.version][rateIdx]
+		f.mode, f.modeExt = int(b[3]>>6), int(b[3]>>4&3)
+
+		factor, sideBytes := 144, 32
+		if f.mode == 3 {
+			sideBytes = 17
+		}
+		if f.version == 0 {
+			f.mainDataBegin = int(b[4])<<1 | int(b[5]>>7)
+		} else {
+			factor, sideBytes = 72, sideBytes/2+1
+			f.mainDataBegin = int(b[4])
+		}
+		f.size = factor*f.bitrate*1000/f.sampleRate + padding
+		if f.size > len(b) {
+			t.Fatalf("frame %d: %d bytes, %d left in the stream", len(frames), f.size, len(b))
+		}
+		if f.mainDataBegin > mainData {
+			t.Fatalf("frame %d: main data begins %d bytes back, only %d written",
+				len(frames), f.mainDataBegin, mainData)
+		}
+		mainData += f.size - 4 - sideBytes
+		frames = append(frames, f)
+		b = b[f.size:]
+	}
+	return frames
+}
+
+// signal returns seconds of interleaved PCM with the same sine of freq Hz
+// in every channel, plus noise at noise times the sine's amplitude
+func signal(sampleRate, channels int, freq, amplitude, noise, seconds float64) []int16 {
+	rng := rand.New(rand.NewPCG(1, 2))
+	n := int(seconds * float64(sampleRate))
+	pcm := make([]int16, 0, n*channels)
+	for i := 0; i < n; i++ {
+		v := math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate)) + noise*(2*rng.Float64()-1)
+		for ch := 0; ch < channels; ch++ {
+			pcm = append(pcm, int16(amplitude*32767*v/(1+noise)))
+		}
+	}
+	return pcm
+}
+
+func encode(t *testing.T, opts Options, pcm []int16) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	enc, err := NewEncoder(&out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes make the encoder buffer partial frames
+	for len(pcm) > 0 {
+		n := min(len(pcm), 1001*opts.Channels)
+		if err := enc.Encode(pcm[:n]); err != nil {
+			t.Fatal(err)
+		}
+		pcm = pcm[n:]
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// meanBitrate returns the average bitrate of the frames in kbit/s
+func meanBitrate(frames []frameHeader) float64 {
+	bytes := 0
+	for _, f := range frames {
+		bytes += f.size
+	}
+	samples := 1152
+	if frames[0].version == 1 {
+		samples = 576
+	}
+	return float64(bytes) * 8 * float64(frames[0].sampleRate) / float64(len(frames)*samples) / 1000
+}
+
+func TestEncodeFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		sine  bool
+		modes []int // channel modes the frames may use
+	}{
+		{"joint stereo 44100", Options{SampleRate: 44100, Channels: 2, Bitrate: 128}, true, []int{1}},
+		{"stereo 48000", Options{SampleRate: 48000, Channels: 2, Mode: Stereo, Bitrate: 192}, true, []int{0}},
+		{"mono 32000", Options{SampleRate: 32000, Channels: 1, Mode: Mono, Bitrate: 64}, true, []int{3}},
+		{"downmix 22050", Options{SampleRate: 22050, Channels: 2, Mode: Mono, Bitrate: 32}, true, []int{3}},
+		{"joint stereo 24000", Options{SampleRate: 24000, Channels: 2}, true, []int{1}},
+		{"mono 16000 fast", Options{SampleRate: 16000, Channels: 1, Mode: Mono, Bitrate: 24, Quality: 9}, true, []int{3}},
+		{"silence 44100", Options{SampleRate: 44100, Channels: 2, Bitrate: 320}, false, []int{1}},
+		{"silence 22050", Options{SampleRate: 22050, Channels: 1, Mode: Mono, Bitrate: 8}, false, []int{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amplitude := 0.0
+			if test.sine {
+				amplitude = 0.5
+			}
+			pcm := signal(test.opts.SampleRate, test.opts.Channels, 440, amplitude, 0, 1)
+			frames := parseFrames(t, encode(t, test.opts, pcm))
+
+			// The last partial frame is padded and one more frame flushes
+			// the filter bank
+			samples := 1152
+			if test.opts.SampleRate < 32000 {
+				samples = 576
+			}
+			n := len(pcm) / test.opts.Channels
+			if want := (n+samples-1)/samples + 1; len(frames) != want {
+				t.Fatalf("got %d frames, want %d", len(frames), want)
+			}
+			bitrate := test.opts.Bitrate
+			if bitrate == 0 {
+				bitrate = 128
+				if samples == 576 {
+					bitrate = 64
+				}
+			}
+			midSide := 0
+			for i, f := range frames {
+				if f.sampleRate != test.opts.SampleRate || f.bitrate != bitrate {
+					t.Fatalf("frame %d is %d Hz %d kbit/s, want %d Hz %d kbit/s",
+						i, f.sampleRate, f.bitrate, test.opts.SampleRate, bitrate)
+				}
+				if !containsInt(test.modes, f.mode) {
+					t.Fatalf("frame %d has channel mode %d, want one of %v", i, f.mode, test.modes)
+				}
+				if f.modeExt == 2 {
+					midSide++
+				}
+			}
+			// Padding keeps the CBR stream at the nominal bitrate
+			if got := meanBitrate(frames); math.Abs(got-float64(bitrate)) > 0.1 {
+				t.Errorf("mean bitrate %.2f kbit/s, want %d", got, bitrate)
+			}
+			// Both channels are the same, so joint stereo codes the frames
+			// with a signal as mid/side
+			if test.sine && test.modes[0] == 1 && midSide < len(frames)/2 {
+				t.Errorf("%d of %d frames coded as mid/side", midSide, len(frames))
+			}
+		})
+	}
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncodeVBR(t *testing.T) {
+	pcm := signal(44100, 2, 440, 0.5, 0.3, 3)
+	var means []float64
+	for _, quality := range []int{0, 5, 9} {
+		frames := parseFrames(t, encode(t, Options{SampleRate: 44100, Channels: 2, BitrateMode: VBR, Quality: quality}, pcm))
+		means = append(means, meanBitrate(frames))
+		t.Logf("quality %d: %.1f kbit/s", quality, means[len(means)-1])
+	}
+	for i := 1; i < len(means); i++ {
+		if means[i] >= means[i-1] {
+			t.Errorf("mean bitrates %v do not fall as the quality setting rises", means)
+		}
+	}
+
+	// Silence needs no bits, so every frame takes the lowest bitrate
+	silence := signal(44100, 2, 440, 0, 0, 1)
+	for i, f := range parseFrames(t, encode(t, Options{SampleRate: 44100, Channels: 2, BitrateMode: VBR}, silence)) {
+		if f.bitrate != 32 {
+			t.Fatalf("silent frame %d is %d kbit/s, want 32", i, f.bitrate)
+		}
+	}
+}
+
+func TestEncodeABR(t *testing.T) {
+	tests := []struct {
+		sampleRate int
+		channels   int
+		bitrate    int
+	}{
+		{44100, 2, 128},
+		{44100, 2, 192},
+		{48000, 1, 64},
+		{22050, 2, 64},
+	}
+	for _, test := range tests {
+		pcm := signal(test.sampleRate, test.channels, 440, 0.5, 0.3, 5)
+		frames := parseFrames(t, encode(t, Options{SampleRate: test.sampleRate, Channels: test.channels,
+			Mode: Stereo, BitrateMode: ABR, Bitrate: test.bitrate}, pcm))
+		mean := meanBitrate(frames)
+		t.Logf("%d Hz %d kbit/s: %.1f kbit/s", test.sampleRate, test.bitrate, mean)
+		used := map[int]bool{}
+		for _, f := range frames {
+			used[f.bitrate] = true
+		}
+		if len(used) < 2 {
+			t.Errorf("%d Hz: every frame is %d kbit/s, want a varying bitrate", test.sampleRate, frames[0].bitrate)
+		}
+		if math.Abs(mean-float64(test.bitrate)) > 0.1*float64(test.bitrate) {
+			t.Errorf("%d Hz: mean bitrate %.1f kbit/s, want %d ± 10%%", test.sampleRate, mean, test.bitrate)
+		}
+	}
+}
+
+// decode decodes a stream with an independent decoder, which always
+// outputs 16-bit stereo
+func decode(t *testing.T, b []byte) ([]int16, int) {
+	t.Helper()
+	dec, err := gomp3.NewDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]int16, len(raw)/2)
+	for i := range pcm {
+		pcm[i] = int16(uint16(raw[2*i]) | uint16(raw[2*i+1])<<8)
+	}
+	return pcm, dec.SampleRate()
+}
+
+// tonePower returns the share of the power of a channel of interleaved
+// stereo PCM that is at freq Hz, and its RMS level
+func tonePower(pcm []int16, ch int, sampleRate int, freq float64) (float64, float64) {
+	// Goertzel over the channel
+	w := 2 * math.Pi * freq / float64(sampleRate)
+	var s1, s2, total float64
+	n := 0
+	for i := ch; i < len(pcm); i += 2 {
+		x := float64(pcm[i]) / 32768
+		s1, s2 = x+2*math.Cos(w)*s1-s2, s1
+		total += x * x
+		n++
+	}
+	power := s1*s1 + s2*s2 - 2*math.Cos(w)*s1*s2
+	return 2 * power / (float64(n) * total), math.Sqrt(total / float64(n))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"joint stereo 44100", Options{SampleRate: 44100, Channels: 2, Bitrate: 128}},
+		{"stereo 48000 VBR", Options{SampleRate: 48000, Channels: 2, Mode: Stereo, BitrateMode: VBR, Quality: 2}},
+		{"mono 32000 ABR", Options{SampleRate: 32000, Channels: 1, Mode: Mono, BitrateMode: ABR, Bitrate: 96}},
+		{"joint stereo 22050", Options{SampleRate: 22050, Channels: 2, Bitrate: 64}},
+		{"mono 16000", Options{SampleRate: 16000, Channels: 1, Mode: Mono, Bitrate: 32}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const freq, amplitude = 1000, 0.5
+			pcm := signal(test.opts.SampleRate, test.opts.Channels, freq, amplitude, 0, 1)
+			out, sampleRate := decode(t, encode(t, test.opts, pcm))
+			if sampleRate != test.opts.SampleRate {
+				t.Fatalf("decoded at %d Hz, want %d", sampleRate, test.opts.SampleRate)
+			}
+			n := len(pcm) / test.opts.Channels
+			if len(out)/2 < n {
+				t.Fatalf("decoded %d samples, want at least %d", len(out)/2, n)
+			}
+			// The middle half is clear of the encoder and decoder delay
+			// and of the silence after the input ends
+			out = out[2*(n/4) : 2*(3*n/4)]
+			for ch := 0; ch < 2; ch++ {
+				share, rms := tonePower(out, ch, sampleRate, freq)
+				t.Logf("channel %d: %.4f of the power at %d Hz, rms %.4f", ch, share, freq, rms)
+				if share < 0.99 {
+					t.Errorf("channel %d: %.4f of the power is at %d Hz, want at least 0.99", ch, share, freq)
+				}
+				// A lone tone masks a lot of noise, so VBR may quantize the
+				// tone itself coarsely
+				if want := amplitude / math.Sqrt2; math.Abs(20*math.Log10(rms/want)) > 1 {
+					t.Errorf("channel %d: rms %.4f, want %.4f ± 1 dB", ch, rms, want)
+				}
+			}
+		})
+	}
+
+	silence := signal(44100, 2, 440, 0, 0, 1)
+	out, _ := decode(t, encode(t, Options{SampleRate: 44100, Channels: 2}, silence))
+	for i, v := range out {
+		if v != 0 {
+			t.Fatalf("silence decoded to %d at sample %d", v, i)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mp3
+
+import "math"
+
+const (
+	granuleSize = 576
+	subbands    = 32
+)
+
+var (
+	// analysisMatrix holds the cosine matrix M[k][i] of the polyphase filter
+	analysisMatrix [subbands][64]float64
+	// mdctTable holds the long block window folded into the MDCT cosines,
+	// scaled by 1/9 to undo the gain of the decoder's inverse MDCT
+	mdctTable [18][36]float64
+	// aliasCs and aliasCa are the alias reduction butterfly coefficients
+	aliasCs, aliasCa [8]float64
+)
+
+func init() {
+	for k := 0; k < subbands; k++ {
+		for i := 0; i < 64; i++ {
+			analysisMatrix[k][i] = math.Cos(float64((2*k+1)*(i-16)) * math.Pi / 64)
+		}
+	}
+	for i := 0; i < 18; i++ {
+		for k := 0; k < 36; k++ {
+			window := math.Sin(math.Pi / 36 * (float64(k) + 0.5))
+			mdctTable[i][k] = window / 9 * math.Cos(math.Pi/72*float64((2*k+1+18)*(2*i+1)))
+		}
+	}
+	for i, c := range [8]float64{-0.6, -0.535, -0.33, -0.185, -0.095, -0.041, -0.0142, -0.0037} {
+		aliasCs[i] = 1 / math.Sqrt(1+c*c)
+		aliasCa[i] = c / math.Sqrt(1+c*c)
+	}
+}
+
+// filterbank turns PCM into MDCT spectra for one channel. It keeps the
+// polyphase filter history and the previous granule's subband samples that
+// the overlapping MDCT needs.
+type filterbank struct {
+	history [512]float64
+	offset  int
+	prev    [subbands][18]float64
+}
+
+// analyze runs the polyphase analysis filter over 32 new samples and
+// writes one sample for each subband
+func (f *filterbank) analyze(pcm []float64, out *[subbands]float64) {
+	// The newest sample goes in front, as in the reference X[] buffer
+	f.offset = (f.offset - 32) & 511
+	for i := 0; i < 32; i++ {
+		f.history[(f.offset+31-i)&511] = pcm[i]
+	}
+
+	var y [64]float64
+	for i := 0; i < 64; i++ {
+		var sum float64
+		for j := 0; j < 8; j++ {
+			sum += analysisWindow[i+64*j] * f.history[(f.offset+i+64*j)&511]
+		}
+		y[i] = sum
+	}
+
+	for k := 0; k < subbands; k++ {
+		var sum float64
+		row := &analysisMatrix[k]
+		for i := 0; i < 64; i++ {
+			sum += row[i] * y[i]
+		}
+		out[k] = sum
+	}
+}
+
+// granule transforms 576 PCM samples into 576 MDCT lines using long blocks
+func (f *filterbank) granule(pcm []float64, xr *[granuleSize]float64) {
+	var cur [subbands][18]float64
+	var s [subbands]float64
+	for t := 0; t < 18; t++ {
+		f.analyze(pcm[t*32:t*32+32], &s)
+		for sb := 0; sb < subbands; sb++ {
+			// Compensate for the frequency inversion of odd subbands
+			if sb&1 == 1 && t&1 == 1 {
+				cur[sb][t] = -s[sb]
+			} else {
+				cur[sb][t] = s[sb]
+			}
+		}
+	}
+
+	var in [36]float64
+	for sb := 0; sb < subbands; sb++ {
+		copy(in[:18], f.prev[sb][:])
+		copy(in[18:], cur[sb][:])
+		for i := 0; i < 18; i++ {
+			var sum float64
+			row := &mdctTable[i]
+			for k := 0; k < 36; k++ {
+				sum += row[k] * in[k]
+			}
+			xr[sb*18+i] = sum
+		}
+
+		// Alias reduction, the inverse of the decoder's butterflies
+		if sb > 0 {
+			for i := 0; i < 8; i++ {
+				lo := xr[(sb-1)*18+17-i]
+				hi := xr[sb*18+i]
+				xr[(sb-1)*18+17-i] = lo*aliasCs[i] + hi*aliasCa[i]
+				xr[sb*18+i] = hi*aliasCs[i] - lo*aliasCa[i]
+			}
+		}
+	}
+	f.prev = cur
+}
@@ -0,0 +1,211 @@
+package mp3
+
+// huffTable is one of the Layer III Huffman code tables
+type huffTable struct {
+	xlen    int // values per dimension coded directly
+	linbits int // extra bits for escaped values of 15 and above
+	codes   []uint16
+	lens    []uint8
+}
+
+// bigValueTables is indexed by table_select. Tables 4 and 14 do not exist.
+var bigValueTables = [32]huffTable{
+	{},
+	{2, 0, huffCodes1, huffLens1},
+	{3, 0, huffCodes2, huffLens2},
+	{3, 0, huffCodes3, huffLens3},
+	{},
+	{4, 0, huffCodes5, huffLens5},
+	{4, 0, huffCodes6, huffLens6},
+	{6, 0, huffCodes7, huffLens7},
+	{6, 0, huffCodes8, huffLens8},
+	{6, 0, huffCodes9, huffLens9},
+	{8, 0, huffCodes10, huffLens10},
+	{8, 0, huffCodes11, huffLens11},
+	{8, 0, huffCodes12, huffLens12},
+	{16, 0, huffCodes13, huffLens13},
+	{},
+	{16, 0, huffCodes15, huffLens15},
+	{16, 1, huffCodes16, huffLens16},
+	{16, 2, huffCodes16, huffLens16},
+	{16, 3, huffCodes16, huffLens16},
+	{16, 4, huffCodes16, huffLens16},
+	{16, 6, huffCodes16, huffLens16},
+	{16, 8, huffCodes16, huffLens16},
+	{16, 10, huffCodes16, huffLens16},
+	{16, 13, huffCodes16, huffLens16},
+	{16, 4, huffCodes24, huffLens24},
+	{16, 5, huffCodes24, huffLens24},
+	{16, 6, huffCodes24, huffLens24},
+	{16, 7, huffCodes24, huffLens24},
+	{16, 8, huffCodes24, huffLens24},
+	{16, 9, huffCodes24, huffLens24},
+	{16, 11, huffCodes24, huffLens24},
+	{16, 13, huffCodes24, huffLens24},
+}
+
+// count1Tables holds the quadruple tables A and B
+var count1Tables = [2]huffTable{
+	{2, 0, huffCodes32, huffLens32},
+	{2, 0, huffCodes33, huffLens33},
+}
+
+// maxBigValue is the largest magnitude table 31 can code
+const maxBigValue = 15 + 1<<13 - 1
+
+// candidateTables lists the tables worth trying for a region by the
+// largest value in it, for values below 16
+var candidateTables = [16][]int{
+	{0},
+	{1},
+	{2, 3},
+	{5, 6},
+	{7, 8, 9},
+	{7, 8, 9},
+	{10, 11, 12},
+	{10, 11, 12},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+	{13, 15},
+}
+
+// pairBits returns the bits needed to code ix[start:end] with table t
+func pairBits(ix []int, start, end, t int) int {
+	h := &bigValueTables[t]
+	bits := 0
+	for i := start; i < end; i += 2 {
+		x, y := ix[i], ix[i+1]
+		if h.linbits > 0 {
+			if x >= 15 {
+				bits += h.linbits
+				x = 15
+			}
+			if y >= 15 {
+				bits += h.linbits
+				y = 15
+			}
+		}
+		bits += int(h.lens[x*h.xlen+y])
+		if x != 0 {
+			bits++
+		}
+		if y != 0 {
+			bits++
+		}
+	}
+	return bits
+}
+
+// chooseTable picks the cheapest table for ix[start:end], returning the
+// table number and the bits it needs
+func chooseTable(ix []int, start, end int) (int, int) {
+	max := 0
+	for i := start; i < end; i++ {
+		if ix[i] > max {
+			max = ix[i]
+		}
+	}
+	if max == 0 {
+		return 0, 0
+	}
+
+	best, bestBits := -1, 0
+	if max < 16 {
+		for _, t := range candidateTables[max] {
+			if bits := pairBits(ix, start, end, t); best < 0 || bits < bestBits {
+				best, bestBits = t, bits
+			}
+		}
+		return best, bestBits
+	}
+
+	// Escaped values: take the smallest linbits of each table family
+	// that can hold the largest value
+	for _, family := range [2][8]int{{16, 17, 18, 19, 20, 21, 22, 23}, {24, 25, 26, 27, 28, 29, 30, 31}} {
+		for _, t := range family {
+			if max-15 < 1<<bigValueTables[t].linbits {
+				if bits := pairBits(ix, start, end, t); best < 0 || bits < bestBits {
+					best, bestBits = t, bits
+				}
+				break
+			}
+		}
+	}
+	return best, bestBits
+}
+
+// quadIndex returns the count1 table index of a quadruple
+func quadIndex(ix []int, i int) int {
+	return ix[i]<<3 | ix[i+1]<<2 | ix[i+2]<<1 | ix[i+3]
+}
+
+// count1Bits returns the bits needed for the count1 region with each table
+func count1Bits(ix []int, start, end int) (a, b int) {
+	for i := start; i < end; i += 4 {
+		q := quadIndex(ix, i)
+		signs := ix[i] + ix[i+1] + ix[i+2] + ix[i+3]
+		a += int(count1Tables[0].lens[q]) + signs
+		b += int(count1Tables[1].lens[q]) + signs
+	}
+	return a, b
+}
+
+// writePair writes one pair of big values with their signs
+func writePair(w *bitWriter, t int, x, y int) {
+	h := &bigValueTables[t]
+	ax, ay := abs(x), abs(y)
+	cx, cy := ax, ay
+	if h.linbits > 0 {
+		if cx > 15 {
+			cx = 15
+		}
+		if cy > 15 {
+			cy = 15
+		}
+	}
+	idx := cx*h.xlen + cy
+	w.write(uint32(h.codes[idx]), int(h.lens[idx]))
+	if cx == 15 && h.linbits > 0 {
+		w.write(uint32(ax-15), h.linbits)
+	}
+	if ax != 0 {
+		w.write(sign(x), 1)
+	}
+	if cy == 15 && h.linbits > 0 {
+		w.write(uint32(ay-15), h.linbits)
+	}
+	if ay != 0 {
+		w.write(sign(y), 1)
+	}
+}
+
+// writeQuad writes one count1 quadruple with its signs
+func writeQuad(w *bitWriter, t int, v []int) {
+	h := &count1Tables[t]
+	q := abs(v[0])<<3 | abs(v[1])<<2 | abs(v[2])<<1 | abs(v[3])
+	w.write(uint32(h.codes[q]), int(h.lens[q]))
+	for _, x := range v {
+		if x != 0 {
+			w.write(sign(x), 1)
+		}
+	}
+}
+
+func sign(x int) uint32 {
+	if x < 0 {
+		return 1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
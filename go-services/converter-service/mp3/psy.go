@@ -0,0 +1,85 @@
+package mp3
+
+import "math"
+
+// fullScaleEnergy is the MDCT energy of a full scale sine wave in one
+// granule, used to place the absolute threshold of hearing
+const fullScaleEnergy = 1.22
+
+// psyModel estimates how much quantization noise each scalefactor band
+// can hide. It is a simple spreading function model in the Bark domain,
+// computed per granule on the MDCT spectrum.
+type psyModel struct {
+	sfb    [23]int
+	bark   [sfbCount + 1]float64
+	ath    [sfbCount + 1]float64 // threshold in quiet per band
+	cutoff int                   // first line removed by the lowpass
+}
+
+// newPsyModel creates a new psyModel instance for a sample rate and a
+// lowpass frequency in Hz
+func newPsyModel(sfb [23]int, sampleRate int, lowpass float64) *psyModel {
+	p := &psyModel{sfb: sfb, cutoff: granuleSize}
+	lineHz := float64(sampleRate) / 2 / granuleSize
+	if lowpass > 0 {
+		p.cutoff = int(lowpass / lineHz)
+		if p.cutoff > granuleSize {
+			p.cutoff = granuleSize
+		}
+	}
+	for b := 0; b <= sfbCount; b++ {
+		lo, hi := sfb[b], sfb[b+1]
+		p.bark[b] = bark(float64(lo+hi) / 2 * lineHz)
+		min := math.Inf(1)
+		for i := lo; i < hi; i++ {
+			min = math.Min(min, athDB((float64(i)+0.5)*lineHz))
+		}
+		// The loudest sample value is taken to play at 96 dB SPL
+		p.ath[b] = fullScaleEnergy * math.Pow(10, (min-96)/10) * float64(hi-lo)
+	}
+	return p
+}
+
+// bark converts a frequency in Hz to the Bark scale
+func bark(f float64) float64 {
+	return 13*math.Atan(0.00076*f) + 3.5*math.Atan(f/7500*f/7500)
+}
+
+// athDB is Terhardt's approximation of the threshold in quiet in dB SPL
+func athDB(f float64) float64 {
+	k := math.Max(f, 20) / 1000
+	return 3.64*math.Pow(k, -0.8) - 6.5*math.Exp(-0.6*(k-3.3)*(k-3.3)) + 1e-3*k*k*k*k
+}
+
+// lowpass removes the lines above the cutoff frequency
+func (p *psyModel) lowpass(xr *[granuleSize]float64) {
+	for i := p.cutoff; i < granuleSize; i++ {
+		xr[i] = 0
+	}
+}
+
+// threshold fills in the allowed noise of every band of g. offset is the
+// signal to mask ratio in dB; larger values leave less noise.
+func (p *psyModel) threshold(g *granule, offset float64) {
+	scale := math.Pow(10, -offset/10)
+	for b := 0; b <= sfbCount; b++ {
+		var mask float64
+		for j := 0; j <= sfbCount; j++ {
+			if g.en[j] == 0 {
+				continue
+			}
+			// Masking spreads further towards higher frequencies
+			dz := p.bark[b] - p.bark[j]
+			var db float64
+			if dz >= 0 {
+				db = -10 * dz
+			} else {
+				db = 27 * dz
+			}
+			if db > -60 {
+				mask += g.en[j] * math.Pow(10, db/10)
+			}
+		}
+		g.xmin[b] = math.Max(mask*scale, p.ath[b])
+	}
+}
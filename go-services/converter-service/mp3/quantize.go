@@ -0,0 +1,493 @@
+package mp3
+
+import "math"
+
+const (
+	// maxPart23Bits is the largest part2_3_length a granule can signal
+	maxPart23Bits = 1<<12 - 1
+	// maxGlobalGain is the largest global_gain value
+	maxGlobalGain = 255
+	// sfbCount is the number of long block scalefactor bands with a
+	// transmitted scalefactor; band 21 has none
+	sfbCount = 21
+)
+
+var (
+	// pow43 holds x^(4/3) for every value a big value can take
+	pow43 [maxBigValue + 1]float64
+	// stepTable holds the quantizer multiplier 2^(-3/16*(gain-210)) for
+	// gains from -64, which scalefactors can reach, up to 255
+	stepTable [maxGlobalGain + 1 + 64]float64
+)
+
+func init() {
+	for i := range pow43 {
+		pow43[i] = math.Pow(float64(i), 4.0/3.0)
+	}
+	for i := range stepTable {
+		stepTable[i] = math.Pow(2, -0.1875*float64(i-64-210))
+	}
+}
+
+// sfbMax is the largest scalefactor that fits in each band. MPEG-1 codes
+// bands 0-10 with up to 4 bits and bands 11-20 with up to 3; the MPEG-2
+// partitions used here happen to give the same limits.
+var sfbMax = [sfbCount]int{15, 15, 15, 15, 15, 15, 15, 15, 15, 15, 15, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7}
+
+// granule holds the spectrum and coding state of one granule of one channel
+type granule struct {
+	xr   [granuleSize]float64
+	xr34 [granuleSize]float64 // |xr|^(3/4)
+	ix   [granuleSize]int     // quantized magnitudes
+	xmin [sfbCount + 1]float64
+	en   [sfbCount + 1]float64
+
+	sf            [sfbCount + 1]int
+	globalGain    int
+	scalefacScale int
+
+	part2Bits   int
+	part23Bits  int
+	sfCompress  int
+	bigValues   int
+	count1      int
+	tableSelect [3]int
+	region0     int
+	region1     int
+	count1Table int
+}
+
+// quantizer holds the per stream constants of the quantization loops
+type quantizer struct {
+	sfb  [23]int // long block band boundaries
+	lsf  bool    // MPEG-2 low sampling frequency scalefactor coding
+	fast bool    // skip noise shaping
+}
+
+// prepare computes |xr|^(3/4) and the band energies
+func (q *quantizer) prepare(g *granule) {
+	for i, x := range g.xr {
+		g.xr34[i] = math.Sqrt(math.Abs(x) * math.Sqrt(math.Abs(x)))
+	}
+	for b := 0; b <= sfbCount; b++ {
+		var en float64
+		for i := q.sfb[b]; i < q.sfb[b+1]; i++ {
+			en += g.xr[i] * g.xr[i]
+		}
+		g.en[b] = en
+	}
+}
+
+// amplification returns the gain index offset scalefactor sf gives a band
+func amplification(sf, scalefacScale int) int {
+	// One scalefactor step is 2^(0.5) or 2^(1) in amplitude, which is two
+	// or four global gain steps of 2^(1/4)
+	return sf * 2 << scalefacScale
+}
+
+// quantizeBand quantizes lines [start, end) with the given gain index and
+// returns the largest value, or -1 if a value overflows the Huffman tables
+func (g *granule) quantizeBand(start, end, gain int) int {
+	step := stepIndex(gain)
+	largest := 0
+	for i := start; i < end; i++ {
+		v := g.xr34[i]*step + 0.4054
+		if v > maxBigValue {
+			return -1
+		}
+		n := int(v)
+		g.ix[i] = n
+		if n > largest {
+			largest = n
+		}
+	}
+	return largest
+}
+
+// stepIndex returns the quantizer multiplier for a gain index, which may be
+// negative once scalefactors are applied
+func stepIndex(gain int) float64 {
+	if gain < -64 || gain > maxGlobalGain {
+		return math.Pow(2, -0.1875*float64(gain-210))
+	}
+	return stepTable[gain+64]
+}
+
+// bandNoise returns the quantization noise energy of lines [start, end)
+// after quantizeBand with the same gain index
+func (g *granule) bandNoise(start, end, gain int) float64 {
+	// Dequantization multiplies by 2^((gain-210)/4)
+	scale := math.Pow(2, 0.25*float64(gain-210))
+	var noise float64
+	for i := start; i < end; i++ {
+		d := math.Abs(g.xr[i]) - pow43[g.ix[i]]*scale
+		noise += d * d
+	}
+	return noise
+}
+
+// bandGain returns the effective gain index of band b
+func (g *granule) bandGain(b int) int {
+	return g.globalGain - amplification(g.sf[b], g.scalefacScale)
+}
+
+// quantize quantizes the whole granule with the current gain and
+// scalefactors, returning false on overflow
+func (q *quantizer) quantize(g *granule) bool {
+	for b := 0; b <= sfbCount; b++ {
+		if g.quantizeBand(q.sfb[b], q.sfb[b+1], g.bandGain(b)) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedGain finds the coarsest gain index for band b whose noise stays
+// below the band's masking threshold
+func (q *quantizer) allowedGain(g *granule, b int) int {
+	start, end := q.sfb[b], q.sfb[b+1]
+	if g.en[b] <= g.xmin[b] {
+		return maxGlobalGain
+	}
+
+	// Finer gains than lo would overflow the Huffman tables
+	var peak float64
+	for i := start; i < end; i++ {
+		peak = math.Max(peak, g.xr34[i])
+	}
+	lo := 210 + int(math.Ceil(16.0/3*math.Log2(peak/(maxBigValue-0.4054))))
+	if g.quantizeBand(start, end, lo) < 0 {
+		lo++
+	}
+	hi := maxGlobalGain
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		g.quantizeBand(start, end, mid)
+		if g.bandNoise(start, end, mid) <= g.xmin[b] {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// shape picks the global gain and scalefactors that keep the noise of
+// every band under its threshold with the coarsest quantization possible.
+// It leaves the granule quantized and counted.
+func (q *quantizer) shape(g *granule) {
+	var allowed [sfbCount + 1]int
+	for b := range allowed {
+		allowed[b] = q.allowedGain(g, b)
+	}
+
+	best := -1
+	var bestSf [sfbCount + 1]int
+	var bestGain, bestScale int
+	for scale := 0; scale < 2; scale++ {
+		// Band 21 has no scalefactor, so it bounds the global gain directly
+		gain := allowed[sfbCount]
+		for b := 0; b < sfbCount; b++ {
+			limit := allowed[b]
+			if !q.fast {
+				limit += amplification(sfbMax[b], scale)
+			}
+			if limit < gain {
+				gain = limit
+			}
+		}
+
+		g.globalGain = clampGain(gain)
+		g.scalefacScale = scale
+		for b := 0; b < sfbCount; b++ {
+			g.sf[b] = 0
+			if !q.fast && allowed[b] < g.globalGain {
+				step := amplification(1, scale)
+				g.sf[b] = min((g.globalGain-allowed[b]+step-1)/step, sfbMax[b])
+			}
+		}
+		g.sf[sfbCount] = 0
+
+		bits := q.fitGain(g, g.globalGain)
+		if best < 0 || bits < best {
+			best = bits
+			bestSf = g.sf
+			bestGain = g.globalGain
+			bestScale = scale
+		}
+		if q.fast {
+			break
+		}
+	}
+
+	g.sf = bestSf
+	g.scalefacScale = bestScale
+	q.fitGain(g, bestGain)
+}
+
+// fitGain quantizes at the given global gain, raising it until nothing
+// overflows, and returns the bits the granule needs
+func (q *quantizer) fitGain(g *granule, gain int) int {
+	for g.globalGain = clampGain(gain); ; g.globalGain++ {
+		if q.quantize(g) || g.globalGain == maxGlobalGain {
+			break
+		}
+	}
+	return q.count(g)
+}
+
+// fit adjusts the global gain, keeping the scalefactors, so the granule
+// uses as many bits as possible without exceeding budget
+func (q *quantizer) fit(g *granule, budget int) {
+	if budget > maxPart23Bits {
+		budget = maxPart23Bits
+	}
+	start := g.globalGain
+
+	// Search the coarsest acceptable gain in [lo, hi]
+	lo, hi := 0, maxGlobalGain
+	if q.fitGain(g, start) <= budget {
+		hi = start
+	} else {
+		lo = start + 1
+	}
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if q.fitGain(g, mid) <= budget {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if q.fitGain(g, lo) <= budget {
+		return
+	}
+
+	// Even the coarsest gain does not fit; drop the noise shaping
+	g.sf = [sfbCount + 1]int{}
+	for gain := lo; gain < maxGlobalGain; gain++ {
+		if q.fitGain(g, gain) <= budget {
+			return
+		}
+	}
+	// At the largest gain every value quantizes to zero
+	q.fitGain(g, maxGlobalGain)
+}
+
+func clampGain(gain int) int {
+	if gain < 0 {
+		return 0
+	}
+	if gain > maxGlobalGain {
+		return maxGlobalGain
+	}
+	return gain
+}
+
+// count works out the Huffman partition and tables for the quantized
+// values and sets part2Bits and part23Bits
+func (q *quantizer) count(g *granule) int {
+	return q.countRegions(g, false)
+}
+
+// finish recounts the granule trying more region splits, which can only
+// lower part23Bits
+func (q *quantizer) finish(g *granule) {
+	if !q.fast {
+		q.countRegions(g, true)
+	}
+}
+
+func (q *quantizer) countRegions(g *granule, search bool) int {
+	ix := g.ix[:]
+
+	// Trailing zero pairs form the rzero region
+	end := granuleSize
+	for end > 1 && ix[end-1] == 0 && ix[end-2] == 0 {
+		end -= 2
+	}
+	// Quadruples of values no larger than one form the count1 region
+	big := end
+	for big > 3 && ix[big-1] <= 1 && ix[big-2] <= 1 && ix[big-3] <= 1 && ix[big-4] <= 1 {
+		big -= 4
+	}
+	g.count1 = (end - big) / 4
+	g.bigValues = big / 2
+
+	a, b := count1Bits(ix, big, big+g.count1*4)
+	g.count1Table = 0
+	bits := a
+	if b < a {
+		g.count1Table = 1
+		bits = b
+	}
+
+	bits += q.divideRegions(g, big, search)
+	g.part2Bits = q.scalefactorBits(g)
+	g.part23Bits = g.part2Bits + bits
+	return g.part23Bits
+}
+
+// divideRegions splits the big values into three regions at scalefactor
+// band boundaries and picks a table for each, returning the bits needed.
+// With search it also tries the neighbours of the default split.
+func (q *quantizer) divideRegions(g *granule, big int, search bool) int {
+	g.tableSelect = [3]int{}
+	g.region0, g.region1 = 0, 0
+	if big == 0 {
+		return 0
+	}
+
+	// Count the bands that hold big values
+	bands := 0
+	for bands < 22 && q.sfb[bands] < big {
+		bands++
+	}
+
+	ix := g.ix[:]
+	best := -1
+	// Try the split suggested by the reference encoder and its neighbours
+	r0 := subdivide[bands][0]
+	r1 := subdivide[bands][1]
+	spread := 0
+	if search {
+		spread = 1
+	}
+	for d0 := -spread; d0 <= spread; d0++ {
+		for d1 := -spread; d1 <= spread; d1++ {
+			c0, c1 := r0+d0, r1+d1
+			if c0 < 0 || c0 > 15 || c1 < 0 || c1 > 7 {
+				continue
+			}
+			start1 := q.sfb[min(c0+1, 22)]
+			start2 := q.sfb[min(c0+c1+2, 22)]
+			if start1 > big {
+				start1 = big
+			}
+			if start2 > big {
+				start2 = big
+			}
+			t0, b0 := chooseTable(ix, 0, start1)
+			t1, b1 := chooseTable(ix, start1, start2)
+			t2, b2 := chooseTable(ix, start2, big)
+			if bits := b0 + b1 + b2; best < 0 || bits < best {
+				best = bits
+				g.region0, g.region1 = c0, c1
+				g.tableSelect = [3]int{t0, t1, t2}
+			}
+		}
+	}
+	return best
+}
+
+// subdivide is the reference encoder's region0_count and region1_count
+// for a given number of bands containing big values
+var subdivide = [23][2]int{
+	{0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 1}, {1, 1}, {1, 1},
+	{1, 2}, {2, 2}, {2, 3}, {2, 3}, {3, 4}, {3, 4}, {3, 4}, {4, 5},
+	{4, 5}, {4, 6}, {5, 6}, {5, 6}, {5, 7}, {6, 7}, {6, 7},
+}
+
+// scalefactorBits picks the scalefactor compression for the granule and
+// returns the bits the scalefactors take
+func (q *quantizer) scalefactorBits(g *granule) int {
+	if q.lsf {
+		return q.scalefactorBitsLSF(g)
+	}
+
+	var max1, max2 int
+	for b := 0; b < 11; b++ {
+		max1 = max(max1, g.sf[b])
+	}
+	for b := 11; b < sfbCount; b++ {
+		max2 = max(max2, g.sf[b])
+	}
+	best := -1
+	for c := 0; c < 16; c++ {
+		if max1 >= 1<<slen1[c] || max2 >= 1<<slen2[c] {
+			continue
+		}
+		if bits := 11*slen1[c] + 10*slen2[c]; best < 0 || bits < best {
+			best = bits
+			g.sfCompress = c
+		}
+	}
+	return best
+}
+
+// lsfPartitions is the number of bands in each scalefactor partition for
+// long blocks without intensity stereo
+var lsfPartitions = [4]int{6, 5, 5, 5}
+
+// scalefactorBitsLSF codes the scalefactors the MPEG-2 way, as four
+// partitions with their own bit lengths packed into scalefac_compress
+func (q *quantizer) scalefactorBitsLSF(g *granule) int {
+	var slen [4]int
+	b := 0
+	bits := 0
+	for p, n := range lsfPartitions {
+		largest := 0
+		for i := 0; i < n; i++ {
+			largest = max(largest, g.sf[b])
+			b++
+		}
+		for largest >= 1<<slen[p] {
+			slen[p]++
+		}
+		bits += n * slen[p]
+	}
+	g.sfCompress = (slen[0]*5+slen[1])<<4 | slen[2]<<2 | slen[3]
+	return bits
+}
+
+// writeScalefactors writes the scalefactors chosen by scalefactorBits
+func (q *quantizer) writeScalefactors(w *bitWriter, g *granule) {
+	if q.lsf {
+		c := g.sfCompress
+		slen := [4]int{(c >> 4) / 5, (c >> 4) % 5, (c & 15) >> 2, c & 3}
+		b := 0
+		for p, n := range lsfPartitions {
+			for i := 0; i < n; i++ {
+				w.write(uint32(g.sf[b]), slen[p])
+				b++
+			}
+		}
+		return
+	}
+	for b := 0; b < sfbCount; b++ {
+		if b < 11 {
+			w.write(uint32(g.sf[b]), slen1[g.sfCompress])
+		} else {
+			w.write(uint32(g.sf[b]), slen2[g.sfCompress])
+		}
+	}
+}
+
+// writeHuffman writes the quantized values with their signs
+func (q *quantizer) writeHuffman(w *bitWriter, g *granule) {
+	var signed [granuleSize + 4]int
+	for i, v := range g.ix {
+		if g.xr[i] < 0 {
+			v = -v
+		}
+		signed[i] = v
+	}
+
+	big := g.bigValues * 2
+	start1 := min(q.sfb[min(g.region0+1, 22)], big)
+	start2 := min(q.sfb[min(g.region0+g.region1+2, 22)], big)
+	for i := 0; i < big; i += 2 {
+		t := g.tableSelect[0]
+		if i >= start2 {
+			t = g.tableSelect[2]
+		} else if i >= start1 {
+			t = g.tableSelect[1]
+		}
+		if t != 0 {
+			writePair(w, t, signed[i], signed[i+1])
+		}
+	}
+	for i := 0; i < g.count1; i++ {
+		writeQuad(w, g.count1Table, signed[big+i*4:big+i*4+4])
+	}
+}
@@ -0,0 +1,202 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrInvalid is returned for structurally broken files
+	ErrInvalid = errors.New("mp4: invalid file")
+	// ErrNoMovie is returned when the file has no moov box
+	ErrNoMovie = errors.New("mp4: no moov box found")
+	// ErrFragmented is returned for fragmented files, whose samples live in
+	// moof boxes rather than the moov sample tables
+	ErrFragmented = errors.New("mp4: fragmented files are not supported")
+
+	errTruncated = fmt.Errorf("%w: truncated box", ErrInvalid)
+)
+
+const (
+	// maxMovieSize caps how much of the moov box is read into memory
+	maxMovieSize = 64 << 20
+	// maxSampleSize caps the size of a single encoded audio sample
+	maxSampleSize = 8 << 20
+	// maxBoxDepth caps nesting in the few places boxes are searched recursively
+	maxBoxDepth = 8
+)
+
+// boxHeader describes a box as it appears in the file
+type boxHeader struct {
+	typ        string
+	size       int64 // total size including the header, -1 if it runs to EOF
+	headerSize int64
+}
+
+// readBoxHeader reads a box header from r, returning io.EOF when r ends
+// cleanly before a new box
+func readBoxHeader(r io.Reader) (boxHeader, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(r, buf[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return boxHeader{}, errTruncated
+		}
+		return boxHeader{}, err
+	}
+
+	h := boxHeader{
+		typ:        string(buf[4:8]),
+		size:       int64(binary.BigEndian.Uint32(buf[:4])),
+		headerSize: 8,
+	}
+	if !validBoxType(buf[4:8]) {
+		return h, fmt.Errorf("%w: bad box type %q", ErrInvalid, h.typ)
+	}
+
+	switch h.size {
+	case 0:
+		h.size = -1
+	case 1:
+		if _, err := io.ReadFull(r, buf[8:16]); err != nil {
+			return h, errTruncated
+		}
+		size := binary.BigEndian.Uint64(buf[8:16])
+		if size > 1<<62 {
+			return h, fmt.Errorf("%w: %s box too large", ErrInvalid, h.typ)
+		}
+		h.size = int64(size)
+		h.headerSize = 16
+	}
+	if h.size != -1 && h.size < h.headerSize {
+		return h, fmt.Errorf("%w: %s box smaller than its header", ErrInvalid, h.typ)
+	}
+	return h, nil
+}
+
+// validBoxType reports whether a four character code is printable ASCII,
+// which is a cheap way to reject files that are not ISO-BMFF at all
+func validBoxType(typ []byte) bool {
+	for _, c := range typ {
+		if c < 0x20 || c > 0x7e {
+			// Apple uses the copyright sign in some metadata box names
+			if c != 0xa9 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// walkBoxes calls fn for every box contained in b
+func walkBoxes(b []byte, fn func(typ string, payload []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return errTruncated
+		}
+		size := uint64(binary.BigEndian.Uint32(b[:4]))
+		typ := string(b[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return errTruncated
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return fmt.Errorf("%w: bad size for %q box", ErrInvalid, typ)
+		}
+		if err := fn(typ, b[header:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// byteReader is a bounds checked big-endian reader over a box payload. The
+// first out of range read sets err and every later read returns zero.
+type byteReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *byteReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b)-r.off {
+		r.err = errTruncated
+		return nil
+	}
+	p := r.b[r.off : r.off+n]
+	r.off += n
+	return p
+}
+
+func (r *byteReader) skip(n int) { r.take(n) }
+
+func (r *byteReader) remaining() int { return len(r.b) - r.off }
+
+func (r *byteReader) rest() []byte { return r.take(r.remaining()) }
+
+func (r *byteReader) u8() uint8 {
+	if p := r.take(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (r *byteReader) u16() uint16 {
+	if p := r.take(2); p != nil {
+		return binary.BigEndian.Uint16(p)
+	}
+	return 0
+}
+
+func (r *byteReader) u24() uint32 {
+	if p := r.take(3); p != nil {
+		return uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+	}
+	return 0
+}
+
+func (r *byteReader) u32() uint32 {
+	if p := r.take(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (r *byteReader) u64() uint64 {
+	if p := r.take(8); p != nil {
+		return binary.BigEndian.Uint64(p)
+	}
+	return 0
+}
+
+// fullBox reads the version and flags that prefix every full box
+func (r *byteReader) fullBox() (version uint8, flags uint32) {
+	return r.u8(), r.u24()
+}
+
+// entries reads an entry count and checks that count entries of entrySize
+// bytes fit in what is left of the box, so hostile counts cannot force huge
+// allocations
+func (r *byteReader) entries(entrySize int) int {
+	count := r.u32()
+	if r.err != nil {
+		return 0
+	}
+	if uint64(count)*uint64(entrySize) > uint64(r.remaining()) {
+		r.err = fmt.Errorf("%w: entry count %d exceeds box size", ErrInvalid, count)
+		return 0
+	}
+	return int(count)
+}
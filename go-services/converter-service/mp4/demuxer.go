@@ -0,0 +1,466 @@
+// Package mp4 is a small ISO-BMFF (MP4/MOV) demuxer that finds the audio
+// tracks of a file and iterates over their encoded samples.
+//
+// Only the boxes needed for audio extraction are parsed. Fragmented files
+// and edit lists are not supported.
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Codec identifies the coding format of an audio track
+type Codec string
+
+const (
+	CodecAAC  Codec = "aac"
+	CodecMP3  Codec = "mp3"
+	CodecAC3  Codec = "ac-3"
+	CodecEAC3 Codec = "ec-3"
+	CodecALAC Codec = "alac"
+	CodecFLAC Codec = "flac"
+	CodecOpus Codec = "opus"
+)
+
+// File is a demuxed MP4 or QuickTime file
+type File struct {
+	MajorBrand       string
+	CompatibleBrands []string
+	AudioTracks      []*AudioTrack
+
+	r io.ReadSeeker
+}
+
+// AudioTrack describes an audio track and where its samples live
+type AudioTrack struct {
+	ID uint32
+	// Codec is derived from the sample entry; unknown formats use the
+	// sample entry's four character code
+	Codec Codec
+	// SampleEntry is the four character code of the sample entry, eg "mp4a"
+	SampleEntry string
+	// ObjectType is the MPEG-4 objectTypeIndication from the esds box
+	ObjectType uint8
+	// Config holds the decoder specific info, the AudioSpecificConfig for AAC
+	Config     []byte
+	SampleRate int
+	Channels   int
+	// Timescale is the number of sample timestamp units per second
+	Timescale   uint32
+	Duration    time.Duration
+	SampleCount int
+
+	table sampleTable
+	file  *File
+}
+
+// Open parses the boxes of an MP4 file up to and including the moov box. If
+// r is an io.ReadSeeker it is used to seek, otherwise r is only read forwards
+// and Open fails with ErrNotSeekable when the moov box follows the media data.
+func Open(r io.Reader) (*File, error) {
+	f := &File{r: toReadSeeker(r)}
+
+	var pos int64
+	for {
+		h, err := readBoxHeader(f.r)
+		if err == io.EOF {
+			return nil, ErrNoMovie
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch h.typ {
+		case "ftyp":
+			payload, err := readPayload(f.r, h, 1<<16)
+			if err != nil {
+				return nil, err
+			}
+			f.parseFileType(payload)
+		case "moov":
+			payload, err := readPayload(f.r, h, maxMovieSize)
+			if err != nil {
+				return nil, err
+			}
+			if err := f.parseMovie(payload); err != nil {
+				return nil, err
+			}
+			return f, nil
+		default:
+			if h.size == -1 {
+				// A box that runs to the end of the file is always the last one
+				return nil, ErrNoMovie
+			}
+			if _, err := f.r.Seek(pos+h.size, io.SeekStart); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					// The box runs past the end of the file, like a box of
+					// size zero would
+					return nil, ErrNoMovie
+				}
+				return nil, err
+			}
+		}
+		pos += h.size
+	}
+}
+
+// readPayload reads the rest of a box whose header has already been read
+func readPayload(r io.Reader, h boxHeader, limit int64) ([]byte, error) {
+	if h.size == -1 {
+		b, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) > limit {
+			return nil, fmt.Errorf("%w: %s box larger than %d bytes", ErrInvalid, h.typ, limit)
+		}
+		return b, nil
+	}
+
+	n := h.size - h.headerSize
+	if n > limit {
+		return nil, fmt.Errorf("%w: %s box larger than %d bytes", ErrInvalid, h.typ, limit)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errTruncated
+	}
+	return b, nil
+}
+
+func (f *File) parseFileType(b []byte) {
+	r := &byteReader{b: b}
+	f.MajorBrand = string(r.take(4))
+	r.skip(4) // minor version
+	for r.remaining() >= 4 {
+		f.CompatibleBrands = append(f.CompatibleBrands, string(r.take(4)))
+	}
+}
+
+func (f *File) parseMovie(b []byte) error {
+	return walkBoxes(b, func(typ string, payload []byte) error {
+		if typ == "mvex" {
+			return ErrFragmented
+		}
+		if typ != "trak" {
+			return nil
+		}
+		track, err := parseTrack(payload)
+		if err != nil {
+			return err
+		}
+		if track != nil {
+			track.file = f
+			f.AudioTracks = append(f.AudioTracks, track)
+		}
+		return nil
+	})
+}
+
+// parseTrack parses a trak box, returning nil if it is not an audio track
+func parseTrack(b []byte) (*AudioTrack, error) {
+	t := &AudioTrack{}
+	var mdia []byte
+	err := walkBoxes(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "tkhd":
+			r := &byteReader{b: payload}
+			version, _ := r.fullBox()
+			if version == 1 {
+				r.skip(16)
+			} else {
+				r.skip(8)
+			}
+			t.ID = r.u32()
+			return r.err
+		case "mdia":
+			mdia = payload
+		}
+		return nil
+	})
+	if err != nil || mdia == nil {
+		return nil, err
+	}
+
+	var handler string
+	var mediaDuration uint64
+	var stbl []byte
+	err = walkBoxes(mdia, func(typ string, payload []byte) error {
+		r := &byteReader{b: payload}
+		switch typ {
+		case "hdlr":
+			r.fullBox()
+			r.skip(4) // pre_defined
+			handler = string(r.take(4))
+		case "mdhd":
+			version, _ := r.fullBox()
+			if version == 1 {
+				r.skip(16)
+				t.Timescale = r.u32()
+				mediaDuration = r.u64()
+			} else {
+				r.skip(8)
+				t.Timescale = r.u32()
+				mediaDuration = uint64(r.u32())
+			}
+		case "minf":
+			return walkBoxes(payload, func(typ string, payload []byte) error {
+				if typ == "stbl" {
+					stbl = payload
+				}
+				return nil
+			})
+		}
+		return r.err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if handler != "soun" {
+		return nil, nil
+	}
+	if stbl == nil {
+		return nil, fmt.Errorf("%w: audio track %d has no sample table", ErrInvalid, t.ID)
+	}
+	if t.Timescale == 0 {
+		return nil, fmt.Errorf("%w: audio track %d has a zero timescale", ErrInvalid, t.ID)
+	}
+
+	if err := t.parseSampleTable(stbl); err != nil {
+		return nil, err
+	}
+	t.SampleCount = t.table.count()
+	if mediaDuration == 0 {
+		mediaDuration = t.table.duration()
+	}
+	t.Duration = ticksToDuration(mediaDuration, t.Timescale)
+	return t, nil
+}
+
+func (t *AudioTrack) parseSampleTable(b []byte) error {
+	var sawEntry bool
+	err := walkBoxes(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "stsd":
+			r := &byteReader{b: payload}
+			r.fullBox()
+			if r.u32() == 0 || r.err != nil {
+				return fmt.Errorf("%w: empty sample description", ErrInvalid)
+			}
+			// Only the first sample entry is used; multiple entries are rare
+			// for audio and would need per-chunk switching of decoders
+			sawEntry = true
+			return walkBoxes(r.rest(), func(typ string, payload []byte) error {
+				if t.SampleEntry != "" {
+					return nil
+				}
+				return t.parseSampleEntry(typ, payload)
+			})
+		default:
+			return t.table.parse(typ, payload)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !sawEntry {
+		return fmt.Errorf("%w: audio track %d has no sample description", ErrInvalid, t.ID)
+	}
+	return t.table.validate()
+}
+
+// parseSampleEntry parses an AudioSampleEntry, including the QuickTime
+// version 1 and 2 layouts
+func (t *AudioTrack) parseSampleEntry(typ string, b []byte) error {
+	t.SampleEntry = typ
+	t.Codec = Codec(typ)
+
+	r := &byteReader{b: b}
+	r.skip(6) // reserved
+	r.skip(2) // data_reference_index
+	version := r.u16()
+	r.skip(6) // revision and vendor
+	t.Channels = int(r.u16())
+	r.skip(2) // sample size
+	r.skip(4) // compression id and packet size
+	t.SampleRate = int(r.u32() >> 16)
+	switch version {
+	case 1:
+		r.skip(16)
+	case 2:
+		r.skip(4) // size of struct
+		rate := r.u64()
+		t.SampleRate = int(math.Float64frombits(rate))
+		t.Channels = int(r.u32())
+		r.skip(20)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if err := t.findDecoderConfig(r.rest(), 0); err != nil {
+		return err
+	}
+
+	switch typ {
+	case "mp4a":
+		switch t.ObjectType {
+		case 0x40, 0x66, 0x67, 0x68:
+			t.Codec = CodecAAC
+			t.applyAudioSpecificConfig()
+		case 0x69, 0x6b:
+			t.Codec = CodecMP3
+		}
+	case ".mp3":
+		t.Codec = CodecMP3
+	case "ac-3":
+		t.Codec = CodecAC3
+	case "ec-3":
+		t.Codec = CodecEAC3
+	case "alac":
+		t.Codec = CodecALAC
+	case "fLaC":
+		t.Codec = CodecFLAC
+	case "Opus":
+		t.Codec = CodecOpus
+	}
+	return nil
+}
+
+// findDecoderConfig looks for an esds box among the children of a sample
+// entry, descending into the QuickTime wave box when present
+func (t *AudioTrack) findDecoderConfig(b []byte, depth int) error {
+	if depth > maxBoxDepth {
+		return fmt.Errorf("%w: boxes nested too deeply", ErrInvalid)
+	}
+	// Some writers pad sample entries with a few zero bytes
+	if len(b) < 8 {
+		return nil
+	}
+	return walkBoxes(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "esds":
+			return t.parseESDescriptor(payload)
+		case "wave":
+			return t.findDecoderConfig(payload, depth+1)
+		}
+		return nil
+	})
+}
+
+// ES descriptor tags from ISO/IEC 14496-1
+const (
+	esDescrTag            = 0x03
+	decoderConfigDescrTag = 0x04
+	decSpecificInfoTag    = 0x05
+)
+
+// parseESDescriptor extracts the object type and decoder specific info
+// from an esds box
+func (t *AudioTrack) parseESDescriptor(b []byte) error {
+	r := &byteReader{b: b}
+	r.fullBox()
+
+	tag, size := readDescriptor(r)
+	if tag != esDescrTag {
+		return r.err
+	}
+	es := &byteReader{b: r.take(size)}
+	es.skip(2) // ES_ID
+	flags := es.u8()
+	if flags&0x80 != 0 {
+		es.skip(2) // dependsOn_ES_ID
+	}
+	if flags&0x40 != 0 {
+		es.skip(int(es.u8())) // URL
+	}
+	if flags&0x20 != 0 {
+		es.skip(2) // OCR_ES_Id
+	}
+
+	tag, size = readDescriptor(es)
+	if tag != decoderConfigDescrTag {
+		return firstErr(es.err, r.err)
+	}
+	dc := &byteReader{b: es.take(size)}
+	t.ObjectType = dc.u8()
+	dc.skip(12) // stream type, buffer size and bitrates
+
+	if dc.remaining() > 0 {
+		tag, size = readDescriptor(dc)
+		if tag == decSpecificInfoTag {
+			t.Config = append([]byte(nil), dc.take(size)...)
+		}
+	}
+	return firstErr(dc.err, es.err, r.err)
+}
+
+// readDescriptor reads a descriptor tag and its variable length size
+func readDescriptor(r *byteReader) (tag uint8, size int) {
+	tag = r.u8()
+	for i := 0; i < 4; i++ {
+		c := r.u8()
+		size = size<<7 | int(c&0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if size > r.remaining() {
+		r.err = errTruncated
+		return 0, 0
+	}
+	return tag, size
+}
+
+// aacSampleRates maps the samplingFrequencyIndex of an AudioSpecificConfig
+var aacSampleRates = [...]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000,
+	22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// applyAudioSpecificConfig takes the sample rate and channel count from the
+// AudioSpecificConfig, which is more reliable than the sample entry
+func (t *AudioTrack) applyAudioSpecificConfig() {
+	c := t.Config
+	if len(c) < 2 {
+		return
+	}
+	objectType := c[0] >> 3
+	index := (c[0]&0x07)<<1 | c[1]>>7
+	channels := (c[1] >> 3) & 0x0f
+	if objectType == 31 {
+		// Escaped object types shift the rest of the fields by six bits and
+		// are not used by AAC-LC files, so keep the sample entry values
+		return
+	}
+	if int(index) < len(aacSampleRates) {
+		t.SampleRate = aacSampleRates[index]
+	}
+	if channels > 0 && channels < 7 {
+		t.Channels = int(channels)
+	} else if channels == 7 {
+		t.Channels = 8
+	}
+}
+
+// ticksToDuration converts a duration in timescale units without overflowing
+func ticksToDuration(ticks uint64, timescale uint32) time.Duration {
+	secs := ticks / uint64(timescale)
+	if secs > uint64(1<<63-1)/uint64(time.Second) {
+		return time.Duration(1<<63 - 1)
+	}
+	rem := ticks % uint64(timescale)
+	return time.Duration(secs)*time.Second + time.Duration(rem*uint64(time.Second)/uint64(timescale))
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func fullBox(typ string, payload ...[]byte) []byte {
+	return box(typ, append([][]byte{{0, 0, 0, 0}}, payload...)...)
+}
+
+func be32(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// testMovie builds a file with six samples of sizes 10 to 15 in an mdat
+// box, followed by a moov box with a single AAC track that stores them in
+// two chunks of four and two samples
+func testMovie(co64 bool) []byte {
+	ftyp := box("ftyp", []byte("isom"), be32(0x200), []byte("isommp41"))
+	var mdat, sizes []byte
+	for size := 10; size < 16; size++ {
+		mdat = append(mdat, bytes.Repeat([]byte{0x21}, size)...)
+		sizes = append(sizes, be32(uint32(size))...)
+	}
+	first := uint32(len(ftyp) + 8)
+	second := first + 10 + 11 + 12 + 13
+	stco := fullBox("stco", be32(2, first, second))
+	if co64 {
+		stco = fullBox("co64", be32(2, 0, first, 0, second))
+	}
+
+	asc := []byte{0x12, 0x10} // AAC-LC, 44100 Hz, stereo
+	esds := fullBox("esds",
+		[]byte{esDescrTag, 23, 0, 1, 0},
+		[]byte{decoderConfigDescrTag, 17, 0x40, 0x15, 0, 0, 0}, be32(0, 0),
+		[]byte{decSpecificInfoTag, 2}, asc,
+		[]byte{6, 1, 2})
+	entry := box("mp4a", make([]byte, 6), []byte{0, 1}, make([]byte, 8), []byte{0, 2, 0, 16}, make([]byte, 4),
+		be32(44100<<16), esds)
+	stbl := box("stbl",
+		fullBox("stsd", be32(1), entry),
+		fullBox("stts", be32(1, 6, 1024)),
+		fullBox("stsc", be32(2, 1, 4, 1, 2, 2, 1)),
+		fullBox("stsz", be32(0, 6), sizes),
+		stco)
+	mdia := box("mdia",
+		fullBox("mdhd", be32(0, 0, 44100, 6*1024, 0)),
+		fullBox("hdlr", be32(0), []byte("soun"), make([]byte, 13)),
+		box("minf", stbl))
+	trak := box("trak", fullBox("tkhd", be32(0, 0, 1, 0, 6*1024), make([]byte, 60)), mdia)
+	return slices.Concat(ftyp, box("mdat", mdat), box("moov", trak))
+}
+
+// payload returns the offset of the payload of the first box of type typ
+func payload(t *testing.T, b []byte, typ string) int {
+	t.Helper()
+	i := bytes.Index(b, []byte(typ))
+	if i < 4 {
+		t.Fatalf("no %s box", typ)
+	}
+	return i + 4
+}
+
+// demux opens b and reads every sample, returning the first error
+func demux(b []byte) error {
+	f, err := Open(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for _, track := range f.AudioTracks {
+		it := track.Samples()
+		for it.Next() {
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTestMovie(t *testing.T) {
+	for _, co64 := range []bool{false, true} {
+		f, err := Open(bytes.NewReader(testMovie(co64)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.AudioTracks) != 1 {
+			t.Fatalf("got %d audio tracks, want 1", len(f.AudioTracks))
+		}
+		it := f.AudioTracks[0].Samples()
+		n := 0
+		for it.Next() {
+			if s := it.Sample(); len(s.Data) != 10+n || !bytes.Equal(s.Data, bytes.Repeat([]byte{0x21}, len(s.Data))) {
+				t.Errorf("sample %d: got %d bytes %x", n, len(s.Data), s.Data)
+			}
+			n++
+		}
+		if err := it.Err(); err != nil || n != 6 {
+			t.Fatalf("got %d samples, err %v, want 6 samples", n, err)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	put32 := func(typ string, off int, v uint32) func(*testing.T, []byte) []byte {
+		return func(t *testing.T, b []byte) []byte {
+			binary.BigEndian.PutUint32(b[payload(t, b, typ)+off:], v)
+			return b
+		}
+	}
+	tests := []struct {
+		name   string
+		co64   bool
+		mutate func(t *testing.T, b []byte) []byte
+	}{
+		// Truncated boxes
+		{"box header cut short", false, func(t *testing.T, b []byte) []byte {
+			return b[:payload(t, b, "moov")-3]
+		}},
+		{"largesize cut short", false, func(t *testing.T, b []byte) []byte {
+			moov := payload(t, b, "moov") - 8
+			return append(b[:moov], 0, 0, 0, 1, 'm', 'o', 'o', 'v', 0, 0, 0, 0)
+		}},
+		{"moov cut short", false, func(t *testing.T, b []byte) []byte {
+			return b[:len(b)-1]
+		}},
+		{"stsz entries cut short", false, func(t *testing.T, b []byte) []byte {
+			stsz := payload(t, b, "stsz") - 8
+			binary.BigEndian.PutUint32(b[stsz:], binary.BigEndian.Uint32(b[stsz:])-4)
+			return b
+		}},
+		{"descriptor cut short", false, func(t *testing.T, b []byte) []byte {
+			b[payload(t, b, "esds")+5] = 0x7f
+			return b
+		}},
+
+		// Sizes that do not fit
+		{"box smaller than its header", false, put32("moov", -8, 4)},
+		{"moov past end of file", false, func(t *testing.T, b []byte) []byte {
+			binary.BigEndian.PutUint32(b[payload(t, b, "moov")-8:], uint32(len(b)))
+			return b
+		}},
+		{"moov over size limit", false, put32("moov", -8, maxMovieSize+9)},
+		{"largesize too large", false, func(t *testing.T, b []byte) []byte {
+			moov := payload(t, b, "moov") - 8
+			return append(b[:moov], 0, 0, 0, 1, 'm', 'o', 'o', 'v', 0x80, 0, 0, 0, 0, 0, 0, 0)
+		}},
+		{"child past its parent", false, func(t *testing.T, b []byte) []byte {
+			stbl := payload(t, b, "stbl") - 8
+			binary.BigEndian.PutUint32(b[stbl:], binary.BigEndian.Uint32(b[stbl:])+100)
+			return b
+		}},
+		{"child smaller than its header", false, put32("stts", -8, 4)},
+
+		// Sample sizes
+		{"stsz count past box", false, put32("stsz", 8, 1000)},
+		{"stsz sample too large", false, put32("stsz", 12, maxSampleSize+1)},
+		{"stsz constant size too large", false, put32("stsz", 4, maxSampleSize+1)},
+		{"stsz more samples than chunks", false, put32("stsc", 24, 1)},
+		{"sample past end of file", false, put32("stsz", 32, 1000)},
+
+		// Chunk offsets
+		{"stco count past box", false, put32("stco", 4, 3)},
+		{"stco offset past end of file", false, put32("stco", 12, 1<<31)},
+		{"co64 count past box", true, put32("co64", 4, 3)},
+		{"co64 offset out of range", true, put32("co64", 16, 1<<31)},
+
+		// Sample to chunk table
+		{"stsc count past box", false, put32("stsc", 4, 3)},
+		{"stsc not starting at chunk 1", false, put32("stsc", 8, 2)},
+		{"stsc chunk without samples", false, put32("stsc", 12, 0)},
+		{"stsc out of order", false, put32("stsc", 20, 1)},
+		{"stsc past last chunk", false, put32("stsc", 20, 3)},
+
+		// Time to sample table
+		{"stts count past box", false, put32("stts", 4, 2)},
+		{"stts covers missing samples", false, put32("stts", 8, 7)},
+		{"zero timescale", false, put32("mdhd", 12, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.mutate(t, testMovie(tt.co64))
+			if err := demux(b); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("got %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		file       string
+		brand      string
+		id         uint32
+		codec      Codec
+		objectType uint8
+		config     []byte
+		sampleRate int
+		channels   int
+		delta      uint64 // ticks per sample
+		sizes      []int
+	}{
+		{"aac_mono.mp4", "M4A ", 1, CodecAAC, 0x40, []byte{0x13, 0x88}, 22050, 1,
+			1024, []int{210, 236, 299, 193, 90, 192}},
+		{"aac_stereo_moov_last.mp4", "isom", 2, CodecAAC, 0x40, []byte{0x11, 0x90}, 48000, 2,
+			1024, []int{434, 533, 642, 576, 298}},
+		{"aac_stereo.mov", "qt  ", 1, CodecAAC, 0x40, []byte{0x12, 0x90}, 32000, 2,
+			1024, []int{709, 488, 573, 733}},
+		{"mp3.mp4", "isom", 1, CodecMP3, 0x6b, nil, 44100, 2,
+			1152, []int{104, 104, 104, 104}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := Open(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.MajorBrand != tt.brand {
+				t.Errorf("got major brand %q, want %q", f.MajorBrand, tt.brand)
+			}
+			if len(f.AudioTracks) != 1 {
+				t.Fatalf("got %d audio tracks, want 1", len(f.AudioTracks))
+			}
+			track := f.AudioTracks[0]
+			if track.ID != tt.id || track.Codec != tt.codec || track.SampleEntry != "mp4a" ||
+				track.ObjectType != tt.objectType || !bytes.Equal(track.Config, tt.config) {
+				t.Errorf("got track %d %s %s %#x %x, want %d %s mp4a %#x %x", track.ID, track.Codec,
+					track.SampleEntry, track.ObjectType, track.Config, tt.id, tt.codec, tt.objectType, tt.config)
+			}
+			if track.SampleRate != tt.sampleRate || track.Channels != tt.channels ||
+				track.Timescale != uint32(tt.sampleRate) {
+				t.Errorf("got %d Hz, %d channels, timescale %d, want %d Hz, %d channels",
+					track.SampleRate, track.Channels, track.Timescale, tt.sampleRate, tt.channels)
+			}
+			duration := ticksToDuration(uint64(len(tt.sizes))*tt.delta, track.Timescale)
+			if track.Duration != duration || track.SampleCount != len(tt.sizes) {
+				t.Errorf("got %v in %d samples, want %v in %d", track.Duration, track.SampleCount,
+					duration, len(tt.sizes))
+			}
+
+			var sizes []int
+			it := track.Samples()
+			for it.Next() {
+				s := it.Sample()
+				at := ticksToDuration(uint64(s.Index)*tt.delta, track.Timescale)
+				if s.Index != len(sizes) || s.Time != at {
+					t.Errorf("sample %d: got index %d at %v, want %v", len(sizes), s.Index, s.Time, at)
+				}
+				sizes = append(sizes, len(s.Data))
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(sizes, tt.sizes) {
+				t.Errorf("got sample sizes %v, want %v", sizes, tt.sizes)
+			}
+		})
+	}
+}
+
+func TestOpenFragmented(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "fragmented.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(bytes.NewReader(b)); !errors.Is(err, ErrFragmented) {
+		t.Fatalf("got %v, want ErrFragmented", err)
+	}
+}
+
+func TestForwardOnly(t *testing.T) {
+	// The moov box comes first, so the samples can be read in order
+	b, err := os.ReadFile(filepath.Join("testdata", "aac_mono.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(struct{ io.Reader }{bytes.NewReader(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := f.AudioTracks[0].Samples()
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The samples precede the moov box and cannot be reached again
+	b, err = os.ReadFile(filepath.Join("testdata", "aac_stereo_moov_last.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = Open(struct{ io.Reader }{bytes.NewReader(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = f.AudioTracks[0].Samples()
+	if it.Next() || !errors.Is(it.Err(), ErrNotSeekable) {
+		t.Fatalf("got %v, want ErrNotSeekable", it.Err())
+	}
+}
+
+// addSeeds adds the testdata files and the test movie to the fuzz corpus
+func addSeeds(f *testing.F) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.m[op][4v]"))
+	if err != nil || len(paths) == 0 {
+		f.Fatalf("no seed files: %v", err)
+	}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add(testMovie(false))
+	f.Add(testMovie(true))
+}
+
+// FuzzOpen checks that Open only fails with the package's errors, whether
+// or not it can seek
+func FuzzOpen(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		readers := []io.Reader{bytes.NewReader(b), struct{ io.Reader }{bytes.NewReader(b)}}
+		for _, r := range readers {
+			file, err := Open(r)
+			if err != nil {
+				if !errors.Is(err, ErrInvalid) && !errors.Is(err, ErrNoMovie) &&
+					!errors.Is(err, ErrFragmented) && !errors.Is(err, ErrNotSeekable) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				continue
+			}
+			for _, track := range file.AudioTracks {
+				if track.Timescale == 0 || track.Duration < 0 || track.SampleCount < 0 {
+					t.Fatalf("bad track %+v", track)
+				}
+			}
+		}
+	})
+}
+
+// FuzzSamples checks that iteration either yields every sample in order
+// or stops with ErrInvalid
+func FuzzSamples(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		file, err := Open(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		for _, track := range file.AudioTracks {
+			var last time.Duration
+			n := 0
+			it := track.Samples()
+			for it.Next() {
+				s := it.Sample()
+				if s.Index != n || s.Time < last || len(s.Data) > maxSampleSize {
+					t.Fatalf("sample %d: got index %d at %v after %v, %d bytes", n, s.Index, s.Time, last, len(s.Data))
+				}
+				last = s.Time
+				n++
+			}
+			if err := it.Err(); err != nil {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			} else if n != track.SampleCount {
+				t.Fatalf("got %d samples, want %d", n, track.SampleCount)
+			}
+		}
+	})
+}
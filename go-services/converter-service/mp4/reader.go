@@ -0,0 +1,66 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotSeekable is returned when the demuxer needs to move backwards in a
+// reader that can only be read forwards. Callers that hit it should spool
+// the input to a seekable file first.
+var ErrNotSeekable = errors.New("mp4: reader cannot seek backwards")
+
+// skipper is implemented by readers that can cheaply skip ahead without
+// returning the skipped bytes, such as a gridfs.DownloadStream
+type skipper interface {
+	Skip(n int64) (int64, error)
+}
+
+// forwardReader adapts a plain io.Reader to io.ReadSeeker for forward seeks,
+// which is all the demuxer needs when the moov box precedes the media data
+type forwardReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (f *forwardReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *forwardReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	default:
+		return f.pos, fmt.Errorf("mp4: unsupported seek whence %d", whence)
+	}
+	if offset < f.pos {
+		return f.pos, ErrNotSeekable
+	}
+
+	n := offset - f.pos
+	var skipped int64
+	var err error
+	if s, ok := f.r.(skipper); ok {
+		skipped, err = s.Skip(n)
+	} else {
+		skipped, err = io.CopyN(io.Discard, f.r, n)
+	}
+	f.pos += skipped
+	if err == nil && skipped < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return f.pos, err
+}
+
+// toReadSeeker returns r itself when it can seek, or a forward-only wrapper
+func toReadSeeker(r io.Reader) io.ReadSeeker {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs
+	}
+	return &forwardReader{r: r}
+}
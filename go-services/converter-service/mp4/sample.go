@@ -0,0 +1,297 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+type timeToSample struct {
+	count uint32
+	delta uint32
+}
+
+type sampleToChunk struct {
+	firstChunk      uint32
+	samplesPerChunk uint32
+}
+
+// sampleTable holds the stbl boxes needed to locate samples. Samples are
+// located lazily while iterating so long files do not need a table entry
+// per sample beyond what the file itself stores.
+type sampleTable struct {
+	times        []timeToSample
+	chunks       []sampleToChunk
+	chunkOffsets []uint64
+	sampleSize   uint32   // used when every sample has the same size
+	sampleSizes  []uint32 // used when sampleSize is zero
+	sampleCount  uint32
+	haveSizes    bool
+}
+
+func (st *sampleTable) parse(typ string, b []byte) error {
+	r := &byteReader{b: b}
+	switch typ {
+	case "stts":
+		r.fullBox()
+		n := r.entries(8)
+		st.times = make([]timeToSample, n)
+		for i := range st.times {
+			st.times[i] = timeToSample{count: r.u32(), delta: r.u32()}
+		}
+	case "stsc":
+		r.fullBox()
+		n := r.entries(12)
+		st.chunks = make([]sampleToChunk, n)
+		for i := range st.chunks {
+			st.chunks[i] = sampleToChunk{firstChunk: r.u32(), samplesPerChunk: r.u32()}
+			r.skip(4) // sample_description_index
+		}
+	case "stsz":
+		r.fullBox()
+		st.haveSizes = true
+		st.sampleSize = r.u32()
+		if st.sampleSize != 0 {
+			st.sampleCount = r.u32()
+			break
+		}
+		n := r.entries(4)
+		st.sampleCount = uint32(n)
+		st.sampleSizes = make([]uint32, n)
+		for i := range st.sampleSizes {
+			st.sampleSizes[i] = r.u32()
+		}
+	case "stz2":
+		r.fullBox()
+		st.haveSizes = true
+		r.skip(3) // reserved
+		fieldSize := r.u8()
+		count := r.u32()
+		if r.err != nil {
+			break
+		}
+		if fieldSize != 4 && fieldSize != 8 && fieldSize != 16 {
+			return fmt.Errorf("%w: stz2 field size %d", ErrInvalid, fieldSize)
+		}
+		if uint64(count)*uint64(fieldSize) > uint64(r.remaining())*8 {
+			return fmt.Errorf("%w: entry count %d exceeds box size", ErrInvalid, count)
+		}
+		st.sampleCount = count
+		st.sampleSizes = make([]uint32, count)
+		for i := range st.sampleSizes {
+			switch fieldSize {
+			case 4:
+				b := r.b[r.off+i/2]
+				if i%2 == 0 {
+					st.sampleSizes[i] = uint32(b >> 4)
+				} else {
+					st.sampleSizes[i] = uint32(b & 0x0f)
+				}
+			case 8:
+				st.sampleSizes[i] = uint32(r.u8())
+			case 16:
+				st.sampleSizes[i] = uint32(r.u16())
+			}
+		}
+		if fieldSize == 4 {
+			r.skip(int(count+1) / 2)
+		}
+	case "stco":
+		r.fullBox()
+		n := r.entries(4)
+		st.chunkOffsets = make([]uint64, n)
+		for i := range st.chunkOffsets {
+			st.chunkOffsets[i] = uint64(r.u32())
+		}
+	case "co64":
+		r.fullBox()
+		n := r.entries(8)
+		st.chunkOffsets = make([]uint64, n)
+		for i := range st.chunkOffsets {
+			st.chunkOffsets[i] = r.u64()
+		}
+	}
+	return r.err
+}
+
+// validate checks the invariants the sample iterator relies on
+func (st *sampleTable) validate() error {
+	if !st.haveSizes {
+		return fmt.Errorf("%w: missing sample size box", ErrInvalid)
+	}
+	if st.sampleCount == 0 {
+		return nil
+	}
+	if len(st.chunks) == 0 || len(st.chunkOffsets) == 0 {
+		return fmt.Errorf("%w: missing chunk boxes", ErrInvalid)
+	}
+	if st.chunks[0].firstChunk != 1 {
+		return fmt.Errorf("%w: sample to chunk table does not start at chunk 1", ErrInvalid)
+	}
+	for i, c := range st.chunks {
+		if c.samplesPerChunk == 0 {
+			return fmt.Errorf("%w: chunk with no samples", ErrInvalid)
+		}
+		if i > 0 && c.firstChunk <= st.chunks[i-1].firstChunk {
+			return fmt.Errorf("%w: sample to chunk table out of order", ErrInvalid)
+		}
+		if uint64(c.firstChunk) > uint64(len(st.chunkOffsets)) {
+			return fmt.Errorf("%w: sample to chunk entry for chunk %d past the last chunk", ErrInvalid, c.firstChunk)
+		}
+	}
+	var timed uint64
+	for _, t := range st.times {
+		timed += uint64(t.count)
+	}
+	if timed > uint64(st.sampleCount) {
+		return fmt.Errorf("%w: time to sample table covers %d of %d samples", ErrInvalid, timed, st.sampleCount)
+	}
+	if st.sampleSize > maxSampleSize {
+		return fmt.Errorf("%w: sample size %d too large", ErrInvalid, st.sampleSize)
+	}
+	return nil
+}
+
+func (st *sampleTable) count() int {
+	return int(st.sampleCount)
+}
+
+// duration sums the time to sample table, in timescale units
+func (st *sampleTable) duration() uint64 {
+	var d uint64
+	for _, t := range st.times {
+		d += uint64(t.count) * uint64(t.delta)
+	}
+	return d
+}
+
+func (st *sampleTable) size(i uint32) uint32 {
+	if st.sampleSize != 0 {
+		return st.sampleSize
+	}
+	return st.sampleSizes[i]
+}
+
+// Sample is one encoded access unit of an audio track
+type Sample struct {
+	// Data is only valid until the next call to Next
+	Data []byte
+	// Index is the position of the sample in the track, starting at zero
+	Index int
+	// Time is the decode timestamp of the sample
+	Time     time.Duration
+	Duration time.Duration
+}
+
+// SampleIterator walks the samples of a track in decode order
+type SampleIterator struct {
+	track *AudioTrack
+	st    *sampleTable
+
+	next      uint32 // index of the next sample
+	chunk     int    // index of the next chunk
+	chunkLeft uint32 // samples left in the current chunk
+	offset    uint64 // file offset of the next sample
+	stsc      int    // current sample to chunk entry
+	stts      int    // next time to sample entry
+	sttsLeft  uint32
+	delta     uint32
+	ticks     uint64
+
+	buf    []byte
+	sample Sample
+	err    error
+}
+
+// Samples returns an iterator over the encoded samples of the track.
+// Samples are read from the reader passed to Open, so iterators of tracks
+// from the same File must not be used concurrently.
+func (t *AudioTrack) Samples() *SampleIterator {
+	return &SampleIterator{track: t, st: &t.table}
+}
+
+// Next advances to the next sample, returning false at the end of the track
+// or on error
+func (it *SampleIterator) Next() bool {
+	if it.err != nil || it.next >= it.st.sampleCount {
+		return false
+	}
+
+	st := it.st
+	if it.chunkLeft == 0 {
+		if it.chunk >= len(st.chunkOffsets) {
+			it.err = fmt.Errorf("%w: sample %d is past the last chunk", ErrInvalid, it.next)
+			return false
+		}
+		for it.stsc+1 < len(st.chunks) && uint64(it.chunk)+1 >= uint64(st.chunks[it.stsc+1].firstChunk) {
+			it.stsc++
+		}
+		it.offset = st.chunkOffsets[it.chunk]
+		it.chunkLeft = st.chunks[it.stsc].samplesPerChunk
+		it.chunk++
+	}
+
+	for it.sttsLeft == 0 && it.stts < len(st.times) {
+		it.sttsLeft = st.times[it.stts].count
+		it.delta = st.times[it.stts].delta
+		it.stts++
+	}
+	if it.sttsLeft > 0 {
+		it.sttsLeft--
+	}
+
+	size := st.size(it.next)
+	if size > maxSampleSize {
+		it.err = fmt.Errorf("%w: sample size %d too large", ErrInvalid, size)
+		return false
+	}
+	if cap(it.buf) < int(size) {
+		it.buf = make([]byte, size)
+	}
+	it.buf = it.buf[:size]
+	if err := it.read(it.offset, it.buf); err != nil {
+		it.err = err
+		return false
+	}
+
+	timescale := it.track.Timescale
+	it.sample = Sample{
+		Data:     it.buf,
+		Index:    int(it.next),
+		Time:     ticksToDuration(it.ticks, timescale),
+		Duration: ticksToDuration(uint64(it.delta), timescale),
+	}
+
+	it.offset += uint64(size)
+	it.ticks += uint64(it.delta)
+	it.chunkLeft--
+	it.next++
+	return true
+}
+
+func (it *SampleIterator) read(offset uint64, p []byte) error {
+	if offset > 1<<62 {
+		return fmt.Errorf("%w: sample offset %d out of range", ErrInvalid, offset)
+	}
+	r := it.track.file.r
+	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: sample %d extends past the end of the file", ErrInvalid, it.next)
+		}
+		return err
+	}
+	return nil
+}
+
+// Sample returns the current sample
+func (it *SampleIterator) Sample() Sample {
+	return it.sample
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *SampleIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/muhreeowki/ds-mp4-mp3-converter/converter/mp3"
+)
+
+// Output formats the converter can produce
+const (
+	FormatMP3 = "mp3"
+	FormatWAV = "wav"
+)
+
+// ConversionOptions are the audio settings requested with an upload. Zero
+// values keep the defaults: MP3 at the source sample rate and channel count.
+type ConversionOptions struct {
+	Format     string `json:"format,omitempty"`
+	Bitrate    int    `json:"bitrate,omitempty"` // CBR bitrate in kbit/s
+	Quality    *int   `json:"quality,omitempty"` // VBR quality, 0 best to 9
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	// Start and End trim the audio, in seconds from the start of the track.
+	// A zero End keeps everything after Start.
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+}
+
+// outputFormat is the resolved shape of the converted audio
+type outputFormat struct {
+	format     string
+	sampleRate int
+	channels   int
+	mp3        mp3.Options
+}
+
+// resolve checks the options and fills in the defaults for a source with
+// the given sample rate and channel count
+func (o ConversionOptions) resolve(srcRate, srcChannels int) (*outputFormat, error) {
+	out := &outputFormat{
+		format:     o.Format,
+		sampleRate: o.SampleRate,
+		channels:   o.Channels,
+	}
+	if out.format == "" {
+		out.format = FormatMP3
+	}
+	if out.channels == 0 {
+		out.channels = min(srcChannels, 2)
+	}
+	if out.channels != 1 && out.channels != 2 {
+		return nil, fmt.Errorf("unsupported channel count %d", out.channels)
+	}
+	if o.Start < 0 || o.End < 0 || (o.End != 0 && o.End <= o.Start) {
+		return nil, fmt.Errorf("invalid trim range %gs to %gs", o.Start, o.End)
+	}
+
+	switch out.format {
+	case FormatWAV:
+		if o.Bitrate != 0 || o.Quality != nil {
+			return nil, fmt.Errorf("bitrate and quality do not apply to wav")
+		}
+		if out.sampleRate == 0 {
+			out.sampleRate = srcRate
+		}
+	case FormatMP3:
+		if out.sampleRate == 0 {
+			out.sampleRate = nearest(mp3.SampleRates(), srcRate)
+		}
+		bitrates := mp3.Bitrates(out.sampleRate)
+		if bitrates == nil {
+			return nil, fmt.Errorf("mp3 does not support a sample rate of %d Hz", out.sampleRate)
+		}
+		out.mp3 = mp3.Options{
+			SampleRate: out.sampleRate,
+			Channels:   out.channels,
+		}
+		if out.channels == 1 {
+			out.mp3.Mode = mp3.Mono
+		}
+		switch {
+		case o.Quality != nil:
+			if *o.Quality < 0 || *o.Quality > 9 {
+				return nil, fmt.Errorf("quality %d out of range 0-9", *o.Quality)
+			}
+			if o.Bitrate != 0 {
+				return nil, fmt.Errorf("bitrate and quality are mutually exclusive")
+			}
+			out.mp3.BitrateMode = mp3.VBR
+			out.mp3.Quality = *o.Quality
+		case o.Bitrate != 0:
+			// Not every bitrate exists at every sample rate, so take the
+			// closest one the stream can carry
+			out.mp3.Bitrate = nearest(bitrates, o.Bitrate)
+		default:
+			out.mp3.Bitrate = 192
+			if out.sampleRate < 32000 {
+				// MPEG-2 rates top out at 160 kbit/s
+				out.mp3.Bitrate = 96
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q", out.format)
+	}
+	return out, nil
+}
+
+// nearest returns the value in values closest to v
+func nearest(values []int, v int) int {
+	best := values[0]
+	for _, x := range values[1:] {
+		if math.Abs(float64(x-v)) < math.Abs(float64(best-v)) {
+			best = x
+		}
+	}
+	return best
+}
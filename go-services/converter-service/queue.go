@@ -9,7 +9,23 @@ import (
 )
 
 type MessageQueue interface {
-	SendVideoUploadedMessage(id string, size int64, username string) error
+	SendMP3ConvertedMessage(mp3Id string, videoId string, userId string, username string) error
+	PublishJobEvent(event *JobEvent) error
+}
+
+// jobEventsExchange is the fanout exchange job events are published on
+const jobEventsExchange = "jobEvents"
+
+// VideoMessage is the message the gateway publishes for every uploaded video
+type VideoMessage struct {
+	JobId    string `json:"jobId,omitempty"`
+	VideoId  string `json:"videoId"`
+	Mp3Id    string `json:"mp3Id"`
+	// UserId is the stable id of the owner and Username their email
+	UserId   string `json:"userId,omitempty"`
+	Username string `json:"username"`
+	// Options is only set on messages from the gateway
+	Options *ConversionOptions `json:"options,omitempty"`
 }
 
 type RabbitMQ struct {
@@ -21,7 +37,7 @@ func NewRabbitMQ(connStr string) (*RabbitMQ, error) {
 	// Connect to RabbitMQ Serevr
 	conn, err := amqp.Dial(connStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: err", err)
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
 	}
 
 	// Create a channel
@@ -46,11 +62,12 @@ func (mq *RabbitMQ) Close() {
 	mq.conn.Close()
 }
 
-func (mq *RabbitMQ) SendVideoUploadedMessage(mp3Id string, videoId string, size int64, username string) error {
-	msg := map[string]string{
-		"videoId":  videoId,
-		"mp3Id":    mp3Id,
-		"username": username,
+func (mq *RabbitMQ) SendMP3ConvertedMessage(mp3Id string, videoId string, userId string, username string) error {
+	msg := VideoMessage{
+		VideoId:  videoId,
+		Mp3Id:    mp3Id,
+		UserId:   userId,
+		Username: username,
 	}
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -65,6 +82,9 @@ func (mq *RabbitMQ) SendVideoUploadedMessage(mp3Id string, videoId string, size
 		false,
 		nil,
 	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a RabbitMQ queue: %v", err)
+	}
 
 	return mq.channel.Publish(
 		"",
@@ -76,3 +96,33 @@ func (mq *RabbitMQ) SendVideoUploadedMessage(mp3Id string, videoId string, size
 			Body:        data,
 		})
 }
+
+func (mq *RabbitMQ) PublishJobEvent(event *JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode job event: %v", err)
+	}
+
+	err = mq.channel.ExchangeDeclare(
+		jobEventsExchange, // name
+		"fanout",          // type
+		false,             // durable
+		false,             // auto-deleted
+		false,             // internal
+		false,             // no-wait
+		nil,               // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a RabbitMQ exchange: %v", err)
+	}
+
+	return mq.channel.Publish(
+		jobEventsExchange,
+		"",
+		false,
+		false,
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        data,
+		})
+}
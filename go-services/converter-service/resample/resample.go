@@ -0,0 +1,174 @@
+// Package resample converts interleaved 16-bit PCM between sample rates.
+//
+// It uses a Kaiser windowed sinc filter evaluated at arbitrary phases, so
+// any pair of rates works, including ratios that do not reduce to small
+// fractions such as 44.1 to 48 kHz.
+package resample
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// zeroCrossings is the number of sinc lobes on each side of the filter
+	zeroCrossings = 16
+	// phases is the resolution of the filter table per input sample
+	phases = 256
+	// rolloff places the cutoff just below the lower Nyquist frequency
+	rolloff = 0.95
+	// kaiserBeta trades stopband attenuation against transition width
+	kaiserBeta = 9.0
+)
+
+// Resampler converts a stream of interleaved PCM from one rate to another
+type Resampler struct {
+	channels int
+	step     float64 // input samples per output sample
+	half     int     // filter half width in input samples
+	table    []float64
+
+	// hist holds the input of each channel starting at absolute sample
+	// index base. The first half samples are the zeros before the stream.
+	hist  [][]float64
+	base  int
+	time  float64 // absolute input position of the next output sample
+	total int     // input samples per channel received so far
+	out   []int16
+}
+
+// New creates a new Resampler instance
+func New(inRate, outRate, channels int) (*Resampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, fmt.Errorf("resample: invalid rates %d to %d Hz", inRate, outRate)
+	}
+	if channels < 1 {
+		return nil, fmt.Errorf("resample: invalid channel count %d", channels)
+	}
+	r := &Resampler{
+		channels: channels,
+		step:     float64(inRate) / float64(outRate),
+	}
+
+	// Downsampling lowers the cutoff and so widens the filter in input
+	// samples
+	cutoff := rolloff * math.Min(1, float64(outRate)/float64(inRate))
+	r.half = int(math.Ceil(zeroCrossings / cutoff))
+	r.table = make([]float64, r.half*phases+2)
+	norm := besselI0(kaiserBeta)
+	for i := range r.table {
+		x := float64(i) / phases
+		if x > float64(r.half) {
+			break
+		}
+		w := x / float64(r.half)
+		window := besselI0(kaiserBeta*math.Sqrt(1-w*w)) / norm
+		r.table[i] = cutoff * sinc(cutoff*x) * window
+	}
+
+	r.hist = make([][]float64, channels)
+	for ch := range r.hist {
+		r.hist[ch] = make([]float64, r.half)
+	}
+	r.base = -r.half
+	return r, nil
+}
+
+// Process resamples interleaved samples and returns the output produced so
+// far. The returned slice is reused by the next call.
+func (r *Resampler) Process(pcm []int16) []int16 {
+	for i := 0; i+r.channels <= len(pcm); i += r.channels {
+		for ch := range r.hist {
+			r.hist[ch] = append(r.hist[ch], float64(pcm[i+ch]))
+		}
+		r.total++
+	}
+	return r.produce(r.base + len(r.hist[0]))
+}
+
+// Flush returns the output for the end of the stream, where the filter
+// runs past the last input sample into silence
+func (r *Resampler) Flush() []int16 {
+	for ch := range r.hist {
+		r.hist[ch] = append(r.hist[ch], make([]float64, r.half+1)...)
+	}
+	end := r.base + len(r.hist[0])
+	r.out = r.out[:0]
+	for r.time < float64(r.total) && int(r.time)+r.half < end {
+		r.emit()
+	}
+	return r.out
+}
+
+// produce computes every output sample whose filter lies before end
+func (r *Resampler) produce(end int) []int16 {
+	r.out = r.out[:0]
+	for int(r.time)+r.half < end {
+		r.emit()
+	}
+
+	// Drop the input no future output sample reaches
+	drop := int(r.time) - r.half + 1 - r.base
+	if drop > 0 {
+		for ch := range r.hist {
+			r.hist[ch] = append(r.hist[ch][:0], r.hist[ch][drop:]...)
+		}
+		r.base += drop
+	}
+	return r.out
+}
+
+// emit appends the output sample at r.time and advances to the next
+func (r *Resampler) emit() {
+	center := int(r.time)
+	for _, hist := range r.hist {
+		var sum float64
+		for i := center - r.half + 1; i <= center+r.half; i++ {
+			sum += hist[i-r.base] * r.tap(math.Abs(r.time-float64(i)))
+		}
+		r.out = append(r.out, clip16(sum))
+	}
+	r.time += r.step
+}
+
+// tap interpolates the filter table at a distance in input samples
+func (r *Resampler) tap(x float64) float64 {
+	pos := x * phases
+	i := int(pos)
+	if i >= len(r.table)-1 {
+		return 0
+	}
+	f := pos - float64(i)
+	return r.table[i] + f*(r.table[i+1]-r.table[i])
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func clip16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
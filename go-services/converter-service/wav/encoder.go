@@ -0,0 +1,113 @@
+// Package wav writes 16-bit PCM WAVE files.
+//
+// The RIFF header records the size of the sample data, so the encoder
+// needs an io.WriteSeeker to fill it in once the stream is complete.
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrClosed is returned when encoding after Close
+var ErrClosed = errors.New("wav: encoder closed")
+
+// headerSize is the size of the RIFF, fmt and data chunk headers
+const headerSize = 44
+
+// maxDataSize is the most sample data a RIFF file can describe
+const maxDataSize = 1<<32 - 1 - (headerSize - 8)
+
+// Encoder writes interleaved 16-bit PCM as a WAVE file
+type Encoder struct {
+	w          io.WriteSeeker
+	sampleRate int
+	channels   int
+	size       int64 // bytes of sample data written
+	buf        []byte
+	closed     bool
+	err        error
+}
+
+// NewEncoder creates a new Encoder instance and writes a placeholder header
+// to w
+func NewEncoder(w io.WriteSeeker, sampleRate, channels int) (*Encoder, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("wav: invalid sample rate %d", sampleRate)
+	}
+	if channels < 1 || channels > 8 {
+		return nil, fmt.Errorf("wav: unsupported channel count %d", channels)
+	}
+	e := &Encoder{w: w, sampleRate: sampleRate, channels: channels}
+	if _, err := w.Write(e.header()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// header returns the file header for the data written so far
+func (e *Encoder) header() []byte {
+	blockAlign := 2 * e.channels
+	h := make([]byte, 0, headerSize)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(headerSize-8+e.size))
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, 1) // PCM
+	h = binary.LittleEndian.AppendUint16(h, uint16(e.channels))
+	h = binary.LittleEndian.AppendUint32(h, uint32(e.sampleRate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(e.sampleRate*blockAlign))
+	h = binary.LittleEndian.AppendUint16(h, uint16(blockAlign))
+	h = binary.LittleEndian.AppendUint16(h, 16)
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(e.size))
+	return h
+}
+
+// Encode writes interleaved PCM samples
+func (e *Encoder) Encode(pcm []int16) error {
+	if e.closed {
+		return ErrClosed
+	}
+	if e.err != nil {
+		return e.err
+	}
+	if e.size+2*int64(len(pcm)) > maxDataSize {
+		e.err = fmt.Errorf("wav: file exceeds 4 GiB")
+		return e.err
+	}
+	e.buf = e.buf[:0]
+	for _, v := range pcm {
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(v))
+	}
+	n, err := e.w.Write(e.buf)
+	e.size += int64(n)
+	if err != nil {
+		e.err = err
+	}
+	return err
+}
+
+// Close rewrites the header with the final sizes and leaves w positioned
+// at the end of the file. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err != nil {
+		return e.err
+	}
+	if _, err := e.w.Seek(0, io.SeekStart); err != nil {
+		e.err = err
+		return err
+	}
+	if _, err := e.w.Write(e.header()); err != nil {
+		e.err = err
+		return err
+	}
+	_, e.err = e.w.Seek(0, io.SeekEnd)
+	return e.err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix marks the API keys of the auth service, which are sent as
+// bearer tokens in place of a JWT
+const apiKeyPrefix = "mp3k_"
+
+const (
+	// apiKeyCacheTTL bounds how long a revoked key keeps working at the
+	// gateway, and how often its last use is recorded
+	apiKeyCacheTTL = 30 * time.Second
+	// maxCachedAPIKeys limits the cache, since anyone can send keys
+	maxCachedAPIKeys = 10000
+)
+
+// apiKeyEntry is a cached answer of the auth service about a key
+type apiKeyEntry struct {
+	identity *Identity // nil for an invalid key
+	expires  time.Time
+}
+
+// apiKeyCache verifies API keys with the auth service and remembers the
+// answers for a short while, so scripts do not cost a round trip per
+// request
+type apiKeyCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]apiKeyEntry
+}
+
+// newAPIKeyCache creates a new apiKeyCache instance
+func newAPIKeyCache() *apiKeyCache {
+	return &apiKeyCache{
+		url:     os.Getenv("AUTH_SVC_URL") + "/api-keys/verify",
+		client:  &http.Client{Timeout: 10 * time.Second},
+		entries: make(map[[sha256.Size]byte]apiKeyEntry),
+	}
+}
+
+// verify returns the identity of an API key, limited to the key's scopes
+func (c *apiKeyCache) verify(key string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(key))
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[sum]
+	c.mu.Unlock()
+	if !ok || now.After(entry.expires) {
+		identity, err := c.fetch(key)
+		if err != nil {
+			return nil, err
+		}
+		entry = apiKeyEntry{identity: identity, expires: now.Add(apiKeyCacheTTL)}
+		c.store(sum, entry, now)
+	}
+	if entry.identity == nil {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	return entry.identity, nil
+}
+
+// store caches an entry, dropping expired ones when the cache is full
+func (c *apiKeyCache) store(sum [sha256.Size]byte, entry apiKeyEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedAPIKeys {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedAPIKeys {
+			return
+		}
+	}
+	c.entries[sum] = entry
+}
+
+// fetch asks the auth service about a key. It returns a nil identity for
+// an invalid key, and an error when the auth service cannot answer.
+func (c *apiKeyCache) fetch(key string) (*Identity, error) {
+	body, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify api key: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returned [%s] status code", resp.Status)
+	}
+
+	identity := &Identity{}
+	if err := json.NewDecoder(resp.Body).Decode(identity); err != nil {
+		return nil, fmt.Errorf("failed to decode api key identity: %v", err)
+	}
+	if identity.Scopes == nil {
+		identity.Scopes = []string{}
+	}
+	return identity, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Permissions a route can require
+const (
+	PermUpload      = "upload"
+	PermDownloadOwn = "download-own"
+	PermDownloadAny = "download-any"
+	PermManageUsers = "manage-users"
+)
+
+// Roles carried in tokens
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleService = "service"
+)
+
+// rolePermissions are the permissions granted by each role. Services are
+// backends that fetch converted files for any user but upload nothing.
+var rolePermissions = map[string][]string{
+	RoleUser:    {PermUpload, PermDownloadOwn},
+	RoleService: {PermDownloadOwn, PermDownloadAny},
+	RoleAdmin:   {PermUpload, PermDownloadOwn, PermDownloadAny, PermManageUsers},
+}
+
+// Can reports whether one of the identity's roles grants perm. An API key
+// is further limited to its scopes.
+func (id *Identity) Can(perm string) bool {
+	if id.Scopes != nil && !slices.Contains(id.Scopes, perm) {
+		return false
+	}
+	for _, role := range id.Roles {
+		if slices.Contains(rolePermissions[role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIError is an error with the status code it is reported with
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// errUnauthorized and errForbidden report failed authentication and
+// missing permissions
+func errUnauthorized(err error) error {
+	return &APIError{Status: http.StatusUnauthorized, Message: err.Error()}
+}
+
+func errForbidden(perm string) error {
+	return &APIError{Status: http.StatusForbidden, Message: fmt.Sprintf("permission %s is required", perm)}
+}
+
+type identityKey struct{}
+
+// identityFrom returns the identity authorize stored in the request
+func identityFrom(r *http.Request) *Identity {
+	return r.Context().Value(identityKey{}).(*Identity)
+}
+
+// authorize wraps a handler so it only runs for a valid token granting
+// perm. The identity is passed to the handler in the request context.
+func (s *GatewayServer) authorize(perm string, f GatewayHandlerFunc) http.HandlerFunc {
+	return s.makeHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return s.checkAccess(w, r, r.Header.Get("Authorization"), perm, f)
+	})
+}
+
+// authorizeStream is authorize for event streams. Browsers cannot set
+// headers on EventSource or WebSocket requests, so the token may also be
+// passed as the access_token query parameter.
+func (s *GatewayServer) authorizeStream(perm string, f GatewayHandlerFunc) http.HandlerFunc {
+	return s.makeHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		if token == "" && r.URL.Query().Get("access_token") != "" {
+			token = "Bearer " + r.URL.Query().Get("access_token")
+		}
+		return s.checkAccess(w, r, token, perm, f)
+	})
+}
+
+func (s *GatewayServer) checkAccess(w http.ResponseWriter, r *http.Request, token, perm string, f GatewayHandlerFunc) error {
+	if token == "" {
+		return errUnauthorized(fmt.Errorf("authorization header is missing"))
+	}
+	user, err := s.validateToken(token)
+	if err != nil {
+		return errUnauthorized(err)
+	}
+	if !user.Can(perm) {
+		return errForbidden(perm)
+	}
+	return f(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, user)))
+}
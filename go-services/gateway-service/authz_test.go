@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a key the auth service could sign tokens with
+type signingKey struct {
+	kid     string
+	private ed25519.PrivateKey
+}
+
+func newSigningKey(t *testing.T, kid string) *signingKey {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKey{kid: kid, private: private}
+}
+
+func newTokenId(t *testing.T) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sign returns a bearer token for the subject with the given roles. edit
+// changes the claims before they are signed.
+func (k *signingKey) sign(t *testing.T, subject string, roles []string, edit func(*AuthClaims)) string {
+	t.Helper()
+	now := time.Now()
+	claims := &AuthClaims{
+		Email: subject + "@example.com",
+		Roles: roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        newTokenId(t),
+			Subject:   subject,
+			Issuer:    jwtIssuer(),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+		},
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + signed
+}
+
+// newAuthzTest returns a gateway that trusts key without asking the auth
+// service for keys
+func newAuthzTest(key *signingKey) *GatewayServer {
+	s := &GatewayServer{jwks: newJWKSCache(), revocations: newRevocationList(), apiKeys: newAPIKeyCache()}
+	s.jwks.keys[key.kid] = key.private.Public().(ed25519.PublicKey)
+	s.jwks.lastRefresh = time.Now()
+	return s
+}
+
+func TestAuthorize(t *testing.T) {
+	key := newSigningKey(t, "current")
+	s := newAuthzTest(key)
+	user := key.sign(t, "user", []string{RoleUser}, nil)
+	admin := key.sign(t, "admin", []string{RoleAdmin}, nil)
+	service := key.sign(t, "service", []string{RoleService}, nil)
+	expired := key.sign(t, "user", []string{RoleUser}, func(c *AuthClaims) {
+		c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+		c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	})
+	otherAudience := key.sign(t, "user", []string{RoleUser}, func(c *AuthClaims) {
+		c.Audience = jwt.ClaimStrings{"another-service"}
+	})
+	revoked := key.sign(t, "user", []string{RoleUser}, func(c *AuthClaims) { c.ID = "revoked" })
+	s.revocations.tokens["revoked"] = time.Now().Add(time.Hour)
+	unknownKey := newSigningKey(t, "unknown").sign(t, "user", []string{RoleUser}, nil)
+
+	// API keys are answered from the cache, limited to their scopes
+	apiKey := apiKeyPrefix + "downloadonly"
+	s.apiKeys.entries[sha256.Sum256([]byte(apiKey))] = apiKeyEntry{
+		identity: &Identity{Id: "user", Roles: []string{RoleUser}, Scopes: []string{PermDownloadOwn}},
+		expires:  time.Now().Add(time.Hour),
+	}
+
+	tests := []struct {
+		name   string
+		stream bool
+		perm   string
+		header string
+		query  string // access_token
+		want   int
+		sub    string // identity passed to the handler
+	}{
+		{"no token", false, PermUpload, "", "", http.StatusUnauthorized, ""},
+		{"not a bearer token", false, PermUpload, "Basic dXNlcjpwYXNz", "", http.StatusUnauthorized, ""},
+		{"empty bearer token", false, PermUpload, "Bearer ", "", http.StatusUnauthorized, ""},
+		{"malformed token", false, PermUpload, "Bearer not.a.jwt", "", http.StatusUnauthorized, ""},
+		{"expired token", false, PermUpload, expired, "", http.StatusUnauthorized, ""},
+		{"token for another audience", false, PermUpload, otherAudience, "", http.StatusUnauthorized, ""},
+		{"revoked token", false, PermUpload, revoked, "", http.StatusUnauthorized, ""},
+		{"unknown signing key", false, PermUpload, unknownKey, "", http.StatusUnauthorized, ""},
+		{"user uploads", false, PermUpload, user, "", http.StatusOK, "user"},
+		{"user manages users", false, PermManageUsers, user, "", http.StatusForbidden, ""},
+		{"service uploads", false, PermUpload, service, "", http.StatusForbidden, ""},
+		{"service downloads any", false, PermDownloadAny, service, "", http.StatusOK, "service"},
+		{"admin manages users", false, PermManageUsers, admin, "", http.StatusOK, "admin"},
+		{"api key in scope", false, PermDownloadOwn, "Bearer " + apiKey, "", http.StatusOK, "user"},
+		{"api key out of scope", false, PermUpload, "Bearer " + apiKey, "", http.StatusForbidden, ""},
+		{"query token on a plain route", false, PermUpload, "", user[len("Bearer "):], http.StatusUnauthorized, ""},
+		{"query token on a stream", true, PermDownloadOwn, "", user[len("Bearer "):], http.StatusOK, "user"},
+		{"header token on a stream", true, PermDownloadOwn, user, "", http.StatusOK, "user"},
+		{"no token on a stream", true, PermDownloadOwn, "", "", http.StatusUnauthorized, ""},
+		{"bad query token on a stream", true, PermDownloadOwn, "", "not.a.jwt", http.StatusUnauthorized, ""},
+		{"header wins over the query", true, PermDownloadOwn, "Bearer not.a.jwt", user[len("Bearer "):], http.StatusUnauthorized, ""},
+		{"query token without permission", true, PermManageUsers, "", user[len("Bearer "):], http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sub string
+			handler := func(w http.ResponseWriter, r *http.Request) error {
+				sub = identityFrom(r).Id
+				return WriteJSON(w, http.StatusOK, "ok")
+			}
+			wrap := s.authorize
+			if test.stream {
+				wrap = s.authorizeStream
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.query != "" {
+				r.URL.RawQuery = "access_token=" + test.query
+			}
+			w := httptest.NewRecorder()
+			wrap(test.perm, handler)(w, r)
+			if w.Code != test.want || sub != test.sub {
+				t.Errorf("got %d for %q, want %d for %q: %s", w.Code, sub, test.want, test.sub, w.Body)
+			}
+		})
+	}
+}
+
+func TestIdentityCan(t *testing.T) {
+	tests := []struct {
+		identity Identity
+		perm     string
+		want     bool
+	}{
+		{Identity{Roles: []string{RoleUser}}, PermUpload, true},
+		{Identity{Roles: []string{RoleUser}}, PermDownloadAny, false},
+		{Identity{Roles: []string{RoleService}}, PermDownloadAny, true},
+		{Identity{Roles: []string{RoleService}}, PermUpload, false},
+		{Identity{Roles: []string{RoleUser, RoleService}}, PermUpload, true},
+		{Identity{Roles: []string{"unknown"}}, PermDownloadOwn, false},
+		{Identity{}, PermDownloadOwn, false},
+		// Scopes limit what the roles grant and grant nothing themselves
+		{Identity{Roles: []string{RoleAdmin}, Scopes: []string{PermUpload}}, PermUpload, true},
+		{Identity{Roles: []string{RoleAdmin}, Scopes: []string{PermUpload}}, PermManageUsers, false},
+		{Identity{Roles: []string{RoleAdmin}, Scopes: []string{}}, PermUpload, false},
+		{Identity{Roles: []string{RoleUser}, Scopes: []string{PermManageUsers}}, PermManageUsers, false},
+	}
+	for _, test := range tests {
+		if got := test.identity.Can(test.perm); got != test.want {
+			t.Errorf("roles %v scopes %v: Can(%s) = %v, want %v",
+				test.identity.Roles, test.identity.Scopes, test.perm, got, test.want)
+		}
+	}
+}
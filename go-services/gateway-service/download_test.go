@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// download requests a file as identity with the given headers
+func download(s *GatewayServer, id string, identity *Identity, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/download/"+id, nil)
+	r.SetPathValue("mp3Id", id)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	w := httptest.NewRecorder()
+	s.makeHandlerFunc(s.handleDownload)(w, r)
+	return w
+}
+
+func TestDownload(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	uploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newFakeStore()
+	s := &GatewayServer{store: store}
+	id := store.addFile("owner", "talk.mp3", data, uploaded)
+	etag := `"` + id + `"`
+	owner := &Identity{Id: "owner", Roles: []string{RoleUser}}
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		want         int
+		body         []byte
+		contentRange string
+	}{
+		{"whole file", nil, http.StatusOK, data, ""},
+		{"first bytes", map[string]string{"Range": "bytes=0-99"}, http.StatusPartialContent, data[:100], "bytes 0-99/1000"},
+		{"middle bytes", map[string]string{"Range": "bytes=500-599"}, http.StatusPartialContent, data[500:600], "bytes 500-599/1000"},
+		{"open ended", map[string]string{"Range": "bytes=900-"}, http.StatusPartialContent, data[900:], "bytes 900-999/1000"},
+		{"suffix", map[string]string{"Range": "bytes=-10"}, http.StatusPartialContent, data[990:], "bytes 990-999/1000"},
+		{"end past the file", map[string]string{"Range": "bytes=990-2000"}, http.StatusPartialContent, data[990:], "bytes 990-999/1000"},
+		{"start past the file", map[string]string{"Range": "bytes=1000-1100"}, http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+		{"malformed range", map[string]string{"Range": "bytes=500-100"}, http.StatusRequestedRangeNotSatisfiable, nil, ""},
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified, nil, ""},
+		{"one of the etags matches", map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified, nil, ""},
+		{"weak etag matches", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified, nil, ""},
+		{"any etag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified, nil, ""},
+		{"etag changed", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, data, ""},
+		{"not modified since", map[string]string{"If-Modified-Since": uploaded.Format(http.TimeFormat)}, http.StatusNotModified, nil, ""},
+		{"modified since", map[string]string{"If-Modified-Since": uploaded.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, data, ""},
+		// A resumed download only gets the rest if the file is the same
+		{"resume same file", map[string]string{"Range": "bytes=100-", "If-Range": etag}, http.StatusPartialContent, data[100:], "bytes 100-999/1000"},
+		{"resume changed file", map[string]string{"Range": "bytes=100-", "If-Range": `"other"`}, http.StatusOK, data, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := download(s, id, owner, test.header)
+			if w.Code != test.want {
+				t.Fatalf("got %d, want %d", w.Code, test.want)
+			}
+			if test.body != nil && !bytes.Equal(w.Body.Bytes(), test.body) {
+				t.Errorf("got %d bytes, want %d", w.Body.Len(), len(test.body))
+			}
+			if test.want == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with a %d byte body", w.Body.Len())
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range %q, want %q", got, test.contentRange)
+			}
+			if test.want == http.StatusOK || test.want == http.StatusPartialContent {
+				if got := w.Header().Get("Content-Length"); got != fmt.Sprint(len(test.body)) {
+					t.Errorf("Content-Length %s, want %d", got, len(test.body))
+				}
+				if got := w.Header().Get("Content-Type"); got != "audio/mpeg" {
+					t.Errorf("Content-Type %q", got)
+				}
+				if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+					t.Errorf("Accept-Ranges %q", got)
+				}
+				if got := w.Header().Get("Last-Modified"); got != uploaded.Format(http.TimeFormat) {
+					t.Errorf("Last-Modified %q", got)
+				}
+			}
+			if test.want != http.StatusRequestedRangeNotSatisfiable && w.Header().Get("ETag") != etag {
+				t.Errorf("ETag %q, want %q", w.Header().Get("ETag"), etag)
+			}
+		})
+	}
+
+	w := download(s, id, owner, nil)
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename=talk.mp3` {
+		t.Errorf("Content-Disposition %q", got)
+	}
+	store.mu.Lock()
+	if store.closed != len(tests)+1 {
+		t.Errorf("%d of %d opened files were closed", store.closed, len(tests)+1)
+	}
+	store.mu.Unlock()
+}
+
+func TestDownloadMultipleRanges(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	store := newFakeStore()
+	s := &GatewayServer{store: store}
+	id := store.addFile("owner", "song.mp3", data, time.Now())
+
+	w := download(s, id, &Identity{Id: "owner", Roles: []string{RoleUser}}, map[string]string{"Range": "bytes=0-4,10-14"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", w.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	parts := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []string{"bytes 0-4/1000", "bytes 10-14/1000"} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != want || string(body) != "01234" {
+			t.Errorf("part %s with %q, want %s with 01234", part.Header.Get("Content-Range"), body, want)
+		}
+		if part.Header.Get("Content-Type") != "audio/mpeg" {
+			t.Errorf("part Content-Type %q", part.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestDownloadAccess(t *testing.T) {
+	store := newFakeStore()
+	s := &GatewayServer{store: store}
+	id := store.addFile("owner", "song.mp3", []byte("mp3 data"), time.Now())
+
+	tests := []struct {
+		name     string
+		id       string
+		identity *Identity
+		want     int
+	}{
+		{"owner", id, &Identity{Id: "owner", Roles: []string{RoleUser}}, http.StatusOK},
+		{"another user", id, &Identity{Id: "other", Roles: []string{RoleUser}}, http.StatusNotFound},
+		{"service", id, &Identity{Id: "svc", Roles: []string{RoleService}}, http.StatusOK},
+		{"admin", id, &Identity{Id: "admin", Roles: []string{RoleAdmin}}, http.StatusOK},
+		{"api key without download-any", id, &Identity{Id: "admin", Roles: []string{RoleAdmin}, Scopes: []string{PermDownloadOwn}}, http.StatusNotFound},
+		{"missing file", "missing", &Identity{Id: "owner", Roles: []string{RoleUser}}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		headers := []map[string]string{nil}
+		if test.want == http.StatusNotFound {
+			// Other users' files look the same as missing ones, even to
+			// conditional and range requests
+			headers = append(headers, map[string]string{"If-None-Match": "*"}, map[string]string{"Range": "bytes=0-1"})
+		}
+		for _, header := range headers {
+			if w := download(s, test.id, test.identity, header); w.Code != test.want {
+				t.Errorf("%s with %v: got %d, want %d", test.name, header, w.Code, test.want)
+			}
+		}
+	}
+}
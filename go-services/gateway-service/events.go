@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobEvent is published by the converter for every status change of a job
+// and for progress while converting. Every event carries the full state of
+// the job, and Seq increases with each event so clients can resume.
+type JobEvent struct {
+	JobId   string    `json:"jobId"`
+	Seq     int64     `json:"seq"`
+	Status  string    `json:"status"`
+	Percent float64   `json:"percent"`
+	Mp3Id   string    `json:"mp3Id,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+const (
+	// eventBacklog is the number of events kept per job for clients that
+	// reconnect with Last-Event-ID
+	eventBacklog = 64
+	// eventTTL is how long the events of a job without subscribers are
+	// kept after its last event
+	eventTTL = 10 * time.Minute
+	// keepAliveInterval keeps idle connections from being closed by proxies
+	keepAliveInterval = 15 * time.Second
+	// subscriberBuffer is the number of events a slow client may fall behind
+	// before it is disconnected
+	subscriberBuffer = 16
+)
+
+// eventHub fans job events from the broker out to connected clients
+type eventHub struct {
+	mu        sync.Mutex
+	jobs      map[string]*jobStream
+	lastSweep time.Time
+}
+
+// jobStream holds the recent events and the subscribers of one job
+type jobStream struct {
+	events  []*JobEvent
+	subs    map[chan *JobEvent]struct{}
+	updated time.Time
+}
+
+// newEventHub creates a new eventHub instance
+func newEventHub() *eventHub {
+	return &eventHub{jobs: make(map[string]*jobStream)}
+}
+
+// stream returns the stream of a job, creating it if needed. The caller
+// holds mu.
+func (h *eventHub) stream(jobId string) *jobStream {
+	stream, ok := h.jobs[jobId]
+	if !ok {
+		stream = &jobStream{subs: make(map[chan *JobEvent]struct{}), updated: time.Now()}
+		h.jobs[jobId] = stream
+	}
+	return stream
+}
+
+// publish records an event and passes it to the subscribers of its job
+func (h *eventHub) publish(event *JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sweep()
+
+	stream := h.stream(event.JobId)
+	// Drop duplicates and events that arrive out of order
+	if n := len(stream.events); n > 0 && event.Seq <= stream.events[n-1].Seq {
+		return
+	}
+	stream.events = append(stream.events, event)
+	if len(stream.events) > eventBacklog {
+		stream.events = stream.events[len(stream.events)-eventBacklog:]
+	}
+	stream.updated = time.Now()
+
+	for ch := range stream.subs {
+		select {
+		case ch <- event:
+		default:
+			// The client is not keeping up. Closing its channel ends the
+			// connection and it resumes from its last event.
+			delete(stream.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// sweep forgets jobs that have had no events or subscribers for a while.
+// The caller holds mu.
+func (h *eventHub) sweep() {
+	now := time.Now()
+	if now.Sub(h.lastSweep) < time.Minute {
+		return
+	}
+	h.lastSweep = now
+	for jobId, stream := range h.jobs {
+		if len(stream.subs) == 0 && now.Sub(stream.updated) > eventTTL {
+			delete(h.jobs, jobId)
+		}
+	}
+}
+
+// subscription is the state of a job's events when a client subscribes
+type subscription struct {
+	// backlog holds the buffered events after the client's last event
+	backlog []*JobEvent
+	// complete is set when backlog holds every event since the last one
+	complete bool
+	// finished is set when the client has already seen the final event
+	finished bool
+	// events receives the events published after subscribing
+	events chan *JobEvent
+}
+
+// subscribe registers for the events of a job after lastSeq
+func (h *eventHub) subscribe(jobId string, lastSeq int64) *subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream := h.stream(jobId)
+	sub := &subscription{events: make(chan *JobEvent, subscriberBuffer)}
+	stream.subs[sub.events] = struct{}{}
+
+	for _, event := range stream.events {
+		if event.Seq > lastSeq {
+			sub.backlog = append(sub.backlog, event)
+		} else if event.Seq == lastSeq && isFinished(event.Status) {
+			sub.finished = true
+		}
+	}
+	sub.complete = len(stream.events) > 0 &&
+		(len(sub.backlog) == 0 || sub.backlog[0].Seq == lastSeq+1)
+	return sub
+}
+
+// unsubscribe removes a channel returned by subscribe
+func (h *eventHub) unsubscribe(jobId string, ch chan *JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if stream, ok := h.jobs[jobId]; ok {
+		if _, ok := stream.subs[ch]; ok {
+			delete(stream.subs, ch)
+			close(ch)
+		}
+		stream.updated = time.Now()
+	}
+}
+
+// eventSink writes job events to a client
+type eventSink interface {
+	send(event *JobEvent) error
+	keepAlive() error
+	// done is closed when the client goes away
+	done() <-chan struct{}
+}
+
+// handleJobEvents streams the events of one of the user's jobs as
+// Server-Sent Events, or over a WebSocket when the request asks for an
+// upgrade. Browsers cannot set headers on either, so the token may also be
+// passed as the access_token query parameter and the last event id as
+// lastEventId.
+func (s *GatewayServer) handleJobEvents(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	jobId := r.PathValue("id")
+	job, err := s.store.GetJob(jobId)
+	if errors.Is(err, ErrJobNotFound) || (err == nil && job.Owner != user.Id && !user.Can(PermDownloadAny)) {
+		return WriteJSON(w, http.StatusNotFound, "job not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get job: %v", err)
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	var lastSeq int64
+	if lastEventId != "" {
+		if lastSeq, err = strconv.ParseInt(lastEventId, 10, 64); err != nil {
+			return fmt.Errorf("invalid Last-Event-ID %q", lastEventId)
+		}
+	}
+
+	// Subscribing before reading the backlog means no event is missed
+	sub := s.events.subscribe(jobId, lastSeq)
+	defer s.events.unsubscribe(jobId, sub.events)
+
+	var sink eventSink
+	if isWebSocketRequest(r) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return err
+		}
+		defer ws.Close()
+		if sub.finished {
+			return nil
+		}
+		sink = ws
+	} else {
+		// No Content stops EventSource from reconnecting
+		if sub.finished {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		sse, err := newSSESink(w, r)
+		if err != nil {
+			return err
+		}
+		sink = sse
+	}
+
+	// Every event holds the whole job state, so when the events since
+	// lastSeq are no longer buffered the latest state is enough
+	backlog := sub.backlog
+	if !sub.complete {
+		latest := jobSnapshot(job)
+		if len(backlog) > 0 {
+			latest = backlog[len(backlog)-1]
+		}
+		backlog = []*JobEvent{latest}
+	}
+	for _, event := range backlog {
+		if err := sink.send(event); err != nil {
+			return nil
+		}
+		if isFinished(event.Status) {
+			return nil
+		}
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return nil
+			}
+			if err := sink.send(event); err != nil {
+				return nil
+			}
+			if isFinished(event.Status) {
+				return nil
+			}
+		case <-ticker.C:
+			if err := sink.keepAlive(); err != nil {
+				return nil
+			}
+		case <-sink.done():
+			return nil
+		}
+	}
+}
+
+// jobSnapshot turns a stored job into an event. It has no sequence number
+// since it does not correspond to an event from the converter.
+func jobSnapshot(job *Job) *JobEvent {
+	event := &JobEvent{
+		JobId:  job.Id.Hex(),
+		Status: job.Status,
+		Mp3Id:  job.Mp3Id,
+		Error:  job.Error,
+		Time:   job.UpdatedAt,
+	}
+	if job.Status == JobDone {
+		event.Percent = 100
+	}
+	return event
+}
+
+// isFinished reports whether a job in status will see no further events
+func isFinished(status string) bool {
+	return status == JobDone || status == JobFailed
+}
+
+// sseSink writes events in the text/event-stream format
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ctx     <-chan struct{}
+}
+
+// newSSESink creates a new sseSink instance and writes the response headers
+func newSSESink(w http.ResponseWriter, r *http.Request) (*sseSink, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// Ask browsers to wait a little before reconnecting
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+	return &sseSink{w: w, flusher: flusher, ctx: r.Context().Done()}, nil
+}
+
+func (s *sseSink) send(event *JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Seq > 0 {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", event.Seq); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseSink) keepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseSink) done() <-chan struct{} {
+	return s.ctx
+}
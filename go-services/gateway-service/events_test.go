@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// publishRange publishes the events first to last of a job, the last one
+// with status and the others converting
+func publishRange(h *eventHub, jobId string, first, last int64, status string) {
+	for seq := first; seq <= last; seq++ {
+		event := &JobEvent{JobId: jobId, Seq: seq, Status: JobConverting, Percent: float64(seq)}
+		if seq == last {
+			event.Status = status
+		}
+		h.publish(event)
+	}
+}
+
+func seqs(events []*JobEvent) []int64 {
+	var s []int64
+	for _, event := range events {
+		s = append(s, event.Seq)
+	}
+	return s
+}
+
+func TestSubscribeBacklog(t *testing.T) {
+	h := newEventHub()
+	// Only the last eventBacklog events, 37 to 100, are kept
+	publishRange(h, "job", 1, 100, JobConverting)
+	first := int64(100 - eventBacklog + 1)
+
+	tests := []struct {
+		name     string
+		lastSeq  int64
+		from     int64 // first event in the backlog, 0 for none
+		complete bool
+	}{
+		{"new client", 0, first, false},
+		{"before the backlog", first - 2, first, false},
+		{"just before the backlog", first - 1, first, true},
+		{"at the start of the backlog", first, first + 1, true},
+		{"inside the backlog", 90, 91, true},
+		{"at the last event", 100, 0, true},
+		{"after the last event", 150, 0, true},
+	}
+	for _, test := range tests {
+		sub := h.subscribe("job", test.lastSeq)
+		h.unsubscribe("job", sub.events)
+		var want []int64
+		for seq := test.from; test.from > 0 && seq <= 100; seq++ {
+			want = append(want, seq)
+		}
+		got := seqs(sub.backlog)
+		if len(got) != len(want) || (len(got) > 0 && (got[0] != want[0] || got[len(got)-1] != want[len(want)-1])) {
+			t.Errorf("%s: backlog %v, want %v", test.name, got, want)
+		}
+		if sub.complete != test.complete || sub.finished {
+			t.Errorf("%s: complete %v finished %v, want complete %v", test.name, sub.complete, sub.finished, test.complete)
+		}
+	}
+
+	// Nothing is known about a job without events
+	if sub := h.subscribe("other", 0); sub.complete || len(sub.backlog) != 0 {
+		t.Errorf("job without events: backlog %v complete %v", seqs(sub.backlog), sub.complete)
+	}
+}
+
+func TestSubscribeFinished(t *testing.T) {
+	h := newEventHub()
+	publishRange(h, "job", 1, 5, JobDone)
+	if sub := h.subscribe("job", 5); !sub.finished || len(sub.backlog) != 0 {
+		t.Errorf("after the final event: finished %v backlog %v", sub.finished, seqs(sub.backlog))
+	}
+	if sub := h.subscribe("job", 4); sub.finished || len(sub.backlog) != 1 || sub.backlog[0].Status != JobDone {
+		t.Errorf("before the final event: finished %v backlog %v", sub.finished, seqs(sub.backlog))
+	}
+}
+
+func TestEventHubPublish(t *testing.T) {
+	h := newEventHub()
+	publishRange(h, "job", 1, 2, JobConverting)
+	sub := h.subscribe("job", 2)
+	slow := h.subscribe("job", 2)
+
+	// Duplicates and events out of order are dropped
+	publishRange(h, "job", 3, 3, JobConverting)
+	publishRange(h, "job", 2, 3, JobConverting)
+	if event := <-sub.events; event.Seq != 3 {
+		t.Fatalf("got event %d, want 3", event.Seq)
+	}
+	select {
+	case event := <-sub.events:
+		t.Fatalf("got event %d again", event.Seq)
+	default:
+	}
+	<-slow.events
+
+	// A subscriber that falls subscriberBuffer events behind is dropped
+	for seq := int64(4); seq <= 4+subscriberBuffer; seq++ {
+		publishRange(h, "job", seq, seq, JobConverting)
+		<-sub.events
+	}
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", n, subscriberBuffer)
+	}
+	h.unsubscribe("job", slow.events)
+	h.unsubscribe("job", sub.events)
+}
+
+// newEventsTest returns a gateway with a job of the user "owner" and the
+// events published for it
+func newEventsTest(status string, lastSeq int64) (*GatewayServer, string) {
+	store := newFakeStore()
+	s := &GatewayServer{store: store, events: newEventHub()}
+	jobId := store.addJob("owner", status)
+	if lastSeq > 0 {
+		publishRange(s.events, jobId, 1, lastSeq, status)
+	}
+	return s, jobId
+}
+
+// getEvents requests the events of a job as identity over SSE
+func getEvents(s *GatewayServer, jobId string, identity *Identity, lastEventId string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/events", nil)
+	r.SetPathValue("id", jobId)
+	if lastEventId != "" {
+		r.Header.Set("Last-Event-ID", lastEventId)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	w := httptest.NewRecorder()
+	s.makeHandlerFunc(s.handleJobEvents)(w, r)
+	return w
+}
+
+func TestHandleJobEvents(t *testing.T) {
+	owner := &Identity{Id: "owner", Roles: []string{RoleUser}}
+	tests := []struct {
+		name        string
+		status      string
+		lastSeq     int64 // published events
+		identity    *Identity
+		lastEventId string
+		want        int
+		ids         []string // event ids sent
+		final       string   // status of the last event sent
+	}{
+		{"finished job seen to the end", JobDone, 3, owner, "3", http.StatusNoContent, nil, ""},
+		{"failed job seen to the end", JobFailed, 3, owner, "3", http.StatusNoContent, nil, ""},
+		{"finished job resumed", JobDone, 3, owner, "1", http.StatusOK, []string{"2", "3"}, JobDone},
+		{"finished job from the start", JobDone, 3, owner, "", http.StatusOK, []string{"1", "2", "3"}, JobDone},
+		// Without buffered events the stored job is sent, without an id
+		{"finished job after a restart", JobDone, 0, owner, "3", http.StatusOK, nil, JobDone},
+		{"job of another user", JobDone, 3, &Identity{Id: "other", Roles: []string{RoleUser}}, "", http.StatusNotFound, nil, ""},
+		{"job of another user for a service", JobDone, 3, &Identity{Id: "svc", Roles: []string{RoleService}}, "3", http.StatusNoContent, nil, ""},
+		{"invalid Last-Event-ID", JobDone, 3, owner, "x", http.StatusBadRequest, nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, jobId := newEventsTest(test.status, test.lastSeq)
+			w := getEvents(s, jobId, test.identity, test.lastEventId)
+			if w.Code != test.want {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			var ids []string
+			var last string
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				if id, ok := strings.CutPrefix(line, "id: "); ok {
+					ids = append(ids, id)
+				}
+				if data, ok := strings.CutPrefix(line, "data: "); ok {
+					last = data
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+				t.Errorf("sent event ids %v, want %v", ids, test.ids)
+			}
+			if !strings.Contains(last, `"status":"`+test.final+`"`) {
+				t.Errorf("last event %s, want status %s", last, test.final)
+			}
+		})
+	}
+
+	s, _ := newEventsTest(JobDone, 0)
+	if w := getEvents(s, "missing", owner, ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing job: got %d, want 404", w.Code)
+	}
+}
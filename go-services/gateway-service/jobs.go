@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job statuses, in the order a successful job goes through them
+const (
+	JobQueued      = "queued"
+	JobDownloading = "downloading"
+	JobConverting  = "converting"
+	JobStoring     = "storing"
+	JobDone        = "done"
+	JobFailed      = "failed"
+)
+
+var jobStatuses = []string{JobQueued, JobDownloading, JobConverting, JobStoring, JobDone, JobFailed}
+
+// ErrJobNotFound is returned when a job does not exist
+var ErrJobNotFound = errors.New("job not found")
+
+// Job tracks the conversion of one uploaded video
+type Job struct {
+	Id       primitive.ObjectID `bson:"_id" json:"id"`
+	Owner    string             `bson:"owner" json:"owner"`
+	Status   string             `bson:"status" json:"status"`
+	Filename string             `bson:"filename" json:"filename"`
+	VideoId  string             `bson:"videoId" json:"videoId"`
+	Mp3Id    string             `bson:"mp3Id,omitempty" json:"mp3Id,omitempty"`
+	Options  *ConversionOptions `bson:"options,omitempty" json:"options,omitempty"`
+	// CallbackURL overrides the owner's default webhook for this job
+	CallbackURL string          `bson:"callbackUrl,omitempty" json:"callbackUrl,omitempty"`
+	Error       string          `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time       `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time       `bson:"updatedAt" json:"updatedAt"`
+	History     []JobTransition `bson:"history" json:"history"`
+}
+
+// JobTransition records when a job entered a status
+type JobTransition struct {
+	Status string    `bson:"status" json:"status"`
+	Time   time.Time `bson:"time" json:"time"`
+}
+
+// JobUpdate describes a status change of a job
+type JobUpdate struct {
+	Status string
+	Mp3Id  string // set when the job is done
+	Error  string // set when the job failed
+}
+
+// JobFilter selects the jobs returned by ListJobs
+type JobFilter struct {
+	Owner  string
+	Status []string
+	Since  time.Time // only jobs created at or after Since
+	Until  time.Time // only jobs created before Until
+	Limit  int
+	Offset int
+}
+
+// JobList is a page of jobs
+type JobList struct {
+	Jobs   []*Job `json:"jobs"`
+	Total  int64  `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// handleGetJob returns one of the user's jobs
+func (s *GatewayServer) handleGetJob(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	job, err := s.store.GetJob(r.PathValue("id"))
+	// Other users' jobs are reported as missing, like their files
+	if errors.Is(err, ErrJobNotFound) || (err == nil && job.Owner != user.Id && !user.Can(PermDownloadAny)) {
+		return WriteJSON(w, http.StatusNotFound, "job not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get job: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, job)
+}
+
+// handleListJobs lists the user's jobs, newest first. It accepts limit and
+// offset for pagination, a comma separated status filter and since/until
+// bounds on the creation time in RFC 3339 format.
+func (s *GatewayServer) handleListJobs(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	filter, err := parseJobFilter(r)
+	if err != nil {
+		return err
+	}
+	filter.Owner = user.Id
+
+	jobs, total, err := s.store.ListJobs(filter)
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, &JobList{
+		Jobs:   jobs,
+		Total:  total,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	})
+}
+
+// parseJobFilter reads the query parameters of GET /jobs
+func parseJobFilter(r *http.Request) (JobFilter, error) {
+	q := r.URL.Query()
+	filter := JobFilter{}
+	var err error
+	if filter.Limit, filter.Offset, err = parsePage(q); err != nil {
+		return filter, err
+	}
+	if v := q.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			if !slices.Contains(jobStatuses, status) {
+				return filter, fmt.Errorf("status must be one of %s", strings.Join(jobStatuses, ", "))
+			}
+			filter.Status = append(filter.Status, status)
+		}
+	}
+	for key, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", key)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// parsePage reads the limit and offset query parameters of a listing
+func parsePage(q url.Values) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksRefreshInterval is how often the auth service's keys are fetched.
+	// New keys are published an hour before they sign anything.
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefresh limits refreshes triggered by tokens with unknown key
+	// ids, which anyone can send
+	jwksMinRefresh = 30 * time.Second
+)
+
+// AuthClaims are the claims of the tokens issued by the auth service
+type AuthClaims struct {
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	Verified bool     `json:"verified"`
+	jwt.RegisteredClaims
+}
+
+// jwk is the part of a JSON Web Key the gateway uses
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+}
+
+// jwksCache holds the auth service's public keys so tokens are verified
+// without a round trip. It refreshes them in the background and when a
+// token names a key it does not know yet.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]ed25519.PublicKey
+	lastRefresh time.Time
+	refreshing  sync.Mutex
+}
+
+// newJWKSCache creates a new jwksCache instance for the keys of the auth
+// service
+func newJWKSCache() *jwksCache {
+	return &jwksCache{
+		url:    os.Getenv("AUTH_SVC_URL") + "/.well-known/jwks.json",
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]ed25519.PublicKey),
+	}
+}
+
+// run fetches the keys and keeps them up to date
+func (c *jwksCache) run() {
+	if err := c.refresh(); err != nil {
+		log.Printf("failed to fetch JWKS: %v", err)
+	}
+	for range time.Tick(jwksRefreshInterval) {
+		if err := c.refresh(); err != nil {
+			log.Printf("failed to fetch JWKS: %v", err)
+		}
+	}
+}
+
+// refresh replaces the cached keys with the published ones
+func (c *jwksCache) refresh() error {
+	c.refreshing.Lock()
+	defer c.refreshing.Unlock()
+
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth service returned [%s] status code", resp.Status)
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kty != "OKP" || key.Crv != "Ed25519" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[key.Kid] = ed25519.PublicKey(x)
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.lastRefresh = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// key returns the public key with the given id, refreshing the keys once
+// if it is unknown
+func (c *jwksCache) key(kid string) (ed25519.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.lastRefresh) > jwksMinRefresh
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		if err := c.refresh(); err != nil {
+			log.Printf("failed to fetch JWKS: %v", err)
+		}
+		c.mu.RLock()
+		key, ok = c.keys[kid]
+		c.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key")
+}
+
+// jwtIssuer returns the issuer tokens must carry
+func jwtIssuer() string {
+	if iss := os.Getenv("JWT_ISSUER"); iss != "" {
+		return iss
+	}
+	return "auth-service"
+}
+
+// jwtAudience returns the audience tokens must carry
+func jwtAudience() string {
+	if aud := os.Getenv("JWT_AUDIENCE"); aud != "" {
+		return aud
+	}
+	return "mp3-converter"
+}
+
+// verify checks a bearer token against the cached keys and returns its
+// claims
+func (c *jwksCache) verify(header string) (*AuthClaims, error) {
+	tokenString, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || tokenString == "" {
+		return nil, fmt.Errorf("missing token")
+	}
+
+	claims := &AuthClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.key(kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwtIssuer()),
+		jwt.WithAudience(jwtAudience()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil || claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer publishes a key set like the auth service's JWKS endpoint
+type jwksServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []jwk
+	requests int
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// publish replaces the published keys
+func (s *jwksServer) publish(keys ...*signingKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = []jwk{{Kty: "RSA", Kid: "rsa"}} // skipped by the gateway
+	for _, key := range keys {
+		x := base64.RawURLEncoding.EncodeToString(key.private.Public().(ed25519.PublicKey))
+		s.keys = append(s.keys, jwk{Kty: "OKP", Crv: "Ed25519", X: x, Kid: key.kid})
+	}
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func TestJWKSRotation(t *testing.T) {
+	server := newJWKSServer(t)
+	cache := newJWKSCache()
+	cache.url = server.URL
+
+	old, next := newSigningKey(t, "old"), newSigningKey(t, "next")
+	oldToken := old.sign(t, "user", []string{RoleUser}, nil)
+	nextToken := next.sign(t, "user", []string{RoleUser}, nil)
+	unknownToken := newSigningKey(t, "unknown").sign(t, "user", []string{RoleUser}, nil)
+	// A token that names the old key but is signed with another one
+	forged := (&signingKey{kid: "old", private: next.private}).sign(t, "user", []string{RoleUser}, nil)
+
+	expect := func(when string, tokens map[string]bool) {
+		t.Helper()
+		for name, token := range map[string]string{"old": oldToken, "next": nextToken, "unknown": unknownToken, "forged": forged} {
+			want, ok := tokens[name]
+			if !ok {
+				continue
+			}
+			claims, err := cache.verify(token)
+			if got := err == nil; got != want {
+				t.Errorf("%s: token signed with the %s key verified %v, want %v (%v)", when, name, got, want, err)
+			}
+			if err == nil && claims.Subject != "user" {
+				t.Errorf("%s: token signed with the %s key has subject %q", when, name, claims.Subject)
+			}
+		}
+	}
+
+	server.publish(old)
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expect("before rotation", map[string]bool{"old": true, "unknown": false, "forged": false})
+
+	// The next key is published ahead of signing anything. A token with
+	// its kid makes the cache refresh, but not more than once in
+	// jwksMinRefresh.
+	server.publish(old, next)
+	requests := server.requestCount()
+	expect("within jwksMinRefresh", map[string]bool{"next": false})
+	if server.requestCount() != requests {
+		t.Error("an unknown kid refreshed the keys within jwksMinRefresh")
+	}
+	cache.lastRefresh = time.Now().Add(-2 * jwksMinRefresh)
+	expect("after publishing the next key", map[string]bool{"old": true, "next": true, "unknown": false, "forged": false})
+	if server.requestCount() != requests+1 {
+		t.Errorf("verifying made %d requests, want 1", server.requestCount()-requests)
+	}
+
+	// Once the old key is retired its tokens stop verifying
+	server.publish(next)
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expect("after retiring the old key", map[string]bool{"old": false, "next": true, "unknown": false, "forged": false})
+
+	// The last keys are kept when the auth service cannot be reached
+	server.Close()
+	if err := cache.refresh(); err == nil {
+		t.Error("refresh succeeded without the auth service")
+	}
+	expect("without the auth service", map[string]bool{"next": true})
+}
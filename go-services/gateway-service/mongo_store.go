@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -15,11 +18,61 @@ import (
 type Store interface {
 	SaveFile(filename string, file io.Reader) (string, error)
 	DeleteFile(objectId string) error
+	GetMP3File(objectId string) (*AudioFile, error)
+	CreateJob(job *Job) error
+	GetJob(id string) (*Job, error)
+	ListJobs(filter JobFilter) ([]*Job, int64, error)
+	UpdateJob(id string, update JobUpdate) error
+	GetWebhook(owner string) (*Webhook, error)
+	EnsureWebhook(owner string, secret string) (*Webhook, error)
+	UpdateWebhook(owner string, url *string, secret string) (*Webhook, error)
+	CreateDelivery(delivery *WebhookDelivery) error
+	ClaimDelivery(now time.Time, lease time.Duration) (*WebhookDelivery, error)
+	RecordDeliveryAttempt(id primitive.ObjectID, attempt WebhookAttempt, status string, next time.Time) error
+	ListDeliveries(filter DeliveryFilter) ([]*WebhookDelivery, int64, error)
+}
+
+// ErrFileNotFound is returned when a requested file does not exist
+var ErrFileNotFound = errors.New("file not found")
+
+// AudioMetadata is the metadata the converter stores with converted files
+type AudioMetadata struct {
+	Owner       string `bson:"owner"`
+	VideoId     string `bson:"videoId"`
+	ContentType string `bson:"contentType"`
+}
+
+// AudioFile is a converted file opened for reading. It supports seeking so
+// it can be served with http.ServeContent.
+type AudioFile struct {
+	Id         string
+	Name       string
+	Length     int64
+	UploadDate time.Time
+	Metadata   AudioMetadata
+
+	// ReadSeekCloser reads the file's content
+	io.ReadSeekCloser
+}
+
+// gridfsReader reads a GridFS file. It supports seeking by reopening the
+// download stream when a Seek moved backwards.
+type gridfsReader struct {
+	bucket *gridfs.Bucket
+	fileId interface{}
+	stream *gridfs.DownloadStream
+	length int64
+	pos    int64 // position seen by the caller
+	read   int64 // position of stream
 }
 
 type MongoStore struct {
-	gridfs *gridfs.Bucket
-	client *mongo.Client
+	gridfs     *gridfs.Bucket
+	gfsMp3     *gridfs.Bucket
+	jobs       *mongo.Collection
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+	client     *mongo.Client
 }
 
 func NewMongoStore(conStr string) (*MongoStore, error) {
@@ -38,7 +91,7 @@ func NewMongoStore(conStr string) (*MongoStore, error) {
 
 	// Check the connection
 	var result bson.M
-	if err := db.RunCommand(context.Background(), bson.D{{"ping", 1}}).Decode(&result); err != nil {
+	if err := db.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}}).Decode(&result); err != nil {
 		return nil, fmt.Errorf("Failed to ping MongoDB: %v", err)
 	}
 	log.Println("Successfully connected to MongoDB.")
@@ -48,10 +101,40 @@ func NewMongoStore(conStr string) (*MongoStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create GridFS bucket: %v", err)
 	}
+	gfsMp3, err := gridfs.NewBucket(client.Database("mp3"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create GridFS bucket: %v", err)
+	}
+
+	// Jobs are listed per user, newest first
+	jobs := db.Collection("jobs")
+	if _, err := jobs.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "owner", Value: 1}, {Key: "createdAt", Value: -1}},
+	}); err != nil {
+		return nil, fmt.Errorf("Failed to create jobs index: %v", err)
+	}
+
+	// Deliveries are claimed by due time, listed per user and recorded
+	// once per job and event
+	deliveries := db.Collection("webhookDeliveries")
+	if _, err := deliveries.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "jobId", Value: 1}, {Key: "event", Value: 1}, {Key: "url", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("Failed to create webhook delivery indexes: %v", err)
+	}
 
 	return &MongoStore{
-		gridfs: gfs,
-		client: client,
+		gridfs:     gfs,
+		gfsMp3:     gfsMp3,
+		jobs:       jobs,
+		webhooks:   db.Collection("webhooks"),
+		deliveries: deliveries,
+		client:     client,
 	}, nil
 }
 
@@ -60,9 +143,317 @@ func (s *MongoStore) SaveFile(filename string, file io.Reader) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return objectId.String(), nil
+	return objectId.Hex(), nil
 }
 
 func (s *MongoStore) DeleteFile(objectId string) error {
-	return s.gridfs.Delete(objectId)
+	id, err := primitive.ObjectIDFromHex(objectId)
+	if err != nil {
+		return fmt.Errorf("invalid file id %q: %v", objectId, err)
+	}
+	return s.gridfs.Delete(id)
+}
+
+// GetMP3File opens a converted file from the mp3 bucket
+func (s *MongoStore) GetMP3File(objectId string) (*AudioFile, error) {
+	id, err := primitive.ObjectIDFromHex(objectId)
+	if err != nil {
+		return nil, ErrFileNotFound
+	}
+	stream, err := s.gfsMp3.OpenDownloadStream(id)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := stream.GetFile()
+	file := &AudioFile{
+		Id:         objectId,
+		Name:       info.Name,
+		Length:     info.Length,
+		UploadDate: info.UploadDate,
+		ReadSeekCloser: &gridfsReader{
+			bucket: s.gfsMp3,
+			fileId: id,
+			stream: stream,
+			length: info.Length,
+		},
+	}
+	if info.Metadata != nil {
+		if err := bson.Unmarshal(info.Metadata, &file.Metadata); err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("invalid metadata for file %s: %v", objectId, err)
+		}
+	}
+	return file, nil
+}
+
+// Read reads from the current position, reopening the download stream when
+// a Seek moved backwards
+func (f *gridfsReader) Read(p []byte) (int, error) {
+	if f.pos >= f.length {
+		return 0, io.EOF
+	}
+	if f.pos < f.read {
+		f.stream.Close()
+		stream, err := f.bucket.OpenDownloadStream(f.fileId)
+		if err != nil {
+			return 0, err
+		}
+		f.stream, f.read = stream, 0
+	}
+	if f.pos > f.read {
+		n, err := f.stream.Skip(f.pos - f.read)
+		f.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.stream.Read(p)
+	f.pos += int64(n)
+	f.read += int64(n)
+	return n, err
+}
+
+// Seek sets the position for the next Read. The stream itself only moves
+// when reading.
+func (f *gridfsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.length
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Close closes the download stream
+func (f *gridfsReader) Close() error {
+	return f.stream.Close()
+}
+
+// CreateJob inserts a new job, filling in its id and timestamps
+func (s *MongoStore) CreateJob(job *Job) error {
+	now := time.Now().UTC()
+	job.Id = primitive.NewObjectID()
+	job.CreatedAt, job.UpdatedAt = now, now
+	job.History = []JobTransition{{Status: job.Status, Time: now}}
+	_, err := s.jobs.InsertOne(context.Background(), job)
+	return err
+}
+
+// GetJob retrieves a job by id
+func (s *MongoStore) GetJob(id string) (*Job, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+	job := &Job{}
+	err = s.jobs.FindOne(context.Background(), bson.M{"_id": objectId}).Decode(job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ListJobs returns a page of the jobs matching filter, newest first, and
+// the total number of matches
+func (s *MongoStore) ListJobs(filter JobFilter) ([]*Job, int64, error) {
+	query := bson.M{"owner": filter.Owner}
+	if len(filter.Status) > 0 {
+		query["status"] = bson.M{"$in": filter.Status}
+	}
+	created := bson.M{}
+	if !filter.Since.IsZero() {
+		created["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		created["$lt"] = filter.Until
+	}
+	if len(created) > 0 {
+		query["createdAt"] = created
+	}
+
+	ctx := context.Background()
+	total, err := s.jobs.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit))
+	cursor, err := s.jobs.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	jobs := []*Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, 0, err
+	}
+	return jobs, total, nil
+}
+
+// UpdateJob moves a job to a new status and records the transition
+func (s *MongoStore) UpdateJob(id string, update JobUpdate) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrJobNotFound
+	}
+	now := time.Now().UTC()
+	set := bson.M{"status": update.Status, "updatedAt": now}
+	if update.Mp3Id != "" {
+		set["mp3Id"] = update.Mp3Id
+	}
+	if update.Error != "" {
+		set["error"] = update.Error
+	}
+	_, err = s.jobs.UpdateByID(context.Background(), objectId, bson.M{
+		"$set":  set,
+		"$push": bson.M{"history": JobTransition{Status: update.Status, Time: now}},
+	})
+	return err
+}
+
+// GetWebhook retrieves a user's webhook settings
+func (s *MongoStore) GetWebhook(owner string) (*Webhook, error) {
+	webhook := &Webhook{}
+	err := s.webhooks.FindOne(context.Background(), bson.M{"_id": owner}).Decode(webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// EnsureWebhook returns a user's webhook settings, creating them with
+// secret if they do not exist yet
+func (s *MongoStore) EnsureWebhook(owner string, secret string) (*Webhook, error) {
+	now := time.Now().UTC()
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	webhook := &Webhook{}
+	err := s.webhooks.FindOneAndUpdate(context.Background(), bson.M{"_id": owner}, bson.M{
+		"$setOnInsert": bson.M{"secret": secret, "createdAt": now, "updatedAt": now},
+	}, opts).Decode(webhook)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// UpdateWebhook changes the default callback URL of a user when url is not
+// nil, and the secret when it is not empty
+func (s *MongoStore) UpdateWebhook(owner string, url *string, secret string) (*Webhook, error) {
+	update := bson.M{"$set": bson.M{"updatedAt": time.Now().UTC()}}
+	if url != nil && *url != "" {
+		update["$set"].(bson.M)["url"] = *url
+	} else if url != nil {
+		update["$unset"] = bson.M{"url": ""}
+	}
+	if secret != "" {
+		update["$set"].(bson.M)["secret"] = secret
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	webhook := &Webhook{}
+	err := s.webhooks.FindOneAndUpdate(context.Background(), bson.M{"_id": owner}, update, opts).Decode(webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// CreateDelivery records a new delivery. A delivery of the same event of a
+// job to the same URL is only recorded once.
+func (s *MongoStore) CreateDelivery(delivery *WebhookDelivery) error {
+	_, err := s.deliveries.InsertOne(context.Background(), delivery)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// ClaimDelivery returns the pending delivery that has been due the longest
+// and hides it from other callers for lease
+func (s *MongoStore) ClaimDelivery(now time.Time, lease time.Duration) (*WebhookDelivery, error) {
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	delivery := &WebhookDelivery{}
+	err := s.deliveries.FindOneAndUpdate(context.Background(),
+		bson.M{"status": DeliveryPending, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(lease)}},
+		opts,
+	).Decode(delivery)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// RecordDeliveryAttempt appends an attempt to a delivery and moves it to
+// status, to be attempted again at next if it is still pending
+func (s *MongoStore) RecordDeliveryAttempt(id primitive.ObjectID, attempt WebhookAttempt, status string, next time.Time) error {
+	update := bson.M{
+		"$set":  bson.M{"status": status, "updatedAt": time.Now().UTC()},
+		"$push": bson.M{"attempts": attempt},
+	}
+	if next.IsZero() {
+		update["$unset"] = bson.M{"nextAttemptAt": ""}
+	} else {
+		update["$set"].(bson.M)["nextAttemptAt"] = next
+	}
+	_, err := s.deliveries.UpdateByID(context.Background(), id, update)
+	return err
+}
+
+// ListDeliveries returns a page of the deliveries matching filter, newest
+// first, and the total number of matches
+func (s *MongoStore) ListDeliveries(filter DeliveryFilter) ([]*WebhookDelivery, int64, error) {
+	query := bson.M{"owner": filter.Owner}
+	if filter.JobId != "" {
+		query["jobId"] = filter.JobId
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	ctx := context.Background()
+	total, err := s.deliveries.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit))
+	cursor, err := s.deliveries.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	deliveries := []*WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, 0, err
+	}
+	return deliveries, total, nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConversionOptions are the audio settings a client can send with an
+// upload. They are passed to the converter in the queued message.
+type ConversionOptions struct {
+	Format     string  `json:"format,omitempty"`
+	Bitrate    int     `json:"bitrate,omitempty"` // CBR bitrate in kbit/s
+	Quality    *int    `json:"quality,omitempty"` // VBR quality, 0 best to 9
+	SampleRate int     `json:"sampleRate,omitempty"`
+	Channels   int     `json:"channels,omitempty"`
+	Start      float64 `json:"start,omitempty"` // trim start in seconds
+	End        float64 `json:"end,omitempty"`   // trim end in seconds
+}
+
+var (
+	formats = []string{"mp3", "wav"}
+	// mp3SampleRates are the rates the converter's MP3 encoder supports
+	mp3SampleRates = []int{16000, 22050, 24000, 32000, 44100, 48000}
+	wavSampleRates = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000}
+)
+
+// parseConversionOptions reads and validates the conversion options from
+// the form fields of an upload
+func parseConversionOptions(r *http.Request) (*ConversionOptions, error) {
+	opts := &ConversionOptions{Format: strings.ToLower(r.FormValue("format"))}
+	if opts.Format == "" {
+		opts.Format = "mp3"
+	}
+	if !slices.Contains(formats, opts.Format) {
+		return nil, fmt.Errorf("format must be one of %s", strings.Join(formats, ", "))
+	}
+
+	var err error
+	if opts.Bitrate, err = formInt(r, "bitrate"); err != nil {
+		return nil, err
+	}
+	if opts.Bitrate != 0 && (opts.Bitrate < 8 || opts.Bitrate > 320) {
+		return nil, fmt.Errorf("bitrate must be between 8 and 320 kbit/s")
+	}
+	if r.FormValue("quality") != "" {
+		quality, err := formInt(r, "quality")
+		if err != nil {
+			return nil, err
+		}
+		if quality < 0 || quality > 9 {
+			return nil, fmt.Errorf("quality must be between 0 and 9")
+		}
+		opts.Quality = &quality
+	}
+	if opts.Bitrate != 0 && opts.Quality != nil {
+		return nil, fmt.Errorf("bitrate and quality cannot both be set")
+	}
+	if opts.Format == "wav" && (opts.Bitrate != 0 || opts.Quality != nil) {
+		return nil, fmt.Errorf("bitrate and quality only apply to mp3")
+	}
+
+	if opts.SampleRate, err = formInt(r, "sampleRate"); err != nil {
+		return nil, err
+	}
+	rates := mp3SampleRates
+	if opts.Format == "wav" {
+		rates = wavSampleRates
+	}
+	if opts.SampleRate != 0 && !slices.Contains(rates, opts.SampleRate) {
+		return nil, fmt.Errorf("sampleRate for %s must be one of %v", opts.Format, rates)
+	}
+	// MPEG-2 rates below 32 kHz carry 8 to 160 kbit/s and MPEG-1 rates 32
+	// to 320. The converter picks the closest bitrate within the range.
+	if opts.Bitrate != 0 && opts.SampleRate != 0 {
+		low, high := 32, 320
+		if opts.SampleRate < 32000 {
+			low, high = 8, 160
+		}
+		if opts.Bitrate < low || opts.Bitrate > high {
+			return nil, fmt.Errorf("bitrate at %d Hz must be between %d and %d kbit/s", opts.SampleRate, low, high)
+		}
+	}
+
+	switch strings.ToLower(r.FormValue("channels")) {
+	case "":
+	case "mono", "1":
+		opts.Channels = 1
+	case "stereo", "2":
+		opts.Channels = 2
+	default:
+		return nil, fmt.Errorf("channels must be mono or stereo")
+	}
+
+	if opts.Start, err = formSeconds(r, "start"); err != nil {
+		return nil, err
+	}
+	if opts.End, err = formSeconds(r, "end"); err != nil {
+		return nil, err
+	}
+	if opts.End != 0 && opts.End <= opts.Start {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	return opts, nil
+}
+
+// formInt parses an optional integer form field, returning 0 when unset
+func formInt(r *http.Request, key string) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	return n, nil
+}
+
+// formSeconds parses an optional, non-negative time in seconds
+func formSeconds(r *http.Request, key string) (float64, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return 0, nil
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(secs) || secs < 0 || secs > 24*60*60 {
+		return 0, fmt.Errorf("%s must be a time in seconds", key)
+	}
+	return secs, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseForm(form url.Values) (*ConversionOptions, error) {
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return parseConversionOptions(r)
+}
+
+func TestParseConversionOptions(t *testing.T) {
+	quality := func(q int) *int { return &q }
+	tests := []struct {
+		form url.Values
+		want ConversionOptions
+	}{
+		{url.Values{}, ConversionOptions{Format: "mp3"}},
+		{url.Values{"format": {"WAV"}}, ConversionOptions{Format: "wav"}},
+		{url.Values{"bitrate": {"128"}}, ConversionOptions{Format: "mp3", Bitrate: 128}},
+		{url.Values{"bitrate": {"8"}}, ConversionOptions{Format: "mp3", Bitrate: 8}},
+		{url.Values{"quality": {"0"}}, ConversionOptions{Format: "mp3", Quality: quality(0)}},
+		{url.Values{"quality": {"9"}, "sampleRate": {"16000"}}, ConversionOptions{Format: "mp3", Quality: quality(9), SampleRate: 16000}},
+		{url.Values{"bitrate": {"320"}, "sampleRate": {"48000"}}, ConversionOptions{Format: "mp3", Bitrate: 320, SampleRate: 48000}},
+		{url.Values{"bitrate": {"32"}, "sampleRate": {"32000"}}, ConversionOptions{Format: "mp3", Bitrate: 32, SampleRate: 32000}},
+		{url.Values{"bitrate": {"160"}, "sampleRate": {"22050"}}, ConversionOptions{Format: "mp3", Bitrate: 160, SampleRate: 22050}},
+		{url.Values{"bitrate": {"8"}, "sampleRate": {"24000"}}, ConversionOptions{Format: "mp3", Bitrate: 8, SampleRate: 24000}},
+		{url.Values{"format": {"wav"}, "sampleRate": {"8000"}}, ConversionOptions{Format: "wav", SampleRate: 8000}},
+		{url.Values{"channels": {"Mono"}}, ConversionOptions{Format: "mp3", Channels: 1}},
+		{url.Values{"channels": {"2"}}, ConversionOptions{Format: "mp3", Channels: 2}},
+		{url.Values{"start": {"1.5"}, "end": {"10"}}, ConversionOptions{Format: "mp3", Start: 1.5, End: 10}},
+		{url.Values{"end": {"30"}}, ConversionOptions{Format: "mp3", End: 30}},
+		{url.Values{"start": {"30"}}, ConversionOptions{Format: "mp3", Start: 30}},
+	}
+	for _, test := range tests {
+		opts, err := parseForm(test.form)
+		if err != nil {
+			t.Errorf("%v: %v", test.form, err)
+			continue
+		}
+		if !reflect.DeepEqual(*opts, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.form, *opts, test.want)
+		}
+	}
+}
+
+func TestParseConversionOptionsRejected(t *testing.T) {
+	tests := []struct {
+		form url.Values
+		err  string
+	}{
+		{url.Values{"format": {"ogg"}}, "format must be one of"},
+		{url.Values{"bitrate": {"fast"}}, "bitrate must be an integer"},
+		{url.Values{"bitrate": {"7"}}, "bitrate must be between 8 and 320"},
+		{url.Values{"bitrate": {"321"}}, "bitrate must be between 8 and 320"},
+		{url.Values{"quality": {"-1"}}, "quality must be between 0 and 9"},
+		{url.Values{"quality": {"10"}}, "quality must be between 0 and 9"},
+		{url.Values{"quality": {"best"}}, "quality must be an integer"},
+		// CBR and VBR settings are exclusive, and neither applies to wav
+		{url.Values{"bitrate": {"128"}, "quality": {"2"}}, "cannot both be set"},
+		{url.Values{"format": {"wav"}, "bitrate": {"128"}}, "only apply to mp3"},
+		{url.Values{"format": {"wav"}, "quality": {"2"}}, "only apply to mp3"},
+		// Sample rates depend on the format
+		{url.Values{"sampleRate": {"8000"}}, "sampleRate for mp3 must be one of"},
+		{url.Values{"sampleRate": {"11025"}}, "sampleRate for mp3 must be one of"},
+		{url.Values{"format": {"wav"}, "sampleRate": {"96000"}}, "sampleRate for wav must be one of"},
+		{url.Values{"sampleRate": {"44.1k"}}, "sampleRate must be an integer"},
+		// Bitrates the sample rate cannot carry
+		{url.Values{"bitrate": {"192"}, "sampleRate": {"22050"}}, "bitrate at 22050 Hz must be between 8 and 160"},
+		{url.Values{"bitrate": {"320"}, "sampleRate": {"16000"}}, "bitrate at 16000 Hz must be between 8 and 160"},
+		{url.Values{"bitrate": {"16"}, "sampleRate": {"44100"}}, "bitrate at 44100 Hz must be between 32 and 320"},
+		{url.Values{"bitrate": {"24"}, "sampleRate": {"32000"}}, "bitrate at 32000 Hz must be between 32 and 320"},
+		{url.Values{"channels": {"3"}}, "channels must be mono or stereo"},
+		{url.Values{"channels": {"surround"}}, "channels must be mono or stereo"},
+		{url.Values{"start": {"-1"}}, "start must be a time in seconds"},
+		{url.Values{"start": {"NaN"}}, "start must be a time in seconds"},
+		{url.Values{"end": {"86401"}}, "end must be a time in seconds"},
+		{url.Values{"end": {"1:30"}}, "end must be a time in seconds"},
+		{url.Values{"start": {"10"}, "end": {"10"}}, "end must be after start"},
+		{url.Values{"start": {"10"}, "end": {"5"}}, "end must be after start"},
+	}
+	for _, test := range tests {
+		opts, err := parseForm(test.form)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %+v, %v, want error %q", test.form, opts, err, test.err)
+		}
+	}
+}
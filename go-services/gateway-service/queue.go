@@ -9,7 +9,27 @@ import (
 )
 
 type MessageQueue interface {
-	SendVideoUploadedMessage(id string, size int64, username string) error
+	SendVideoUploadedMessage(jobId string, id string, size int64, user *Identity, opts *ConversionOptions) error
+	ConsumeJobEvents(handler func(*JobEvent)) error
+	ConsumeWebhookEvents(handler func(*JobEvent) error) error
+}
+
+// jobEventsExchange is the fanout exchange the converter publishes job
+// events on
+const jobEventsExchange = "jobEvents"
+
+// webhookEventsQueue is bound to the job events exchange and shared by all
+// gateway instances, so each event is turned into webhooks only once
+const webhookEventsQueue = "webhookEvents"
+
+// VideoMessage is the message published for every uploaded video
+type VideoMessage struct {
+	JobId    string             `json:"jobId,omitempty"`
+	VideoId  string             `json:"videoId"`
+	Mp3Id    string             `json:"mp3Id"`
+	UserId   string             `json:"userId"`
+	Username string             `json:"username"`
+	Options  *ConversionOptions `json:"options,omitempty"`
 }
 
 type RabbitMQ struct {
@@ -21,7 +41,7 @@ func NewRabbitMQ(connStr string) (*RabbitMQ, error) {
 	// Connect to RabbitMQ Serevr
 	conn, err := amqp.Dial(connStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: err", err)
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
 	}
 
 	// Create a channel
@@ -38,11 +58,13 @@ func NewRabbitMQ(connStr string) (*RabbitMQ, error) {
 	}, nil
 }
 
-func (mq *RabbitMQ) SendVideoUploadedMessage(id string, size int64, username string) error {
-	msg := map[string]string{
-		"videoId":  id,
-		"mp3Id":    "",
-		"username": username,
+func (mq *RabbitMQ) SendVideoUploadedMessage(jobId string, id string, size int64, user *Identity, opts *ConversionOptions) error {
+	msg := VideoMessage{
+		JobId:    jobId,
+		VideoId:  id,
+		UserId:   user.Id,
+		Username: user.Email,
+		Options:  opts,
 	}
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -68,3 +90,124 @@ func (mq *RabbitMQ) SendVideoUploadedMessage(id string, size int64, username str
 			Body:        data,
 		})
 }
+
+// ConsumeJobEvents binds a private queue to the job events exchange so this
+// gateway instance sees every event, and calls handler for each of them
+func (mq *RabbitMQ) ConsumeJobEvents(handler func(*JobEvent)) error {
+	if err := mq.declareJobEventsExchange(); err != nil {
+		return err
+	}
+
+	queue, err := mq.channel.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a RabbitMQ queue: %v", err)
+	}
+	if err := mq.channel.QueueBind(queue.Name, "", jobEventsExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind a RabbitMQ queue: %v", err)
+	}
+
+	msgs, err := mq.channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // auto-ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to consume job events: %v", err)
+	}
+
+	go func() {
+		for d := range msgs {
+			event := &JobEvent{}
+			if err := json.Unmarshal(d.Body, event); err != nil {
+				log.Printf("failed to decode job event: %v", err)
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+// ConsumeWebhookEvents consumes job events from the queue shared by all
+// gateway instances. An event is acknowledged once handler succeeds and
+// requeued when it fails.
+func (mq *RabbitMQ) ConsumeWebhookEvents(handler func(*JobEvent) error) error {
+	if err := mq.declareJobEventsExchange(); err != nil {
+		return err
+	}
+
+	queue, err := mq.channel.QueueDeclare(
+		webhookEventsQueue, // name
+		true,               // durable
+		false,              // delete when unused
+		false,              // exclusive
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a RabbitMQ queue: %v", err)
+	}
+	if err := mq.channel.QueueBind(queue.Name, "", jobEventsExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind a RabbitMQ queue: %v", err)
+	}
+
+	msgs, err := mq.channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		false,      // auto-ack
+		false,      // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to consume webhook events: %v", err)
+	}
+
+	go func() {
+		for d := range msgs {
+			event := &JobEvent{}
+			if err := json.Unmarshal(d.Body, event); err != nil {
+				log.Printf("failed to decode job event: %v", err)
+				d.Nack(false, false)
+				continue
+			}
+			if err := handler(event); err != nil {
+				log.Printf("failed to handle job event for webhooks: %v", err)
+				d.Nack(false, true)
+				continue
+			}
+			d.Ack(false)
+		}
+	}()
+	return nil
+}
+
+// declareJobEventsExchange declares the exchange the converter publishes
+// job events on
+func (mq *RabbitMQ) declareJobEventsExchange() error {
+	err := mq.channel.ExchangeDeclare(
+		jobEventsExchange, // name
+		"fanout",          // type
+		false,             // durable
+		false,             // auto-deleted
+		false,             // internal
+		false,             // no-wait
+		nil,               // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a RabbitMQ exchange: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// revocationRefreshInterval bounds how long a revoked token keeps working
+// at the gateway
+const revocationRefreshInterval = 10 * time.Second
+
+// revocationList mirrors the auth service's list of revoked tokens, since
+// the gateway verifies tokens without asking it
+type revocationList struct {
+	url    string
+	client *http.Client
+
+	mu     sync.RWMutex
+	tokens map[string]time.Time // jti to expiry
+	users  map[string]time.Time // sub to issued at or before
+}
+
+// newRevocationList creates a new revocationList instance
+func newRevocationList() *revocationList {
+	return &revocationList{
+		url:    os.Getenv("AUTH_SVC_URL") + "/revocations",
+		client: &http.Client{Timeout: 10 * time.Second},
+		tokens: make(map[string]time.Time),
+		users:  make(map[string]time.Time),
+	}
+}
+
+// run keeps the list up to date. When the auth service cannot be reached
+// the last list is kept.
+func (l *revocationList) run() {
+	if err := l.refresh(); err != nil {
+		log.Printf("failed to fetch revocations: %v", err)
+	}
+	for range time.Tick(revocationRefreshInterval) {
+		if err := l.refresh(); err != nil {
+			log.Printf("failed to fetch revocations: %v", err)
+		}
+	}
+}
+
+// refresh replaces the list with the auth service's
+func (l *revocationList) refresh() error {
+	resp, err := l.client.Get(l.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth service returned [%s] status code", resp.Status)
+	}
+
+	list := struct {
+		Tokens []struct {
+			Id        string    `json:"jti"`
+			ExpiresAt time.Time `json:"exp"`
+		} `json:"tokens"`
+		Users []struct {
+			UserId       string    `json:"sub"`
+			IssuedBefore time.Time `json:"issuedBefore"`
+		} `json:"users"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("failed to decode revocations: %v", err)
+	}
+
+	tokens := make(map[string]time.Time, len(list.Tokens))
+	for _, token := range list.Tokens {
+		tokens[token.Id] = token.ExpiresAt
+	}
+	users := make(map[string]time.Time, len(list.Users))
+	for _, user := range list.Users {
+		users[user.UserId] = user.IssuedBefore
+	}
+
+	l.mu.Lock()
+	l.tokens, l.users = tokens, users
+	l.mu.Unlock()
+	return nil
+}
+
+// isRevoked reports whether a token has been revoked
+func (l *revocationList) isRevoked(claims *AuthClaims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.tokens[claims.ID]; ok {
+		return true
+	}
+	issuedBefore, ok := l.users[claims.Subject]
+	return ok && claims.IssuedAt != nil && !claims.IssuedAt.After(issuedBefore)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRevocationList(t *testing.T) {
+	// The auth service lists watermarks at the exact time of the revocation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tokens":[{"jti":"revoked","exp":"2024-05-01T13:00:00Z"}],
+			"users":[{"sub":"user","issuedBefore":"2024-05-01T12:00:00.5Z"}]}`))
+	}))
+	defer server.Close()
+	l := newRevocationList()
+	l.url = server.URL
+	if err := l.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	revokedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		id       string
+		subject  string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"revoked by id", "revoked", "other", revokedAt, true},
+		{"issued before the watermark", "jti", "user", revokedAt.Add(-time.Minute), true},
+		// Token times have a precision of a second, so tokens issued in the
+		// second of the revocation are revoked even if they came after it
+		{"issued in the second of the watermark", "jti", "user", revokedAt, true},
+		{"issued in the next second", "jti", "user", revokedAt.Add(time.Second), false},
+		{"another user", "jti", "other", revokedAt, false},
+	}
+	for _, test := range tests {
+		claims := &AuthClaims{RegisteredClaims: jwt.RegisteredClaims{
+			ID:       test.id,
+			Subject:  test.subject,
+			IssuedAt: jwt.NewNumericDate(test.issuedAt),
+		}}
+		if got := l.isRevoked(claims); got != test.revoked {
+			t.Errorf("%s: revoked %v, want %v", test.name, got, test.revoked)
+		}
+	}
+}
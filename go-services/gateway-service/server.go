@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
 type GatewayHandlerFunc func(w http.ResponseWriter, r *http.Request) error
@@ -14,6 +20,11 @@ type GatewayHandlerFunc func(w http.ResponseWriter, r *http.Request) error
 type GatewayServer struct {
 	store        Store
 	messageQueue MessageQueue
+	events       *eventHub
+	webhooks     *webhookDispatcher
+	jwks         *jwksCache
+	revocations  *revocationList
+	apiKeys      *apiKeyCache
 	listenAddr   string
 }
 
@@ -22,16 +33,69 @@ func NewGatewayServer(listenAddr string, store Store, messageQueue MessageQueue)
 	return &GatewayServer{
 		store:        store,
 		messageQueue: messageQueue,
+		events:       newEventHub(),
+		webhooks:     newWebhookDispatcher(store),
+		jwks:         newJWKSCache(),
+		revocations:  newRevocationList(),
+		apiKeys:      newAPIKeyCache(),
 		listenAddr:   listenAddr,
 	}
 }
 
 // ListenAndServe starts the server and listens for incoming requests
 func (s *GatewayServer) ListenAndServe() error {
+	if err := s.messageQueue.ConsumeJobEvents(s.events.publish); err != nil {
+		return err
+	}
+	if err := s.messageQueue.ConsumeWebhookEvents(s.webhooks.handleJobEvent); err != nil {
+		return err
+	}
+	s.webhooks.run()
+	go s.jwks.run()
+	go s.revocations.run()
+
 	router := http.NewServeMux()
 	router.HandleFunc("GET /healthz", s.makeHandlerFunc(s.handleHealth))
 	router.HandleFunc("POST /login", s.makeHandlerFunc(s.handleLogin))
-	router.HandleFunc("POST /upload", s.makeHandlerFunc(s.handleVideoUpload))
+	router.HandleFunc("POST /login/mfa", s.makeHandlerFunc(s.handleLoginMFA))
+	router.HandleFunc("POST /register", s.makeHandlerFunc(s.handleRegister))
+	router.HandleFunc("POST /token/refresh", s.makeHandlerFunc(s.handleRefresh))
+	router.HandleFunc("POST /logout", s.makeHandlerFunc(s.handleLogout))
+	router.HandleFunc("POST /password/forgot", s.makeHandlerFunc(s.handleForgotPassword))
+	router.HandleFunc("POST /password/reset", s.makeHandlerFunc(s.handleResetPassword))
+	router.HandleFunc("POST /email/verify", s.makeHandlerFunc(s.handleVerifyEmail))
+	router.HandleFunc("POST /email/verify/resend", s.makeHandlerFunc(s.handleResendVerification))
+	router.HandleFunc("POST /mfa/totp/enroll", s.makeHandlerFunc(s.handleEnrollTOTP))
+	router.HandleFunc("POST /mfa/totp/confirm", s.makeHandlerFunc(s.handleConfirmTOTP))
+	router.HandleFunc("DELETE /mfa/totp", s.makeHandlerFunc(s.handleDisableTOTP))
+	router.HandleFunc("POST /webauthn/register/begin", s.makeHandlerFunc(s.handleWebAuthn))
+	router.HandleFunc("POST /webauthn/register/finish", s.makeHandlerFunc(s.handleWebAuthnFinish))
+	router.HandleFunc("POST /webauthn/login/begin", s.makeHandlerFunc(s.handleWebAuthn))
+	router.HandleFunc("POST /webauthn/login/finish", s.makeHandlerFunc(s.handleWebAuthnFinish))
+	router.HandleFunc("GET /webauthn/credentials", s.makeHandlerFunc(s.handleWebAuthn))
+	router.HandleFunc("DELETE /webauthn/credentials/{id}", s.makeHandlerFunc(s.handleDeletePasskey))
+	router.HandleFunc("POST /device/code", s.makeHandlerFunc(s.handleDeviceGrant))
+	router.HandleFunc("POST /device/token", s.makeHandlerFunc(s.handleDeviceGrant))
+	router.HandleFunc("GET /device/{userCode}", s.makeHandlerFunc(s.handleGetDevice))
+	router.HandleFunc("POST /device/approve", s.makeHandlerFunc(s.handleDecideDevice))
+	router.HandleFunc("POST /device/deny", s.makeHandlerFunc(s.handleDecideDevice))
+	router.HandleFunc("POST /api-keys", s.makeHandlerFunc(s.handleAPIKeys))
+	router.HandleFunc("GET /api-keys", s.makeHandlerFunc(s.handleAPIKeys))
+	router.HandleFunc("DELETE /api-keys/{id}", s.makeHandlerFunc(s.handleRevokeAPIKey))
+	router.HandleFunc("POST /upload", s.authorize(PermUpload, s.handleVideoUpload))
+	router.HandleFunc("GET /download/{mp3Id}", s.authorize(PermDownloadOwn, s.handleDownload))
+	router.HandleFunc("GET /jobs", s.authorize(PermDownloadOwn, s.handleListJobs))
+	router.HandleFunc("GET /jobs/{id}", s.authorize(PermDownloadOwn, s.handleGetJob))
+	router.HandleFunc("GET /jobs/{id}/events", s.authorizeStream(PermDownloadOwn, s.handleJobEvents))
+	router.HandleFunc("GET /webhook", s.authorize(PermUpload, s.handleGetWebhook))
+	router.HandleFunc("PUT /webhook", s.authorize(PermUpload, s.handlePutWebhook))
+	router.HandleFunc("DELETE /webhook", s.authorize(PermUpload, s.handleDeleteWebhook))
+	router.HandleFunc("POST /webhook/secret", s.authorize(PermUpload, s.handleRotateWebhookSecret))
+	router.HandleFunc("GET /webhook/deliveries", s.authorize(PermUpload, s.handleListDeliveries))
+	router.HandleFunc("PUT /users/{id}/role", s.authorize(PermManageUsers, s.handleSetRole))
+	router.HandleFunc("POST /users/{id}/revoke-sessions", s.authorize(PermManageUsers, s.handleRevokeSessions))
+	router.HandleFunc("GET /lockouts", s.authorize(PermManageUsers, s.handleListLockouts))
+	router.HandleFunc("DELETE /users/{id}/lockout", s.authorize(PermManageUsers, s.handleClearLockout))
 
 	log.Printf("Server is listening on %s...", s.listenAddr)
 	return http.ListenAndServe(s.listenAddr, router)
@@ -47,73 +111,318 @@ func (s *GatewayServer) handleLogin(w http.ResponseWriter, r *http.Request) erro
 	if r.ContentLength == 0 {
 		return fmt.Errorf("request body is empty")
 	}
-	// Call the auth service to login the user
-	resp, err := http.Post(os.Getenv("AUTH_SVC_URL")+"/login", "json", r.Body)
-	if err != nil {
-		return err
+	return proxyToAuth(w, r, "/login")
+}
+
+// handleLoginMFA completes a login with a two-factor code
+func (s *GatewayServer) handleLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/login/mfa")
+}
+
+// handleEnrollTOTP starts setting up an authenticator app
+func (s *GatewayServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/mfa/totp/enroll")
+}
+
+// handleConfirmTOTP enables two-factor authentication with a first code
+func (s *GatewayServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/mfa/totp/confirm")
+}
+
+// handleDisableTOTP turns two-factor authentication off
+func (s *GatewayServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/mfa/totp")
+}
+
+// handleWebAuthn forwards the passkey endpoints that take no body
+func (s *GatewayServer) handleWebAuthn(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, r.URL.Path)
+}
+
+// handleWebAuthnFinish forwards the answer of an authenticator to a
+// passkey ceremony
+func (s *GatewayServer) handleWebAuthnFinish(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, r.URL.Path)
+}
+
+// handleDeletePasskey removes one of the caller's passkeys
+func (s *GatewayServer) handleDeletePasskey(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/webauthn/credentials/"+url.PathEscape(r.PathValue("id")))
+}
+
+// handleDeviceGrant forwards the form of a device requesting or polling
+// for a login
+func (s *GatewayServer) handleDeviceGrant(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
 	}
+	return proxyToAuth(w, r, r.URL.Path)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to login: auth service returned [%s] status code.", resp.Status)
+// handleGetDevice shows which client a user code belongs to
+func (s *GatewayServer) handleGetDevice(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/device/"+url.PathEscape(r.PathValue("userCode")))
+}
+
+// handleDecideDevice approves or denies the device with a user code
+func (s *GatewayServer) handleDecideDevice(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
 	}
+	return proxyToAuth(w, r, r.URL.Path)
+}
+
+// handleRegister handles the registration endpoint
+func (s *GatewayServer) handleRegister(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/register")
+}
 
-	log.Printf("login successful")
-	// Return the response from the auth service
-	data := make(map[string]string)
-	if json.NewDecoder(resp.Body).Decode(&data); err != nil {
+// handleRefresh exchanges a refresh token for new tokens
+func (s *GatewayServer) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/token/refresh")
+}
+
+// handleForgotPassword asks for a password reset link by email
+func (s *GatewayServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/password/forgot")
+}
+
+// handleResetPassword sets a new password with a reset token
+func (s *GatewayServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/password/reset")
+}
+
+// handleVerifyEmail verifies the caller's email address with the token
+// emailed to them
+func (s *GatewayServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	return proxyToAuth(w, r, "/email/verify")
+}
+
+// handleResendVerification emails the caller a new verification link
+func (s *GatewayServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/email/verify/resend")
+}
+
+// handleLogout revokes the caller's token and, if it is sent, their
+// refresh token
+func (s *GatewayServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/logout")
+}
+
+// handleAPIKeys creates and lists the caller's API keys. The auth service
+// only accepts a JWT here, so a key can not create other keys.
+func (s *GatewayServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/api-keys")
+}
+
+// handleRevokeAPIKey revokes one of the caller's API keys
+func (s *GatewayServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/api-keys/"+url.PathEscape(r.PathValue("id")))
+}
+
+// handleSetRole lets an admin change the role of a user
+func (s *GatewayServer) handleSetRole(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/users/"+url.PathEscape(r.PathValue("id"))+"/role")
+}
+
+// handleRevokeSessions lets an admin end every session of a user
+func (s *GatewayServer) handleRevokeSessions(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/users/"+url.PathEscape(r.PathValue("id"))+"/revoke-sessions")
+}
+
+// handleListLockouts lets an admin see the accounts locked after failed
+// logins
+func (s *GatewayServer) handleListLockouts(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/lockouts")
+}
+
+// handleClearLockout lets an admin unlock a user
+func (s *GatewayServer) handleClearLockout(w http.ResponseWriter, r *http.Request) error {
+	return proxyToAuth(w, r, "/users/"+url.PathEscape(r.PathValue("id"))+"/lockout")
+}
+
+// proxyToAuth passes a request on to the auth service along with its
+// Authorization header and the client's IP, and the response back as is,
+// so clients see its status codes and errors
+func proxyToAuth(w http.ResponseWriter, r *http.Request, path string) error {
+	req, err := http.NewRequest(r.Method, os.Getenv("AUTH_SVC_URL")+path, io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	// The device grant takes forms, everything else JSON
+	if contentType := r.Header.Get("Content-Type"); strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		req.Header.Set("Content-Type", contentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := r.Header.Get("Authorization"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Real-IP", host)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if retry := resp.Header.Get("Retry-After"); retry != "" {
+		w.Header().Set("Retry-After", retry)
+	}
+	if cache := resp.Header.Get("Cache-Control"); cache != "" {
+		w.Header().Set("Cache-Control", cache)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		w.WriteHeader(resp.StatusCode)
+		return nil
+	}
+	var data interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("auth service returned [%s] status code.", resp.Status)
+	}
 	return WriteJSON(w, resp.StatusCode, data)
 }
 
 // handleVideoUpload handles the video upload endpoint
 func (s *GatewayServer) handleVideoUpload(w http.ResponseWriter, r *http.Request) error {
-	// Validate the token received in the request header
-	if r.Header["Authorization"] == nil {
-		return fmt.Errorf("authorization header is missing")
-	}
-	if err := validateToken(r.Header.Get("Authorization")); err != nil {
-		return err
+	user := identityFrom(r)
+	if !user.Verified {
+		return &APIError{
+			Status:  http.StatusForbidden,
+			Message: "verify your email address before uploading: follow the link sent to " + user.Email + ", then refresh your token",
+		}
 	}
-	log.Println("token validated")
-	// TODO: Get the users claims from the token. (ie username, email etc.)
 
 	// Parse Video file from request
 	if err := r.ParseMultipartForm(20000000); err != nil {
 		return fmt.Errorf("failed to parse multipart form: %v", err)
 	}
 
+	opts, err := parseConversionOptions(r)
+	if err != nil {
+		return err
+	}
+	callbackURL := r.FormValue("callbackUrl")
+	if callbackURL != "" {
+		if err := validateCallbackURL(callbackURL); err != nil {
+			return err
+		}
+		// Create the signing secret now so it can be fetched before the
+		// first delivery
+		if _, err := s.ensureWebhook(user.Id); err != nil {
+			return err
+		}
+	}
+
 	// retrieve file from form data
 	file, handler, err := r.FormFile("mp4File")
 	if err != nil {
-		return fmt.Errorf("failed to retrive mp4 from request: ", err)
+		return fmt.Errorf("failed to retrive mp4 from request: %v", err)
 	}
 	defer file.Close()
 
-	fmt.Println("File Name:", handler.Filename)
-	fmt.Println("File Size:", handler.Size)
-
 	// 1. Store the file in the mongo store using gridfs
 	videoId, err := s.store.SaveFile(handler.Filename, file)
 	if err != nil {
 		return fmt.Errorf("failed to save video file: %v", err)
 	}
-	log.Printf("Video stored in mongoDB gridfs with ID: %s", videoId)
-	// 2. Send a message to the message queue to process the video
-	if err := s.messageQueue.SendVideoUploadedMessage(videoId, handler.Size, "bob"); err != nil {
+	log.Printf("User %s uploaded %s (%d bytes) as video %s", user.Email, handler.Filename, handler.Size, videoId)
+	// 2. Create a job to track the conversion
+	job := &Job{
+		Owner:       user.Id,
+		Status:      JobQueued,
+		Filename:    handler.Filename,
+		VideoId:     videoId,
+		Options:     opts,
+		CallbackURL: callbackURL,
+	}
+	if err := s.store.CreateJob(job); err != nil {
+		s.store.DeleteFile(videoId)
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+	jobId := job.Id.Hex()
+	// 3. Send a message to the message queue to process the video
+	if err := s.messageQueue.SendVideoUploadedMessage(jobId, videoId, handler.Size, user, opts); err != nil {
 		s.store.DeleteFile(videoId)
+		s.store.UpdateJob(jobId, JobUpdate{Status: JobFailed, Error: "failed to queue video for conversion"})
 		return fmt.Errorf("failed to put video file: %v", err)
-	} // TODO: Get users username from the JWT Token
+	}
 
-	return WriteJSON(w, http.StatusOK, "upload successful")
+	return WriteJSON(w, http.StatusAccepted, map[string]string{"jobId": jobId, "status": job.Status})
 }
 
-// TODO: Add download handler
+// handleDownload streams a converted file to the user who owns it. Range
+// and conditional requests are handled by http.ServeContent.
+func (s *GatewayServer) handleDownload(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	file, err := s.store.GetMP3File(r.PathValue("mp3Id"))
+	if errors.Is(err, ErrFileNotFound) {
+		return WriteJSON(w, http.StatusNotFound, "file not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	// Other users' files are reported as missing so ids cannot be probed
+	if file.Metadata.Owner != user.Id && !user.Can(PermDownloadAny) {
+		log.Printf("User %s was denied file %s", user.Email, file.Id)
+		return WriteJSON(w, http.StatusNotFound, "file not found")
+	}
+
+	contentType := file.Metadata.ContentType
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	// Stored files never change, so the id is a strong validator
+	w.Header().Set("ETag", `"`+file.Id+`"`)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	http.ServeContent(w, r, file.Name, file.UploadDate, file)
+	return nil
+}
 
+// makeHandlerFunc turns a GatewayHandlerFunc into an http.HandlerFunc.
+// Errors are reported as bad requests unless they are an APIError.
 func (s *GatewayServer) makeHandlerFunc(f GatewayHandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
 			log.Printf("error: %v", err)
+			var apiErr *APIError
+			if errors.As(err, &apiErr) {
+				WriteJSON(w, apiErr.Status, apiErr.Message)
+				return
+			}
 			WriteJSON(w, http.StatusBadRequest, err.Error())
 		}
 	}
@@ -125,23 +434,28 @@ type User struct {
 	Password string `json:"password"`
 }
 
-// validateToken validates the token by calling the auth service
-func validateToken(token string) error {
-	if len(token) == 0 {
-		return fmt.Errorf("missing token")
-	}
+// Identity is the user a token was issued to
+type Identity struct {
+	Id       string   `json:"sub"` // stable user id, which owns files and jobs
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	Verified bool     `json:"verified"` // whether the email address is verified
+	Scopes   []string `json:"scopes"`   // set for API keys, nil for tokens
+}
 
-	// Call the auth service to validate the token
-	req, err := http.NewRequest("GET", os.Getenv("AUTH_SVC_URL")+"/validate", nil)
+// validateToken verifies the token locally against the auth service's
+// published keys and revocations, and returns the identity of the user it
+// was issued to. API keys are verified by the auth service instead.
+func (s *GatewayServer) validateToken(token string) (*Identity, error) {
+	if key, ok := strings.CutPrefix(token, "Bearer "+apiKeyPrefix); ok {
+		return s.apiKeys.verify(apiKeyPrefix + key)
+	}
+	claims, err := s.jwks.verify(token)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	req.Header.Add("Authorization", token)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid token")
+	if s.revocations.isRevoked(claims) {
+		return nil, fmt.Errorf("invalid token")
 	}
-	return nil
+	return &Identity{Id: claims.Subject, Email: claims.Email, Roles: claims.Roles, Verified: claims.Verified}, nil
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeStore is an in memory Store for tests. Methods a test does not set
+// up panic through the nil embedded Store.
+type fakeStore struct {
+	Store
+
+	mu       sync.Mutex
+	files    map[string]*fakeFile
+	closed   int // files opened with GetMP3File and closed
+	jobs     map[string]*Job
+	webhooks map[string]*Webhook
+	attempts []recordedAttempt
+}
+
+// recordedAttempt is a call to RecordDeliveryAttempt
+type recordedAttempt struct {
+	id      primitive.ObjectID
+	attempt WebhookAttempt
+	status  string
+	next    time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{files: map[string]*fakeFile{}, jobs: map[string]*Job{}, webhooks: map[string]*Webhook{}}
+}
+
+// fakeFile is a converted file in a fakeStore
+type fakeFile struct {
+	info AudioFile
+	data []byte
+}
+
+// fakeContent reads a file opened with GetMP3File
+type fakeContent struct {
+	*bytes.Reader
+	store *fakeStore
+}
+
+func (c *fakeContent) Close() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.closed++
+	return nil
+}
+
+// addFile stores a converted file of the owner and returns its id
+func (s *fakeStore) addFile(owner, name string, data []byte, uploaded time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := primitive.NewObjectID().Hex()
+	s.files[id] = &fakeFile{
+		info: AudioFile{Id: id, Name: name, Length: int64(len(data)), UploadDate: uploaded, Metadata: AudioMetadata{Owner: owner}},
+		data: data,
+	}
+	return id
+}
+
+func (s *fakeStore) GetMP3File(objectId string) (*AudioFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[objectId]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	file := f.info
+	file.ReadSeekCloser = &fakeContent{Reader: bytes.NewReader(f.data), store: s}
+	return &file, nil
+}
+
+// addJob stores a job of the owner in a status and returns its id
+func (s *fakeStore) addJob(owner, status string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	job := &Job{Id: primitive.NewObjectID(), Owner: owner, Status: status, CreatedAt: now, UpdatedAt: now}
+	s.jobs[job.Id.Hex()] = job
+	return job.Id.Hex()
+}
+
+func (s *fakeStore) GetJob(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	copy := *job
+	return &copy, nil
+}
+
+func (s *fakeStore) GetWebhook(owner string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	webhook, ok := s.webhooks[owner]
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	copy := *webhook
+	return &copy, nil
+}
+
+func (s *fakeStore) RecordDeliveryAttempt(id primitive.ObjectID, attempt WebhookAttempt, status string, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, recordedAttempt{id: id, attempt: attempt, status: status, next: next})
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook event types
+const (
+	EventJobDone   = "job.done"
+	EventJobFailed = "job.failed"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// webhookMaxAttempts is the number of attempts before a delivery is
+	// given up. With the delays below the last one is about an hour after
+	// the first.
+	webhookMaxAttempts = 8
+	webhookBaseDelay   = 30 * time.Second
+	webhookMaxDelay    = time.Hour
+	webhookTimeout     = 10 * time.Second
+	// webhookLease is how long a claimed delivery is hidden from other
+	// workers, so one left behind by a crashed gateway is retried
+	webhookLease   = time.Minute
+	webhookWorkers = 4
+	webhookPoll    = 5 * time.Second
+	// webhookBodyLimit caps the part of a response body kept in the log
+	webhookBodyLimit = 512
+)
+
+var (
+	// ErrWebhookNotFound is returned when a user has no webhook settings
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrDeliveryNotFound is returned when no delivery is due
+	ErrDeliveryNotFound = errors.New("delivery not found")
+)
+
+// Webhook holds a user's webhook settings. URL is the default callback for
+// uploads that do not name their own, and Secret signs every delivery.
+type Webhook struct {
+	Owner     string    `bson:"_id" json:"-"`
+	URL       string    `bson:"url,omitempty" json:"url,omitempty"`
+	Secret    string    `bson:"secret" json:"secret"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// WebhookDelivery is one event sent to one callback URL, with every
+// attempt made to send it
+type WebhookDelivery struct {
+	Id            primitive.ObjectID `bson:"_id" json:"id"`
+	Owner         string             `bson:"owner" json:"-"`
+	JobId         string             `bson:"jobId" json:"jobId"`
+	Event         string             `bson:"event" json:"event"`
+	URL           string             `bson:"url" json:"url"`
+	Payload       json.RawMessage    `bson:"payload" json:"payload"`
+	Status        string             `bson:"status" json:"status"`
+	Attempts      []WebhookAttempt   `bson:"attempts" json:"attempts"`
+	NextAttemptAt *time.Time         `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// WebhookAttempt records the outcome of one attempt to send a delivery
+type WebhookAttempt struct {
+	Time       time.Time `bson:"time" json:"time"`
+	StatusCode int       `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Response   string    `bson:"response,omitempty" json:"response,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	DurationMs int64     `bson:"durationMs" json:"durationMs"`
+}
+
+// DeliveryFilter selects the deliveries returned by ListDeliveries
+type DeliveryFilter struct {
+	Owner  string
+	JobId  string
+	Status string
+	Limit  int
+	Offset int
+}
+
+// DeliveryList is a page of deliveries
+type DeliveryList struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+	Total      int64              `json:"total"`
+	Limit      int                `json:"limit"`
+	Offset     int                `json:"offset"`
+}
+
+// webhookPayload is the body POSTed to callback URLs
+type webhookPayload struct {
+	Id        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+	Job       *Job      `json:"job"`
+}
+
+// handleGetWebhook returns the user's webhook settings, including the
+// secret deliveries are signed with
+func (s *GatewayServer) handleGetWebhook(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	webhook, err := s.store.GetWebhook(user.Id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		return WriteJSON(w, http.StatusNotFound, "webhook not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get webhook: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, webhook)
+}
+
+// handlePutWebhook sets the user's default callback URL. The signing
+// secret is created the first time.
+func (s *GatewayServer) handlePutWebhook(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	req := struct {
+		URL string `json:"url"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("failed to decode request body: %v", err)
+	}
+	if err := validateCallbackURL(req.URL); err != nil {
+		return err
+	}
+
+	if _, err := s.ensureWebhook(user.Id); err != nil {
+		return err
+	}
+	webhook, err := s.store.UpdateWebhook(user.Id, &req.URL, "")
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, webhook)
+}
+
+// handleDeleteWebhook removes the user's default callback URL. The secret
+// is kept since uploads may still name their own callback.
+func (s *GatewayServer) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	none := ""
+	_, err := s.store.UpdateWebhook(user.Id, &none, "")
+	if errors.Is(err, ErrWebhookNotFound) {
+		return WriteJSON(w, http.StatusNotFound, "webhook not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleRotateWebhookSecret replaces the user's signing secret. Pending
+// deliveries are signed with the new secret from their next attempt.
+func (s *GatewayServer) handleRotateWebhookSecret(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	if _, err := s.ensureWebhook(user.Id); err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	webhook, err := s.store.UpdateWebhook(user.Id, nil, secret)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, webhook)
+}
+
+// handleListDeliveries lists the user's webhook deliveries, newest first.
+// It accepts limit and offset for pagination and jobId and status filters.
+func (s *GatewayServer) handleListDeliveries(w http.ResponseWriter, r *http.Request) error {
+	user := identityFrom(r)
+
+	q := r.URL.Query()
+	limit, offset, err := parsePage(q)
+	if err != nil {
+		return err
+	}
+	filter := DeliveryFilter{
+		Owner:  user.Id,
+		JobId:  q.Get("jobId"),
+		Status: q.Get("status"),
+		Limit:  limit,
+		Offset: offset,
+	}
+	switch filter.Status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		return fmt.Errorf("status must be one of %s, %s, %s", DeliveryPending, DeliveryDelivered, DeliveryFailed)
+	}
+
+	deliveries, total, err := s.store.ListDeliveries(filter)
+	if err != nil {
+		return fmt.Errorf("failed to list deliveries: %v", err)
+	}
+	return WriteJSON(w, http.StatusOK, &DeliveryList{
+		Deliveries: deliveries,
+		Total:      total,
+		Limit:      filter.Limit,
+		Offset:     filter.Offset,
+	})
+}
+
+// ensureWebhook returns the user's webhook settings, creating them with a
+// new secret if needed
+func (s *GatewayServer) ensureWebhook(owner string) (*Webhook, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	webhook, err := s.store.EnsureWebhook(owner, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// newWebhookSecret generates a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// validateCallbackURL checks that a callback is an absolute http(s) URL.
+// Where it may point is checked when connecting, see webhookDialControl.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || len(raw) > 2048 || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("callback url must be an absolute http or https url")
+	}
+	return nil
+}
+
+// webhookDispatcher sends signed webhook deliveries and retries the failed
+// ones with exponential backoff. Deliveries are kept in the store, so they
+// survive restarts and are shared by every gateway instance.
+type webhookDispatcher struct {
+	store  Store
+	client *http.Client
+	wake   chan struct{}
+}
+
+// newWebhookDispatcher creates a new webhookDispatcher instance
+func newWebhookDispatcher(store Store) *webhookDispatcher {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	// Callbacks are user supplied, so internal addresses are refused
+	// unless the downstream services live on the same network
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") != "true" {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &webhookDispatcher{
+		store: store,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   webhookTimeout,
+			// A redirect counts as a failed attempt
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP does not count as private but cloud networks use internally
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookDialControl refuses connections to loopback, private, shared and
+// link local addresses
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("callback address %s is not allowed", host)
+	}
+	return nil
+}
+
+// handleJobEvent queues a delivery when a job finishes and its owner has a
+// callback for it. Returning an error has the event redelivered.
+func (d *webhookDispatcher) handleJobEvent(event *JobEvent) error {
+	if !isFinished(event.Status) {
+		return nil
+	}
+	job, err := d.store.GetJob(event.JobId)
+	if errors.Is(err, ErrJobNotFound) {
+		log.Printf("webhook: job %s not found", event.JobId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	callback := job.CallbackURL
+	if callback == "" {
+		webhook, err := d.store.GetWebhook(job.Owner)
+		if errors.Is(err, ErrWebhookNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		callback = webhook.URL
+	}
+	if callback == "" {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{
+		Id:            primitive.NewObjectID(),
+		Owner:         job.Owner,
+		JobId:         event.JobId,
+		Event:         EventJobDone,
+		URL:           callback,
+		Status:        DeliveryPending,
+		Attempts:      []WebhookAttempt{},
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if event.Status == JobFailed {
+		delivery.Event = EventJobFailed
+	}
+	delivery.Payload, err = json.Marshal(&webhookPayload{
+		Id:        delivery.Id.Hex(),
+		Event:     delivery.Event,
+		CreatedAt: now,
+		Job:       job,
+	})
+	if err != nil {
+		return err
+	}
+	// A redelivered event finds the delivery already recorded
+	if err := d.store.CreateDelivery(delivery); err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run starts the workers sending due deliveries
+func (d *webhookDispatcher) run() {
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+	for {
+		delivery, err := d.store.ClaimDelivery(time.Now().UTC(), webhookLease)
+		if err == nil {
+			d.attempt(delivery)
+			continue
+		}
+		if !errors.Is(err, ErrDeliveryNotFound) {
+			log.Printf("webhook: failed to claim delivery: %v", err)
+		}
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *webhookDispatcher) attempt(delivery *WebhookDelivery) {
+	start := time.Now()
+	attempt := WebhookAttempt{Time: start.UTC()}
+	statusCode, response, err := d.send(delivery)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	attempt.StatusCode = statusCode
+	attempt.Response = response
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	status := DeliveryDelivered
+	var next time.Time
+	if err != nil {
+		n := len(delivery.Attempts) + 1
+		if n >= webhookMaxAttempts {
+			status = DeliveryFailed
+		} else {
+			status = DeliveryPending
+			next = attempt.Time.Add(webhookBackoff(n))
+		}
+		log.Printf("webhook: delivery %s attempt %d to %s failed: %v", delivery.Id.Hex(), n, delivery.URL, err)
+	}
+	// next stays zero once the delivery is settled
+	if err := d.store.RecordDeliveryAttempt(delivery.Id, attempt, status, next); err != nil {
+		log.Printf("webhook: failed to record delivery %s: %v", delivery.Id.Hex(), err)
+	}
+}
+
+// webhookBackoff returns the delay before the attempt after the nth one
+func webhookBackoff(n int) time.Duration {
+	delay := time.Duration(float64(webhookBaseDelay) * math.Pow(2, float64(n-1)))
+	return min(delay, webhookMaxDelay)
+}
+
+// send POSTs a delivery signed with the owner's current secret. The
+// signature is the hex HMAC-SHA256 of the timestamp, a dot and the body,
+// so receivers can reject old timestamps to prevent replays.
+func (d *webhookDispatcher) send(delivery *WebhookDelivery) (int, string, error) {
+	webhook, err := d.store.GetWebhook(delivery.Owner)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get signing secret: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(delivery.Payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mp4-mp3-converter-webhooks")
+	req.Header.Set("X-Webhook-Id", delivery.Id.Hex())
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookBodyLimit))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(body), fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return resp.StatusCode, string(body), nil
+}
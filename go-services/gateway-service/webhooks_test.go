@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newWebhookTest returns a dispatcher allowed to reach httptest servers
+// and a store with a webhook for the user "owner"
+func newWebhookTest(t *testing.T) (*webhookDispatcher, *fakeStore) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	store := newFakeStore()
+	store.webhooks["owner"] = &Webhook{Owner: "owner", Secret: "whsec_test"}
+	return newWebhookDispatcher(store), store
+}
+
+func newDelivery(url string, attempts int) *WebhookDelivery {
+	return &WebhookDelivery{
+		Id:       primitive.NewObjectID(),
+		Owner:    "owner",
+		JobId:    "job",
+		Event:    EventJobDone,
+		URL:      url,
+		Payload:  []byte(`{"event":"job.done"}`),
+		Status:   DeliveryPending,
+		Attempts: make([]WebhookAttempt, attempts),
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	d, _ := newWebhookTest(t)
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	delivery := newDelivery(server.URL, 0)
+	if _, _, err := d.send(delivery); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(delivery.Payload) {
+		t.Errorf("body %q, want %q", body, delivery.Payload)
+	}
+	timestamp := header.Get("X-Webhook-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+		t.Errorf("X-Webhook-Timestamp %q is not the current Unix time", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(timestamp + "." + string(delivery.Payload)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Webhook-Signature") != want {
+		t.Errorf("X-Webhook-Signature %q, want %q", header.Get("X-Webhook-Signature"), want)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":    "application/json",
+		"X-Webhook-Id":    delivery.Id.Hex(),
+		"X-Webhook-Event": EventJobDone,
+	} {
+		if header.Get(name) != want {
+			t.Errorf("%s %q, want %q", name, header.Get(name), want)
+		}
+	}
+}
+
+func TestWebhookSendFailures(t *testing.T) {
+	d, _ := newWebhookTest(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, strings.Repeat("x", 2*webhookBodyLimit))
+		case "/redirect":
+			http.Redirect(w, r, "/", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	status, response, err := d.send(newDelivery(server.URL+"/error", 0))
+	if err == nil || status != http.StatusInternalServerError || len(response) != webhookBodyLimit {
+		t.Errorf("error response gave %d, %d bytes, %v", status, len(response), err)
+	}
+	// Redirects are not followed
+	if status, _, err := d.send(newDelivery(server.URL+"/redirect", 0)); err == nil || status != http.StatusFound {
+		t.Errorf("redirect gave %d, %v", status, err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+	for i, delay := range want {
+		if got := webhookBackoff(i + 1); got != delay {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+
+	// The last attempt is about an hour after the first
+	var total time.Duration
+	for n := 1; n < webhookMaxAttempts; n++ {
+		total += webhookBackoff(n)
+	}
+	if total < 55*time.Minute || total > 70*time.Minute {
+		t.Errorf("the last attempt is %v after the first, want about an hour", total)
+	}
+}
+
+func TestWebhookAttempt(t *testing.T) {
+	d, store := newWebhookTest(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		attempts int // made before this one
+		status   string
+		delay    time.Duration // until the next attempt, zero when settled
+	}{
+		{"/", 0, DeliveryDelivered, 0},
+		{"/", webhookMaxAttempts - 1, DeliveryDelivered, 0},
+		{"/fail", 0, DeliveryPending, webhookBaseDelay},
+		{"/fail", 3, DeliveryPending, 8 * webhookBaseDelay},
+		{"/fail", webhookMaxAttempts - 2, DeliveryPending, webhookBackoff(webhookMaxAttempts - 1)},
+		{"/fail", webhookMaxAttempts - 1, DeliveryFailed, 0},
+	}
+	for _, test := range tests {
+		delivery := newDelivery(server.URL+test.path, test.attempts)
+		d.attempt(delivery)
+		got := store.attempts[len(store.attempts)-1]
+		if got.id != delivery.Id || got.status != test.status {
+			t.Errorf("%s after %d attempts recorded %s, want %s", test.path, test.attempts, got.status, test.status)
+		}
+		if test.delay == 0 && !got.next.IsZero() {
+			t.Errorf("%s after %d attempts scheduled another at %v", test.path, test.attempts, got.next)
+		}
+		if test.delay != 0 && got.next.Sub(got.attempt.Time) != test.delay {
+			t.Errorf("%s after %d attempts retries after %v, want %v",
+				test.path, test.attempts, got.next.Sub(got.attempt.Time), test.delay)
+		}
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:4700::1111]:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.1:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"[::ffff:100.100.100.200]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"localhost:80", false},
+	}
+	for _, test := range tests {
+		err := webhookDialControl("tcp", test.address, nil)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s allowed %v, want %v (%v)", test.address, allowed, test.allowed, err)
+		}
+	}
+
+	// Without WEBHOOK_ALLOW_PRIVATE the dispatcher cannot reach a local
+	// server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the dispatcher connected to a loopback address")
+	}))
+	defer server.Close()
+	store := newFakeStore()
+	store.webhooks["owner"] = &Webhook{Owner: "owner", Secret: "whsec_test"}
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "")
+	if _, _, err := newWebhookDispatcher(store).send(newDelivery(server.URL, 0)); err == nil ||
+		!strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("sending to %s returned %v, want a refused address", server.URL, err)
+	}
+}
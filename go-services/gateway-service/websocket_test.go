@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsClient is the client end of a WebSocket connection
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWebSocket sends an opening handshake for path to server and returns
+// the response, and the connection if it was upgraded
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, header http.Header) (*http.Response, *wsClient) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = header
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+	return resp, &wsClient{t: t, conn: conn, br: br}
+}
+
+// write sends a masked frame, as clients must
+func (c *wsClient) write(opcode byte, payload []byte) {
+	c.t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next frame sent by the server
+func (c *wsClient) read() (byte, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		c.t.Fatalf("server sent a fragmented or masked frame: % x", header)
+	}
+	n := int(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		c.t.Fatal("server sent a frame over 64 KiB")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// readEvent reads a text message holding a job event
+func (c *wsClient) readEvent() *JobEvent {
+	c.t.Helper()
+	opcode, payload := c.read()
+	if opcode != wsText {
+		c.t.Fatalf("got opcode %#x, want a text message", opcode)
+	}
+	event := &JobEvent{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		c.t.Fatal(err)
+	}
+	return event
+}
+
+// newWebSocketTest serves the events route of a gateway with a running
+// job of the user "user", which has published one event
+func newWebSocketTest(t *testing.T) (*GatewayServer, *httptest.Server, string, string) {
+	key := newSigningKey(t, "current")
+	s := newAuthzTest(key)
+	store := newFakeStore()
+	s.store, s.events = store, newEventHub()
+	jobId := store.addJob("user", JobConverting)
+	publishRange(s.events, jobId, 1, 1, JobConverting)
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /jobs/{id}/events", s.authorizeStream(PermDownloadOwn, s.handleJobEvents))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	token := key.sign(t, "user", []string{RoleUser}, nil)[len("Bearer "):]
+	return s, server, jobId, token
+}
+
+func wsHeader(key string) http.Header {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, Upgrade")
+	h.Set("Upgrade", "websocket")
+	h.Set("Sec-WebSocket-Version", "13")
+	h.Set("Sec-WebSocket-Key", key)
+	return h
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	s, server, jobId, token := newWebSocketTest(t)
+	// The key and accept value from RFC 6455 section 1.3
+	resp, c := dialWebSocket(t, server, fmt.Sprintf("/jobs/%s/events?access_token=%s", jobId, token),
+		wsHeader("dGhlIHNhbXBsZSBub25jZQ=="))
+	if c == nil {
+		t.Fatalf("handshake returned %s", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", got)
+	}
+	if !headerContains(resp.Header, "Connection", "upgrade") || resp.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("upgrade headers %v", resp.Header)
+	}
+
+	if event := c.readEvent(); event.Seq != 1 || event.Status != JobConverting {
+		t.Errorf("first event %+v", event)
+	}
+
+	// Pings are answered with the same payload
+	c.write(wsPing, []byte("are you there"))
+	if opcode, payload := c.read(); opcode != wsPong || string(payload) != "are you there" {
+		t.Errorf("ping answered with opcode %#x payload %q", opcode, payload)
+	}
+
+	// Events published after subscribing follow, and the final one ends
+	// the stream with a normal closure
+	s.events.publish(&JobEvent{JobId: jobId, Seq: 2, Status: JobDone, Percent: 100})
+	if event := c.readEvent(); event.Seq != 2 || event.Status != JobDone {
+		t.Errorf("final event %+v", event)
+	}
+	if opcode, payload := c.read(); opcode != wsClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("got opcode %#x payload % x, want a normal closure", opcode, payload)
+	}
+}
+
+func TestWebSocketClientClose(t *testing.T) {
+	s, server, jobId, token := newWebSocketTest(t)
+	_, c := dialWebSocket(t, server, fmt.Sprintf("/jobs/%s/events?access_token=%s", jobId, token), wsHeader("x3JJHMbDL1EzLkh9GBhXDw=="))
+	if c == nil {
+		t.Fatal("handshake failed")
+	}
+	c.readEvent()
+	c.write(wsClose, []byte{0x03, 0xe8})
+	// The server closes its end and unsubscribes
+	if opcode, _ := c.read(); opcode != wsClose {
+		t.Errorf("got opcode %#x, want a close frame", opcode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.events.mu.Lock()
+		subs := len(s.events.jobs[jobId].subs)
+		s.events.mu.Unlock()
+		if subs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the closed connection is still subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	_, server, jobId, token := newWebSocketTest(t)
+	path := fmt.Sprintf("/jobs/%s/events?access_token=%s", jobId, token)
+
+	oldVersion := wsHeader("dGhlIHNhbXBsZSBub25jZQ==")
+	oldVersion.Set("Sec-WebSocket-Version", "8")
+	resp, _ := dialWebSocket(t, server, path, oldVersion)
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("version 8 returned %s with Sec-WebSocket-Version %q", resp.Status, resp.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	noKey := wsHeader("")
+	noKey.Del("Sec-WebSocket-Key")
+	if resp, _ := dialWebSocket(t, server, path, noKey); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing key returned %s", resp.Status)
+	}
+
+	// The token is checked before upgrading
+	if resp, _ := dialWebSocket(t, server, "/jobs/"+jobId+"/events", wsHeader("dGhlIHNhbXBsZSBub25jZQ==")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("missing token returned %s", resp.Status)
+	}
+}